@@ -0,0 +1,606 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/couchbase/vellum"
+)
+
+// DefaultTermsAggSize is the number of buckets returned by a TermsAgg without a Size.
+const DefaultTermsAggSize = 10
+
+// Aggregation summarizes the docs matched by a query.  Each segment's matches are collected into
+// a partial result, and the partial results of every segment are merged before they're
+// finished, so bucket counts and metrics are exact.  Bucket aggregations run their sub
+// aggregations on the docs of each bucket.
+type Aggregation interface {
+	// collect returns the partial result for the docs of the segment.
+	collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error)
+	// finish turns the merged partial result into the final result.
+	finish(res *AggResult)
+}
+
+// AggResult is the result of an aggregation, Value for metrics and Buckets for bucket
+// aggregations.
+type AggResult struct {
+	// Value is the metric, it's 0 if the metric didn't see any values.
+	Value float64
+	// Count is the number of values a metric saw.
+	Count   int64
+	Buckets []*Bucket
+
+	sum, min, max float64
+	distinct      map[string]struct{}
+}
+
+// Bucket is a bucket of a bucket aggregation, with the results of its sub aggregations.
+type Bucket struct {
+	// Key is the bucket's term, the start of a histogram bucket, or the name of a range.
+	Key value.Value
+	// From and To are the bounds of a range bucket.
+	From     *float64
+	To       *float64
+	DocCount int64
+	Aggs     map[string]*AggResult
+
+	// id identifies the bucket when merging the buckets of segments, and order is the position of
+	// histogram and range buckets.
+	id    string
+	order float64
+}
+
+// merge adds another segment's partial result to the result.
+func (r *AggResult) merge(other *AggResult) {
+	if other.Count > 0 {
+		if r.Count == 0 || other.min < r.min {
+			r.min = other.min
+		}
+		if r.Count == 0 || other.max > r.max {
+			r.max = other.max
+		}
+	}
+	r.Count += other.Count
+	r.sum += other.sum
+	if other.distinct != nil {
+		if r.distinct == nil {
+			r.distinct = map[string]struct{}{}
+		}
+		for v := range other.distinct {
+			r.distinct[v] = struct{}{}
+		}
+	}
+
+	buckets := make(map[string]*Bucket, len(r.Buckets))
+	for _, b := range r.Buckets {
+		buckets[b.id] = b
+	}
+	for _, ob := range other.Buckets {
+		b, ok := buckets[ob.id]
+		if !ok {
+			r.Buckets = append(r.Buckets, ob)
+			buckets[ob.id] = ob
+			continue
+		}
+		b.DocCount += ob.DocCount
+		mergeAggResults(b.Aggs, ob.Aggs)
+	}
+}
+
+// collectAggs collects the partial results of the aggregations for the segment's docs.
+func collectAggs(seg *Segment, docs *roaring.Bitmap, aggs map[string]Aggregation) (map[string]*AggResult, error) {
+	results := make(map[string]*AggResult, len(aggs))
+	for name, agg := range aggs {
+		res, err := agg.collect(seg, docs)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation %v failed: err:%v", name, err)
+		}
+		results[name] = res
+	}
+	return results, nil
+}
+
+// mergeAggResults merges the partial results in src into dst.
+func mergeAggResults(dst, src map[string]*AggResult) {
+	for name, res := range src {
+		if d, ok := dst[name]; ok {
+			d.merge(res)
+		} else {
+			dst[name] = res
+		}
+	}
+}
+
+func finishAggs(aggs map[string]Aggregation, results map[string]*AggResult) {
+	for name, agg := range aggs {
+		if res, ok := results[name]; ok {
+			agg.finish(res)
+		}
+	}
+}
+
+// Aggregate runs the aggregations over the docs of the results.
+func (r *SearchResults) Aggregate(aggs map[string]Aggregation) (map[string]*AggResult, error) {
+	if r.seg == nil {
+		return nil, fmt.Errorf("results aren't from a segment, run the query with a QueryBuilder")
+	}
+	r.seg.rwlock.RLock()
+	defer r.seg.rwlock.RUnlock()
+	results, err := collectAggs(r.seg, r.internalDocIds, aggs)
+	if err != nil {
+		return nil, err
+	}
+	finishAggs(aggs, results)
+	return results, nil
+}
+
+// newBucket returns a bucket of docs, with its sub aggregations collected.
+func newBucket(seg *Segment, id string, key value.Value, docs *roaring.Bitmap, aggs map[string]Aggregation) (*Bucket, error) {
+	subAggs, err := collectAggs(seg, docs, aggs)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{Key: key, DocCount: int64(docs.GetCardinality()), Aggs: subAggs, id: id}, nil
+}
+
+func finishBuckets(res *AggResult, aggs map[string]Aggregation) {
+	for _, b := range res.Buckets {
+		finishAggs(aggs, b.Aggs)
+	}
+}
+
+func sortBucketsByOrder(res *AggResult) {
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].order < res.Buckets[j].order })
+}
+
+// TermsAgg buckets the docs by the terms of a string or bool field, and keeps the Size buckets
+// with the most docs.  The buckets of indexed fields come from the term dictionary and the
+// posting lists, fields which aren't indexed need doc values.
+type TermsAgg struct {
+	Field string
+	Size  int
+	Aggs  map[string]Aggregation
+}
+
+func (a *TermsAgg) collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error) {
+	res := &AggResult{}
+	fieldID, ok := seg.fieldToFieldId[a.Field]
+	if !ok {
+		return res, nil
+	}
+	add := func(term string, termDocs *roaring.Bitmap) error {
+		if termDocs.IsEmpty() {
+			return nil
+		}
+		b, err := newBucket(seg, term, NewStringVal(term), termDocs, a.Aggs)
+		if err != nil {
+			return err
+		}
+		res.Buckets = append(res.Buckets, b)
+		return nil
+	}
+
+	if _, ok := seg.termDicBytes[fieldID]; ok {
+		termDictionary, err := seg.termDictionary(a.Field)
+		if err != nil {
+			return nil, err
+		}
+		itr, err := termDictionary.Iterator(nil, nil)
+		for ; err == nil; err = itr.Next() {
+			term, termID := itr.Current()
+			if err := add(string(term), roaring.And(seg.postings[uint32(termID)].Postings(), docs)); err != nil {
+				return nil, err
+			}
+		}
+		if err != vellum.ErrIteratorDone {
+			return nil, fmt.Errorf("failed to iterate the terms of field %v: err:%v", a.Field, err)
+		}
+		return res, nil
+	}
+	if bf, ok := seg.boolFields[fieldID]; ok {
+		for _, val := range []bool{false, true} {
+			if err := add(strconv.FormatBool(val), roaring.And(bf.docs(val), docs)); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return nil, fmt.Errorf("field %v isn't indexed and doesn't have doc values", a.Field)
+	}
+	switch dv := dv.(type) {
+	case *SortedSetDocValues:
+		ordDocs := map[uint32]*roaring.Bitmap{}
+		var ords []uint32
+		docIter := docs.Iterator()
+		for docIter.HasNext() {
+			did := docIter.Next()
+			ords = dv.Ords(ords[:0], did)
+			for _, ord := range ords {
+				if _, ok := ordDocs[ord]; !ok {
+					ordDocs[ord] = roaring.New()
+				}
+				ordDocs[ord].Add(did)
+			}
+		}
+		for ord, termDocs := range ordDocs {
+			if err := add(dv.Term(ord), termDocs); err != nil {
+				return nil, err
+			}
+		}
+	case *BoolDocValues:
+		for _, val := range []bool{false, true} {
+			if err := add(strconv.FormatBool(val), roaring.And(dv.Docs(val), docs)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("field %v isn't a string or bool field", a.Field)
+	}
+	return res, nil
+}
+
+// finish keeps the buckets with the most docs, ties are broken by the term.
+func (a *TermsAgg) finish(res *AggResult) {
+	sort.Slice(res.Buckets, func(i, j int) bool {
+		bi, bj := res.Buckets[i], res.Buckets[j]
+		if bi.DocCount != bj.DocCount {
+			return bi.DocCount > bj.DocCount
+		}
+		return bi.id < bj.id
+	})
+	size := a.Size
+	if size <= 0 {
+		size = DefaultTermsAggSize
+	}
+	if len(res.Buckets) > size {
+		res.Buckets = res.Buckets[:size]
+	}
+	finishBuckets(res, a.Aggs)
+}
+
+// numericValues reads the values of a numeric or date field's doc values as float64s, times are
+// unix nanoseconds.  It returns nil if the segment doesn't have the field.
+func (seg *Segment) numericValues(field string) (func(dst []float64, did uint32) []float64, error) {
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return nil, nil
+	}
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return nil, fmt.Errorf("field %v doesn't have doc values", field)
+	}
+	ndv, ok := dv.(*NumericDocValues)
+	if !ok {
+		return nil, fmt.Errorf("field %v isn't a numeric or date field", field)
+	}
+	var encoded []uint64
+	return func(dst []float64, did uint32) []float64 {
+		encoded = ndv.Encoded(encoded[:0], did)
+		for _, v := range encoded {
+			switch ndv.kind {
+			case value.NumberType:
+				dst = append(dst, decodeFloat64(v))
+			default:
+				dst = append(dst, float64(decodeInt64(v)))
+			}
+		}
+		return dst
+	}, nil
+}
+
+// bucketDocs groups the docs by the keys their values fall in, a doc is in a bucket once however
+// many of its values fall in it.
+func bucketDocs(values func([]float64, uint32) []float64, docs *roaring.Bitmap, keys func(v float64, fn func(key float64))) map[float64]*roaring.Bitmap {
+	buckets := map[float64]*roaring.Bitmap{}
+	var vals []float64
+	docIter := docs.Iterator()
+	for docIter.HasNext() {
+		did := docIter.Next()
+		vals = values(vals[:0], did)
+		for _, v := range vals {
+			keys(v, func(key float64) {
+				if _, ok := buckets[key]; !ok {
+					buckets[key] = roaring.New()
+				}
+				buckets[key].Add(did)
+			})
+		}
+	}
+	return buckets
+}
+
+// AggRange is a bucket of a RangeAgg, From is inclusive and To is exclusive, a nil bound leaves
+// that side open.  Key defaults to "from-to".
+type AggRange struct {
+	Key  string
+	From *float64
+	To   *float64
+}
+
+func (r *AggRange) key() string {
+	if r.Key != "" {
+		return r.Key
+	}
+	bound := func(b *float64) string {
+		if b == nil {
+			return "*"
+		}
+		return strconv.FormatFloat(*b, 'g', -1, 64)
+	}
+	return bound(r.From) + "-" + bound(r.To)
+}
+
+// RangeAgg buckets the docs by ranges of a numeric or date field's values, ranges can overlap.
+// Date fields are compared as unix nanoseconds.
+type RangeAgg struct {
+	Field  string
+	Ranges []AggRange
+	Aggs   map[string]Aggregation
+}
+
+func (a *RangeAgg) collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error) {
+	res := &AggResult{}
+	values, err := seg.numericValues(a.Field)
+	if err != nil || values == nil {
+		return res, err
+	}
+	buckets := bucketDocs(values, docs, func(v float64, fn func(float64)) {
+		for i, r := range a.Ranges {
+			if (r.From == nil || v >= *r.From) && (r.To == nil || v < *r.To) {
+				fn(float64(i))
+			}
+		}
+	})
+	for i, r := range a.Ranges {
+		rangeDocs, ok := buckets[float64(i)]
+		if !ok {
+			rangeDocs = roaring.New()
+		}
+		b, err := newBucket(seg, strconv.Itoa(i), NewStringVal(r.key()), rangeDocs, a.Aggs)
+		if err != nil {
+			return nil, err
+		}
+		b.From, b.To, b.order = r.From, r.To, float64(i)
+		res.Buckets = append(res.Buckets, b)
+	}
+	return res, nil
+}
+
+// finish returns every range, in the order of Ranges.
+func (a *RangeAgg) finish(res *AggResult) {
+	sortBucketsByOrder(res)
+	finishBuckets(res, a.Aggs)
+}
+
+// HistogramAgg buckets the docs by a numeric field's values, into buckets Interval wide.  The
+// buckets start at multiples of Interval, and only the buckets with docs are returned.
+type HistogramAgg struct {
+	Field    string
+	Interval float64
+	Aggs     map[string]Aggregation
+}
+
+func (a *HistogramAgg) collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error) {
+	if a.Interval <= 0 {
+		return nil, fmt.Errorf("histogram interval must be positive: %v", a.Interval)
+	}
+	res := &AggResult{}
+	values, err := seg.numericValues(a.Field)
+	if err != nil || values == nil {
+		return res, err
+	}
+	buckets := bucketDocs(values, docs, func(v float64, fn func(float64)) {
+		fn(math.Floor(v/a.Interval) * a.Interval)
+	})
+	for key, keyDocs := range buckets {
+		b, err := newBucket(seg, strconv.FormatFloat(key, 'g', -1, 64), value.NewNumberValue(key), keyDocs, a.Aggs)
+		if err != nil {
+			return nil, err
+		}
+		b.order = key
+		res.Buckets = append(res.Buckets, b)
+	}
+	return res, nil
+}
+
+func (a *HistogramAgg) finish(res *AggResult) {
+	sortBucketsByOrder(res)
+	finishBuckets(res, a.Aggs)
+}
+
+// DateHistogramAgg buckets the docs by a date field, into buckets Interval long.  The buckets
+// start at multiples of Interval since the unix epoch, in UTC.  Field defaults to the docs'
+// timestamps, TimestampField.
+type DateHistogramAgg struct {
+	Field    string
+	Interval time.Duration
+	Aggs     map[string]Aggregation
+}
+
+func (a *DateHistogramAgg) collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error) {
+	if a.Interval <= 0 {
+		return nil, fmt.Errorf("date histogram interval must be positive: %v", a.Interval)
+	}
+	field := a.Field
+	if field == "" {
+		field = TimestampField
+	}
+	res := &AggResult{}
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return res, nil
+	}
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return nil, fmt.Errorf("field %v doesn't have doc values", field)
+	}
+	ndv, ok := dv.(*NumericDocValues)
+	if !ok || ndv.kind != value.TimeType {
+		return nil, fmt.Errorf("field %v isn't a date field", field)
+	}
+
+	// the times are bucketed as ints, as float64s can't hold every unix nanosecond.
+	interval := int64(a.Interval)
+	buckets := map[int64]*roaring.Bitmap{}
+	var encoded []uint64
+	docIter := docs.Iterator()
+	for docIter.HasNext() {
+		did := docIter.Next()
+		encoded = ndv.Encoded(encoded[:0], did)
+		for _, v := range encoded {
+			nanos := decodeInt64(v)
+			start := nanos - nanos%interval
+			if nanos%interval < 0 {
+				start -= interval
+			}
+			if _, ok := buckets[start]; !ok {
+				buckets[start] = roaring.New()
+			}
+			buckets[start].Add(did)
+		}
+	}
+	for key, keyDocs := range buckets {
+		b, err := newBucket(seg, strconv.FormatInt(key, 10), value.NewTimeValue(time.Unix(0, key).UTC()), keyDocs, a.Aggs)
+		if err != nil {
+			return nil, err
+		}
+		b.order = float64(key)
+		res.Buckets = append(res.Buckets, b)
+	}
+	return res, nil
+}
+
+func (a *DateHistogramAgg) finish(res *AggResult) {
+	sortBucketsByOrder(res)
+	finishBuckets(res, a.Aggs)
+}
+
+// Metric is the statistic a MetricAgg computes.
+type Metric int
+
+const (
+	MetricMin Metric = iota
+	MetricMax
+	MetricAvg
+	MetricSum
+	// MetricCardinality counts the distinct values of a field of any type.  The count is exact,
+	// the distinct values are kept in memory.
+	MetricCardinality
+)
+
+// MetricAgg computes a metric over the values of a field's doc values, every value of a multi
+// valued field counts.  Date fields are unix nanoseconds.
+type MetricAgg struct {
+	Field  string
+	Metric Metric
+}
+
+func (a *MetricAgg) collect(seg *Segment, docs *roaring.Bitmap) (*AggResult, error) {
+	res := &AggResult{}
+	if a.Metric == MetricCardinality {
+		return res, a.collectDistinct(seg, docs, res)
+	}
+	values, err := seg.numericValues(a.Field)
+	if err != nil || values == nil {
+		return res, err
+	}
+	var vals []float64
+	docIter := docs.Iterator()
+	for docIter.HasNext() {
+		vals = values(vals[:0], docIter.Next())
+		for _, v := range vals {
+			if res.Count == 0 || v < res.min {
+				res.min = v
+			}
+			if res.Count == 0 || v > res.max {
+				res.max = v
+			}
+			res.sum += v
+			res.Count++
+		}
+	}
+	return res, nil
+}
+
+// collectDistinct adds the distinct values of the docs to the result.
+func (a *MetricAgg) collectDistinct(seg *Segment, docs *roaring.Bitmap, res *AggResult) error {
+	res.distinct = map[string]struct{}{}
+	fieldID, ok := seg.fieldToFieldId[a.Field]
+	if !ok {
+		return nil
+	}
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return fmt.Errorf("field %v doesn't have doc values", a.Field)
+	}
+	var ords []uint32
+	var encoded []uint64
+	docIter := docs.Iterator()
+	for docIter.HasNext() {
+		did := docIter.Next()
+		switch dv := dv.(type) {
+		case *SortedSetDocValues:
+			ords = dv.Ords(ords[:0], did)
+			for _, ord := range ords {
+				res.distinct[dv.Term(ord)] = struct{}{}
+			}
+		case *NumericDocValues:
+			encoded = dv.Encoded(encoded[:0], did)
+			for _, v := range encoded {
+				res.distinct[distinctNumericKey(dv.kind, v)] = struct{}{}
+			}
+		case *BoolDocValues:
+			for _, val := range []bool{false, true} {
+				if dv.Has(did, val) {
+					res.distinct[strconv.FormatBool(val)] = struct{}{}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// distinctNumericKey is the key of an encoded numeric value for MetricCardinality.  A whole
+// number has the same key as the int with its value, so the ints of one segment and the numbers
+// of another are counted once.
+func distinctNumericKey(kind value.ValueType, v uint64) string {
+	switch kind {
+	case value.IntType, value.TimeType:
+		return strconv.FormatInt(decodeInt64(v), 10)
+	}
+	f := decodeFloat64(v)
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (a *MetricAgg) finish(res *AggResult) {
+	switch a.Metric {
+	case MetricCardinality:
+		res.Count = int64(len(res.distinct))
+		res.Value = float64(res.Count)
+		return
+	}
+	if res.Count == 0 {
+		return
+	}
+	switch a.Metric {
+	case MetricMin:
+		res.Value = res.min
+	case MetricMax:
+		res.Value = res.max
+	case MetricAvg:
+		res.Value = res.sum / float64(res.Count)
+	case MetricSum:
+		res.Value = res.sum
+	}
+}
@@ -0,0 +1,171 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+// bucketCounts returns the keys and doc counts of the buckets, in order.
+func bucketCounts(res *AggResult) []string {
+	counts := []string{}
+	for _, b := range res.Buckets {
+		counts = append(counts, fmt.Sprintf("%v:%d", b.Key.ToString(), b.DocCount))
+	}
+	return counts
+}
+
+func TestSegmentAggregations(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(500)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	res, err := NewQueryBuilder(context.TODO(), segment).And(&RegExTermQuery{"first_name", "k.*|j.*"}).Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	aggs, err := res.Aggregate(map[string]Aggregation{
+		"names":   &TermsAgg{Field: "first_name"},
+		"top":     &TermsAgg{Field: "first_name", Size: 2},
+		"missing": &TermsAgg{Field: "nope"},
+	})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	// ties are broken by the term.
+	assert.Equal(t, []string{"james:5", "john:5", "jon:5", "kevin:5"}, bucketCounts(aggs["names"]))
+	assert.Equal(t, []string{"james:5", "john:5"}, bucketCounts(aggs["top"]))
+	assert.Equal(t, []string{}, bucketCounts(aggs["missing"]))
+}
+
+func TestIndexAggregations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	people := []struct {
+		name   string
+		city   string
+		age    int64
+		active bool
+	}{
+		{"kevin", "nyc", 35, true},
+		{"kelly", "sf", 28, true},
+		{"john", "nyc", 41, false},
+		{"jane", "sf", 19, true},
+		{"eric", "nyc", 52, false},
+		{"amy", "la", 28, true},
+	}
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < len(people); i += 3 {
+		docs := []Document{}
+		for j, p := range people[i : i+3] {
+			row := map[string]value.Value{
+				"name":   NewStringVal(p.name),
+				"city":   NewStringVal(p.city),
+				"age":    value.NewIntValue(p.age),
+				"active": value.NewBoolValue(p.active),
+			}
+			ts := start.Add(time.Duration((i+j)*30) * time.Minute)
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i+j), row, ts))
+		}
+		if err := idx.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	assert.Equal(t, 2, len(idx.Segments()))
+
+	aggregate := func(q Query, aggs map[string]Aggregation) map[string]*AggResult {
+		res, err := idx.Execute(context.TODO(), &SearchRequest{Query: q, Aggs: aggs})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return res.Aggs
+	}
+	f := func(v float64) *float64 { return &v }
+
+	{ // test case - terms across segments, with nested metrics
+		aggs := aggregate(nil, map[string]Aggregation{
+			"cities": &TermsAgg{Field: "city", Aggs: map[string]Aggregation{
+				"avg_age": &MetricAgg{Field: "age", Metric: MetricAvg},
+				"active":  &TermsAgg{Field: "active"},
+			}},
+			"flags": &TermsAgg{Field: "active"},
+		})
+		assert.Equal(t, []string{"nyc:3", "sf:2", "la:1"}, bucketCounts(aggs["cities"]))
+		nyc := aggs["cities"].Buckets[0]
+		assert.Equal(t, float64(35+41+52)/3, nyc.Aggs["avg_age"].Value)
+		assert.Equal(t, []string{"false:2", "true:1"}, bucketCounts(nyc.Aggs["active"]))
+		assert.Equal(t, []string{"true:4", "false:2"}, bucketCounts(aggs["flags"]))
+	}
+	{ // test case - metrics over the matching docs
+		aggs := aggregate(&TermQuery{Field: "city", Term: "nyc"}, map[string]Aggregation{
+			"min":    &MetricAgg{Field: "age", Metric: MetricMin},
+			"max":    &MetricAgg{Field: "age", Metric: MetricMax},
+			"sum":    &MetricAgg{Field: "age", Metric: MetricSum},
+			"names":  &MetricAgg{Field: "name", Metric: MetricCardinality},
+			"cities": &MetricAgg{Field: "city", Metric: MetricCardinality},
+			"none":   &MetricAgg{Field: "nope", Metric: MetricMax},
+		})
+		assert.Equal(t, float64(35), aggs["min"].Value)
+		assert.Equal(t, float64(52), aggs["max"].Value)
+		assert.Equal(t, float64(128), aggs["sum"].Value)
+		assert.Equal(t, int64(3), aggs["sum"].Count)
+		assert.Equal(t, float64(3), aggs["names"].Value)
+		assert.Equal(t, float64(1), aggs["cities"].Value)
+		assert.Equal(t, int64(0), aggs["none"].Count)
+	}
+	{ // test case - ranges and histograms
+		aggs := aggregate(nil, map[string]Aggregation{
+			"ages": &RangeAgg{Field: "age", Ranges: []AggRange{
+				{To: f(30)},
+				{From: f(30), To: f(50)},
+				{Key: "old", From: f(50)},
+			}},
+			"decades": &HistogramAgg{Field: "age", Interval: 10, Aggs: map[string]Aggregation{
+				"names": &TermsAgg{Field: "name", Size: 1},
+			}},
+		})
+		assert.Equal(t, []string{"*-30:3", "30-50:2", "old:1"}, bucketCounts(aggs["ages"]))
+		assert.Equal(t, f(30), aggs["ages"].Buckets[1].From)
+		assert.Equal(t, []string{"10:1", "20:2", "30:1", "40:1", "50:1"}, bucketCounts(aggs["decades"]))
+		assert.Equal(t, []string{"amy:1"}, bucketCounts(aggs["decades"].Buckets[1].Aggs["names"]))
+	}
+	{ // test case - date histogram over the docs' timestamps
+		aggs := aggregate(nil, map[string]Aggregation{
+			"hourly": &DateHistogramAgg{Interval: time.Hour},
+		})
+		buckets := aggs["hourly"].Buckets
+		assert.Equal(t, 3, len(buckets))
+		for i, b := range buckets {
+			assert.Equal(t, true, b.Key.Value().(time.Time).Equal(start.Add(time.Duration(i)*time.Hour)))
+			assert.Equal(t, int64(2), b.DocCount)
+		}
+	}
+	{ // test case - bad aggregations
+		_, err := idx.Execute(context.TODO(), &SearchRequest{Aggs: map[string]Aggregation{
+			"bad": &HistogramAgg{Field: "age"},
+		}})
+		assert.NotEqual(t, nil, err)
+		_, err = idx.Execute(context.TODO(), &SearchRequest{Aggs: map[string]Aggregation{
+			"bad": &MetricAgg{Field: "city", Metric: MetricSum},
+		}})
+		assert.NotEqual(t, nil, err)
+	}
+}
@@ -1,20 +1,268 @@
 package index
 
-//
-// import (
-// 	"github.com/araddon/qlbridge/value"
-// 	"github.com/lytics/lio/src/custdata/kinds"
-// )
-//
-// type AnalysisResults struct {
-// }
-//
-// func analyse(val value.Value) *AnalysisResults {
-// 	// No implicit conversions allowed for Bool type
-// 	switch val.Type() {
-// 	case value.BoolType:
-// 		return
-// 	default:
-// 		return nil, NewUnsupportedConversion(kinds.DataTypeBool, f)
-// 	}
-// }
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a term produced by analysing a field's text.  Position is the token's index in the
+// token stream, Start and End are the byte offsets of the token's text in the input.
+type Token struct {
+	Term     string
+	Position int
+	Start    int
+	End      int
+}
+
+// Tokenizer splits text into tokens.
+type Tokenizer interface {
+	Tokenize(text string) []Token
+}
+
+// TokenFilter transforms a stream of tokens, a filter can change, drop or add tokens.  Filters
+// which drop tokens keep the positions of the remaining tokens, so phrases don't match across a
+// removed stop word.
+type TokenFilter interface {
+	Filter(tokens []Token) []Token
+}
+
+// Analyzer turns a field's text into the terms that are indexed for it.
+type Analyzer interface {
+	Analyze(text string) []Token
+}
+
+// CustomAnalyzer is an Analyzer made of a Tokenizer followed by a chain of TokenFilters.
+type CustomAnalyzer struct {
+	Tokenizer Tokenizer
+	Filters   []TokenFilter
+}
+
+func NewCustomAnalyzer(tokenizer Tokenizer, filters ...TokenFilter) *CustomAnalyzer {
+	return &CustomAnalyzer{Tokenizer: tokenizer, Filters: filters}
+}
+
+func (a *CustomAnalyzer) Analyze(text string) []Token {
+	tokens := a.Tokenizer.Tokenize(text)
+	for _, filter := range a.Filters {
+		tokens = filter.Filter(tokens)
+	}
+	return tokens
+}
+
+// KeywordAnalyzer indexes the whole text as a single term, it's what fields without an analyzer
+// use.
+type KeywordAnalyzer struct{}
+
+func (KeywordAnalyzer) Analyze(text string) []Token {
+	if text == "" {
+		return nil
+	}
+	return []Token{{Term: text, Position: 0, Start: 0, End: len(text)}}
+}
+
+// NewStandardAnalyzer splits text into unicode words, then lowercases and ASCII folds them.
+func NewStandardAnalyzer() Analyzer {
+	return NewCustomAnalyzer(UnicodeWordTokenizer{}, LowercaseFilter{}, ASCIIFoldingFilter{})
+}
+
+// NewEnglishAnalyzer is the standard analyzer with English stop words removed.
+func NewEnglishAnalyzer() Analyzer {
+	return NewCustomAnalyzer(UnicodeWordTokenizer{}, LowercaseFilter{}, ASCIIFoldingFilter{},
+		NewStopWordFilter(EnglishStopWords...))
+}
+
+// tokenize emits a token for each run of runes for which isTokenRune is true.
+func tokenize(text string, isTokenRune func(r rune) bool) []Token {
+	tokens := []Token{}
+	start := -1
+	for i, r := range text {
+		switch {
+		case isTokenRune(r) && start < 0:
+			start = i
+		case !isTokenRune(r) && start >= 0:
+			tokens = append(tokens, Token{Term: text[start:i], Position: len(tokens), Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, Token{Term: text[start:], Position: len(tokens), Start: start, End: len(text)})
+	}
+	return tokens
+}
+
+// WhitespaceTokenizer splits text on unicode white space.
+type WhitespaceTokenizer struct{}
+
+func (WhitespaceTokenizer) Tokenize(text string) []Token {
+	return tokenize(text, func(r rune) bool { return !unicode.IsSpace(r) })
+}
+
+// UnicodeWordTokenizer splits text into words made of unicode letters, marks and digits, so
+// "e-mail user42" becomes e, mail and user42.
+type UnicodeWordTokenizer struct{}
+
+func (UnicodeWordTokenizer) Tokenize(text string) []Token {
+	return tokenize(text, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r)
+	})
+}
+
+// LetterTokenizer splits text on anything that isn't a unicode letter.
+type LetterTokenizer struct{}
+
+func (LetterTokenizer) Tokenize(text string) []Token {
+	return tokenize(text, unicode.IsLetter)
+}
+
+// LowercaseFilter lowercases each token.
+type LowercaseFilter struct{}
+
+func (LowercaseFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = strings.ToLower(tokens[i].Term)
+	}
+	return tokens
+}
+
+// ASCIIFoldingFilter replaces the accented Latin letters and ligatures in each token with their
+// ASCII equivalents, so "café" matches "cafe".
+type ASCIIFoldingFilter struct{}
+
+func (ASCIIFoldingFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = foldASCII(tokens[i].Term)
+	}
+	return tokens
+}
+
+func foldASCII(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if folded, ok := asciiFolding[r]; ok {
+			b.WriteString(folded)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// asciiFolding maps the Latin-1 Supplement and Latin Extended-A letters to ASCII.
+var asciiFolding = func() map[rune]string {
+	m := map[rune]string{}
+	add := func(ascii string, runes string) {
+		for _, r := range runes {
+			m[r] = ascii
+		}
+	}
+	add("A", "ÀÁÂÃÄÅĀĂĄ")
+	add("a", "àáâãäåāăą")
+	add("AE", "Æ")
+	add("ae", "æ")
+	add("C", "ÇĆĈĊČ")
+	add("c", "çćĉċč")
+	add("D", "ĎĐÐ")
+	add("d", "ďđð")
+	add("E", "ÈÉÊËĒĔĖĘĚ")
+	add("e", "èéêëēĕėęě")
+	add("G", "ĜĞĠĢ")
+	add("g", "ĝğġģ")
+	add("H", "ĤĦ")
+	add("h", "ĥħ")
+	add("I", "ÌÍÎÏĨĪĬĮİ")
+	add("i", "ìíîïĩīĭįı")
+	add("IJ", "Ĳ")
+	add("ij", "ĳ")
+	add("J", "Ĵ")
+	add("j", "ĵ")
+	add("K", "Ķ")
+	add("k", "ķĸ")
+	add("L", "ĹĻĽĿŁ")
+	add("l", "ĺļľŀł")
+	add("N", "ÑŃŅŇŊ")
+	add("n", "ñńņňŉŋ")
+	add("O", "ÒÓÔÕÖØŌŎŐ")
+	add("o", "òóôõöøōŏő")
+	add("OE", "Œ")
+	add("oe", "œ")
+	add("R", "ŔŖŘ")
+	add("r", "ŕŗř")
+	add("S", "ŚŜŞŠ")
+	add("s", "śŝşšſ")
+	add("ss", "ß")
+	add("T", "ŢŤŦ")
+	add("t", "ţťŧ")
+	add("TH", "Þ")
+	add("th", "þ")
+	add("U", "ÙÚÛÜŨŪŬŮŰŲ")
+	add("u", "ùúûüũūŭůűų")
+	add("W", "Ŵ")
+	add("w", "ŵ")
+	add("Y", "ÝŶŸ")
+	add("y", "ýÿŷ")
+	add("Z", "ŹŻŽ")
+	add("z", "źżž")
+	return m
+}()
+
+// StopWordFilter removes the stop words from the token stream.
+type StopWordFilter struct {
+	stopWords map[string]struct{}
+}
+
+func NewStopWordFilter(words ...string) *StopWordFilter {
+	stopWords := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		stopWords[w] = struct{}{}
+	}
+	return &StopWordFilter{stopWords}
+}
+
+func (f *StopWordFilter) Filter(tokens []Token) []Token {
+	kept := tokens[:0]
+	for _, token := range tokens {
+		if _, ok := f.stopWords[token.Term]; !ok {
+			kept = append(kept, token)
+		}
+	}
+	return kept
+}
+
+// EnglishStopWords are Lucene's default English stop words.
+var EnglishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into", "is", "it",
+	"no", "not", "of", "on", "or", "such", "that", "the", "their", "then", "there", "these",
+	"they", "this", "to", "was", "will", "with",
+}
+
+// LengthFilter removes tokens with fewer than Min or more than Max runes, a Max of 0 means there
+// is no max.
+type LengthFilter struct {
+	Min int
+	Max int
+}
+
+func (f LengthFilter) Filter(tokens []Token) []Token {
+	kept := tokens[:0]
+	for _, token := range tokens {
+		n := utf8.RuneCountInString(token.Term)
+		if n < f.Min || (f.Max > 0 && n > f.Max) {
+			continue
+		}
+		kept = append(kept, token)
+	}
+	return kept
+}
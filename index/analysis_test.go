@@ -0,0 +1,127 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func terms(tokens []Token) []string {
+	ts := []string{}
+	for _, token := range tokens {
+		ts = append(ts, token.Term)
+	}
+	return ts
+}
+
+func TestTokenizers(t *testing.T) {
+	text := "The Café's e-mail: user42 "
+
+	assert.Equal(t, []string{"The", "Café's", "e-mail:", "user42"}, terms(WhitespaceTokenizer{}.Tokenize(text)))
+	assert.Equal(t, []string{"The", "Café", "s", "e", "mail", "user42"}, terms(UnicodeWordTokenizer{}.Tokenize(text)))
+	assert.Equal(t, []string{"The", "Café", "s", "e", "mail", "user"}, terms(LetterTokenizer{}.Tokenize(text)))
+
+	{ // test case - offsets and positions
+		tokens := WhitespaceTokenizer{}.Tokenize(text)
+		assert.Equal(t, Token{Term: "e-mail:", Position: 2, Start: 12, End: 19}, tokens[2])
+		assert.Equal(t, "e-mail:", text[tokens[2].Start:tokens[2].End])
+	}
+}
+
+func TestTokenFilters(t *testing.T) {
+	analyze := func(text string, filters ...TokenFilter) []string {
+		return terms(NewCustomAnalyzer(WhitespaceTokenizer{}, filters...).Analyze(text))
+	}
+
+	assert.Equal(t, []string{"hello", "wörld"}, analyze("Hello WÖRLD", LowercaseFilter{}))
+	assert.Equal(t, []string{"Creme", "brulee", "AEsop", "strasse"}, analyze("Crème brûlée Æsop straße", ASCIIFoldingFilter{}))
+	assert.Equal(t, []string{"quick", "fox"}, analyze("the quick and the fox", NewStopWordFilter(EnglishStopWords...)))
+	assert.Equal(t, []string{"ab", "abc"}, analyze("a ab abc abcd", LengthFilter{Min: 2, Max: 3}))
+	assert.Equal(t, []string{"abcd"}, analyze("a ab abc abcd", LengthFilter{Min: 4}))
+
+	{ // test case - removed tokens leave a gap in the positions
+		tokens := NewEnglishAnalyzer().Analyze("The Quick and the Fox")
+		assert.Equal(t, []string{"quick", "fox"}, terms(tokens))
+		assert.Equal(t, 1, tokens[0].Position)
+		assert.Equal(t, 4, tokens[1].Position)
+	}
+}
+
+func TestAnalyzedFields(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetAnalyzer("title", NewStandardAnalyzer())
+
+	now := time.Now()
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{
+			"title":    NewStringVal("The Quick Brown Fox"),
+			"category": NewStringVal("Wild Animals"),
+		}, now),
+		NewDocument("doc:2", map[string]value.Value{
+			"title":    value.NewStringsValue([]string{"Café Culture", "Brown bread"}),
+			"category": NewStringVal("Food"),
+		}, now),
+	}
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(q Query) []string {
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return res.ExternalDocIDs
+	}
+
+	{ // test case - analyzed fields match each word
+		assert.Equal(t, []string{"doc:1"}, search(&RegExTermQuery{"title", "quick"}))
+		assert.Equal(t, []string{"doc:1", "doc:2"}, search(&RegExTermQuery{"title", "brown"}))
+		assert.Equal(t, []string{"doc:2"}, search(&RegExTermQuery{"title", "cafe"}))
+		assert.Equal(t, []string{}, search(&RegExTermQuery{"title", "The Quick Brown Fox"}))
+	}
+
+	{ // test case - fields without an analyzer are indexed as one term
+		assert.Equal(t, []string{"doc:1"}, search(&RegExTermQuery{"category", "Wild Animals"}))
+		assert.Equal(t, []string{}, search(&RegExTermQuery{"category", "wild"}))
+	}
+}
+
+func TestIndexAnalyzers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the analyzer isn't registered, it's only known to the index through its options.
+	idx, err := NewIndex(dir, &IndexOptions{
+		DisableBackgroundMerges: true,
+		Analyzers:               map[string]Analyzer{"tags": NewCustomAnalyzer(WhitespaceTokenizer{}, LowercaseFilter{})},
+	})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{"tags": NewStringVal("Go search-engine")}, time.Now()),
+		NewDocument("doc:2", map[string]value.Value{"tags": NewStringVal("Rust")}, time.Now()),
+	}
+	if err := idx.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, FieldTypeText, idx.Mapping().Fields["tags"].Type)
+
+	res, err := idx.Search(context.TODO(), &RegExTermQuery{"tags", "search-engine"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc:1"}, res.ExternalDocIDs)
+}
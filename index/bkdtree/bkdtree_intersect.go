@@ -6,6 +6,25 @@ import (
 	"github.com/pkg/errors"
 )
 
+//IntersectVisitor is the callback interface used by Intersect. It returns the window of the
+//query, and is called with every point inside of the window.
+type IntersectVisitor interface {
+	GetLowPoint() Point
+	GetHighPoint() Point
+	VisitPoint(point Point)
+}
+
+//IntersectCollector is an IntersectVisitor which collects all points inside of the window.
+type IntersectCollector struct {
+	LowPoint  Point
+	HighPoint Point
+	Points    []Point
+}
+
+func (d *IntersectCollector) GetLowPoint() Point     { return d.LowPoint }
+func (d *IntersectCollector) GetHighPoint() Point    { return d.HighPoint }
+func (d *IntersectCollector) VisitPoint(point Point) { d.Points = append(d.Points, point) }
+
 //Intersect does window query
 func (bkd *BkdTree) Intersect(visitor IntersectVisitor) (err error) {
 	bkd.rwlock.RLock()
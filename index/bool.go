@@ -0,0 +1,90 @@
+package index
+
+import (
+	"context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+)
+
+// boolField indexes a bool field as a field with only two terms, so instead of a term dictionary
+// and posting lists it's just the bitmaps of the docs with each value.
+type boolField struct {
+	trueDocs  *roaring.Bitmap
+	falseDocs *roaring.Bitmap
+}
+
+func newBoolField() *boolField {
+	return &boolField{roaring.New(), roaring.New()}
+}
+
+func (bf *boolField) docs(val bool) *roaring.Bitmap {
+	if val {
+		return bf.trueDocs
+	}
+	return bf.falseDocs
+}
+
+// processBoolTerm processes value.Values of type bool, if the wrong type is passed in then we'll get a panic
+func (seg *Segment) processBoolTerm(inDocID uint32, field string, rawTerm value.Value) {
+	fieldID := seg.fieldID(field)
+	bf, ok := seg.boolFields[fieldID]
+	if !ok {
+		bf = newBoolField()
+		seg.boolFields[fieldID] = bf
+	}
+	bf.docs(rawTerm.Value().(bool)).Add(inDocID)
+}
+
+// BoolTermQuery matches docs where the bool field is Value.
+type BoolTermQuery struct {
+	Field string
+	Value bool
+}
+
+func (q *BoolTermQuery) Type() QType {
+	return TypeBoolTermQuery
+}
+
+// QueryBoolTerm returns the docs where the bool field has the query's value.
+func (seg *Segment) QueryBoolTerm(ctx context.Context, query *BoolTermQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.boolTermQuery(ctx, query)
+}
+
+func (seg *Segment) boolTermQuery(ctx context.Context, query *BoolTermQuery) (*SearchResults, error) {
+	fieldID, ok := seg.fieldToFieldId[query.Field]
+	if !ok {
+		return nil, &FieldNotFoundError{Field: query.Field}
+	}
+	bf, ok := seg.boolFields[fieldID]
+	if !ok {
+		return nil, &FieldNotFoundError{Field: query.Field, Type: "bool"}
+	}
+	return &SearchResults{internalDocIds: roaring.And(bf.docs(query.Value), seg.liveDocs)}, nil
+}
+
+// mergeBoolFields adds the bool fields from another segment, remapping their doc IDs with docMap.
+func (seg *Segment) mergeBoolFields(other *Segment, docMap []int64) {
+	fieldNames := make(map[uint32]string, len(other.fieldToFieldId))
+	for field, fid := range other.fieldToFieldId {
+		fieldNames[fid] = field
+	}
+	for fid, bf := range other.boolFields {
+		fieldID := seg.fieldID(fieldNames[fid])
+		merged, ok := seg.boolFields[fieldID]
+		if !ok {
+			merged = newBoolField()
+			seg.boolFields[fieldID] = merged
+		}
+		for _, val := range []bool{true, false} {
+			docIter := bf.docs(val).Iterator()
+			for docIter.HasNext() {
+				if newID := docMap[docIter.Next()]; newID >= 0 {
+					merged.docs(val).Add(uint32(newID))
+				}
+			}
+		}
+	}
+}
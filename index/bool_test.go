@@ -0,0 +1,131 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func boolTestDocs(now time.Time) []Document {
+	docs := []Document{}
+	for i := 0; i < 100; i++ {
+		fieldvals := map[string]value.Value{
+			"active": value.NewBoolValue(i%2 == 0),
+			"age":    value.NewIntValue(int64(i)),
+		}
+		if i%10 == 0 {
+			fieldvals["admin"] = value.NewBoolValue(true)
+		}
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%04d", i), fieldvals, now))
+	}
+	return docs
+}
+
+func TestBoolTermQuery(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), boolTestDocs(now)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	count := func(q *BoolTermQuery) int {
+		res, err := segment.QueryBoolTerm(context.TODO(), q)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return int(res.internalDocIds.GetCardinality())
+	}
+	assert.Equal(t, 50, count(&BoolTermQuery{"active", true}))
+	assert.Equal(t, 50, count(&BoolTermQuery{"active", false}))
+	assert.Equal(t, 10, count(&BoolTermQuery{"admin", true}))
+	assert.Equal(t, 0, count(&BoolTermQuery{"admin", false}))
+
+	{ // test case - bool queries plug into the query builder
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&BoolTermQuery{"active", false},
+				&NumericRangeQuery{"age", value.NewIntValue(90), nil, true, false}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:0091", "doc:0093", "doc:0095", "doc:0097", "doc:0099"}, res.ExternalDocIDs)
+	}
+
+	{ // test case - updated docs move to the other bitmap
+		updated := NewDocument("doc:0001", map[string]value.Value{"active": value.NewBoolValue(true)}, now)
+		if err := segment.IndexDocuments(context.TODO(), []Document{updated}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 51, count(&BoolTermQuery{"active", true}))
+		assert.Equal(t, 49, count(&BoolTermQuery{"active", false}))
+	}
+
+	{ // test case - a non bool field isn't found, like a missing field
+		_, err := segment.QueryBoolTerm(context.TODO(), &BoolTermQuery{"age", true})
+		assert.Equal(t, &FieldNotFoundError{Field: "age", Type: "bool"}, err)
+
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&BooleanQuery{Should: []Query{&BoolTermQuery{"age", true}, &BoolTermQuery{"admin", true}}}).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 10, len(res.ExternalDocIDs))
+	}
+}
+
+func TestBoolFieldsPersistAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 4, MaxMergeAtOnce: 4, FloorSegmentDocs: 1000, MaxMergedSegmentDocs: 10000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	docs := boolTestDocs(now)
+	for i := 0; i < len(docs); i += 25 {
+		if err := idx.IndexDocuments(context.TODO(), docs[i:i+25]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	if _, err := idx.DeleteDocuments(context.TODO(), "doc:0010"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func() []string {
+		res, err := idx.Search(context.TODO(), &BoolTermQuery{"admin", true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+	expected := []string{"doc:0000", "doc:0020", "doc:0030", "doc:0040", "doc:0050", "doc:0060", "doc:0070", "doc:0080", "doc:0090"}
+	assert.Equal(t, expected, search())
+	// the segments don't have a bool age field, so they're skipped.
+	res, err := idx.Search(context.TODO(), &BoolTermQuery{"age", true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 0, len(res.ExternalDocIDs))
+
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 1, len(idx.Segments()))
+	assert.Equal(t, expected, search())
+}
@@ -0,0 +1,154 @@
+package index
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// BooleanQuery combines other queries, including other BooleanQuerys, into a tree.  A doc
+// matches if it matches all of the Must and Filter queries, none of the MustNot queries, and at
+// least MinimumShouldMatch of the Should queries.  Only Must and Should queries add to a doc's
+// score.
+//
+// When there are no Must or Filter queries at least one Should query has to match, and a
+// query with only MustNot queries matches every doc in the segment which isn't excluded.
+type BooleanQuery struct {
+	Must               []Query
+	Should             []Query
+	MustNot            []Query
+	Filter             []Query
+	MinimumShouldMatch int
+}
+
+func (q *BooleanQuery) Type() QType {
+	return TypeBooleanQuery
+}
+
+// QueryBoolean returns the docs which match the boolean query.  A Must or Filter query on a
+// field the segment doesn't have fails with a FieldNotFoundError, as no doc can match it, while
+// Should and MustNot queries on missing fields just don't match any docs.
+func (seg *Segment) QueryBoolean(ctx context.Context, query *BooleanQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.booleanQuery(ctx, query)
+}
+
+func (seg *Segment) booleanQuery(ctx context.Context, query *BooleanQuery) (*SearchResults, error) {
+	if query.MinimumShouldMatch < 0 {
+		return nil, fmt.Errorf("minimum should match can't be negative: %v", query.MinimumShouldMatch)
+	}
+
+	var docs *roaring.Bitmap
+	and := func(other *roaring.Bitmap) error {
+		if err := queryCancelled(ctx); err != nil {
+			return err
+		}
+		if docs == nil {
+			docs = other
+		} else {
+			docs.And(other)
+		}
+		return nil
+	}
+
+	// expressions are evaluated last, on just the docs which match the other clauses.
+	var exprs []*ExprQuery
+	for _, clauses := range [][]Query{query.Must, query.Filter} {
+		for _, child := range clauses {
+			if eq, ok := child.(*ExprQuery); ok {
+				exprs = append(exprs, eq)
+				continue
+			}
+			childDocs, err := seg.execute(ctx, child)
+			if err != nil {
+				return nil, err
+			}
+			if err := and(childDocs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	minShouldMatch := query.MinimumShouldMatch
+	if minShouldMatch == 0 && docs == nil && len(exprs) == 0 && len(query.Should) > 0 {
+		minShouldMatch = 1
+	}
+	if minShouldMatch > 0 {
+		shouldDocs, err := seg.minShouldMatch(ctx, query.Should, minShouldMatch)
+		if err != nil {
+			return nil, err
+		}
+		if err := and(shouldDocs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, eq := range exprs {
+		candidates := docs
+		if candidates == nil {
+			candidates = seg.liveDocs
+		}
+		matched, err := seg.filterExpr(ctx, eq, candidates)
+		if err != nil {
+			return nil, err
+		}
+		docs = matched
+	}
+
+	if docs == nil {
+		if len(query.MustNot) == 0 {
+			return &SearchResults{internalDocIds: roaring.New()}, nil
+		}
+		// a purely negative query excludes docs from the whole segment.
+		docs = seg.liveDocs.Clone()
+	}
+	for _, child := range query.MustNot {
+		childDocs, err := seg.optionalClause(ctx, child)
+		if err != nil {
+			return nil, err
+		}
+		if err := queryCancelled(ctx); err != nil {
+			return nil, err
+		}
+		docs.AndNot(childDocs)
+	}
+	docs.And(seg.liveDocs)
+	return &SearchResults{internalDocIds: docs}, nil
+}
+
+// optionalClause runs a Should or MustNot query, a field the segment doesn't have matches nothing.
+func (seg *Segment) optionalClause(ctx context.Context, query Query) (*roaring.Bitmap, error) {
+	docs, err := seg.execute(ctx, query)
+	if _, ok := err.(*FieldNotFoundError); ok {
+		return roaring.New(), nil
+	}
+	return docs, err
+}
+
+// minShouldMatch returns the docs which match at least n of the queries.
+func (seg *Segment) minShouldMatch(ctx context.Context, queries []Query, n int) (*roaring.Bitmap, error) {
+	if n > len(queries) {
+		return roaring.New(), nil
+	}
+	// atLeast[i] are the docs which matched at least i+1 of the queries run so far.
+	atLeast := make([]*roaring.Bitmap, n)
+	for i := range atLeast {
+		atLeast[i] = roaring.New()
+	}
+	for _, query := range queries {
+		docs, err := seg.optionalClause(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for i := n - 1; i > 0; i-- {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+			atLeast[i].Or(roaring.And(atLeast[i-1], docs))
+		}
+		atLeast[0].Or(docs)
+	}
+	return atLeast[n-1], nil
+}
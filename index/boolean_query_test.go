@@ -0,0 +1,123 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+// unknownQuery is a query type segments don't know how to run.
+type unknownQuery struct{}
+
+func (q *unknownQuery) Type() QType { return 999 }
+
+func booleanTestSegment(t *testing.T) *Segment {
+	now := time.Now()
+	colors := []string{"red", "green", "blue"}
+	docs := []Document{}
+	for i := 0; i < 12; i++ {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%02d", i), map[string]value.Value{
+			"color": NewStringVal(colors[i%3]),
+			"num":   value.NewIntValue(int64(i)),
+			"even":  value.NewBoolValue(i%2 == 0),
+		}, now))
+	}
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	return segment
+}
+
+func TestBooleanQuery(t *testing.T) {
+	segment := booleanTestSegment(t)
+	defer segment.Close()
+
+	search := func(q Query) []string {
+		res, err := segment.QueryBoolean(context.TODO(), q.(*BooleanQuery))
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		ids, err := GetExternalIDs(segment, res.internalDocIds)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	red := &RegExTermQuery{"color", "red"}
+	green := &RegExTermQuery{"color", "green"}
+	even := &BoolTermQuery{"even", true}
+	small := &NumericRangeQuery{"num", nil, value.NewIntValue(6), false, false}
+
+	assert.Equal(t, []string{"doc:00", "doc:06"}, search(&BooleanQuery{Must: []Query{red}, Filter: []Query{even}}))
+	assert.Equal(t, []string{"doc:00", "doc:01", "doc:03", "doc:04", "doc:06", "doc:07", "doc:09", "doc:10"},
+		search(&BooleanQuery{Should: []Query{red, green}}))
+	assert.Equal(t, []string{"doc:03", "doc:09"}, search(&BooleanQuery{Must: []Query{red}, MustNot: []Query{even}}))
+
+	{ // test case - should clauses are optional when there's a must clause
+		assert.Equal(t, []string{"doc:00", "doc:03", "doc:06", "doc:09"},
+			search(&BooleanQuery{Must: []Query{red}, Should: []Query{even}}))
+	}
+
+	{ // test case - minimum should match
+		q := &BooleanQuery{Should: []Query{red, even, small}, MinimumShouldMatch: 2}
+		assert.Equal(t, []string{"doc:00", "doc:02", "doc:03", "doc:04", "doc:06"}, search(q))
+		q.MinimumShouldMatch = 3
+		assert.Equal(t, []string{"doc:00"}, search(q))
+		q.MinimumShouldMatch = 4
+		assert.Equal(t, []string{}, search(q))
+	}
+
+	{ // test case - nested queries, (red or green) and not (even or num < 6)
+		q := &BooleanQuery{
+			Must:    []Query{&BooleanQuery{Should: []Query{red, green}}},
+			MustNot: []Query{&BooleanQuery{Should: []Query{even, small}}},
+		}
+		assert.Equal(t, []string{"doc:07", "doc:09"}, search(q))
+	}
+
+	{ // test case - must not on its own is evaluated against every doc
+		assert.Equal(t, []string{"doc:01", "doc:03", "doc:07", "doc:09"},
+			search(&BooleanQuery{MustNot: []Query{even, &RegExTermQuery{"color", "blue"}}}))
+		if _, err := segment.DeleteDocuments("doc:07"); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:01", "doc:03", "doc:09"},
+			search(&BooleanQuery{MustNot: []Query{even, &RegExTermQuery{"color", "blue"}}}))
+		assert.Equal(t, []string{}, search(&BooleanQuery{}))
+	}
+
+	{ // test case - missing fields
+		missing := &RegExTermQuery{"size", "xl"}
+		assert.Equal(t, []string{"doc:00", "doc:03", "doc:06", "doc:09"}, search(&BooleanQuery{Should: []Query{red, missing}}))
+		assert.Equal(t, []string{"doc:00", "doc:03", "doc:06", "doc:09"}, search(&BooleanQuery{Must: []Query{red}, MustNot: []Query{missing}}))
+		_, err := segment.QueryBoolean(context.TODO(), &BooleanQuery{Must: []Query{red, missing}})
+		assert.Equal(t, &FieldNotFoundError{Field: "size"}, err)
+	}
+
+	{ // test case - unsupported children are an error
+		_, err := segment.QueryBoolean(context.TODO(), &BooleanQuery{Should: []Query{red, &unknownQuery{}}})
+		assert.Equal(t, "unsupported query type: *index.unknownQuery", fmt.Sprint(err))
+	}
+}
+
+func TestQueryBuilderOperators(t *testing.T) {
+	segment := booleanTestSegment(t)
+	defer segment.Close()
+
+	res, err := NewQueryBuilder(context.TODO(), segment).
+		Or(&RegExTermQuery{"color", "red"}, &RegExTermQuery{"color", "blue"}).
+		And(&NumericRangeQuery{"num", value.NewIntValue(3), nil, true, false}).
+		AndNot(&BoolTermQuery{"even", false}).
+		Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc:06", "doc:08"}, res.ExternalDocIDs)
+}
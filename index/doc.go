@@ -6,8 +6,7 @@ import (
 	"github.com/araddon/qlbridge/value"
 )
 
-// TODO replace use of the Doc struct below with this interface
-// replace the doc look in segment.go to use the Analizier
+// Document is a doc to index, string fields are split into terms by the field's Analyzer.
 type Document interface {
 	ID() string
 	Get(key string) (value.Value, bool)
@@ -0,0 +1,591 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+)
+
+// Doc values are the column oriented copy of the fields mapped with DocValues, they map an
+// internal doc ID to the doc's values of the field.  Sorting and aggregations read them instead
+// of the inverted index or the stored fields.  Deleted docs keep their values, readers must check
+// the live docs.
+
+// TimestampField is the numeric doc values column of the docs' timestamps, Document.Ts().  Docs
+// can't have a field with the name.
+const TimestampField = "_ts"
+
+// DocValuesType is the kind of column a field's doc values are kept in.
+type DocValuesType uint32
+
+const (
+	// DocValuesSortedSet columns hold the ordinals of each doc's strings in the sorted set of the
+	// field's strings.
+	DocValuesSortedSet DocValuesType = 1
+	// DocValuesNumeric columns hold each doc's encoded numbers or times, as packed ints.
+	DocValuesNumeric DocValuesType = 2
+	// DocValuesBool columns are the bitsets of the docs with a true and a false value.
+	DocValuesBool DocValuesType = 3
+)
+
+func (t DocValuesType) String() string {
+	switch t {
+	case DocValuesSortedSet:
+		return "sorted set"
+	case DocValuesNumeric:
+		return "numeric"
+	case DocValuesBool:
+		return "bool"
+	}
+	return fmt.Sprintf("DocValuesType(%d)", uint32(t))
+}
+
+// docValuesType returns the column type for a field type, geo fields don't have doc values.
+func docValuesType(ft FieldType) (DocValuesType, bool) {
+	switch ft {
+	case FieldTypeKeyword, FieldTypeText:
+		return DocValuesSortedSet, true
+	case FieldTypeNumeric, FieldTypeDate:
+		return DocValuesNumeric, true
+	case FieldTypeBool:
+		return DocValuesBool, true
+	}
+	return 0, false
+}
+
+// docValues is implemented by *SortedSetDocValues, *NumericDocValues and *BoolDocValues.
+type docValues interface {
+	Type() DocValuesType
+	write(sw *segmentWriter)
+}
+
+// SortedSetDocValues are the doc values of a string field.  The ordinals of the field's strings
+// follow their byte order, so ordinals compare the same way as the strings, but only within a
+// segment.  Each doc's ordinals are sorted and unique.
+type SortedSetDocValues struct {
+	terms   []string
+	offsets *packedInts // the ordinals of doc d are ords[offsets[d]:offsets[d+1]]
+	ords    *packedInts
+}
+
+func (dv *SortedSetDocValues) Type() DocValuesType { return DocValuesSortedSet }
+
+// NumTerms returns the number of distinct strings in the column.
+func (dv *SortedSetDocValues) NumTerms() int {
+	return len(dv.terms)
+}
+
+// Term returns the string with the ordinal.
+func (dv *SortedSetDocValues) Term(ord uint32) string {
+	return dv.terms[ord]
+}
+
+// LookupTerm returns the ordinal of the string.
+func (dv *SortedSetDocValues) LookupTerm(term string) (uint32, bool) {
+	i := sort.SearchStrings(dv.terms, term)
+	if i < len(dv.terms) && dv.terms[i] == term {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// Ords appends the ordinals of the doc's strings to dst.
+func (dv *SortedSetDocValues) Ords(dst []uint32, did uint32) []uint32 {
+	start, end := docRange(dv.offsets, did)
+	for i := start; i < end; i++ {
+		dst = append(dst, uint32(dv.ords.get(i)))
+	}
+	return dst
+}
+
+func (dv *SortedSetDocValues) write(sw *segmentWriter) {
+	sw.putUint32(uint32(len(dv.terms)))
+	for _, term := range dv.terms {
+		sw.putString(term)
+	}
+	dv.offsets.write(sw)
+	dv.ords.write(sw)
+}
+
+// NumericDocValues are the doc values of a numeric or date field.  Values are encoded like the
+// points of the field's bkd tree, so the encoded values sort in the same order as the values.
+// Each doc's values are sorted.
+type NumericDocValues struct {
+	kind    value.ValueType
+	offsets *packedInts // the values of doc d are values[offsets[d]:offsets[d+1]]
+	values  *packedInts
+}
+
+func (dv *NumericDocValues) Type() DocValuesType { return DocValuesNumeric }
+
+// Kind returns the value.ValueType of the column's values, value.IntType, value.NumberType or
+// value.TimeType.
+func (dv *NumericDocValues) Kind() value.ValueType {
+	return dv.kind
+}
+
+// Encoded appends the doc's encoded values to dst.
+func (dv *NumericDocValues) Encoded(dst []uint64, did uint32) []uint64 {
+	start, end := docRange(dv.offsets, did)
+	for i := start; i < end; i++ {
+		dst = append(dst, dv.values.get(i))
+	}
+	return dst
+}
+
+// Values returns the doc's values.
+func (dv *NumericDocValues) Values(did uint32) []value.Value {
+	start, end := docRange(dv.offsets, did)
+	vals := make([]value.Value, 0, end-start)
+	for i := start; i < end; i++ {
+		vals = append(vals, decodeNumeric(dv.kind, dv.values.get(i)))
+	}
+	return vals
+}
+
+func (dv *NumericDocValues) write(sw *segmentWriter) {
+	sw.putUint32(uint32(dv.kind))
+	dv.offsets.write(sw)
+	dv.values.write(sw)
+}
+
+// BoolDocValues are the doc values of a bool field.  The bitsets must not be modified.
+type BoolDocValues struct {
+	trueDocs  *roaring.Bitmap
+	falseDocs *roaring.Bitmap
+}
+
+func (dv *BoolDocValues) Type() DocValuesType { return DocValuesBool }
+
+// Docs returns the docs with the value.
+func (dv *BoolDocValues) Docs(val bool) *roaring.Bitmap {
+	if val {
+		return dv.trueDocs
+	}
+	return dv.falseDocs
+}
+
+// Has returns true if val is one of the doc's values.
+func (dv *BoolDocValues) Has(did uint32, val bool) bool {
+	return dv.Docs(val).Contains(did)
+}
+
+func (dv *BoolDocValues) write(sw *segmentWriter) {
+	sw.putBitmap(dv.trueDocs)
+	sw.putBitmap(dv.falseDocs)
+}
+
+// docRange returns the range of a doc's values, docs past the end of the column have none.
+func docRange(offsets *packedInts, did uint32) (int, int) {
+	if int(did)+1 >= offsets.n {
+		return 0, 0
+	}
+	return int(offsets.get(int(did))), int(offsets.get(int(did) + 1))
+}
+
+// SortedSetDocValues returns the doc values of a keyword or text field.
+func (seg *Segment) SortedSetDocValues(field string) (*SortedSetDocValues, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	dv, err := seg.fieldDocValues(field, DocValuesSortedSet)
+	if err != nil {
+		return nil, err
+	}
+	return dv.(*SortedSetDocValues), nil
+}
+
+// NumericDocValues returns the doc values of a numeric or date field.
+func (seg *Segment) NumericDocValues(field string) (*NumericDocValues, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	dv, err := seg.fieldDocValues(field, DocValuesNumeric)
+	if err != nil {
+		return nil, err
+	}
+	return dv.(*NumericDocValues), nil
+}
+
+// BoolDocValues returns the doc values of a bool field.
+func (seg *Segment) BoolDocValues(field string) (*BoolDocValues, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	dv, err := seg.fieldDocValues(field, DocValuesBool)
+	if err != nil {
+		return nil, err
+	}
+	return dv.(*BoolDocValues), nil
+}
+
+func (seg *Segment) fieldDocValues(field string, typ DocValuesType) (docValues, error) {
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return nil, &FieldNotFoundError{Field: field}
+	}
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return nil, fmt.Errorf("field %v doesn't have doc values", field)
+	} else if dv.Type() != typ {
+		return nil, fmt.Errorf("field %v has %v doc values, not %v", field, dv.Type(), typ)
+	}
+	return dv, nil
+}
+
+// docValuesByID returns the column of the field.  The columns of in-memory segments are built
+// from their builders on first use, and rebuilt after more docs are indexed.
+func (seg *Segment) docValuesByID(fieldID uint32) (docValues, bool) {
+	seg.cacheMu.Lock()
+	defer seg.cacheMu.Unlock()
+	if dv, ok := seg.docValues[fieldID]; ok {
+		return dv, true
+	}
+	b, ok := seg.docValuesBuilders[fieldID]
+	if !ok {
+		return nil, false
+	}
+	dv := b.build()
+	seg.docValues[fieldID] = dv
+	return dv, true
+}
+
+// docValuesBuilder collects the values of a column as the docs of an in-memory segment are
+// indexed, the docs must be added in internal doc ID order.
+type docValuesBuilder struct {
+	typ  DocValuesType
+	kind value.ValueType
+
+	// offsets and values are the docs' values for numeric and sorted set columns, the values of a
+	// sorted set column are indexes into terms.
+	offsets []uint32
+	values  []uint64
+	termIDs map[string]uint32
+	terms   []string
+
+	trueDocs  *roaring.Bitmap
+	falseDocs *roaring.Bitmap
+}
+
+func newDocValuesBuilder(typ DocValuesType, kind value.ValueType) *docValuesBuilder {
+	b := &docValuesBuilder{typ: typ, kind: kind}
+	switch typ {
+	case DocValuesSortedSet:
+		b.termIDs = map[string]uint32{}
+	case DocValuesBool:
+		b.trueDocs, b.falseDocs = roaring.New(), roaring.New()
+	}
+	return b
+}
+
+func (b *docValuesBuilder) add(did uint32, v uint64) {
+	for uint32(len(b.offsets)) < did+2 {
+		b.offsets = append(b.offsets, uint32(len(b.values)))
+	}
+	b.values = append(b.values, v)
+	b.offsets[did+1] = uint32(len(b.values))
+}
+
+// promote converts the values of a numeric column to kind, see widerKind.
+func (b *docValuesBuilder) promote(kind value.ValueType) {
+	for i, v := range b.values {
+		b.values[i], _ = convertEncoded(b.kind, kind, v)
+	}
+	b.kind = kind
+}
+
+func (b *docValuesBuilder) addTerm(did uint32, term string) {
+	id, ok := b.termIDs[term]
+	if !ok {
+		id = uint32(len(b.terms))
+		b.termIDs[term] = id
+		b.terms = append(b.terms, term)
+	}
+	b.add(did, uint64(id))
+}
+
+func (b *docValuesBuilder) addBool(did uint32, val bool) {
+	if val {
+		b.trueDocs.Add(did)
+	} else {
+		b.falseDocs.Add(did)
+	}
+}
+
+// build returns the column of the values added so far.
+func (b *docValuesBuilder) build() docValues {
+	switch b.typ {
+	case DocValuesBool:
+		return &BoolDocValues{b.trueDocs.Clone(), b.falseDocs.Clone()}
+	case DocValuesNumeric:
+		vals := make([]uint64, len(b.values))
+		copy(vals, b.values)
+		offsets := make([]uint64, len(b.offsets))
+		for did := range b.offsets {
+			offsets[did] = uint64(b.offsets[did])
+			if did > 0 {
+				docVals := vals[b.offsets[did-1]:b.offsets[did]]
+				sort.Slice(docVals, func(i, j int) bool { return docVals[i] < docVals[j] })
+			}
+		}
+		return &NumericDocValues{kind: b.kind, offsets: packInts(offsets), values: packInts(vals)}
+	}
+
+	terms := make([]string, len(b.terms))
+	copy(terms, b.terms)
+	sort.Strings(terms)
+	ordOf := make([]uint64, len(terms))
+	for ord, term := range terms {
+		ordOf[b.termIDs[term]] = uint64(ord)
+	}
+	offsets := make([]uint64, 0, len(b.offsets))
+	ords := make([]uint64, 0, len(b.values))
+	for did := range b.offsets {
+		if did > 0 {
+			start := len(ords)
+			for _, id := range b.values[b.offsets[did-1]:b.offsets[did]] {
+				ords = append(ords, ordOf[id])
+			}
+			ords = append(ords[:start], sortUniqueUint64s(ords[start:])...)
+		}
+		offsets = append(offsets, uint64(len(ords)))
+	}
+	return &SortedSetDocValues{terms: terms, offsets: packInts(offsets), ords: packInts(ords)}
+}
+
+// sortUniqueUint64s sorts a and removes its duplicates in place.
+func sortUniqueUint64s(a []uint64) []uint64 {
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	out := a[:0]
+	for i, v := range a {
+		if i == 0 || v != a[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// checkDocValues checks the values of a doc against the type of their field's column, so a doc
+// whose field was remapped with another type is rejected before any of it is indexed.
+func (seg *Segment) checkDocValues(vals []mappedValue) error {
+	for _, mv := range vals {
+		typ, ok := docValuesType(mv.mapping.Type)
+		if !ok || !mv.mapping.DocValues {
+			continue
+		}
+		fieldID, ok := seg.fieldToFieldId[mv.field]
+		if !ok {
+			continue
+		}
+		if b, ok := seg.docValuesBuilders[fieldID]; ok && b.typ != typ {
+			return fmt.Errorf("field %v has %v doc values, not %v", mv.field, b.typ, typ)
+		}
+	}
+	return nil
+}
+
+// addDocValue adds a value of a doc to its field's column.  The value was checked by
+// checkDocValues and checkNumericValues, and its column was created by prepareNumericFields if
+// it's numeric.
+func (seg *Segment) addDocValue(inDocID uint32, mv mappedValue) {
+	typ, ok := docValuesType(mv.mapping.Type)
+	if !ok || !mv.mapping.DocValues {
+		return
+	}
+	fieldID := seg.fieldID(mv.field)
+	b, ok := seg.docValuesBuilders[fieldID]
+	if !ok {
+		b = newDocValuesBuilder(typ, mv.val.Type())
+		seg.docValuesBuilders[fieldID] = b
+	}
+	delete(seg.docValues, fieldID)
+
+	switch typ {
+	case DocValuesSortedSet:
+		b.addTerm(inDocID, mv.val.Value().(string))
+	case DocValuesNumeric:
+		encoded, _ := encodeNumeric(b.kind, mv.val)
+		b.add(inDocID, encoded)
+	case DocValuesBool:
+		b.addBool(inDocID, mv.val.Value().(bool))
+	}
+}
+
+// addTimestamp adds the doc's timestamp to the TimestampField column, docs with a zero
+// timestamp don't have one.
+func (seg *Segment) addTimestamp(inDocID uint32, ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+	fieldID := seg.fieldID(TimestampField)
+	b, ok := seg.docValuesBuilders[fieldID]
+	if !ok {
+		b = newDocValuesBuilder(DocValuesNumeric, value.TimeType)
+		seg.docValuesBuilders[fieldID] = b
+	}
+	delete(seg.docValues, fieldID)
+	b.add(inDocID, encodeTime(ts))
+}
+
+// mergeDocValues adds the columns from another segment, remapping their doc IDs with docMap.
+// kinds is the type of each numeric column in the merged segment, see mergedNumericKinds.
+// Columns which disagree with this segment's column for the field are skipped.
+func (seg *Segment) mergeDocValues(other *Segment, docMap []int64, kinds map[string]value.ValueType) {
+	for field, fid := range other.fieldToFieldId {
+		dv, ok := other.docValuesByID(fid)
+		if !ok {
+			continue
+		}
+		fieldID := seg.fieldID(field)
+		b, ok := seg.docValuesBuilders[fieldID]
+		if !ok {
+			kind := value.UnknownType
+			if _, isNumeric := dv.(*NumericDocValues); isNumeric {
+				kind = kinds[field]
+			}
+			b = newDocValuesBuilder(dv.Type(), kind)
+			seg.docValuesBuilders[fieldID] = b
+		} else if b.typ != dv.Type() {
+			continue
+		}
+		delete(seg.docValues, fieldID)
+
+		switch dv := dv.(type) {
+		case *SortedSetDocValues:
+			var ords []uint32
+			for did := 0; did+1 < dv.offsets.n; did++ {
+				if newID := docMap[did]; newID >= 0 {
+					ords = dv.Ords(ords[:0], uint32(did))
+					for _, ord := range ords {
+						b.addTerm(uint32(newID), dv.terms[ord])
+					}
+				}
+			}
+		case *NumericDocValues:
+			var vals []uint64
+			for did := 0; did+1 < dv.offsets.n; did++ {
+				if newID := docMap[did]; newID >= 0 {
+					vals = dv.Encoded(vals[:0], uint32(did))
+					for _, v := range vals {
+						if converted, ok := convertEncoded(dv.kind, b.kind, v); ok {
+							b.add(uint32(newID), converted)
+						}
+					}
+				}
+			}
+		case *BoolDocValues:
+			for _, val := range []bool{true, false} {
+				docIter := dv.Docs(val).Iterator()
+				for docIter.HasNext() {
+					if newID := docMap[docIter.Next()]; newID >= 0 {
+						b.addBool(uint32(newID), val)
+					}
+				}
+			}
+		}
+	}
+}
+
+// readDocValues decodes a column written by docValues.write.
+func readDocValues(r *segmentReader, typ DocValuesType) (docValues, error) {
+	switch typ {
+	case DocValuesSortedSet:
+		dv := &SortedSetDocValues{}
+		for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+			dv.terms = append(dv.terms, r.string())
+		}
+		dv.offsets, dv.ords = readPackedInts(r), readPackedInts(r)
+		return dv, r.err
+	case DocValuesNumeric:
+		dv := &NumericDocValues{kind: value.ValueType(r.uint32())}
+		dv.offsets, dv.values = readPackedInts(r), readPackedInts(r)
+		return dv, r.err
+	case DocValuesBool:
+		return &BoolDocValues{r.bitmap(), r.bitmap()}, r.err
+	}
+	return nil, fmt.Errorf("unknown doc values type: %v", typ)
+}
+
+// packedInts are n uint64s stored in bitsPerValue bits each, after subtracting the smallest
+// value.  data is the big endian words holding the bits, values can span two words.
+type packedInts struct {
+	n            int
+	min          uint64
+	bitsPerValue uint
+	data         []byte
+}
+
+func packInts(vals []uint64) *packedInts {
+	p := &packedInts{n: len(vals)}
+	if len(vals) == 0 {
+		return p
+	}
+	p.min = vals[0]
+	max := vals[0]
+	for _, v := range vals {
+		if v < p.min {
+			p.min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	p.bitsPerValue = uint(bits.Len64(max - p.min))
+	if p.bitsPerValue == 0 {
+		return p
+	}
+	words := make([]uint64, p.numWords())
+	for i, v := range vals {
+		v -= p.min
+		bit := uint(i) * p.bitsPerValue
+		w, shift := bit/64, bit%64
+		words[w] |= v << shift
+		if shift+p.bitsPerValue > 64 {
+			words[w+1] |= v >> (64 - shift)
+		}
+	}
+	p.data = make([]byte, len(words)*8)
+	for i, w := range words {
+		binary.BigEndian.PutUint64(p.data[i*8:], w)
+	}
+	return p
+}
+
+func (p *packedInts) numWords() int {
+	return (p.n*int(p.bitsPerValue) + 63) / 64
+}
+
+func (p *packedInts) get(i int) uint64 {
+	if p.bitsPerValue == 0 {
+		return p.min
+	}
+	bit := uint(i) * p.bitsPerValue
+	w, shift := bit/64, bit%64
+	v := binary.BigEndian.Uint64(p.data[w*8:]) >> shift
+	if shift+p.bitsPerValue > 64 {
+		v |= binary.BigEndian.Uint64(p.data[(w+1)*8:]) << (64 - shift)
+	}
+	if p.bitsPerValue < 64 {
+		v &= 1<<p.bitsPerValue - 1
+	}
+	return p.min + v
+}
+
+func (p *packedInts) write(sw *segmentWriter) {
+	sw.putUint32(uint32(p.n))
+	sw.putUint64(p.min)
+	sw.putUint32(uint32(p.bitsPerValue))
+	sw.putBytes(p.data)
+}
+
+// readPackedInts returns packed ints which read their words in place from the data.
+func readPackedInts(r *segmentReader) *packedInts {
+	p := &packedInts{n: int(r.uint32()), min: r.uint64(), bitsPerValue: uint(r.uint32())}
+	p.data = r.bytes()
+	if r.err == nil && (p.bitsPerValue > 64 || len(p.data) != p.numWords()*8) {
+		r.err = fmt.Errorf("bad packed ints, n:%v bits:%v len:%v", p.n, p.bitsPerValue, len(p.data))
+	}
+	return p
+}
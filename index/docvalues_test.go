@@ -0,0 +1,207 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestPackedInts(t *testing.T) {
+	for _, vals := range [][]uint64{
+		{},
+		{7, 7, 7},
+		{0, 1, 2, 3, 4, 5, 6, 7, 8},
+		{1 << 63, 1<<63 + 1000, 1<<63 - 5, 1 << 63},
+		{0, math.MaxUint64, 12345, 1 << 40},
+	} {
+		p := packInts(vals)
+		got := []uint64{}
+		for i := range vals {
+			got = append(got, p.get(i))
+		}
+		assert.Equal(t, vals, got)
+	}
+	assert.Equal(t, uint(4), packInts([]uint64{100, 115, 108}).bitsPerValue)
+}
+
+func TestSegmentDocValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	docs := []Document{}
+	for i := 0; i < 10; i++ {
+		row := map[string]value.Value{
+			"color":  NewStringVal([]string{"red", "green", "blue"}[i%3]),
+			"age":    value.NewIntValue(int64(50 - i)),
+			"active": value.NewBoolValue(i%2 == 0),
+			"born":   value.NewTimeValue(now.Add(time.Duration(i) * time.Hour)),
+			"bio":    NewStringVal("not a column"),
+		}
+		if i == 4 {
+			row["tags"] = value.NewStringsValue([]string{"b", "a", "b"})
+			row["scores"] = value.NewSliceValues([]value.Value{value.NewNumberValue(2.5), value.NewNumberValue(-1)})
+		}
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), row, now))
+	}
+
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("bio", NewTextFieldMapping("standard")))
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := segment.WriteToDir(dir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	opened, err := OpenSegment(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer opened.Close()
+
+	for _, seg := range []*Segment{segment, opened} {
+		{ // test case - sorted set ordinals follow the order of the strings
+			dv, err := seg.SortedSetDocValues("color")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, 3, dv.NumTerms())
+			ord, ok := dv.LookupTerm("green")
+			assert.Equal(t, true, ok)
+			assert.Equal(t, uint32(1), ord)
+			_, ok = dv.LookupTerm("pink")
+			assert.Equal(t, false, ok)
+			for did := uint32(0); did < 10; did++ {
+				ords := dv.Ords(nil, did)
+				assert.Equal(t, 1, len(ords))
+				assert.Equal(t, []string{"red", "green", "blue"}[did%3], dv.Term(ords[0]))
+			}
+
+			tags, err := seg.SortedSetDocValues("tags")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, []uint32{0, 1}, tags.Ords(nil, 4))
+			assert.Equal(t, 0, len(tags.Ords(nil, 3)))
+			assert.Equal(t, 0, len(tags.Ords(nil, 9)))
+		}
+		{ // test case - numeric values
+			dv, err := seg.NumericDocValues("age")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, value.IntType, dv.Kind())
+			assert.Equal(t, []value.Value{value.NewIntValue(47)}, dv.Values(3))
+
+			born, err := seg.NumericDocValues("born")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			vals := born.Values(2)
+			assert.Equal(t, true, vals[0].Value().(time.Time).Equal(now.Add(2*time.Hour)))
+			assert.Equal(t, true, born.Encoded(nil, 1)[0] < born.Encoded(nil, 2)[0])
+
+			scores, err := seg.NumericDocValues("scores")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, []value.Value{value.NewNumberValue(-1), value.NewNumberValue(2.5)}, scores.Values(4))
+		}
+		{ // test case - bool bitsets
+			dv, err := seg.BoolDocValues("active")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, true, dv.Has(4, true))
+			assert.Equal(t, false, dv.Has(4, false))
+			assert.Equal(t, roaring.BitmapOf(1, 3, 5, 7, 9).ToArray(), dv.Docs(false).ToArray())
+		}
+		{ // test case - fields without doc values
+			_, err := seg.SortedSetDocValues("bio")
+			assert.NotEqual(t, nil, err)
+			_, err = seg.NumericDocValues("color")
+			assert.NotEqual(t, nil, err)
+			_, err = seg.BoolDocValues("nope")
+			_, ok := err.(*FieldNotFoundError)
+			assert.Equal(t, true, ok)
+		}
+	}
+
+	{ // test case - the columns of in-memory segments follow later batches
+		more := NewDocument("doc:10", map[string]value.Value{"color": NewStringVal("amber")}, now)
+		if err := segment.IndexDocuments(context.TODO(), []Document{more}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		dv, err := segment.SortedSetDocValues("color")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 4, dv.NumTerms())
+		assert.Equal(t, []uint32{0}, dv.Ords(nil, 10))
+		assert.Equal(t, "red", dv.Term(dv.Ords(nil, 0)[0]))
+	}
+}
+
+func TestMergeDocValues(t *testing.T) {
+	now := time.Now()
+	segs := []*Segment{}
+	liveDocs := []*roaring.Bitmap{}
+	for s := 0; s < 2; s++ {
+		seg := NewSegment()
+		defer seg.Close()
+		docs := []Document{}
+		for i := 0; i < 5; i++ {
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%d:%d", s, i), map[string]value.Value{
+				"name":  NewStringVal(fmt.Sprintf("name-%d", s*5+i)),
+				"num":   value.NewIntValue(int64(s*5 + i)),
+				"valid": value.NewBoolValue(i == 0),
+			}, now))
+		}
+		if err := seg.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		seg.DeleteDocuments(fmt.Sprintf("doc:%d:0", s))
+		segs = append(segs, seg)
+		liveDocs = append(liveDocs, seg.liveDocs)
+	}
+
+	merged, err := mergeSegments(segs, liveDocs)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer merged.Close()
+
+	names, err := merged.SortedSetDocValues("name")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	nums, err := merged.NumericDocValues("num")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	valid, err := merged.BoolDocValues("valid")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 8, names.NumTerms())
+	for did := uint32(0); did < 8; did++ {
+		var s, i int
+		fmt.Sscanf(merged.docIDInternalToExternal[did], "doc:%d:%d", &s, &i)
+		assert.Equal(t, fmt.Sprintf("name-%d", s*5+i), names.Term(names.Ords(nil, did)[0]))
+		assert.Equal(t, []value.Value{value.NewIntValue(int64(s*5 + i))}, nums.Values(did))
+	}
+	assert.Equal(t, uint64(0), valid.Docs(true).GetCardinality())
+	assert.Equal(t, uint64(8), valid.Docs(false).GetCardinality())
+}
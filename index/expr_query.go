@@ -0,0 +1,605 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/expr"
+	"github.com/araddon/qlbridge/lex"
+	"github.com/araddon/qlbridge/value"
+	"github.com/araddon/qlbridge/vm"
+)
+
+// DocumentLoader loads the doc with the external ID, found is false if there isn't one.
+type DocumentLoader func(id string) (doc Document, found bool, err error)
+
+// ExprQuery matches the docs for which a qlbridge expression evaluates to true.  It's the
+// fallback for the predicates the index can't answer, every candidate doc is loaded with Load,
+// or from the segment's stored fields if Load is nil, and the expression is evaluated against
+// it, so it's far slower than the other queries.  In the
+// Must or Filter clauses of a BooleanQuery it's only evaluated against the docs which match the
+// other clauses.
+type ExprQuery struct {
+	Node expr.Node
+	Load DocumentLoader
+	// Index answers the expression on the index, in the segments where its field has the type
+	// Index needs.  The expression is only evaluated in the segments where the field has another
+	// type.
+	Index Query
+}
+
+func (q *ExprQuery) Type() QType {
+	return TypeExprQuery
+}
+
+// QueryExpr returns the live docs for which the query's expression is true.
+func (seg *Segment) QueryExpr(ctx context.Context, query *ExprQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.exprQuery(ctx, query)
+}
+
+func (seg *Segment) exprQuery(ctx context.Context, query *ExprQuery) (*SearchResults, error) {
+	docs, err := seg.filterExpr(ctx, query, seg.liveDocs)
+	if err != nil {
+		return nil, err
+	}
+	return &SearchResults{internalDocIds: docs}, nil
+}
+
+// filterExpr returns the candidates for which the query's expression is true.
+func (seg *Segment) filterExpr(ctx context.Context, query *ExprQuery, candidates *roaring.Bitmap) (*roaring.Bitmap, error) {
+	if query.Index != nil {
+		docs, err := seg.execute(ctx, query.Index)
+		if e, ok := err.(*FieldNotFoundError); !ok || e.Type == "" {
+			if err != nil {
+				return nil, err
+			}
+			return roaring.And(docs, candidates), nil
+		}
+	}
+
+	reader := seg.newStoredReader()
+	docs := roaring.New()
+	docIter := roaring.And(candidates, seg.liveDocs).Iterator()
+	for n := 0; docIter.HasNext(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
+		did := docIter.Next()
+		var doc Document
+		if query.Load == nil {
+			var err error
+			if doc, err = reader.document(did, nil); err != nil {
+				return nil, err
+			}
+		} else {
+			externalID, ok := seg.docIDInternalToExternal[did]
+			if !ok {
+				return nil, fmt.Errorf("found an internal docID without an external doc ID mapping: id:%v", did)
+			}
+			loaded, found, err := query.Load(externalID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load doc %v: err:%v", externalID, err)
+			} else if !found {
+				continue
+			}
+			doc = loaded
+		}
+		if evalExpr(doc, query.Node) {
+			docs.Add(did)
+		}
+	}
+	return docs, nil
+}
+
+// evalExpr evaluates the expression against a doc the way the index answers it, a comparison
+// which can't be evaluated, like one with a field the doc doesn't have, is false.  So a doc
+// without a value for a field matches != and NOT predicates on it.
+func evalExpr(doc Document, node expr.Node) bool {
+	switch n := node.(type) {
+	case *expr.BinaryNode:
+		switch n.Operator.T {
+		case lex.TokenLogicAnd:
+			return evalExpr(doc, n.Args[0]) && evalExpr(doc, n.Args[1])
+		case lex.TokenLogicOr:
+			return evalExpr(doc, n.Args[0]) || evalExpr(doc, n.Args[1])
+		case lex.TokenNE:
+			return !evalExpr(doc, equalNode(n.Args[0], n.Args[1]))
+		}
+	case *expr.BooleanNode:
+		for _, arg := range n.Args {
+			if evalExpr(doc, arg) != (n.Operator.T == lex.TokenLogicAnd) {
+				return !(n.Operator.T == lex.TokenLogicAnd)
+			}
+		}
+		return n.Operator.T == lex.TokenLogicAnd
+	case *expr.UnaryNode:
+		if n.Operator.T == lex.TokenNegate {
+			return !evalExpr(doc, n.Arg)
+		}
+	case *expr.NegateNode:
+		return !evalExpr(doc, n.Arg)
+	}
+	v, ok := vm.Eval(doc, node)
+	return ok && v.Type() == value.BoolType && v.Value().(bool)
+}
+
+// equalNode returns the expression a = b.
+func equalNode(a, b expr.Node) expr.Node {
+	return &expr.BinaryNode{Operator: lex.Token{T: lex.TokenEqual, V: "="}, Args: []expr.Node{a, b}}
+}
+
+// ExprTranslator translates qlbridge expressions, like the WHERE clause of a SELECT parsed with
+// rel.ParseSqlSelect, into queries.  It supports =, !=, <, <=, >, >=, IN, LIKE, BETWEEN,
+// CONTAINS, AND, OR and NOT.  Predicates it can't turn into a query on the index, like an = on
+// an analyzed text field, become ExprQuerys which evaluate them against the docs loaded with
+// Load, or against the stored fields if Load is nil.
+//
+// If Mapping is set a field's mapping decides the query a predicate on it turns into, and
+// predicates on fields which aren't mapped fall back to an ExprQuery.  Without a mapping the
+// type of the literal decides: strings are keyword terms, numbers and times are numeric, and
+// bools are bool terms.  As that's a guess, the queries are the Index of an ExprQuery, so the
+// predicate is evaluated in the segments where the field has another type.  Like the index,
+// the fallback matches a doc without a value for a field to != and NOT predicates on it.
+type ExprTranslator struct {
+	Mapping *IndexMapping
+	Load    DocumentLoader
+}
+
+func NewExprTranslator(m *IndexMapping, load DocumentLoader) *ExprTranslator {
+	return &ExprTranslator{Mapping: m, Load: load}
+}
+
+// Translate translates the expression into a query.
+func (t *ExprTranslator) Translate(node expr.Node) (Query, error) {
+	if node == nil {
+		return nil, fmt.Errorf("can't translate a nil expression")
+	}
+	switch n := node.(type) {
+	case *expr.BinaryNode:
+		if len(n.Args) != 2 {
+			return nil, fmt.Errorf("expected 2 args for %v: %v", n.Operator.T, n)
+		}
+		switch n.Operator.T {
+		case lex.TokenLogicAnd, lex.TokenLogicOr:
+			return t.translateLogic(n, n.Operator.T, n.Args)
+		case lex.TokenIN:
+			if arr, ok := n.Args[1].(*expr.ArrayNode); ok {
+				return t.translateIn(n, n.Args[0], arr.Args)
+			}
+		case lex.TokenLike:
+			return t.translateLike(n)
+		case lex.TokenContains:
+			return t.translateContains(n)
+		case lex.TokenEqual, lex.TokenEqualEqual, lex.TokenNE, lex.TokenLT, lex.TokenLE, lex.TokenGT, lex.TokenGE:
+			return t.translateCompare(n)
+		}
+	case *expr.BooleanNode:
+		switch n.Operator.T {
+		case lex.TokenLogicAnd, lex.TokenLogicOr:
+			return t.translateLogic(n, n.Operator.T, n.Args)
+		}
+	case *expr.UnaryNode:
+		if n.Operator.T == lex.TokenNegate {
+			return t.translateNot(n, n.Arg)
+		}
+	case *expr.NegateNode:
+		return t.translateNot(n, n.Arg)
+	case *expr.MultiArgNode:
+		if n.Operator.T == lex.TokenIN && len(n.Args) > 0 {
+			return t.translateIn(n, n.Args[0], n.Args[1:])
+		}
+	case *expr.TriNode:
+		if n.Operator.T == lex.TokenBetween && len(n.Args) == 3 {
+			return t.translateBetween(n)
+		}
+	}
+	return t.fallback(node), nil
+}
+
+func (t *ExprTranslator) fallback(node expr.Node) Query {
+	return &ExprQuery{Node: node, Load: t.Load}
+}
+
+// indexed returns the query answering the predicate on the index.  Without a mapping it's the
+// Index of an ExprQuery for the predicate, see ExprTranslator.
+func (t *ExprTranslator) indexed(node expr.Node, q Query) Query {
+	if t.Mapping != nil {
+		return q
+	}
+	return &ExprQuery{Node: node, Load: t.Load, Index: q}
+}
+
+// isFallback returns true if the query only evaluates its expression.
+func isFallback(q Query) bool {
+	eq, ok := q.(*ExprQuery)
+	return ok && eq.Index == nil
+}
+
+// translateLogic translates an AND or OR, flattening nested operands with the same operator.
+// An OR with an operand which falls back is evaluated as a whole, as it has to look at every doc
+// anyway.
+func (t *ExprTranslator) translateLogic(node expr.Node, op lex.TokenType, args []expr.Node) (Query, error) {
+	bq := &BooleanQuery{}
+	for _, arg := range flattenLogic(op, args) {
+		q, err := t.Translate(arg)
+		if err != nil {
+			return nil, err
+		}
+		if op == lex.TokenLogicAnd {
+			bq.Must = append(bq.Must, q)
+			continue
+		}
+		if isFallback(q) {
+			return t.fallback(node), nil
+		}
+		bq.Should = append(bq.Should, q)
+	}
+	return bq, nil
+}
+
+func flattenLogic(op lex.TokenType, args []expr.Node) []expr.Node {
+	flat := []expr.Node{}
+	for _, arg := range args {
+		switch n := arg.(type) {
+		case *expr.BinaryNode:
+			if n.Operator.T == op {
+				flat = append(flat, flattenLogic(op, n.Args)...)
+				continue
+			}
+		case *expr.BooleanNode:
+			if n.Operator.T == op {
+				flat = append(flat, flattenLogic(op, n.Args)...)
+				continue
+			}
+		}
+		flat = append(flat, arg)
+	}
+	return flat
+}
+
+func (t *ExprTranslator) translateNot(node, arg expr.Node) (Query, error) {
+	q, err := t.Translate(arg)
+	if err != nil {
+		return nil, err
+	}
+	if isFallback(q) {
+		return t.fallback(node), nil
+	}
+	return &BooleanQuery{MustNot: []Query{q}}, nil
+}
+
+// fieldKind is how a predicate on a field can be answered by the index.
+type fieldKind int
+
+const (
+	kindNone fieldKind = iota
+	kindTerm
+	kindNumeric
+	kindBool
+)
+
+// field returns the field of an identity, and how predicates comparing it to lit can be
+// answered.
+func (t *ExprTranslator) field(node expr.Node, lit value.Value) (string, *FieldMapping, fieldKind) {
+	ident, ok := node.(*expr.IdentityNode)
+	if !ok || ident.IsBooleanIdentity() {
+		return "", nil, kindNone
+	}
+	if t.Mapping != nil {
+		fm, ok := t.Mapping.Fields[ident.Text]
+		if !ok || !fm.Index {
+			return ident.Text, nil, kindNone
+		}
+		switch fm.Type {
+		case FieldTypeKeyword:
+			return ident.Text, fm, kindTerm
+		case FieldTypeNumeric, FieldTypeDate:
+			return ident.Text, fm, kindNumeric
+		case FieldTypeBool:
+			return ident.Text, fm, kindBool
+		}
+		return ident.Text, fm, kindNone
+	}
+	switch lit.Type() {
+	case value.StringType:
+		return ident.Text, nil, kindTerm
+	case value.IntType, value.NumberType, value.TimeType:
+		return ident.Text, nil, kindNumeric
+	case value.BoolType:
+		return ident.Text, nil, kindBool
+	}
+	return ident.Text, nil, kindNone
+}
+
+// literal returns the value of a literal node.
+func literal(node expr.Node) (value.Value, bool) {
+	switch n := node.(type) {
+	case *expr.StringNode:
+		return value.NewStringValue(n.Text), true
+	case *expr.NumberNode:
+		if n.IsInt {
+			return value.NewIntValue(n.Int64), true
+		}
+		return value.NewNumberValue(n.Float64), true
+	case *expr.ValueNode:
+		if n.Value == nil || n.Value.Nil() {
+			return nil, false
+		}
+		return n.Value, true
+	case *expr.IdentityNode:
+		if n.IsBooleanIdentity() {
+			return value.NewBoolValue(n.Bool()), true
+		}
+	}
+	return nil, false
+}
+
+// termValue converts a literal to a term of a keyword field.
+func termValue(lit value.Value) (string, bool) {
+	switch lit.Type() {
+	case value.StringType, value.IntType, value.NumberType, value.BoolType:
+		return lit.ToString(), true
+	}
+	return "", false
+}
+
+// numericValue converts a literal to a bound on a numeric or date field.
+func numericValue(fm *FieldMapping, lit value.Value) (value.Value, bool) {
+	if fm != nil && fm.Type == FieldTypeDate {
+		v, err := fm.convert(lit)
+		return v, err == nil
+	}
+	switch lit.Type() {
+	case value.IntType, value.NumberType, value.TimeType:
+		return lit, true
+	case value.StringType:
+		f, err := strconv.ParseFloat(lit.Value().(string), 64)
+		return value.NewNumberValue(f), err == nil
+	}
+	return nil, false
+}
+
+func boolValue(lit value.Value) (bool, bool) {
+	switch lit.Type() {
+	case value.BoolType:
+		return lit.Value().(bool), true
+	case value.StringType:
+		b, err := strconv.ParseBool(lit.Value().(string))
+		return b, err == nil
+	}
+	return false, false
+}
+
+// equalQuery returns the query matching docs where the field equals the literal.
+func (t *ExprTranslator) equalQuery(identity expr.Node, lit value.Value) (Query, bool) {
+	field, fm, kind := t.field(identity, lit)
+	switch kind {
+	case kindTerm:
+		if term, ok := termValue(lit); ok {
+			return &TermQuery{Field: field, Term: term}, true
+		}
+	case kindNumeric:
+		if v, ok := numericValue(fm, lit); ok {
+			return &NumericRangeQuery{Field: field, Min: v, Max: v, InclusiveMin: true, InclusiveMax: true}, true
+		}
+	case kindBool:
+		if b, ok := boolValue(lit); ok {
+			return &BoolTermQuery{Field: field, Value: b}, true
+		}
+	}
+	return nil, false
+}
+
+// reversed is the operator that compares the operands the other way around, for literal < field.
+var reversed = map[lex.TokenType]lex.TokenType{
+	lex.TokenLT: lex.TokenGT,
+	lex.TokenLE: lex.TokenGE,
+	lex.TokenGT: lex.TokenLT,
+	lex.TokenGE: lex.TokenLE,
+}
+
+func (t *ExprTranslator) translateCompare(n *expr.BinaryNode) (Query, error) {
+	identity, op := n.Args[0], n.Operator.T
+	lit, ok := literal(n.Args[1])
+	if !ok {
+		if lit, ok = literal(n.Args[0]); !ok {
+			return t.fallback(n), nil
+		}
+		identity = n.Args[1]
+		if r, ok := reversed[op]; ok {
+			op = r
+		}
+	}
+
+	switch op {
+	case lex.TokenEqual, lex.TokenEqualEqual, lex.TokenNE:
+		q, ok := t.equalQuery(identity, lit)
+		if !ok {
+			return t.fallback(n), nil
+		}
+		if op == lex.TokenNE {
+			return &BooleanQuery{MustNot: []Query{t.indexed(equalNode(n.Args[0], n.Args[1]), q)}}, nil
+		}
+		return t.indexed(n, q), nil
+	}
+
+	low, high := lit, value.Value(nil)
+	if op == lex.TokenLT || op == lex.TokenLE {
+		low, high = nil, lit
+	}
+	q, ok := t.rangeQuery(identity, low, high, op == lex.TokenGE, op == lex.TokenLE)
+	if !ok {
+		return t.fallback(n), nil
+	}
+	return t.indexed(n, q), nil
+}
+
+// rangeQuery returns the query matching docs where the field is between low and high, a nil
+// bound is open.
+func (t *ExprTranslator) rangeQuery(identity expr.Node, low, high value.Value, includeLow, includeHigh bool) (Query, bool) {
+	lit := low
+	if lit == nil {
+		lit = high
+	}
+	field, fm, kind := t.field(identity, lit)
+	switch kind {
+	case kindNumeric:
+		q := &NumericRangeQuery{Field: field, InclusiveMin: includeLow, InclusiveMax: includeHigh}
+		var ok bool
+		if low != nil {
+			if q.Min, ok = numericValue(fm, low); !ok {
+				return nil, false
+			}
+		}
+		if high != nil {
+			if q.Max, ok = numericValue(fm, high); !ok {
+				return nil, false
+			}
+		}
+		return q, true
+	case kindTerm:
+		q := &TermRangeQuery{Field: field, IncludeLow: includeLow, IncludeHigh: includeHigh}
+		// an empty bound would be open, so ranges on empty strings are left to the fallback.
+		var ok bool
+		if low != nil {
+			if q.Low, ok = termValue(low); !ok || q.Low == "" {
+				return nil, false
+			}
+		}
+		if high != nil {
+			if q.High, ok = termValue(high); !ok || q.High == "" {
+				return nil, false
+			}
+		}
+		return q, true
+	}
+	return nil, false
+}
+
+func (t *ExprTranslator) translateBetween(n *expr.TriNode) (Query, error) {
+	low, lowOk := literal(n.Args[1])
+	high, highOk := literal(n.Args[2])
+	if !lowOk || !highOk {
+		return t.fallback(n), nil
+	}
+	q, ok := t.rangeQuery(n.Args[0], low, high, true, true)
+	if !ok {
+		return t.fallback(n), nil
+	}
+	return t.indexed(n, q), nil
+}
+
+func (t *ExprTranslator) translateIn(node, identity expr.Node, args []expr.Node) (Query, error) {
+	if len(args) == 0 {
+		return t.fallback(node), nil
+	}
+	lits := make([]value.Value, len(args))
+	for i, arg := range args {
+		lit, ok := literal(arg)
+		if !ok {
+			return t.fallback(node), nil
+		}
+		lits[i] = lit
+	}
+
+	field, _, kind := t.field(identity, lits[0])
+	if kind == kindTerm {
+		terms := make([]string, len(lits))
+		for i, lit := range lits {
+			term, ok := termValue(lit)
+			if !ok {
+				return t.fallback(node), nil
+			}
+			terms[i] = term
+		}
+		return t.indexed(node, &TermsQuery{Field: field, Terms: terms}), nil
+	}
+	bq := &BooleanQuery{}
+	for i, lit := range lits {
+		q, ok := t.equalQuery(identity, lit)
+		if !ok {
+			return t.fallback(node), nil
+		}
+		bq.Should = append(bq.Should, t.indexed(equalNode(identity, args[i]), q))
+	}
+	return bq, nil
+}
+
+// translateLike translates a LIKE on a keyword field into a wildcard query, % matches any number
+// of characters and _ matches one.
+func (t *ExprTranslator) translateLike(n *expr.BinaryNode) (Query, error) {
+	lit, ok := literal(n.Args[1])
+	if !ok || lit.Type() != value.StringType {
+		return t.fallback(n), nil
+	}
+	field, _, kind := t.field(n.Args[0], lit)
+	if kind != kindTerm {
+		return t.fallback(n), nil
+	}
+	return t.indexed(n, &WildcardQuery{Field: field, Pattern: likeToWildcard(lit.Value().(string))}), nil
+}
+
+func likeToWildcard(like string) string {
+	var pattern strings.Builder
+	for _, r := range like {
+		switch r {
+		case '%':
+			pattern.WriteRune('*')
+		case '_':
+			pattern.WriteRune('?')
+		default:
+			pattern.WriteString(escapeWildcard(string(r)))
+		}
+	}
+	return pattern.String()
+}
+
+// escapeWildcard escapes the characters of s which are special in a wildcard pattern.
+func escapeWildcard(s string) string {
+	return strings.NewReplacer("*", `\*`, "?", `\?`, `\`, `\\`).Replace(s)
+}
+
+// translateContains translates a CONTAINS on a keyword field into a wildcard query, and on a text
+// field into a query for the analyzed terms, in order.
+func (t *ExprTranslator) translateContains(n *expr.BinaryNode) (Query, error) {
+	lit, ok := literal(n.Args[1])
+	if !ok || lit.Type() != value.StringType {
+		return t.fallback(n), nil
+	}
+	s := lit.Value().(string)
+	field, fm, kind := t.field(n.Args[0], lit)
+	switch {
+	case kind == kindTerm:
+		return t.indexed(n, &WildcardQuery{Field: field, Pattern: "*" + escapeWildcard(s) + "*"}), nil
+	case fm != nil && fm.Type == FieldTypeText && fm.Index:
+		analyzer, err := fm.analyzer()
+		if err != nil {
+			return nil, err
+		}
+		terms := []string{}
+		for _, token := range analyzer.Analyze(s) {
+			terms = append(terms, token.Term)
+		}
+		switch {
+		case len(terms) == 0:
+			return t.fallback(n), nil
+		case len(terms) == 1:
+			return &TermQuery{Field: field, Term: terms[0]}, nil
+		case fm.Positions:
+			return &PhraseQuery{Field: field, Terms: terms}, nil
+		}
+		bq := &BooleanQuery{}
+		for _, term := range terms {
+			bq.Must = append(bq.Must, &TermQuery{Field: field, Term: term})
+		}
+		return bq, nil
+	}
+	return t.fallback(n), nil
+}
@@ -0,0 +1,203 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/expr"
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestLikeToWildcard(t *testing.T) {
+	assert.Equal(t, "kev*", likeToWildcard("kev%"))
+	assert.Equal(t, `?an\*\?`, likeToWildcard("_an*?"))
+}
+
+func TestExprTranslate(t *testing.T) {
+	mapping := NewIndexMapping().
+		AddField("age", NewNumericFieldMapping()).
+		AddField("active", NewBoolFieldMapping())
+	for _, field := range []string{"name", "a", "b", "c", "d", "x"} {
+		mapping.AddField(field, NewKeywordFieldMapping())
+	}
+	translator := NewExprTranslator(mapping, nil)
+	translate := func(s string) Query {
+		node, err := expr.ParseExpression(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: err:%v", s, err)
+		}
+		q, err := translator.Translate(node)
+		if err != nil {
+			t.Fatalf("failed to translate %q: err:%v", s, err)
+		}
+		return q
+	}
+
+	{ // test case - comparisons
+		assert.Equal(t, &TermQuery{Field: "name", Term: "kevin"}, translate(`name = "kevin"`))
+		assert.Equal(t, &BooleanQuery{MustNot: []Query{&TermQuery{Field: "name", Term: "kevin"}}}, translate(`name != "kevin"`))
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewIntValue(30), Max: value.NewIntValue(30), InclusiveMin: true, InclusiveMax: true},
+			translate(`age = 30`))
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewIntValue(30)}, translate(`age > 30`))
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewIntValue(30), InclusiveMin: true}, translate(`30 <= age`))
+		assert.Equal(t, &TermRangeQuery{Field: "name", High: "m"}, translate(`name < "m"`))
+		assert.Equal(t, &BoolTermQuery{Field: "active", Value: true}, translate(`active = true`))
+	}
+	{ // test case - IN, BETWEEN, LIKE and CONTAINS
+		assert.Equal(t, &TermsQuery{Field: "name", Terms: []string{"kevin", "john"}}, translate(`name IN ("kevin", "john")`))
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewIntValue(10), Max: value.NewIntValue(20), InclusiveMin: true, InclusiveMax: true},
+			translate(`age BETWEEN 10 AND 20`))
+		assert.Equal(t, &WildcardQuery{Field: "name", Pattern: "ke?v*"}, translate(`name LIKE "ke_v%"`))
+		assert.Equal(t, &WildcardQuery{Field: "name", Pattern: "*ev*"}, translate(`name CONTAINS "ev"`))
+	}
+	{ // test case - logic operators are flattened
+		assert.Equal(t, &BooleanQuery{Must: []Query{
+			&TermQuery{Field: "a", Term: "1"},
+			&TermQuery{Field: "b", Term: "2"},
+			&BooleanQuery{Should: []Query{&TermQuery{Field: "c", Term: "3"}, &TermQuery{Field: "d", Term: "4"}}},
+		}}, translate(`a = "1" AND b = "2" AND (c = "3" OR d = "4")`))
+		assert.Equal(t, &BooleanQuery{MustNot: []Query{&TermQuery{Field: "a", Term: "1"}}}, translate(`NOT a = "1"`))
+	}
+	{ // test case - predicates the index can't answer fall back
+		node, _ := expr.ParseExpression(`a = b`)
+		assert.Equal(t, &ExprQuery{Node: node}, translate(`a = b`))
+
+		node, _ = expr.ParseExpression(`x = "1" OR a = b`)
+		assert.Equal(t, &ExprQuery{Node: node}, translate(`x = "1" OR a = b`))
+
+		q := translate(`x = "1" AND a = b`).(*BooleanQuery)
+		_, ok := q.Must[1].(*ExprQuery)
+		assert.Equal(t, true, ok)
+
+		node, _ = expr.ParseExpression(`nick = "kev"`)
+		assert.Equal(t, &ExprQuery{Node: node}, translate(`nick = "kev"`))
+	}
+	{ // test case - without a mapping the queries are evaluated where the field has another type
+		translator = NewExprTranslator(nil, nil)
+		node, _ := expr.ParseExpression(`age = 30`)
+		assert.Equal(t, &ExprQuery{Node: node, Index: &NumericRangeQuery{Field: "age", Min: value.NewIntValue(30), Max: value.NewIntValue(30),
+			InclusiveMin: true, InclusiveMax: true}}, translate(`age = 30`))
+
+		node, _ = expr.ParseExpression(`name = "kevin"`)
+		assert.Equal(t, &BooleanQuery{MustNot: []Query{&ExprQuery{Node: node, Index: &TermQuery{Field: "name", Term: "kevin"}}}},
+			translate(`name != "kevin"`))
+	}
+}
+
+func TestExprQuery(t *testing.T) {
+	people := []struct {
+		name string
+		bio  string
+		age  int64
+	}{
+		{"kevin", "Kevin likes the quick brown fox", 35},
+		{"kelly", "Kelly has a lazy dog", 28},
+		{"john", "John is quick", 41},
+		{"jane", "Jane rides a brown horse", 19},
+	}
+	now := time.Now()
+	docs := []Document{}
+	stored := map[string]Document{}
+	for i, p := range people {
+		doc := NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{
+			"name": NewStringVal(p.name),
+			"bio":  NewStringVal(p.bio),
+			"age":  value.NewIntValue(p.age),
+		}, now)
+		docs = append(docs, doc)
+		stored[doc.ID()] = doc
+	}
+	loads := 0
+	load := func(id string) (Document, bool, error) {
+		loads++
+		doc, ok := stored[id]
+		return doc, ok, nil
+	}
+
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("bio", NewTextFieldMapping("english")))
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	translator := NewExprTranslator(segment.Mapping(), load)
+
+	search := func(s string) []string {
+		node, err := expr.ParseExpression(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: err:%v", s, err)
+		}
+		q, err := translator.Translate(node)
+		if err != nil {
+			t.Fatalf("failed to translate %q: err:%v", s, err)
+		}
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("failed to run %q: err:%v", s, err)
+		}
+		names := []string{}
+		for _, id := range res.ExternalDocIDs {
+			var i int
+			fmt.Sscanf(id, "doc:%d", &i)
+			names = append(names, people[i].name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	{ // test case - queries answered by the index
+		loads = 0
+		assert.Equal(t, []string{"john", "kevin"}, search(`age > 30`))
+		assert.Equal(t, []string{"kelly", "kevin"}, search(`name LIKE "ke%" AND age BETWEEN 20 AND 40`))
+		assert.Equal(t, []string{"jane", "john"}, search(`name IN ("john", "jane", "bob")`))
+		assert.Equal(t, []string{"jane", "kevin"}, search(`bio CONTAINS "brown"`))
+		assert.Equal(t, []string{"kevin"}, search(`bio CONTAINS "Quick Brown"`))
+		assert.Equal(t, []string{"jane", "kelly"}, search(`NOT (age > 30)`))
+		assert.Equal(t, 0, loads)
+	}
+	{ // test case - the fallback only evaluates the docs matching the rest of the query
+		loads = 0
+		assert.Equal(t, []string{"john"}, search(`age > 30 AND bio = "John is quick"`))
+		assert.Equal(t, 2, loads)
+	}
+	{ // test case - a fallback in an OR or NOT evaluates every doc
+		loads = 0
+		assert.Equal(t, []string{"jane", "john"}, search(`bio = "John is quick" OR age < 20`))
+		assert.Equal(t, 4, loads)
+
+		assert.Equal(t, []string{"jane", "kelly", "kevin"}, search(`NOT bio = "John is quick"`))
+	}
+	{ // test case - without a loader the fallback uses the stored fields
+		node, _ := expr.ParseExpression(`age > 30 AND bio = "John is quick"`)
+		q, err := NewExprTranslator(segment.Mapping(), nil).Translate(node)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:2"}, res.ExternalDocIDs)
+	}
+	{ // test case - a doc without the field matches != on the index and in the fallback
+		assert.Equal(t, []string{"jane", "john", "kelly", "kevin"}, search(`nick != "kev"`))
+		assert.Equal(t, []string{"jane", "john", "kelly", "kevin"}, search(`NOT nick = "kev"`))
+
+		translator = NewExprTranslator(nil, load)
+		assert.Equal(t, []string{"jane", "john", "kelly", "kevin"}, search(`nick != "kev"`))
+		assert.Equal(t, []string{"jane", "kelly", "kevin"}, search(`name != "john"`))
+	}
+	{ // test case - without a mapping a literal of another type than the field is evaluated
+		translator = NewExprTranslator(nil, load)
+		loads = 0
+		assert.Equal(t, []string{}, search(`name = 30`))
+		assert.Equal(t, []string{"jane", "john", "kelly", "kevin"}, search(`name != 30`))
+		assert.Equal(t, []string{}, search(`age = "old"`))
+		assert.Equal(t, []string{"john", "kevin"}, search(`age > 30 AND name IN ("john", "kevin", 35)`))
+		assert.Equal(t, 12, loads)
+	}
+}
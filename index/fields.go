@@ -9,7 +9,7 @@ type IndexableField struct {
 	terminIdInt  uint32 // Question use uint16 instead?  And limit the size of the segment to 65k terms per field?
 	termToTermID map[string]uint32
 
-	Terms Terms
+	Terms Terms // the field's unique terms
 }
 
 func NewIndexableField(field string, fieldID uint32) *IndexableField {
@@ -23,9 +23,8 @@ func NewIndexableField(field string, fieldID uint32) *IndexableField {
 type IndexableFields map[uint32]*IndexableField
 
 type Term struct {
-	Term          string
-	TermID        uint32
-	InternalDocId uint32 // TODO use uint16 instead?  And limit the size of the segment to 65k docs?
+	Term   string
+	TermID uint32
 }
 type Terms []*Term
 
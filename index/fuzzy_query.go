@@ -0,0 +1,170 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/couchbase/vellum"
+	"github.com/couchbase/vellum/levenshtein"
+)
+
+// MaxFuzzyEdits is the largest MaxEdits a FuzzyQuery can use.  The automata grow exponentially
+// with the distance, so like Lucene it's capped at 2.
+const MaxFuzzyEdits = 2
+
+// FuzzyQuery matches docs with a term within MaxEdits insertions, deletions or substitutions of
+// Term.  The first PrefixLength characters of Term must match exactly, which makes the query much
+// cheaper on large term dictionaries.  If Transpositions is set swapping two adjacent characters
+// counts as one edit instead of two.
+type FuzzyQuery struct {
+	Field          string
+	Term           string
+	MaxEdits       int
+	PrefixLength   int
+	Transpositions bool
+	MaxExpansions  int
+}
+
+func (q *FuzzyQuery) Type() QType {
+	return TypeFuzzyQuery
+}
+
+func (q *FuzzyQuery) field() string { return q.Field }
+
+func (q *FuzzyQuery) expand(ctx context.Context, seg *Segment, fn func(term []byte, termID uint32)) error {
+	if q.MaxEdits < 0 || q.MaxEdits > MaxFuzzyEdits {
+		return fmt.Errorf("max edits must be between 0 and %d: %v", MaxFuzzyEdits, q.MaxEdits)
+	} else if q.PrefixLength < 0 {
+		return fmt.Errorf("prefix length can't be negative: %v", q.PrefixLength)
+	}
+	prefix, rest := splitRunes(q.Term, q.PrefixLength)
+
+	lab, err := levenshteinBuilder(uint8(q.MaxEdits), q.Transpositions)
+	if err != nil {
+		return err
+	}
+	dfa, err := lab.BuildDfa(rest, uint8(q.MaxEdits))
+	if err != nil {
+		return fmt.Errorf("failed to build levenshtein automaton for %q: err:%v", q.Term, err)
+	}
+	var aut vellum.Automaton = dfa
+	if prefix != "" {
+		aut = &prefixedAutomaton{prefix: []byte(prefix), aut: dfa}
+	}
+	return seg.expandTerms(ctx, q.Field, aut, []byte(prefix), prefixEnd(prefix), q.MaxExpansions, fn)
+}
+
+// FuzzyResults are the results of a FuzzyQuery, along with the terms it matched.
+type FuzzyResults struct {
+	*SearchResults
+
+	// MatchedTerms are the terms the query expanded to that are in a live doc, in byte order.
+	MatchedTerms []string
+}
+
+// QueryFuzzy returns the docs with a term close to the query's term, and the terms that matched.
+func (seg *Segment) QueryFuzzy(ctx context.Context, query *FuzzyQuery) (*FuzzyResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.fuzzyQuery(ctx, query)
+}
+
+func (seg *Segment) fuzzyQuery(ctx context.Context, query *FuzzyQuery) (*FuzzyResults, error) {
+	res := &FuzzyResults{SearchResults: &SearchResults{internalDocIds: roaring.New()}, MatchedTerms: []string{}}
+	err := query.expand(ctx, seg, func(term []byte, termID uint32) {
+		docs := roaring.And(seg.postings[termID].Postings(), seg.liveDocs)
+		if docs.IsEmpty() {
+			return
+		}
+		res.internalDocIds.Or(docs)
+		res.MatchedTerms = append(res.MatchedTerms, string(term))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+var (
+	levenshteinBuildersMu sync.Mutex
+	levenshteinBuilders   = map[[2]uint8]*levenshtein.LevenshteinAutomatonBuilder{}
+)
+
+// levenshteinBuilder returns the shared builder for the distance.  Creating a builder is far more
+// expensive than building a DFA with it, and the builders are safe to share.
+func levenshteinBuilder(maxEdits uint8, transpositions bool) (*levenshtein.LevenshteinAutomatonBuilder, error) {
+	key := [2]uint8{maxEdits, 0}
+	if transpositions {
+		key[1] = 1
+	}
+	levenshteinBuildersMu.Lock()
+	defer levenshteinBuildersMu.Unlock()
+	if lab, ok := levenshteinBuilders[key]; ok {
+		return lab, nil
+	}
+	lab, err := levenshtein.NewLevenshteinAutomatonBuilder(maxEdits, transpositions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create levenshtein automaton builder: err:%v", err)
+	}
+	levenshteinBuilders[key] = lab
+	return lab, nil
+}
+
+// splitRunes splits s after its first n characters.
+func splitRunes(s string, n int) (string, string) {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos], s[pos:]
+		}
+		i++
+	}
+	return s, ""
+}
+
+// prefixedAutomaton matches the keys made of prefix followed by a key aut matches.  States below
+// len(prefix) are the number of prefix bytes matched so far, the states of aut are shifted up by
+// len(prefix), and -1 is the dead state.
+type prefixedAutomaton struct {
+	prefix []byte
+	aut    vellum.Automaton
+}
+
+func (a *prefixedAutomaton) Start() int {
+	return 0
+}
+
+func (a *prefixedAutomaton) IsMatch(state int) bool {
+	return state >= len(a.prefix) && a.aut.IsMatch(state-len(a.prefix))
+}
+
+func (a *prefixedAutomaton) CanMatch(state int) bool {
+	if state < 0 {
+		return false
+	} else if state < len(a.prefix) {
+		return true
+	}
+	return a.aut.CanMatch(state - len(a.prefix))
+}
+
+func (a *prefixedAutomaton) WillAlwaysMatch(state int) bool {
+	return state >= len(a.prefix) && a.aut.WillAlwaysMatch(state-len(a.prefix))
+}
+
+func (a *prefixedAutomaton) Accept(state int, b byte) int {
+	switch {
+	case state < 0:
+		return -1
+	case state < len(a.prefix):
+		if a.prefix[state] != b {
+			return -1
+		}
+		if state+1 == len(a.prefix) {
+			return len(a.prefix) + a.aut.Start()
+		}
+		return state + 1
+	}
+	return len(a.prefix) + a.aut.Accept(state-len(a.prefix), b)
+}
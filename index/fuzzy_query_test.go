@@ -0,0 +1,114 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestSplitRunes(t *testing.T) {
+	prefix, rest := splitRunes("jöhn", 2)
+	assert.Equal(t, "jö", prefix)
+	assert.Equal(t, "hn", rest)
+
+	prefix, rest = splitRunes("jo", 5)
+	assert.Equal(t, "jo", prefix)
+	assert.Equal(t, "", rest)
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	names := []string{"kevin", "kelvin", "kevan", "john", "jon", "joan", "jonathan", "ojhn", "sally"}
+	now := time.Now()
+	docs := []Document{}
+	for i, name := range names {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"first_name": NewStringVal(name)}, now))
+	}
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(q *FuzzyQuery) (matched []string, terms []string) {
+		res, err := segment.QueryFuzzy(context.TODO(), q)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		ids, err := GetExternalIDs(segment, res.internalDocIds)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		matched = []string{}
+		for _, id := range ids {
+			var i int
+			fmt.Sscanf(id, "doc:%d", &i)
+			matched = append(matched, names[i])
+		}
+		sort.Strings(matched)
+		return matched, res.MatchedTerms
+	}
+
+	{ // test case - a missing letter
+		matched, terms := search(&FuzzyQuery{Field: "first_name", Term: "kevn", MaxEdits: 1})
+		assert.Equal(t, []string{"kevan", "kevin"}, matched)
+		assert.Equal(t, []string{"kevan", "kevin"}, terms)
+	}
+	{ // test case - two edits
+		matched, _ := search(&FuzzyQuery{Field: "first_name", Term: "kevn", MaxEdits: 2})
+		assert.Equal(t, []string{"kelvin", "kevan", "kevin"}, matched)
+	}
+	{ // test case - zero edits is an exact match
+		matched, _ := search(&FuzzyQuery{Field: "first_name", Term: "jon", MaxEdits: 0})
+		assert.Equal(t, []string{"jon"}, matched)
+	}
+	{ // test case - transpositions count as one edit
+		matched, _ := search(&FuzzyQuery{Field: "first_name", Term: "jhon", MaxEdits: 1})
+		assert.Equal(t, []string{"jon"}, matched)
+
+		matched, _ = search(&FuzzyQuery{Field: "first_name", Term: "jhon", MaxEdits: 1, Transpositions: true})
+		assert.Equal(t, []string{"john", "jon"}, matched)
+	}
+	{ // test case - the prefix must match exactly
+		matched, _ := search(&FuzzyQuery{Field: "first_name", Term: "john", MaxEdits: 2})
+		assert.Equal(t, []string{"joan", "john", "jon", "ojhn"}, matched)
+
+		matched, terms := search(&FuzzyQuery{Field: "first_name", Term: "john", MaxEdits: 2, PrefixLength: 1})
+		assert.Equal(t, []string{"joan", "john", "jon"}, matched)
+		assert.Equal(t, []string{"joan", "john", "jon"}, terms)
+
+		matched, _ = search(&FuzzyQuery{Field: "first_name", Term: "jon", MaxEdits: 1, PrefixLength: 3})
+		assert.Equal(t, []string{"jon"}, matched)
+	}
+	{ // test case - deleted docs and their terms don't match
+		if _, err := segment.DeleteDocuments("doc:2"); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		matched, terms := search(&FuzzyQuery{Field: "first_name", Term: "kevn", MaxEdits: 1})
+		assert.Equal(t, []string{"kevin"}, matched)
+		assert.Equal(t, []string{"kevin"}, terms)
+	}
+	{ // test case - in a boolean query
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&FuzzyQuery{Field: "first_name", Term: "jon", MaxEdits: 1}).
+			AndNot(&TermQuery{Field: "first_name", Term: "jon"}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		assert.Equal(t, []string{"doc:3", "doc:5"}, res.ExternalDocIDs)
+	}
+	{ // test case - bad edits and too many terms
+		_, err := segment.QueryFuzzy(context.TODO(), &FuzzyQuery{Field: "first_name", Term: "jon", MaxEdits: 3})
+		assert.NotEqual(t, nil, err)
+
+		_, err = segment.QueryFuzzy(context.TODO(), &FuzzyQuery{Field: "first_name", Term: "jon", MaxEdits: 2, MaxExpansions: 1})
+		_, ok := err.(*TooManyTermsError)
+		assert.Equal(t, true, ok)
+	}
+}
@@ -0,0 +1,857 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/gou"
+	"github.com/epsniff/sidonia/index/bkdtree"
+)
+
+// IndexOptions configures an Index, the zero value uses the defaults.
+type IndexOptions struct {
+	// MergePolicy picks the segments to merge, defaults to NewTieredMergePolicy().
+	MergePolicy MergePolicy
+	// DisableBackgroundMerges stops the index from merging segments after each flush, MaybeMerge
+	// can still be called to merge them.
+	DisableBackgroundMerges bool
+	// Mapping is the schema of the index, it's saved with the index.  It defaults to the saved
+	// mapping, or to NewIndexMapping() for a new index.
+	Mapping *IndexMapping
+	// Analyzers maps text fields to the analyzer which splits them into terms, it's added to the
+	// mapping.  The analyzers aren't saved with the mapping, so they're needed each time the index
+	// is opened.
+	Analyzers map[string]Analyzer
+	// RefreshInterval is how often the docs buffered by AddDocument are refreshed into a
+	// searchable segment.  Zero turns off the periodic refresh, Refresh can still be called.
+	RefreshInterval time.Duration
+	// MaxBufferedDocs is the number of docs AddDocument buffers before it refreshes them,
+	// defaults to DefaultMaxBufferedDocs.
+	MaxBufferedDocs int
+	// IndexWorkers is the number of workers each batch is indexed with, defaults to GOMAXPROCS.
+	// 1 indexes the docs of a batch one at a time.
+	IndexWorkers int
+}
+
+// DefaultMaxBufferedDocs is the default size of the buffer of docs added by AddDocument.
+const DefaultMaxBufferedDocs = 10000
+
+// Index is a Lucene style index made up of immutable segments.  Each call to IndexDocuments
+// flushes a new segment into the index's dir, and a background goroutine merges small
+// segments together using the MergePolicy.  Batches of docs and deletes are written to a
+// write-ahead log before they're applied, and replayed on open if they weren't committed.
+//
+// Docs can also be added one at a time with AddDocument.  They're buffered in memory, like the
+// bkd tree's T0M, until Refresh turns the buffer into a new segment, which makes them
+// searchable.
+type Index struct {
+	dir         string
+	mergePolicy MergePolicy
+	mapping     *IndexMapping  // guarded by writeMu
+	wal         *writeAheadLog // guarded by writeMu, nil once the index is closed
+	seq         uint64         // seq of the last wal record applied, guarded by writeMu
+
+	buffer          []Document // docs added since the last refresh, guarded by writeMu
+	bufferSeq       uint64     // seq of the wal record of the last buffered doc
+	maxBufferedDocs int
+	indexWorkers    int // zero leaves the segments' default
+
+	writeMu sync.Mutex // serializes IndexDocuments, segments are added in the order of the batches
+
+	mu       sync.RWMutex
+	segments []*indexSegment // ordered oldest to newest
+	segGen   uint64          // generation of the next segment
+	merging  map[string]bool // names of the segments being merged
+	closed   bool
+
+	mergeMu sync.Mutex // one merge pass at a time
+	mergeCh chan struct{}
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// indexSegment is a segment of the index which is reference counted, so a search can keep using
+// a segment after a merge has replaced it.
+type indexSegment struct {
+	name string
+	gen  uint64
+	dir  string
+	seg  *Segment
+
+	refs     int32
+	obsolete int32 // set once the segment has been merged away, its dir is removed on the last release
+}
+
+func (s *indexSegment) acquire() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+func (s *indexSegment) release() {
+	if atomic.AddInt32(&s.refs, -1) > 0 {
+		return
+	}
+	if err := s.seg.Close(); err != nil {
+		gou.Errorf("failed to close segment %v: err:%v", s.name, err)
+	}
+	if atomic.LoadInt32(&s.obsolete) == 1 {
+		if err := os.RemoveAll(s.dir); err != nil {
+			gou.Errorf("failed to remove segment %v: err:%v", s.name, err)
+		}
+	}
+}
+
+const segmentDirPattern = `^seg_([0-9]+)$`
+
+func segmentName(gen uint64) string {
+	return fmt.Sprintf("seg_%08d", gen)
+}
+
+// NewIndex opens the index in dir, loading the segments of its last commit and replaying the
+// batches logged after it.  The dir is created if it doesn't exist.
+func NewIndex(dir string, opts *IndexOptions) (*Index, error) {
+	if opts == nil {
+		opts = &IndexOptions{}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create index dir: err:%v", err)
+	}
+	idx := &Index{
+		dir:         dir,
+		mergePolicy: opts.MergePolicy,
+		mapping:     opts.Mapping,
+		merging:     map[string]bool{},
+		mergeCh:     make(chan struct{}, 1),
+		closeCh:     make(chan struct{}),
+
+		maxBufferedDocs: opts.MaxBufferedDocs,
+		indexWorkers:    opts.IndexWorkers,
+	}
+	if idx.mergePolicy == nil {
+		idx.mergePolicy = NewTieredMergePolicy()
+	}
+	if idx.maxBufferedDocs <= 0 {
+		idx.maxBufferedDocs = DefaultMaxBufferedDocs
+	}
+	if idx.mapping == nil {
+		saved, err := readMapping(dir)
+		if err != nil {
+			return nil, err
+		}
+		idx.mapping = saved
+	}
+	if idx.mapping == nil {
+		idx.mapping = NewIndexMapping()
+	}
+	if len(opts.Analyzers) > 0 {
+		idx.mapping = idx.mapping.Clone()
+		for field, analyzer := range opts.Analyzers {
+			idx.mapping.setAnalyzer(field, analyzer)
+		}
+	}
+	if err := idx.mapping.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping: err:%v", err)
+	}
+	if err := writeMapping(dir, idx.mapping); err != nil {
+		return nil, err
+	}
+
+	cp, err := readCommit(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.openSegments(cp); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if err := idx.replay(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+
+	if !opts.DisableBackgroundMerges {
+		idx.wg.Add(1)
+		go idx.mergeLoop()
+	}
+	if opts.RefreshInterval > 0 {
+		idx.wg.Add(1)
+		go idx.refreshLoop(opts.RefreshInterval)
+	}
+	return idx, nil
+}
+
+// openSegments opens the segments listed by the commit, and removes the dirs of segments which
+// were written after it.  Indexes written before the commit file existed have every complete
+// segment in their dir opened, in the order of their generations.
+func (idx *Index) openSegments(cp *commitPoint) error {
+	committed := map[string]bool{}
+	if cp != nil {
+		idx.seq = cp.seq
+		idx.segGen = cp.segGen
+		for _, cs := range cp.segments {
+			segDir := filepath.Join(idx.dir, cs.name)
+			seg, err := OpenSegment(segDir)
+			if err != nil {
+				return fmt.Errorf("failed to open committed segment %v: err:%v", cs.name, err)
+			}
+			idx.segments = append(idx.segments, &indexSegment{name: cs.name, gen: cs.gen, dir: segDir, seg: seg, refs: 1})
+			committed[cs.name] = true
+		}
+	}
+
+	matches, err := bkdtree.FilepathGlob(idx.dir, segmentDirPattern)
+	if err != nil {
+		return fmt.Errorf("failed listing segments: err:%v", err)
+	}
+	for _, match := range matches {
+		gen, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad segment name %v: err:%v", match[0], err)
+		}
+		segDir := filepath.Join(idx.dir, match[0])
+		if cp != nil {
+			if !committed[match[0]] {
+				// a flush or merge that wasn't committed, the wal has the flushed docs.
+				if err := os.RemoveAll(segDir); err != nil {
+					return fmt.Errorf("failed to remove uncommitted segment %v: err:%v", match[0], err)
+				}
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(segDir, segmentFileName)); os.IsNotExist(err) {
+			// a flush or merge that didn't finish
+			if err := os.RemoveAll(segDir); err != nil {
+				return fmt.Errorf("failed to remove partial segment %v: err:%v", match[0], err)
+			}
+			continue
+		}
+		seg, err := OpenSegment(segDir)
+		if err != nil {
+			return err
+		}
+		idx.segments = append(idx.segments, &indexSegment{name: match[0], gen: gen, dir: segDir, seg: seg, refs: 1})
+		if gen >= idx.segGen {
+			idx.segGen = gen + 1
+		}
+	}
+	return nil
+}
+
+// replay opens the wal and applies the records which are newer than the commit, then commits
+// them.
+func (idx *Index) replay() error {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+
+	wal, records, err := openWriteAheadLog(idx.dir, idx.seq)
+	if err != nil {
+		return err
+	}
+	idx.wal = wal
+	for _, rec := range records {
+		if rec.seq <= idx.seq {
+			continue
+		}
+		if rec.op == walAddOp {
+			idx.buffer = append(idx.buffer, rec.docs...)
+			idx.bufferSeq = rec.seq
+			continue
+		}
+		if err := idx.drainBuffer(context.Background()); err != nil {
+			return fmt.Errorf("failed to replay wal record %v: err:%v", rec.seq, err)
+		}
+		switch rec.op {
+		case walIndexOp:
+			err := idx.indexDocuments(context.Background(), rec.docs, rec.seq, false)
+			if _, ok := err.(IndexingErrors); err != nil && !ok {
+				return fmt.Errorf("failed to replay wal record %v: err:%v", rec.seq, err)
+			}
+		case walDeleteOp:
+			if _, err := idx.deleteDocumentsSeq(rec.ids, rec.seq); err != nil {
+				return fmt.Errorf("failed to replay wal record %v: err:%v", rec.seq, err)
+			}
+		}
+	}
+	// the docs which were buffered when the index was closed are made searchable.
+	if err := idx.drainBuffer(context.Background()); err != nil {
+		return fmt.Errorf("failed to replay the buffered docs: err:%v", err)
+	}
+	// commit even if nothing was replayed, so an index without a commit file gets one, and
+	// records the last commit already included are cleared from the wal.
+	return idx.commit()
+}
+
+// commit writes the commit file for the current segments.  Assumes writeMu has been acquired.
+func (idx *Index) commit() error {
+	idx.mu.RLock()
+	segments, segGen := idx.segments, idx.segGen
+	idx.mu.RUnlock()
+	return idx.commitSegments(segments, segGen)
+}
+
+// commitSegments writes the commit file for segments, and empties the wal once the commit
+// includes every record in it.  Assumes writeMu has been acquired.
+func (idx *Index) commitSegments(segments []*indexSegment, segGen uint64) error {
+	cp := &commitPoint{seq: idx.seq, segGen: segGen}
+	for _, s := range segments {
+		cp.segments = append(cp.segments, commitSegment{name: s.name, gen: s.gen})
+	}
+	if err := writeCommit(idx.dir, cp); err != nil {
+		return err
+	}
+	if idx.seq == idx.wal.seq {
+		return idx.wal.reset()
+	}
+	return nil
+}
+
+// Close stops background merging and refreshing, and closes all segments.  Buffered docs
+// which weren't refreshed are replayed from the wal when the index is opened again.
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	if idx.closed {
+		idx.mu.Unlock()
+		return nil
+	}
+	idx.closed = true
+	idx.mu.Unlock()
+
+	close(idx.closeCh)
+	idx.wg.Wait()
+
+	idx.writeMu.Lock()
+	var err error
+	if idx.wal != nil {
+		err = idx.wal.close()
+		idx.wal = nil
+	}
+	idx.writeMu.Unlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, s := range idx.segments {
+		s.release()
+	}
+	idx.segments = nil
+	if err != nil {
+		return fmt.Errorf("failed to close wal: err:%v", err)
+	}
+	return nil
+}
+
+// IndexDocuments indexes docs into a new segment, and flushes it to disk.  Docs which are
+// already in the index are replaced, their old versions are deleted from the older segments.
+// Docs which don't match the mapping are returned as IndexingErrors, and don't replace their
+// old versions.  The docs are written to the wal before they're indexed, and removed from it
+// again if the batch fails, for instance because ctx is cancelled.
+func (idx *Index) IndexDocuments(ctx context.Context, docs []Document) error {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+
+	if idx.wal == nil {
+		return fmt.Errorf("index is closed")
+	}
+	if err := idx.drainBuffer(ctx); err != nil {
+		return err
+	}
+	seq, err := idx.wal.append(walIndexOp, docs, nil)
+	if err != nil {
+		return err
+	}
+	return idx.indexDocuments(ctx, docs, seq, true)
+}
+
+// AddDocument adds the doc to the index's buffer, it's searchable once the buffer has been
+// refreshed.  The doc is written to the wal before it's buffered, so it isn't lost if the index
+// is closed or crashes before the refresh.  A doc which replaces a doc in the index, or in the
+// buffer, deletes the old version when it's refreshed.
+func (idx *Index) AddDocument(ctx context.Context, doc Document) error {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+
+	if idx.wal == nil {
+		return fmt.Errorf("index is closed")
+	}
+	seq, err := idx.wal.append(walAddOp, []Document{doc}, nil)
+	if err != nil {
+		return err
+	}
+	idx.buffer = append(idx.buffer, doc)
+	idx.bufferSeq = seq
+	if len(idx.buffer) >= idx.maxBufferedDocs {
+		return idx.drainBuffer(ctx)
+	}
+	return nil
+}
+
+// Refresh turns the docs buffered by AddDocument into a new segment, which makes them
+// searchable.  Buffered docs which don't match the mapping are returned as IndexingErrors.
+func (idx *Index) Refresh(ctx context.Context) error {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+
+	if idx.wal == nil {
+		return fmt.Errorf("index is closed")
+	}
+	return idx.refresh(ctx)
+}
+
+// refresh indexes the buffered docs into a new segment.  If they can't be indexed they're kept
+// in the buffer, so a later refresh can retry them.  Assumes writeMu has been acquired.
+func (idx *Index) refresh(ctx context.Context) error {
+	if len(idx.buffer) == 0 {
+		return nil
+	}
+	docs, seq := idx.buffer, idx.bufferSeq
+	idx.buffer, idx.bufferSeq = nil, 0
+
+	err := idx.indexDocuments(ctx, docs, seq, false)
+	if _, ok := err.(IndexingErrors); err != nil && !ok {
+		// indexing the same docs again replaces any which were indexed.
+		idx.buffer, idx.bufferSeq = append(docs, idx.buffer...), seq
+	}
+	return err
+}
+
+// drainBuffer refreshes the buffered docs before a batch or delete is applied, so they're
+// applied in the order they were logged.  Buffered docs which don't match the mapping were
+// already acknowledged by AddDocument, so they're only logged.  Assumes writeMu has been
+// acquired.
+func (idx *Index) drainBuffer(ctx context.Context) error {
+	err := idx.refresh(ctx)
+	if _, ok := err.(IndexingErrors); ok {
+		gou.Warnf("failed to index buffered docs: err:%v", err)
+		return nil
+	}
+	return err
+}
+
+func (idx *Index) refreshLoop(interval time.Duration) {
+	defer idx.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-idx.closeCh:
+			return
+		case <-ticker.C:
+			if err := idx.Refresh(context.Background()); err != nil {
+				gou.Errorf("background refresh failed: err:%v", err)
+			}
+		}
+	}
+}
+
+// indexDocuments indexes the docs of the wal record seq, and commits them.  If abort is set seq
+// is the last record in the wal, and it's removed from the wal if the docs fail to index before
+// any of them are applied.  Assumes writeMu has been acquired.
+func (idx *Index) indexDocuments(ctx context.Context, docs []Document, seq uint64, abort bool) error {
+	abortBatch := func(err error) error {
+		if !abort {
+			return err
+		}
+		if abortErr := idx.wal.abort(seq); abortErr != nil {
+			return fmt.Errorf("%v, and failed to remove the batch from the wal: err:%v", err, abortErr)
+		}
+		return err
+	}
+
+	seg := NewSegment()
+	defer seg.Close()
+	mapping := idx.mapping.Clone()
+	seg.SetMapping(mapping)
+	if idx.indexWorkers > 0 {
+		seg.SetWorkers(idx.indexWorkers)
+	}
+
+	err := seg.IndexDocuments(ctx, docs)
+	docErrs, ok := err.(IndexingErrors)
+	if err != nil && !ok {
+		return abortBatch(err)
+	}
+	failed := make(map[string]bool, len(docErrs))
+	for _, docErr := range docErrs {
+		failed[docErr.ID] = true
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if !failed[doc.ID()] {
+			ids = append(ids, doc.ID())
+		}
+	}
+
+	if len(mapping.Fields) != len(idx.mapping.Fields) {
+		if err := writeMapping(idx.dir, mapping); err != nil {
+			return abortBatch(err)
+		}
+		idx.mapping = mapping
+	}
+	if len(ids) > 0 {
+		if err := idx.flush(seg, ids); err != nil {
+			return abortBatch(err)
+		}
+	}
+	idx.seq = seq
+	if err := idx.commit(); err != nil {
+		return err
+	}
+	if len(docErrs) > 0 {
+		return docErrs
+	}
+	return nil
+}
+
+// Mapping returns a copy of the index's mapping, including the dynamically mapped fields.
+func (idx *Index) Mapping() *IndexMapping {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+	return idx.mapping.Clone()
+}
+
+// ParseQuery parses a query string, using the index's mapping to decide the query each field's
+// values turn into.  See QueryParser.
+func (idx *Index) ParseQuery(s string) (Query, error) {
+	return NewQueryParser(idx.Mapping()).Parse(s)
+}
+
+// DeleteDocuments deletes the docs with the given external IDs from every segment, and returns
+// the number of docs deleted.  The deletes are written to the wal before they're applied.
+func (idx *Index) DeleteDocuments(ctx context.Context, ids ...string) (int, error) {
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+
+	if idx.wal == nil {
+		return 0, fmt.Errorf("index is closed")
+	}
+	if err := idx.drainBuffer(ctx); err != nil {
+		return 0, err
+	}
+	seq, err := idx.wal.append(walDeleteOp, nil, ids)
+	if err != nil {
+		return 0, err
+	}
+	return idx.deleteDocumentsSeq(ids, seq)
+}
+
+// deleteDocumentsSeq applies the deletes of the wal record seq, and commits them.  Assumes
+// writeMu has been acquired.
+func (idx *Index) deleteDocumentsSeq(ids []string, seq uint64) (int, error) {
+	idx.mu.Lock()
+	deleted, err := idx.deleteDocuments(idx.segments, ids)
+	idx.mu.Unlock()
+	if err != nil {
+		return deleted, err
+	}
+	idx.seq = seq
+	return deleted, idx.commit()
+}
+
+// deleteDocuments deletes the ids from segs.  Assumes the write locks have been acquired.
+func (idx *Index) deleteDocuments(segs []*indexSegment, ids []string) (int, error) {
+	deleted := 0
+	for _, s := range segs {
+		n, err := s.seg.DeleteDocuments(ids...)
+		if err != nil {
+			return deleted, fmt.Errorf("failed deleting docs from segment %v: err:%v", s.name, err)
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// flush writes the in-memory segment to disk and adds it to the index as the newest segment.
+// ids, the docs in the new segment, are deleted from the older segments at the same time, so a
+// search never sees both versions of a doc.  Assumes writeMu has been acquired.
+func (idx *Index) flush(seg *Segment, ids []string) error {
+	idx.mu.Lock()
+	if idx.closed {
+		idx.mu.Unlock()
+		return fmt.Errorf("index is closed")
+	}
+	gen := idx.segGen
+	idx.segGen++
+	idx.mu.Unlock()
+
+	s, err := idx.writeSegment(gen, seg)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	_, err = idx.deleteDocuments(idx.segments, ids)
+	idx.segments = append(idx.segments, s)
+	idx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	idx.scheduleMerge()
+	return nil
+}
+
+func (idx *Index) writeSegment(gen uint64, seg *Segment) (*indexSegment, error) {
+	name := segmentName(gen)
+	segDir := filepath.Join(idx.dir, name)
+	if err := seg.WriteToDir(segDir); err != nil {
+		return nil, err
+	}
+	opened, err := OpenSegment(segDir)
+	if err != nil {
+		return nil, err
+	}
+	return &indexSegment{name: name, gen: gen, dir: segDir, seg: opened, refs: 1}, nil
+}
+
+func releaseSegments(segs []*indexSegment) {
+	for _, s := range segs {
+		s.release()
+	}
+}
+
+// Segments describes the current segments of the index, oldest to newest.
+func (idx *Index) Segments() []SegmentInfo {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	infos := make([]SegmentInfo, len(idx.segments))
+	for i, s := range idx.segments {
+		infos[i] = SegmentInfo{s.name, s.seg.NumDocs()}
+	}
+	return infos
+}
+
+// IndexSearchResults are the results of a search over all segments of an index.
+type IndexSearchResults struct {
+	ExternalDocIDs []string
+}
+
+// Search runs the queries, and'ed together, against a snapshot of the index.  See
+// Snapshot.Search.
+func (idx *Index) Search(ctx context.Context, queries ...Query) (*IndexSearchResults, error) {
+	snap := idx.Snapshot()
+	defer snap.Close()
+	return snap.Search(ctx, queries...)
+}
+
+// Search runs the queries, and'ed together, against every segment of the snapshot.  A segment
+// which doesn't have one of the queried fields can't match, and is skipped.
+func (snap *Snapshot) Search(ctx context.Context, queries ...Query) (*IndexSearchResults, error) {
+	segs := snap.segs
+	res := &IndexSearchResults{ExternalDocIDs: []string{}}
+	for _, s := range segs {
+		segRes, err := NewQueryBuilder(ctx, s.seg).And(queries...).Run()
+		if _, ok := err.(*FieldNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, searchError(s.name, err)
+		}
+		res.ExternalDocIDs = append(res.ExternalDocIDs, segRes.ExternalDocIDs...)
+	}
+	return res, nil
+}
+
+// searchError wraps an error from searching a segment with the segment's name.  A
+// *QueryCancelledError is returned as it is, so callers can tell the search was cancelled.
+func searchError(segment string, err error) error {
+	if _, ok := err.(*QueryCancelledError); ok {
+		return err
+	}
+	return fmt.Errorf("search failed on segment %v: err:%v", segment, err)
+}
+
+// Document returns the doc with the external ID, with its stored fields.  found is false if the
+// doc isn't in the index.
+func (idx *Index) Document(id string) (doc Document, found bool, err error) {
+	snap := idx.Snapshot()
+	defer snap.Close()
+	return snap.Document(id)
+}
+
+// Document returns the doc with the external ID, with its stored fields.  found is false if the
+// doc isn't in the snapshot.
+func (snap *Snapshot) Document(id string) (doc Document, found bool, err error) {
+	segs := snap.segs
+	for i := len(segs) - 1; i >= 0; i-- {
+		seg := segs[i].seg
+		did, ok := seg.docIDExternalToInternal[id]
+		if !ok || !seg.liveDocs.Contains(did) {
+			continue
+		}
+		doc, err := seg.Document(did)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load doc %v from segment %v: err:%v", id, segs[i].name, err)
+		}
+		return doc, true, nil
+	}
+	return nil, false, nil
+}
+
+// scheduleMerge wakes up the background merge goroutine.
+func (idx *Index) scheduleMerge() {
+	select {
+	case idx.mergeCh <- struct{}{}:
+	default: // a merge is already scheduled
+	}
+}
+
+func (idx *Index) mergeLoop() {
+	defer idx.wg.Done()
+	for {
+		select {
+		case <-idx.closeCh:
+			return
+		case <-idx.mergeCh:
+			if err := idx.MaybeMerge(); err != nil {
+				gou.Errorf("background merge failed: err:%v", err)
+			}
+		}
+	}
+}
+
+// MaybeMerge merges segments until the MergePolicy doesn't find any more merges.
+func (idx *Index) MaybeMerge() error {
+	idx.mergeMu.Lock()
+	defer idx.mergeMu.Unlock()
+
+	for {
+		idx.mu.Lock()
+		if idx.closed {
+			idx.mu.Unlock()
+			return nil
+		}
+		infos := []SegmentInfo{}
+		for _, s := range idx.segments {
+			if !idx.merging[s.name] {
+				infos = append(infos, SegmentInfo{s.name, s.seg.NumDocs()})
+			}
+		}
+		merges := idx.mergePolicy.FindMerges(infos)
+		for _, merge := range merges {
+			for _, info := range merge {
+				idx.merging[info.Name] = true
+			}
+		}
+		idx.mu.Unlock()
+
+		if len(merges) == 0 {
+			return nil
+		}
+		// every merge is run, even after one fails, so each of them clears its segments from
+		// merging.
+		var mergeErr error
+		for _, merge := range merges {
+			if err := idx.merge(merge); err != nil && mergeErr == nil {
+				mergeErr = err
+			}
+		}
+		if mergeErr != nil {
+			return mergeErr
+		}
+	}
+}
+
+// merge merges the segments into a new segment, which replaces them in the index.
+func (idx *Index) merge(merge []SegmentInfo) error {
+	names := map[string]bool{}
+	for _, info := range merge {
+		names[info.Name] = true
+	}
+	defer func() {
+		idx.mu.Lock()
+		for name := range names {
+			delete(idx.merging, name)
+		}
+		idx.mu.Unlock()
+	}()
+
+	// snapshot the live docs of the sources, deletes that happen while merging are carried
+	// over to the merged segment before it replaces them.
+	idx.writeMu.Lock()
+	idx.mu.Lock()
+	srcs := []*indexSegment{}
+	segs := []*Segment{}
+	liveDocs := []*roaring.Bitmap{}
+	for _, s := range idx.segments {
+		if names[s.name] {
+			s.acquire()
+			srcs = append(srcs, s)
+			view := s.seg.pointInTime()
+			segs = append(segs, view)
+			liveDocs = append(liveDocs, view.liveDocs)
+		}
+	}
+	gen := idx.segGen
+	idx.segGen++
+	idx.mu.Unlock()
+	idx.writeMu.Unlock()
+	defer releaseSegments(srcs)
+
+	merged, err := mergeSegments(segs, liveDocs)
+	if err != nil {
+		return fmt.Errorf("failed to merge segments %v: err:%v", merge, err)
+	}
+	s, err := idx.writeSegment(gen, merged)
+	merged.Close()
+	if err != nil {
+		return err
+	}
+
+	idx.writeMu.Lock()
+	defer idx.writeMu.Unlock()
+	deletedIDs := []string{}
+	for i, src := range srcs {
+		deleted := roaring.AndNot(liveDocs[i], src.seg.liveDocs)
+		docIter := deleted.Iterator()
+		for docIter.HasNext() {
+			deletedIDs = append(deletedIDs, src.seg.docIDInternalToExternal[docIter.Next()])
+		}
+	}
+	if _, err := s.seg.DeleteDocuments(deletedIDs...); err != nil {
+		atomic.StoreInt32(&s.obsolete, 1)
+		s.release()
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.closed {
+		// the sources are still in the index's dir, drop the merged copy of them.
+		atomic.StoreInt32(&s.obsolete, 1)
+		s.release()
+		return nil
+	}
+	// the merged segment takes the place of the newest segment it replaces.
+	newest := -1
+	for i, seg := range idx.segments {
+		if names[seg.name] {
+			newest = i
+		}
+	}
+	segments := make([]*indexSegment, 0, len(idx.segments)-len(srcs)+1)
+	for i, seg := range idx.segments {
+		if !names[seg.name] {
+			segments = append(segments, seg)
+		} else if i == newest {
+			segments = append(segments, s)
+		}
+	}
+	// the sources are only removed once the commit no longer lists them.
+	if err := idx.commitSegments(segments, idx.segGen); err != nil {
+		atomic.StoreInt32(&s.obsolete, 1)
+		s.release()
+		return err
+	}
+	for _, seg := range idx.segments {
+		if names[seg.name] {
+			atomic.StoreInt32(&seg.obsolete, 1)
+			seg.release()
+		}
+	}
+	idx.segments = segments
+	return nil
+}
@@ -0,0 +1,427 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestIndexSearchAcrossSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	docs := testDocuments(500)
+	for i := 0; i < len(docs); i += 100 {
+		if err := idx.IndexDocuments(context.TODO(), docs[i:i+100]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	assert.Equal(t, 5, len(idx.Segments()))
+
+	{ // test case - kevin is in every segment
+		res, err := idx.Search(context.TODO(), &RegExTermQuery{"first_name", "kevin"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 5, len(res.ExternalDocIDs))
+	}
+
+	{ // test case - last_name is only in the second segment
+		res, err := idx.Search(context.TODO(), &RegExTermQuery{"first_name", "kev.*"}, &RegExTermQuery{"last_name", "manning"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+	}
+
+	// reopen the index from disk
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	idx, err = NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+	assert.Equal(t, 5, len(idx.Segments()))
+
+	res, err := idx.Search(context.TODO(), &RegExTermQuery{"first_name", "kevin"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 5, len(res.ExternalDocIDs))
+}
+
+func TestIndexMergeSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 4, MaxMergeAtOnce: 4, FloorSegmentDocs: 10, MaxMergedSegmentDocs: 1000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	now := time.Now()
+	for batch := 0; batch < 8; batch++ {
+		docs := []Document{}
+		for i := 0; i < 5; i++ {
+			id := batch*5 + i
+			fieldvals := map[string]value.Value{
+				"color": NewStringVal([]string{"red", "green", "blue"}[id%3]),
+				"batch": NewStringVal(fmt.Sprintf("batch-%d", batch)),
+			}
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%02d", id), fieldvals, now))
+		}
+		if err := idx.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	assert.Equal(t, 8, len(idx.Segments()))
+
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	segments := idx.Segments()
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, 20, segments[0].NumDocs)
+	assert.Equal(t, 20, segments[1].NumDocs)
+
+	res, err := idx.Search(context.TODO(), &RegExTermQuery{"color", "red"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	sort.Strings(res.ExternalDocIDs)
+	expected := []string{}
+	for id := 0; id < 40; id += 3 {
+		expected = append(expected, fmt.Sprintf("doc:%02d", id))
+	}
+	assert.Equal(t, expected, res.ExternalDocIDs)
+
+	res, err = idx.Search(context.TODO(), &RegExTermQuery{"batch", "batch-[67]"}, &RegExTermQuery{"color", "green|blue"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 6, len(res.ExternalDocIDs))
+}
+
+func TestIndexUpdateAndDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentDocs: 1000, MaxMergedSegmentDocs: 10000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	if err := idx.IndexDocuments(context.TODO(), testDocuments(200)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	update := NewDocument("doc_number:101", map[string]value.Value{
+		"first_name": NewStringVal("kevin"),
+		"last_name":  NewStringVal("smith"),
+	}, time.Now())
+	if err := idx.IndexDocuments(context.TODO(), []Document{update}); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	deleted, err := idx.DeleteDocuments(context.TODO(), "doc_number:102", "doc_number:0")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 2, deleted)
+
+	check := func() {
+		res, err := idx.Search(context.TODO(), &RegExTermQuery{"last_name", ".*"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+
+		res, err = idx.Search(context.TODO(), &RegExTermQuery{"last_name", "smith"}, &RegExTermQuery{"first_name", "kevin"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+
+		total := 0
+		for _, info := range idx.Segments() {
+			total += info.NumDocs
+		}
+		assert.Equal(t, 198, total)
+	}
+	check()
+
+	// the deletes are written next to the segments, and survive reopening the index.
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	idx, err = NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+	check()
+
+	// merging drops the deleted docs for good.
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	segments := idx.Segments()
+	assert.Equal(t, 1, len(segments))
+	idx.mu.RLock()
+	assert.Equal(t, uint32(198), idx.segments[0].seg.docIdInc)
+	idx.mu.RUnlock()
+	check()
+}
+
+func TestIndexAddDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &IndexOptions{DisableBackgroundMerges: true, MaxBufferedDocs: 5}
+	idx, err := NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	add := func(idx *Index, id, name string) {
+		doc := NewDocument(id, map[string]value.Value{"name": NewStringVal(name)}, time.Now())
+		if err := idx.AddDocument(context.TODO(), doc); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	search := func(idx *Index, name string) []string {
+		res, err := idx.Search(context.TODO(), &TermQuery{Field: "name", Term: name})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+
+	{ // test case - buffered docs are searchable after a refresh
+		add(idx, "doc:1", "kevin")
+		add(idx, "doc:2", "kevin")
+		assert.Equal(t, []string{}, search(idx, "kevin"))
+		if err := idx.Refresh(context.TODO()); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:1", "doc:2"}, search(idx, "kevin"))
+		assert.Equal(t, 1, len(idx.Segments()))
+
+		// an empty buffer doesn't add a segment.
+		if err := idx.Refresh(context.TODO()); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, len(idx.Segments()))
+	}
+	{ // test case - updates and deletes are applied in the order they were made
+		add(idx, "doc:1", "kelly")
+		add(idx, "doc:3", "kevin")
+		deleted, err := idx.DeleteDocuments(context.TODO(), "doc:3")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, deleted)
+		assert.Equal(t, []string{"doc:2"}, search(idx, "kevin"))
+		assert.Equal(t, []string{"doc:1"}, search(idx, "kelly"))
+	}
+	{ // test case - a full buffer is refreshed
+		for i := 10; i < 15; i++ {
+			add(idx, fmt.Sprintf("doc:%d", i), "jane")
+		}
+		assert.Equal(t, 5, len(search(idx, "jane")))
+	}
+	{ // test case - buffered docs survive closing the index
+		add(idx, "doc:20", "eric")
+		add(idx, "doc:2", "eric")
+		if err := idx.Close(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		idx, err = NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		defer idx.Close()
+		assert.Equal(t, []string{"doc:2", "doc:20"}, search(idx, "eric"))
+		assert.Equal(t, []string{}, search(idx, "kevin"))
+	}
+}
+
+func TestIndexRefreshInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true, RefreshInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	doc := NewDocument("doc:1", map[string]value.Value{"name": NewStringVal("kevin")}, time.Now())
+	if err := idx.AddDocument(context.TODO(), doc); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, found, err := idx.Document("doc:1")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the doc wasn't refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIndexConcurrentOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 3, MaxMergeAtOnce: 3, FloorSegmentDocs: 10, MaxMergedSegmentDocs: 10000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, RefreshInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	ch := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // writer
+		defer wg.Done()
+		for {
+			select {
+			case <-ch:
+				return
+			default:
+			}
+			id := rand.Intn(500)
+			doc := NewDocument(fmt.Sprintf("doc:%d", id), map[string]value.Value{
+				"name": NewStringVal(fmt.Sprintf("name-%d", id%20)),
+				"age":  value.NewIntValue(int64(id % 100)),
+			}, time.Now())
+			if err := idx.AddDocument(context.TODO(), doc); err != nil {
+				t.Errorf("err:%v", err)
+			}
+			if id%10 == 0 {
+				if _, err := idx.DeleteDocuments(context.TODO(), fmt.Sprintf("doc:%d", rand.Intn(500))); err != nil {
+					t.Errorf("err:%v", err)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() { // reader
+			defer wg.Done()
+			for {
+				select {
+				case <-ch:
+					return
+				default:
+				}
+				snap := idx.Snapshot()
+				res, err := snap.Execute(context.TODO(), &SearchRequest{
+					Query: &TermQuery{Field: "name", Term: fmt.Sprintf("name-%d", rand.Intn(20))},
+					Sort:  []SortField{{Field: "age"}},
+					Aggs:  map[string]Aggregation{"ages": &MetricAgg{Field: "age", Metric: MetricAvg}},
+				})
+				if err != nil {
+					t.Errorf("err:%v", err)
+				} else if len(res.Hits) > 0 {
+					if _, found, err := snap.Document(res.Hits[0].ID); err != nil || !found {
+						t.Errorf("hit %v wasn't found in its snapshot, err:%v", res.Hits[0].ID, err)
+					}
+				}
+				snap.Close()
+			}
+		}()
+	}
+	// run a while, then tell the readers and writer to stop.
+	time.Sleep(2 * time.Second)
+	close(ch)
+	wg.Wait()
+}
+
+func TestTieredMergePolicy(t *testing.T) {
+	policy := &TieredMergePolicy{SegmentsPerTier: 3, MaxMergeAtOnce: 3, FloorSegmentDocs: 10, MaxMergedSegmentDocs: 1000}
+
+	merges := policy.FindMerges([]SegmentInfo{{"a", 5}, {"b", 500}, {"c", 8}, {"d", 1}, {"e", 900}})
+	assert.Equal(t, [][]SegmentInfo{{{"d", 1}, {"a", 5}, {"c", 8}}}, merges)
+
+	// tier 1 (30 to 299 docs) only has two segments, and e is too big to merge.
+	merges = policy.FindMerges([]SegmentInfo{{"a", 50}, {"b", 200}, {"c", 8}, {"e", 1000}, {"f", 1000}, {"g", 1000}})
+	assert.Equal(t, 0, len(merges))
+
+	{ // test case - a zero or degenerate policy uses the defaults, instead of never finishing
+		infos := []SegmentInfo{}
+		for i := 0; i < 12; i++ {
+			infos = append(infos, SegmentInfo{fmt.Sprintf("s%02d", i), 100})
+		}
+		want := NewTieredMergePolicy().FindMerges(infos)
+		assert.Equal(t, 1, len(want))
+		assert.Equal(t, want, (&TieredMergePolicy{}).FindMerges(infos))
+		assert.Equal(t, want, (&TieredMergePolicy{SegmentsPerTier: 1, MaxMergeAtOnce: 1, FloorSegmentDocs: -5}).FindMerges(infos))
+	}
+}
+
+func TestIndexZeroMergePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: &TieredMergePolicy{}})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+	for i := 0; i < 3; i++ {
+		doc := NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"name": NewStringVal("kevin")}, time.Now())
+		if err := idx.IndexDocuments(context.TODO(), []Document{doc}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 3, len(idx.Segments()))
+}
@@ -0,0 +1,401 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+)
+
+const mappingFileName = "mapping.json"
+
+// FieldType is the type of a mapped field, it decides how the field's values are indexed.
+type FieldType string
+
+const (
+	// FieldTypeKeyword fields are indexed as a single exact term.
+	FieldTypeKeyword FieldType = "keyword"
+	// FieldTypeText fields are split into terms by the field's analyzer.
+	FieldTypeText FieldType = "text"
+	// FieldTypeNumeric fields hold ints or numbers, and are indexed in a bkd tree.  A field which
+	// only holds ints keeps them as ints, the first number promotes its ints to numbers.
+	FieldTypeNumeric FieldType = "numeric"
+	FieldTypeBool    FieldType = "bool"
+	// FieldTypeDate fields hold times, or RFC3339 strings.
+	FieldTypeDate FieldType = "date"
+	// FieldTypeGeo fields hold a map with a lat and a lon, which are indexed as the numeric
+	// fields field.lat and field.lon.
+	FieldTypeGeo FieldType = "geo"
+)
+
+// DynamicPolicy decides what happens to fields which aren't in the mapping.
+type DynamicPolicy string
+
+const (
+	// DynamicTrue maps new fields from the type of their first value, and adds them to the mapping.
+	DynamicTrue DynamicPolicy = "true"
+	// DynamicFalse ignores new fields.
+	DynamicFalse DynamicPolicy = "false"
+	// DynamicStrict fails to index docs with new fields.
+	DynamicStrict DynamicPolicy = "strict"
+)
+
+// FieldMapping describes how a field is indexed.
+type FieldMapping struct {
+	Type FieldType `json:"type"`
+	// Analyzer is the name of the analyzer of a text field, see RegisterAnalyzer.
+	Analyzer string `json:"analyzer,omitempty"`
+	// Index makes the field searchable.
+	Index bool `json:"index"`
+	// Store keeps the field's original values, so they can be returned with search results.
+	Store bool `json:"store"`
+	// DocValues keeps the field's values in columns, for sorting and aggregations.
+	DocValues bool `json:"doc_values"`
+	// Positions records where each of a text field's terms occur in a doc, for phrase and span
+	// queries.
+	Positions bool `json:"positions,omitempty"`
+
+	// custom is an analyzer set by SetAnalyzer, it's used instead of Analyzer and isn't saved.
+	custom Analyzer
+}
+
+func NewKeywordFieldMapping() *FieldMapping {
+	return &FieldMapping{Type: FieldTypeKeyword, Index: true, Store: true, DocValues: true}
+}
+
+func NewTextFieldMapping(analyzer string) *FieldMapping {
+	return &FieldMapping{Type: FieldTypeText, Analyzer: analyzer, Index: true, Store: true, Positions: true}
+}
+
+func NewNumericFieldMapping() *FieldMapping {
+	return &FieldMapping{Type: FieldTypeNumeric, Index: true, Store: true, DocValues: true}
+}
+
+func NewBoolFieldMapping() *FieldMapping {
+	return &FieldMapping{Type: FieldTypeBool, Index: true, Store: true, DocValues: true}
+}
+
+func NewDateFieldMapping() *FieldMapping {
+	return &FieldMapping{Type: FieldTypeDate, Index: true, Store: true, DocValues: true}
+}
+
+func NewGeoFieldMapping() *FieldMapping {
+	return &FieldMapping{Type: FieldTypeGeo, Index: true, Store: true}
+}
+
+// IndexMapping is the schema of an index, it maps field names to the FieldMapping used to index
+// them.  The fields of maps are mapped by their flattened name, field.key.
+type IndexMapping struct {
+	Fields  map[string]*FieldMapping `json:"fields"`
+	Dynamic DynamicPolicy            `json:"dynamic"`
+}
+
+// NewIndexMapping returns an empty mapping which maps new fields dynamically.
+func NewIndexMapping() *IndexMapping {
+	return &IndexMapping{Fields: map[string]*FieldMapping{}, Dynamic: DynamicTrue}
+}
+
+// AddField sets the mapping of a field.
+func (m *IndexMapping) AddField(field string, fm *FieldMapping) *IndexMapping {
+	m.Fields[field] = fm
+	return m
+}
+
+// setAnalyzer maps the field as a text field split into terms by the analyzer, the rest of the
+// field's mapping is kept if it's already a text field.
+func (m *IndexMapping) setAnalyzer(field string, analyzer Analyzer) {
+	fm := NewTextFieldMapping("")
+	if old, ok := m.Fields[field]; ok && old.Type == FieldTypeText {
+		fmCopy := *old
+		fm = &fmCopy
+	}
+	fm.custom = analyzer
+	m.Fields[field] = fm
+}
+
+// Validate checks the field types and analyzers of the mapping.
+func (m *IndexMapping) Validate() error {
+	switch m.Dynamic {
+	case DynamicTrue, DynamicFalse, DynamicStrict:
+	default:
+		return fmt.Errorf("unknown dynamic mapping policy: %q", m.Dynamic)
+	}
+	for field, fm := range m.Fields {
+		switch fm.Type {
+		case FieldTypeKeyword, FieldTypeNumeric, FieldTypeBool, FieldTypeDate, FieldTypeGeo:
+		case FieldTypeText:
+			if _, err := fm.analyzer(); err != nil {
+				return fmt.Errorf("field %v: err:%v", field, err)
+			}
+		default:
+			return fmt.Errorf("field %v has an unknown type: %q", field, fm.Type)
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the mapping.
+func (m *IndexMapping) Clone() *IndexMapping {
+	clone := &IndexMapping{Fields: make(map[string]*FieldMapping, len(m.Fields)), Dynamic: m.Dynamic}
+	for field, fm := range m.Fields {
+		fmCopy := *fm
+		clone.Fields[field] = &fmCopy
+	}
+	return clone
+}
+
+// analyzer returns the analyzer of a text field, text fields without one use "standard".
+func (fm *FieldMapping) analyzer() (Analyzer, error) {
+	if fm.custom != nil {
+		return fm.custom, nil
+	}
+	name := fm.Analyzer
+	if name == "" {
+		name = "standard"
+	}
+	analyzer, ok := LookupAnalyzer(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer: %q", name)
+	}
+	return analyzer, nil
+}
+
+// dynamicFieldMapping returns the mapping for a new field from the type of its value, or nil if
+// the type can't be indexed.
+func dynamicFieldMapping(val value.Value) *FieldMapping {
+	switch val.Type() {
+	case value.StringType:
+		return NewKeywordFieldMapping()
+	case value.IntType, value.NumberType:
+		return NewNumericFieldMapping()
+	case value.BoolType:
+		return NewBoolFieldMapping()
+	case value.TimeType:
+		return NewDateFieldMapping()
+	}
+	return nil
+}
+
+// mappedValue is a value of a doc, along with the mapping of its field.
+type mappedValue struct {
+	field   string
+	mapping *FieldMapping
+	val     value.Value
+}
+
+// mapDocument flattens the doc into the values of its mapped fields, and checks each value
+// against its field's type.  New fields mapped by the dynamic policy are returned in newFields,
+// and are only added to the mapping by the caller once the doc is known to be valid.
+func (m *IndexMapping) mapDocument(doc Document) (vals []mappedValue, newFields map[string]*FieldMapping, err error) {
+	newFields = map[string]*FieldMapping{}
+	for field, val := range doc.Row() {
+		if field == TimestampField {
+			return nil, nil, fmt.Errorf("field name %v is reserved for the doc's timestamp", field)
+		}
+		if vals, err = m.mapValue(vals, newFields, field, val); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vals, newFields, nil
+}
+
+func (m *IndexMapping) mapValue(vals []mappedValue, newFields map[string]*FieldMapping, field string, val value.Value) ([]mappedValue, error) {
+	if val == nil || val.Nil() || val.Err() {
+		return vals, nil
+	}
+
+	fm, ok := m.Fields[field]
+	if !ok {
+		fm, ok = newFields[field]
+	}
+	if !ok || fm.Type != FieldTypeGeo {
+		var err error
+		switch val.Type() {
+		case value.StringsType, value.SliceValueType:
+			for _, elem := range val.(value.Slice).SliceValue() {
+				if vals, err = m.mapValue(vals, newFields, field, elem); err != nil {
+					return nil, err
+				}
+			}
+			return vals, nil
+		case value.MapValueType, value.MapStringType, value.MapIntType, value.MapNumberType,
+			value.MapBoolType, value.MapTimeType:
+			for key, elem := range val.(value.Map).MapValue().Val() {
+				if vals, err = m.mapValue(vals, newFields, field+"."+key, elem); err != nil {
+					return nil, err
+				}
+			}
+			return vals, nil
+		}
+	}
+
+	if !ok {
+		switch m.Dynamic {
+		case DynamicFalse:
+			return vals, nil
+		case DynamicStrict:
+			return nil, fmt.Errorf("field %v isn't in the mapping", field)
+		}
+		if fm = dynamicFieldMapping(val); fm == nil {
+			return vals, nil
+		}
+		newFields[field] = fm
+	}
+
+	val, err := fm.convert(val)
+	if err != nil {
+		return nil, fmt.Errorf("field %v: err:%v", field, err)
+	}
+	return append(vals, mappedValue{field, fm, val}), nil
+}
+
+// convert checks that the value's type matches the field's type, converting the values which
+// have more than one representation.
+func (fm *FieldMapping) convert(val value.Value) (value.Value, error) {
+	mismatch := fmt.Errorf("can't index a %v value in a %v field", val.Type(), fm.Type)
+	switch fm.Type {
+	case FieldTypeKeyword, FieldTypeText:
+		if val.Type() == value.StringType {
+			return val, nil
+		}
+	case FieldTypeNumeric:
+		switch val.Type() {
+		case value.IntType, value.NumberType:
+			return val, nil
+		}
+	case FieldTypeBool:
+		if val.Type() == value.BoolType {
+			return val, nil
+		}
+	case FieldTypeDate:
+		switch val.Type() {
+		case value.TimeType:
+			return val, nil
+		case value.StringType:
+			t, err := time.Parse(time.RFC3339Nano, val.Value().(string))
+			if err != nil {
+				return nil, fmt.Errorf("can't parse date: err:%v", err)
+			}
+			return value.NewTimeValue(t), nil
+		}
+	case FieldTypeGeo:
+		if _, _, err := geoPoint(val); err != nil {
+			return nil, err
+		}
+		return val, nil
+	}
+	return nil, mismatch
+}
+
+// geoPoint returns the lat and lon of a geo value, a map with numeric lat and lon keys.
+func geoPoint(val value.Value) (lat, lon float64, err error) {
+	m, ok := val.(value.Map)
+	if !ok {
+		return 0, 0, fmt.Errorf("can't index a %v value in a geo field", val.Type())
+	}
+	coords := m.MapValue().Val()
+	get := func(key string) (float64, error) {
+		v, ok := coords[key]
+		if !ok {
+			return 0, fmt.Errorf("geo value is missing the %v", key)
+		}
+		switch v.Type() {
+		case value.NumberType:
+			return v.Value().(float64), nil
+		case value.IntType:
+			return float64(v.Value().(int64)), nil
+		}
+		return 0, fmt.Errorf("geo %v must be a number, not a %v", key, v.Type())
+	}
+	if lat, err = get("lat"); err != nil {
+		return 0, 0, err
+	}
+	if lon, err = get("lon"); err != nil {
+		return 0, 0, err
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, fmt.Errorf("geo point out of range: lat:%v lon:%v", lat, lon)
+	}
+	return lat, lon, nil
+}
+
+// DocumentError is the error for a doc of a batch which couldn't be indexed.
+type DocumentError struct {
+	ID  string
+	Err error
+}
+
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("failed to index doc %v: err:%v", e.ID, e.Err)
+}
+
+// IndexingErrors is returned by IndexDocuments when some of the docs of a batch couldn't be
+// indexed, the rest of the batch was indexed.
+type IndexingErrors []*DocumentError
+
+func (e IndexingErrors) Error() string {
+	return fmt.Sprintf("failed to index %d docs, first error: %v", len(e), e[0])
+}
+
+// writeMapping saves the mapping in the index's dir.
+func writeMapping(dir string, m *IndexMapping) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode mapping: err:%v", err)
+	}
+	path := filepath.Join(dir, mappingFileName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write mapping: err:%v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write mapping: err:%v", err)
+	}
+	return nil
+}
+
+// readMapping loads the mapping saved in the index's dir, it returns nil if there isn't one.
+func readMapping(dir string) (*IndexMapping, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, mappingFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read mapping: err:%v", err)
+	}
+	m := NewIndexMapping()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to decode mapping: err:%v", err)
+	}
+	return m, nil
+}
+
+var (
+	analyzersMu sync.RWMutex
+	analyzers   = map[string]Analyzer{
+		"keyword":    KeywordAnalyzer{},
+		"standard":   NewStandardAnalyzer(),
+		"english":    NewEnglishAnalyzer(),
+		"whitespace": NewCustomAnalyzer(WhitespaceTokenizer{}),
+		"simple":     NewCustomAnalyzer(LetterTokenizer{}, LowercaseFilter{}),
+	}
+)
+
+// RegisterAnalyzer makes an analyzer available to mappings by name.  Mappings only save the
+// analyzer's name, so custom analyzers must be registered before an index using them is opened.
+func RegisterAnalyzer(name string, analyzer Analyzer) {
+	analyzersMu.Lock()
+	defer analyzersMu.Unlock()
+	analyzers[name] = analyzer
+}
+
+// LookupAnalyzer returns the analyzer registered with the name.
+func LookupAnalyzer(name string) (Analyzer, bool) {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+	analyzer, ok := analyzers[name]
+	return analyzer, ok
+}
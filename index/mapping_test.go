@@ -0,0 +1,162 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestMappingTypeEnforcement(t *testing.T) {
+	mapping := NewIndexMapping().
+		AddField("name", NewKeywordFieldMapping()).
+		AddField("bio", NewTextFieldMapping("english")).
+		AddField("age", NewNumericFieldMapping()).
+		AddField("active", NewBoolFieldMapping()).
+		AddField("joined", NewDateFieldMapping()).
+		AddField("home", NewGeoFieldMapping())
+	mapping.Dynamic = DynamicStrict
+
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(mapping)
+
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{
+			"name":   NewStringVal("eric"),
+			"bio":    NewStringVal("The writer of the Index"),
+			"age":    value.NewIntValue(30),
+			"active": value.NewBoolValue(true),
+			"joined": NewStringVal("2019-01-02T03:04:05Z"),
+			"home":   value.NewMapValue(map[string]interface{}{"lat": 45.5, "lon": -122.6}),
+		}, now),
+		NewDocument("doc:2", map[string]value.Value{
+			"name": NewStringVal("kevin"),
+			"age":  NewStringVal("thirty"),
+		}, now),
+		NewDocument("doc:3", map[string]value.Value{
+			"name":  NewStringVal("angela"),
+			"email": NewStringVal("angela@example.com"),
+		}, now),
+		NewDocument("doc:4", map[string]value.Value{
+			"name": NewStringVal("jon"),
+			"age":  value.NewNumberValue(41.5),
+			"home": value.NewMapValue(map[string]interface{}{"lat": 95.0, "lon": 0.0}),
+		}, now),
+		NewDocument("doc:5", map[string]value.Value{
+			"name": value.NewStringsValue([]string{"john", "johnny"}),
+			"age":  value.NewNumberValue(41.5),
+		}, now),
+	}
+
+	err := segment.IndexDocuments(context.TODO(), docs)
+	docErrs, ok := err.(IndexingErrors)
+	if !ok {
+		t.Fatalf("expected IndexingErrors, got err:%v", err)
+	}
+	failed := []string{}
+	for _, docErr := range docErrs {
+		failed = append(failed, docErr.ID)
+	}
+	assert.Equal(t, []string{"doc:2", "doc:3", "doc:4"}, failed)
+	assert.Equal(t, 2, segment.NumDocs())
+
+	search := func(q Query) []string {
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return res.ExternalDocIDs
+	}
+	assert.Equal(t, []string{"doc:1"}, search(&RegExTermQuery{"bio", "writer"}))
+	assert.Equal(t, []string{}, search(&RegExTermQuery{"bio", "the"}))
+	assert.Equal(t, []string{"doc:5"}, search(&RegExTermQuery{"name", "johnny"}))
+	assert.Equal(t, []string{"doc:5"}, search(&NumericRangeQuery{"age", value.NewIntValue(40), nil, true, true}))
+	assert.Equal(t, []string{"doc:1"}, search(&BoolTermQuery{"active", true}))
+	assert.Equal(t, []string{"doc:1"}, search(&NumericRangeQuery{"joined", value.NewTimeValue(now.AddDate(-1, 0, 0)), nil, true, true}))
+	assert.Equal(t, []string{"doc:1"}, search(&NumericRangeQuery{"home.lat", value.NewNumberValue(45), value.NewNumberValue(46), true, true}))
+
+	{ // test case - fields that aren't indexed can't be searched
+		segment := NewSegment()
+		defer segment.Close()
+		fm := NewKeywordFieldMapping()
+		fm.Index = false
+		segment.SetMapping(NewIndexMapping().AddField("secret", fm))
+		doc := NewDocument("doc:1", map[string]value.Value{"secret": NewStringVal("xyz"), "name": NewStringVal("eric")}, now)
+		if err := segment.IndexDocuments(context.TODO(), []Document{doc}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		_, err := NewQueryBuilder(context.TODO(), segment).And(&RegExTermQuery{"secret", "xyz"}).Run()
+		assert.Equal(t, &FieldNotFoundError{Field: "secret"}, err)
+	}
+
+	{ // test case - unknown fields are ignored by the false policy
+		segment := NewSegment()
+		defer segment.Close()
+		segment.SetMapping(&IndexMapping{Fields: map[string]*FieldMapping{}, Dynamic: DynamicFalse})
+		doc := NewDocument("doc:1", map[string]value.Value{"name": NewStringVal("eric")}, now)
+		if err := segment.IndexDocuments(context.TODO(), []Document{doc}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, segment.NumDocs())
+		assert.Equal(t, 0, len(segment.Mapping().Fields))
+	}
+}
+
+func TestIndexMappingPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{ // test case - invalid mappings are rejected
+		mapping := NewIndexMapping().AddField("bio", NewTextFieldMapping("no-such-analyzer"))
+		if _, err := NewIndex(dir, &IndexOptions{Mapping: mapping}); err == nil {
+			t.Fatalf("expected an error for an unknown analyzer")
+		}
+	}
+
+	mapping := NewIndexMapping().AddField("bio", NewTextFieldMapping("english"))
+	idx, err := NewIndex(dir, &IndexOptions{Mapping: mapping, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	now := time.Now()
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{"bio": NewStringVal("Quick brown fox"), "age": value.NewIntValue(3)}, now),
+		NewDocument("doc:2", map[string]value.Value{"bio": value.NewIntValue(7)}, now),
+	}
+	err = idx.IndexDocuments(context.TODO(), docs)
+	if docErrs, ok := err.(IndexingErrors); !ok || len(docErrs) != 1 || docErrs[0].ID != "doc:2" {
+		t.Fatalf("expected an error for doc:2, got err:%v", err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	idx, err = NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	fields := []string{}
+	for field, fm := range idx.Mapping().Fields {
+		fields = append(fields, field+":"+string(fm.Type))
+	}
+	sort.Strings(fields)
+	assert.Equal(t, []string{"age:numeric", "bio:text"}, fields)
+
+	res, err := idx.Search(context.TODO(), &RegExTermQuery{"bio", "fox"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc:1"}, res.ExternalDocIDs)
+}
@@ -0,0 +1,211 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/couchbase/vellum"
+	"github.com/epsniff/sidonia/index/bkdtree"
+)
+
+// mergeSegments builds a new in-memory segment out of the live docs in segs.  liveDocs[i] is
+// the snapshot of segs[i]'s live docs to merge, docs deleted from it are dropped for good.
+func mergeSegments(segs []*Segment, liveDocs []*roaring.Bitmap) (*Segment, error) {
+	merged := NewSegment()
+
+	// docMaps[i][oldInternalID] is the doc's internal ID in the merged segment, or -1 if the doc
+	// was deleted.
+	docMaps := make([][]int64, len(segs))
+	for i, seg := range segs {
+		docMap := make([]int64, seg.docIdInc)
+		for did := range docMap {
+			docMap[did] = -1
+		}
+		docIter := liveDocs[i].Iterator()
+		for docIter.HasNext() {
+			did := docIter.Next()
+			externalID := seg.docIDInternalToExternal[did]
+			newID := merged.docIdInc
+			merged.docIdInc++
+			merged.docIDInternalToExternal[newID] = externalID
+			merged.docIDExternalToInternal[externalID] = newID
+			merged.liveDocs.Add(newID)
+			docMap[did] = int64(newID)
+		}
+		docMaps[i] = docMap
+	}
+
+	for i, seg := range segs {
+		for field, fieldID := range seg.fieldToFieldId {
+			if _, ok := seg.termDicBytes[fieldID]; !ok {
+				continue
+			}
+			termDictionary, err := seg.termDictionary(field)
+			if err != nil {
+				merged.Close()
+				return nil, err
+			}
+			if err := merged.mergeTermDic(field, termDictionary, seg, docMaps[i]); err != nil {
+				merged.Close()
+				return nil, err
+			}
+		}
+	}
+
+	for _, field := range merged.fields {
+		if err := merged.buildTermDic(field); err != nil {
+			merged.Close()
+			return nil, err
+		}
+	}
+
+	kinds := mergedNumericKinds(segs)
+	for i, seg := range segs {
+		if err := merged.mergeNumericFields(seg, docMaps[i], kinds); err != nil {
+			merged.Close()
+			return nil, err
+		}
+		merged.mergeBoolFields(seg, docMaps[i])
+		merged.mergeNorms(seg, docMaps[i])
+		merged.mergeDocValues(seg, docMaps[i], kinds)
+		if err := merged.mergeStored(seg, docMaps[i]); err != nil {
+			merged.Close()
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// mergedNumericKinds returns the type of the values of each numeric field of the merged segment.
+// It's the widest type the field has in any of the segments, so a field which holds ints in one
+// segment and numbers in another holds numbers whatever the order of the segments.
+func mergedNumericKinds(segs []*Segment) map[string]value.ValueType {
+	kinds := map[string]value.ValueType{}
+	add := func(field string, kind value.ValueType) {
+		if k, ok := kinds[field]; ok {
+			kind = widerKind(k, kind)
+		}
+		kinds[field] = kind
+	}
+	for _, seg := range segs {
+		for field, fid := range seg.fieldToFieldId {
+			if nf, ok := seg.numericFields[fid]; ok {
+				add(field, nf.kind)
+			}
+			if dv, ok := seg.docValuesByID(fid); ok {
+				if ndv, ok := dv.(*NumericDocValues); ok {
+					add(field, ndv.kind)
+				}
+			}
+		}
+	}
+	return kinds
+}
+
+// mergeNumericFields adds the points of the numeric fields from another segment, remapping their
+// doc IDs with docMap.  kinds is the type of each field in the merged segment.
+func (seg *Segment) mergeNumericFields(other *Segment, docMap []int64, kinds map[string]value.ValueType) error {
+	fieldNames := make(map[uint32]string, len(other.fieldToFieldId))
+	for field, fid := range other.fieldToFieldId {
+		fieldNames[fid] = field
+	}
+	for fid, nf := range other.numericFields {
+		field := fieldNames[fid]
+		mergedField, err := seg.numericField(seg.fieldID(field), kinds[field])
+		if err != nil {
+			return err
+		}
+		points, err := nf.allPoints()
+		if err != nil {
+			return fmt.Errorf("failed reading bkd tree for field %v: err:%v", field, err)
+		}
+		for _, point := range points {
+			newID := docMap[point.UserData]
+			if newID < 0 {
+				continue
+			}
+			encoded, ok := convertEncoded(nf.kind, mergedField.kind, point.Vals[0])
+			if !ok {
+				return fmt.Errorf("can't merge %v values into the %v field %v", nf.kind, mergedField.kind, field)
+			}
+			point = bkdtree.Point{Vals: []uint64{encoded}, UserData: uint64(newID)}
+			if err := mergedField.bkd.Insert(point); err != nil {
+				return fmt.Errorf("failed writing bkd tree for field %v: err:%v", field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTermDic adds the terms of a field from another segment, remapping the doc IDs in their
+// posting lists, positions and frequencies with docMap.
+func (seg *Segment) mergeTermDic(field string, termDictionary *vellum.FST, other *Segment, docMap []int64) error {
+	fieldID := seg.fieldID(field)
+	iField, ok := seg.fields[fieldID]
+	if !ok {
+		iField = NewIndexableField(field, fieldID)
+		seg.fields[fieldID] = iField
+	}
+
+	itr, err := termDictionary.Iterator(nil, nil)
+	for ; err == nil; err = itr.Next() {
+		term, oldTermID := itr.Current()
+		oldList, ok := other.postings[uint32(oldTermID)]
+		if !ok {
+			continue
+		}
+
+		oldPositions, _, posErr := other.termPositions(uint32(oldTermID))
+		if posErr != nil {
+			return posErr
+		}
+		oldFreqs, freqErr := other.termFreqs(uint32(oldTermID))
+		if freqErr != nil {
+			return freqErr
+		}
+
+		// the term's frequency is summed over the docs which are kept.
+		docs := roaring.New()
+		freq := uint32(0)
+		postingIter := oldList.Postings().Iterator()
+		for postingIter.HasNext() {
+			did := postingIter.Next()
+			if newID := docMap[did]; newID >= 0 {
+				docs.Add(uint32(newID))
+				freq += termFreq(oldPositions, oldFreqs, did)
+			}
+		}
+		if docs.IsEmpty() {
+			continue
+		}
+
+		termID, ok := iField.termToTermID[string(term)]
+		if !ok {
+			termID = seg.termIdInc
+			seg.termIdInc++
+			iField.termToTermID[string(term)] = termID
+			iField.Terms = append(iField.Terms, &Term{Term: string(term), TermID: termID})
+			seg.postings[termID] = TermPostingList{0, roaring.New()}
+		}
+		list := seg.postings[termID]
+		list.postings.Or(docs)
+		list.TermFrequency += freq
+		seg.postings[termID] = list
+
+		for did, positions := range oldPositions {
+			if newID := docMap[did]; newID >= 0 {
+				seg.addPosition(termID, uint32(newID), positions...)
+			}
+		}
+		for did, freq := range oldFreqs {
+			if newID := docMap[did]; newID >= 0 {
+				seg.addFreq(termID, uint32(newID), freq)
+			}
+		}
+	}
+	if err != nil && err != vellum.ErrIteratorDone {
+		return fmt.Errorf("failed iterating term dictionary for field %v: err:%v", field, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package index
+
+import (
+	"sort"
+)
+
+// SegmentInfo describes a segment of an Index to a MergePolicy.
+type SegmentInfo struct {
+	Name    string
+	NumDocs int
+}
+
+// MergePolicy decides which segments of an Index should be merged together.
+type MergePolicy interface {
+	// FindMerges returns groups of segments, each group is merged into one new segment.  The
+	// segments passed in are the ones that aren't already being merged.
+	FindMerges(segments []SegmentInfo) [][]SegmentInfo
+}
+
+// TieredMergePolicy groups segments into tiers of roughly equal size, and merges the smallest
+// segments of a tier once it holds SegmentsPerTier segments.  Like Lucene's policy of the same
+// name, this keeps the number of segments logarithmic to the number of docs in the index.  Fields
+// which aren't set, or can't work (a SegmentsPerTier or MaxMergeAtOnce below 2), use the values
+// of NewTieredMergePolicy.
+type TieredMergePolicy struct {
+	// SegmentsPerTier is how many segments a tier can hold before they're merged.
+	SegmentsPerTier int
+	// MaxMergeAtOnce limits how many segments are merged together.
+	MaxMergeAtOnce int
+	// FloorSegmentDocs, segments smaller than this are all treated as the same size.
+	FloorSegmentDocs int
+	// MaxMergedSegmentDocs segments aren't merged if the result would have more docs than this.
+	MaxMergedSegmentDocs int
+}
+
+func NewTieredMergePolicy() *TieredMergePolicy {
+	return &TieredMergePolicy{
+		SegmentsPerTier:      10,
+		MaxMergeAtOnce:       10,
+		FloorSegmentDocs:     1000,
+		MaxMergedSegmentDocs: 5000000,
+	}
+}
+
+func (p *TieredMergePolicy) FindMerges(segments []SegmentInfo) [][]SegmentInfo {
+	p = p.withDefaults()
+	tiers := map[int][]SegmentInfo{}
+	for _, info := range segments {
+		if info.NumDocs >= p.MaxMergedSegmentDocs {
+			continue
+		}
+		tier := p.tier(info.NumDocs)
+		tiers[tier] = append(tiers[tier], info)
+	}
+
+	tierNums := make([]int, 0, len(tiers))
+	for tier := range tiers {
+		tierNums = append(tierNums, tier)
+	}
+	sort.Ints(tierNums)
+
+	merges := [][]SegmentInfo{}
+	for _, tier := range tierNums {
+		infos := tiers[tier]
+		if len(infos) < p.SegmentsPerTier {
+			continue
+		}
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].NumDocs < infos[j].NumDocs })
+		for len(infos) >= p.SegmentsPerTier {
+			n := p.MaxMergeAtOnce
+			if n > len(infos) {
+				n = len(infos)
+			}
+			merge, docs := []SegmentInfo{}, 0
+			for _, info := range infos[:n] {
+				if docs+info.NumDocs > p.MaxMergedSegmentDocs {
+					break
+				}
+				merge = append(merge, info)
+				docs += info.NumDocs
+			}
+			if len(merge) < 2 {
+				break
+			}
+			merges = append(merges, merge)
+			infos = infos[len(merge):]
+		}
+	}
+	return merges
+}
+
+// withDefaults returns a copy of the policy with the defaults in place of the fields which aren't
+// usable.
+func (p *TieredMergePolicy) withDefaults() *TieredMergePolicy {
+	def := NewTieredMergePolicy()
+	cp := *p
+	if cp.SegmentsPerTier < 2 {
+		cp.SegmentsPerTier = def.SegmentsPerTier
+	}
+	if cp.MaxMergeAtOnce < 2 {
+		cp.MaxMergeAtOnce = def.MaxMergeAtOnce
+	}
+	if cp.FloorSegmentDocs <= 0 {
+		cp.FloorSegmentDocs = def.FloorSegmentDocs
+	}
+	if cp.MaxMergedSegmentDocs <= 0 {
+		cp.MaxMergedSegmentDocs = def.MaxMergedSegmentDocs
+	}
+	return &cp
+}
+
+// tier returns the tier a segment with numDocs belongs to, tier n holds the segments with fewer
+// than FloorSegmentDocs * SegmentsPerTier^(n+1) docs.
+func (p *TieredMergePolicy) tier(numDocs int) int {
+	tier := 0
+	for size := p.FloorSegmentDocs * p.SegmentsPerTier; numDocs >= size; size *= p.SegmentsPerTier {
+		tier++
+	}
+	return tier
+}
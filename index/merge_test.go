@@ -0,0 +1,45 @@
+package index
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/bmizerany/assert"
+)
+
+func TestMergeDroppedDocs(t *testing.T) {
+	fm := NewTextFieldMapping("standard")
+	fm.Positions = false
+	for _, mapping := range []*IndexMapping{
+		NewIndexMapping().AddField("body", NewTextFieldMapping("standard")),
+		NewIndexMapping().AddField("body", fm),
+	} {
+		docs := scoringTestDocs()
+		segment := NewSegment()
+		segment.SetMapping(mapping.Clone())
+		if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		// "fox fox fox" is dropped by the merge.
+		if _, err := segment.DeleteDocuments("doc:1", "doc:2"); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		merged, err := mergeSegments([]*Segment{segment}, []*roaring.Bitmap{segment.liveDocs})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+
+		// the merged segment has the postings of a segment which only had the kept docs.
+		kept := NewSegment()
+		kept.SetMapping(mapping.Clone())
+		if err := kept.IndexDocuments(context.TODO(), append(docs[:1:1], docs[3:]...)); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, segmentPostings(kept), segmentPostings(merged))
+
+		segment.Close()
+		merged.Close()
+		kept.Close()
+	}
+}
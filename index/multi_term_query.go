@@ -0,0 +1,240 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/couchbase/vellum"
+	"github.com/couchbase/vellum/regexp"
+)
+
+// DefaultMaxExpansions is the number of terms a PrefixQuery, WildcardQuery, TermRangeQuery or
+// FuzzyQuery can match in a segment when the query's MaxExpansions isn't set.
+const DefaultMaxExpansions = 1024
+
+// TooManyTermsError is returned when a query matches more terms than its MaxExpansions.
+type TooManyTermsError struct {
+	Field string
+	Max   int
+}
+
+func (e *TooManyTermsError) Error() string {
+	return fmt.Sprintf("query on field %v matched more than %d terms", e.Field, e.Max)
+}
+
+// multiTermQuery is a query which matches the docs of every term it expands to.
+type multiTermQuery interface {
+	Query
+	field() string
+	// expand calls fn with each of the segment's terms that the query matches.
+	expand(ctx context.Context, seg *Segment, fn func(term []byte, termID uint32)) error
+}
+
+// PrefixQuery matches docs with a term starting with Prefix.
+type PrefixQuery struct {
+	Field         string
+	Prefix        string
+	MaxExpansions int
+}
+
+func (q *PrefixQuery) Type() QType {
+	return TypePrefixQuery
+}
+
+func (q *PrefixQuery) field() string { return q.Field }
+
+func (q *PrefixQuery) expand(ctx context.Context, seg *Segment, fn func(term []byte, termID uint32)) error {
+	return seg.expandTerms(ctx, q.Field, nil, []byte(q.Prefix), prefixEnd(q.Prefix), q.MaxExpansions, fn)
+}
+
+// WildcardQuery matches docs with a term matching Pattern, where * matches any number of
+// characters and ? matches one.  A \\ escapes the next character.
+type WildcardQuery struct {
+	Field         string
+	Pattern       string
+	MaxExpansions int
+}
+
+func (q *WildcardQuery) Type() QType {
+	return TypeWildcardQuery
+}
+
+func (q *WildcardQuery) field() string { return q.Field }
+
+func (q *WildcardQuery) expand(ctx context.Context, seg *Segment, fn func(term []byte, termID uint32)) error {
+	expr, prefix := wildcardToRegexp(q.Pattern)
+	r, err := regexp.New(expr)
+	if err != nil {
+		return fmt.Errorf("bad wildcard pattern %q: err:%v", q.Pattern, err)
+	}
+	return seg.expandTerms(ctx, q.Field, r, []byte(prefix), prefixEnd(prefix), q.MaxExpansions, fn)
+}
+
+// TermRangeQuery matches docs with a term between Low and High, in byte order.  An empty Low or
+// High leaves that side of the range open.
+type TermRangeQuery struct {
+	Field         string
+	Low           string
+	High          string
+	IncludeLow    bool
+	IncludeHigh   bool
+	MaxExpansions int
+}
+
+func (q *TermRangeQuery) Type() QType {
+	return TypeTermRangeQuery
+}
+
+func (q *TermRangeQuery) field() string { return q.Field }
+
+func (q *TermRangeQuery) expand(ctx context.Context, seg *Segment, fn func(term []byte, termID uint32)) error {
+	// Low + "\x00" is the first key after Low, so it turns the bounds into the inclusive start
+	// and exclusive end the FST iterator takes.
+	var start, end []byte
+	if q.Low != "" {
+		start = []byte(q.Low)
+		if !q.IncludeLow {
+			start = append(start, 0)
+		}
+	}
+	if q.High != "" {
+		end = []byte(q.High)
+		if q.IncludeHigh {
+			end = append(end, 0)
+		}
+	}
+	return seg.expandTerms(ctx, q.Field, nil, start, end, q.MaxExpansions, fn)
+}
+
+// QueryPrefix returns the docs with a term starting with the query's prefix.
+func (seg *Segment) QueryPrefix(ctx context.Context, query *PrefixQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.prefixQuery(ctx, query)
+}
+
+func (seg *Segment) prefixQuery(ctx context.Context, query *PrefixQuery) (*SearchResults, error) {
+	return seg.queryMultiTerm(ctx, query)
+}
+
+// QueryWildcard returns the docs with a term matching the query's pattern.
+func (seg *Segment) QueryWildcard(ctx context.Context, query *WildcardQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.wildcardQuery(ctx, query)
+}
+
+func (seg *Segment) wildcardQuery(ctx context.Context, query *WildcardQuery) (*SearchResults, error) {
+	return seg.queryMultiTerm(ctx, query)
+}
+
+// QueryTermRange returns the docs with a term inside of the query's range.
+func (seg *Segment) QueryTermRange(ctx context.Context, query *TermRangeQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.termRangeQuery(ctx, query)
+}
+
+func (seg *Segment) termRangeQuery(ctx context.Context, query *TermRangeQuery) (*SearchResults, error) {
+	return seg.queryMultiTerm(ctx, query)
+}
+
+func (seg *Segment) queryMultiTerm(ctx context.Context, query multiTermQuery) (*SearchResults, error) {
+	postings := []*roaring.Bitmap{}
+	err := query.expand(ctx, seg, func(term []byte, termID uint32) {
+		postings = append(postings, seg.postings[termID].Postings())
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &SearchResults{internalDocIds: roaring.FastOr(postings...)}
+	res.internalDocIds.And(seg.liveDocs)
+	return res, nil
+}
+
+// expandTerms calls fn with each term of the field between start (inclusive) and end
+// (exclusive) that aut matches, a nil aut matches every term.  It fails with a
+// TooManyTermsError if more than maxExpansions terms match, and a QueryCancelledError if ctx is
+// done before it's through the terms.
+func (seg *Segment) expandTerms(ctx context.Context, field string, aut vellum.Automaton, start, end []byte, maxExpansions int, fn func(term []byte, termID uint32)) error {
+	termDictionary, err := seg.termDictionary(field)
+	if err != nil {
+		return err
+	}
+	if maxExpansions <= 0 {
+		maxExpansions = DefaultMaxExpansions
+	}
+
+	var itr *vellum.FSTIterator
+	if aut == nil {
+		itr, err = termDictionary.Iterator(start, end)
+	} else {
+		itr, err = termDictionary.Search(aut, start, end)
+	}
+	for expansions := 0; err == nil; err = itr.Next() {
+		if expansions++; expansions > maxExpansions {
+			return &TooManyTermsError{field, maxExpansions}
+		} else if expansions%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return err
+			}
+		}
+		term, termID := itr.Current()
+		fn(term, uint32(termID))
+	}
+	if err != vellum.ErrIteratorDone {
+		return fmt.Errorf("failed iterating term dictionary for field %v: err:%v", field, err)
+	}
+	return nil
+}
+
+// prefixEnd returns the first key after all of the keys starting with prefix, or nil if there
+// isn't one.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// wildcardToRegexp converts a wildcard pattern to a regexp, and returns the literal prefix
+// before the pattern's first wildcard.
+func wildcardToRegexp(pattern string) (expr string, prefix string) {
+	var re, literal strings.Builder
+	inPrefix, escaped := true, false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '*':
+			inPrefix = false
+			re.WriteString(".*")
+			continue
+		case r == '?':
+			inPrefix = false
+			re.WriteString(".")
+			continue
+		}
+		if inPrefix {
+			literal.WriteRune(r)
+		}
+		re.WriteString(regexpQuote(r))
+	}
+	return re.String(), literal.String()
+}
+
+func regexpQuote(r rune) string {
+	if strings.ContainsRune(`\.+*?()|[]{}^$`, r) {
+		return `\` + string(r)
+	}
+	return string(r)
+}
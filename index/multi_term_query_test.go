@@ -0,0 +1,92 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("ac"), prefixEnd("ab"))
+	assert.Equal(t, []byte("b"), prefixEnd("a\xff"))
+	assert.Equal(t, []byte(nil), prefixEnd("\xff\xff"))
+	assert.Equal(t, []byte(nil), prefixEnd(""))
+}
+
+func TestWildcardToRegexp(t *testing.T) {
+	expr, prefix := wildcardToRegexp("ban*a?")
+	assert.Equal(t, "ban.*a.", expr)
+	assert.Equal(t, "ban", prefix)
+
+	expr, prefix = wildcardToRegexp(`a\*b.c*`)
+	assert.Equal(t, `a\*b\.c.*`, expr)
+	assert.Equal(t, "a*b.c", prefix)
+}
+
+func TestMultiTermQueries(t *testing.T) {
+	fruits := []string{"apple", "apricot", "banana", "band", "bandana", "can", "cantaloupe", "a*b", "a.b"}
+	now := time.Now()
+	docs := []Document{}
+	for i, fruit := range fruits {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"fruit": NewStringVal(fruit)}, now))
+	}
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(q Query) []string {
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		matched := []string{}
+		for _, id := range res.ExternalDocIDs {
+			var i int
+			fmt.Sscanf(id, "doc:%d", &i)
+			matched = append(matched, fruits[i])
+		}
+		sort.Strings(matched)
+		return matched
+	}
+
+	{ // test case - prefix
+		assert.Equal(t, []string{"a*b", "a.b", "apple", "apricot"}, search(&PrefixQuery{Field: "fruit", Prefix: "a"}))
+		assert.Equal(t, []string{"band", "bandana"}, search(&PrefixQuery{Field: "fruit", Prefix: "band"}))
+		assert.Equal(t, []string{}, search(&PrefixQuery{Field: "fruit", Prefix: "z"}))
+		assert.Equal(t, len(fruits), len(search(&PrefixQuery{Field: "fruit"})))
+	}
+
+	{ // test case - wildcard
+		assert.Equal(t, []string{"banana", "bandana"}, search(&WildcardQuery{Field: "fruit", Pattern: "ban*a"}))
+		assert.Equal(t, []string{"band"}, search(&WildcardQuery{Field: "fruit", Pattern: "?an?"}))
+		assert.Equal(t, []string{"apricot", "cantaloupe"}, search(&WildcardQuery{Field: "fruit", Pattern: "*o*"}))
+		assert.Equal(t, []string{"a*b"}, search(&WildcardQuery{Field: "fruit", Pattern: `a\*b`}))
+		assert.Equal(t, []string{"a.b"}, search(&WildcardQuery{Field: "fruit", Pattern: "a.b"}))
+	}
+
+	{ // test case - term range
+		assert.Equal(t, []string{"banana", "band", "bandana"}, search(&TermRangeQuery{Field: "fruit", Low: "b", High: "c"}))
+		assert.Equal(t, []string{"band", "bandana", "can"}, search(&TermRangeQuery{Field: "fruit", Low: "banana", High: "can", IncludeHigh: true}))
+		assert.Equal(t, []string{"banana", "band", "bandana"}, search(&TermRangeQuery{Field: "fruit", Low: "banana", High: "can", IncludeLow: true}))
+		assert.Equal(t, []string{"can", "cantaloupe"}, search(&TermRangeQuery{Field: "fruit", Low: "c"}))
+		assert.Equal(t, []string{"a*b", "a.b", "apple"}, search(&TermRangeQuery{Field: "fruit", High: "apple", IncludeHigh: true}))
+	}
+
+	{ // test case - expansion caps
+		_, err := segment.QueryPrefix(context.TODO(), &PrefixQuery{Field: "fruit", Prefix: "a", MaxExpansions: 3})
+		assert.Equal(t, &TooManyTermsError{"fruit", 3}, err)
+		_, err = segment.QueryWildcard(context.TODO(), &WildcardQuery{Field: "fruit", Pattern: "*", MaxExpansions: 8})
+		assert.Equal(t, &TooManyTermsError{"fruit", 8}, err)
+		_, err = segment.QueryTermRange(context.TODO(), &TermRangeQuery{Field: "fruit", Low: "b", MaxExpansions: 5})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package index
+
+// Norms are the lengths of the string fields of each doc, the number of terms indexed for the
+// field in the doc.  Scorers use them so a term in a short field counts for more than the same
+// term in a long one.
+
+// fieldStats are the number of docs with a value for a field, and the sum of their lengths.
+type fieldStats struct {
+	docCount  int64
+	sumLength int64
+}
+
+// addNorm adds length terms to the length of the doc's field.
+func (seg *Segment) addNorm(fieldID, inDocID, length uint32) {
+	if length == 0 {
+		return
+	}
+	norms := seg.norms[fieldID]
+	for uint32(len(norms)) <= inDocID {
+		norms = append(norms, 0)
+	}
+	fs, ok := seg.normStats[fieldID]
+	if !ok {
+		fs = &fieldStats{}
+		seg.normStats[fieldID] = fs
+	}
+	if norms[inDocID] == 0 {
+		fs.docCount++
+	}
+	fs.sumLength += int64(length)
+	norms[inDocID] += length
+	seg.norms[fieldID] = norms
+}
+
+// mergeNorms adds the norms from another segment, remapping their doc IDs with docMap.
+func (seg *Segment) mergeNorms(other *Segment, docMap []int64) {
+	fieldNames := make(map[uint32]string, len(other.fieldToFieldId))
+	for field, fid := range other.fieldToFieldId {
+		fieldNames[fid] = field
+	}
+	for fid, norms := range other.norms {
+		fieldID := seg.fieldID(fieldNames[fid])
+		for did, length := range norms {
+			if newID := docMap[did]; newID >= 0 {
+				seg.addNorm(fieldID, uint32(newID), length)
+			}
+		}
+	}
+}
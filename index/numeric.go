@@ -0,0 +1,441 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/gou"
+	"github.com/araddon/qlbridge/value"
+	"github.com/epsniff/sidonia/index/bkdtree"
+)
+
+// Numeric fields are indexed as one dimensional points in a bkd tree per field, with the
+// internal doc ID as the point's UserData.  Values are encoded into uint64s which sort in the
+// same order as the values, so a range of values is a window query on the tree.
+const (
+	bkdT0mCap       = 1000
+	bkdLeafCap      = 50
+	bkdIntraCap     = 4
+	bkdNumDims      = 1
+	bkdBytesPerDim  = 8
+	bkdPrefixFormat = "num_%d" // bkd file prefix for a field ID
+)
+
+// numericField is the bkd tree of a numeric field, kind is the value.ValueType of the field's
+// values, value.IntType, value.NumberType or value.TimeType.
+type numericField struct {
+	kind value.ValueType
+	bkd  *bkdtree.BkdTree
+}
+
+// encodeInt64 flips the sign bit, so negative numbers sort before positive numbers.
+func encodeInt64(v int64) uint64 {
+	return uint64(v) ^ (1 << 63)
+}
+
+func decodeInt64(v uint64) int64 {
+	return int64(v ^ (1 << 63))
+}
+
+// encodeFloat64 flips the sign bit of positive numbers, and all bits of negative numbers, which
+// makes the IEEE 754 bits sort in the same order as the numbers.
+func encodeFloat64(f float64) uint64 {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | (1 << 63)
+}
+
+func decodeFloat64(v uint64) float64 {
+	if v&(1<<63) != 0 {
+		return math.Float64frombits(v &^ (1 << 63))
+	}
+	return math.Float64frombits(^v)
+}
+
+func encodeTime(t time.Time) uint64 {
+	return encodeInt64(t.UnixNano())
+}
+
+// encodeNumeric encodes val for a numeric field of the given kind.  Ints are accepted for
+// number fields, every other mismatch is an error.
+func encodeNumeric(kind value.ValueType, val value.Value) (uint64, error) {
+	switch {
+	case kind == value.IntType && val.Type() == value.IntType:
+		return encodeInt64(val.Value().(int64)), nil
+	case kind == value.NumberType && val.Type() == value.NumberType:
+		return encodeFloat64(val.Value().(float64)), nil
+	case kind == value.NumberType && val.Type() == value.IntType:
+		return encodeFloat64(float64(val.Value().(int64))), nil
+	case kind == value.TimeType && val.Type() == value.TimeType:
+		return encodeTime(val.Value().(time.Time)), nil
+	}
+	return 0, fmt.Errorf("can't use a value of type %v for a %v field", val.Type(), kind)
+}
+
+// decodeNumeric is the inverse of encodeNumeric.
+func decodeNumeric(kind value.ValueType, v uint64) value.Value {
+	switch kind {
+	case value.IntType:
+		return value.NewIntValue(decodeInt64(v))
+	case value.TimeType:
+		return value.NewTimeValue(time.Unix(0, decodeInt64(v)))
+	}
+	return value.NewNumberValue(decodeFloat64(v))
+}
+
+// convertEncoded re-encodes an encoded value of a from field for a to field, when merging
+// segments that disagree on the type of a field.
+func convertEncoded(from, to value.ValueType, v uint64) (uint64, bool) {
+	switch {
+	case from == to:
+		return v, true
+	case from == value.IntType && to == value.NumberType:
+		return encodeFloat64(float64(decodeInt64(v))), true
+	}
+	return 0, false
+}
+
+// numericField returns the bkd tree for the field, creating it if this is the field's first
+// value.  The trees of in-memory segments live in a tmp dir, which is removed by Close.
+func (seg *Segment) numericField(fieldID uint32, kind value.ValueType) (*numericField, error) {
+	if nf, ok := seg.numericFields[fieldID]; ok {
+		return nf, nil
+	}
+	if seg.tmpDir == "" {
+		dir, err := ioutil.TempDir("", "sidonia-segment")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tmp dir for numeric fields: err:%v", err)
+		}
+		seg.tmpDir = dir
+	}
+	bkd, err := newFieldBkdTree(seg.tmpDir, fieldID)
+	if err != nil {
+		return nil, err
+	}
+	nf := &numericField{kind: kind, bkd: bkd}
+	seg.numericFields[fieldID] = nf
+	return nf, nil
+}
+
+func newFieldBkdTree(dir string, fieldID uint32) (*bkdtree.BkdTree, error) {
+	prefix := fmt.Sprintf(bkdPrefixFormat, fieldID)
+	bkd, err := bkdtree.NewBkdTree(bkdT0mCap, bkdLeafCap, bkdIntraCap, bkdNumDims, bkdBytesPerDim, dir, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bkd tree: err:%v", err)
+	}
+	return bkd, nil
+}
+
+// processNumericTerm indexes value.Values of type int, number or time.
+func (seg *Segment) processNumericTerm(inDocID uint32, field string, rawTerm value.Value) error {
+	fieldID := seg.fieldID(field)
+	nf, err := seg.numericField(fieldID, rawTerm.Type())
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeNumeric(nf.kind, rawTerm)
+	if err != nil {
+		return err
+	}
+	return nf.bkd.Insert(bkdtree.Point{Vals: []uint64{encoded}, UserData: uint64(inDocID)})
+}
+
+// checkNumericValues checks the numeric values of a doc against the type of their field's
+// values, so a doc with a value which can't be indexed is rejected before any of it is.  An int
+// field which gets a number is promoted to a number field.  kinds holds the types of the fields
+// seen earlier in the batch, the doc's are added to it.
+func (seg *Segment) checkNumericValues(kinds map[string]value.ValueType, vals []mappedValue) error {
+	docKinds := map[string]value.ValueType{}
+	for _, mv := range vals {
+		if mv.mapping.Type != FieldTypeNumeric && mv.mapping.Type != FieldTypeDate {
+			continue
+		}
+		kind, ok := docKinds[mv.field]
+		if !ok {
+			kind, ok = kinds[mv.field]
+		}
+		if !ok {
+			kind, ok = seg.numericKind(mv.field)
+		}
+		if !ok {
+			kind = mv.val.Type()
+		}
+		kind = widerKind(kind, mv.val.Type())
+		if _, err := encodeNumeric(kind, mv.val); err != nil {
+			return fmt.Errorf("field %v: err:%v", mv.field, err)
+		}
+		docKinds[mv.field] = kind
+	}
+	for field, kind := range docKinds {
+		kinds[field] = kind
+	}
+	return nil
+}
+
+// widerKind returns the type which can hold the values of both types, a number for an int and
+// a number.  Other types are only compatible with themselves, so a is returned for them.
+func widerKind(a, b value.ValueType) value.ValueType {
+	if (a == value.IntType && b == value.NumberType) || (a == value.NumberType && b == value.IntType) {
+		return value.NumberType
+	}
+	return a
+}
+
+// prepareNumericFields gives the numeric fields of a batch the types in kinds, before any of the
+// batch's values are added to them.  New fields are created with their type, and int fields
+// which the batch adds numbers to are promoted to number fields.
+func (seg *Segment) prepareNumericFields(kinds map[string]value.ValueType) error {
+	for field, kind := range kinds {
+		fm, ok := seg.mapping.Fields[field]
+		if !ok {
+			continue
+		}
+		fieldID := seg.fieldID(field)
+		if fm.Index {
+			nf, err := seg.numericField(fieldID, kind)
+			if err != nil {
+				return err
+			}
+			if nf.kind != kind {
+				if err := seg.promoteNumericField(fieldID, nf, kind); err != nil {
+					return fmt.Errorf("failed to promote field %v: err:%v", field, err)
+				}
+			}
+		}
+		if typ, ok := docValuesType(fm.Type); ok && fm.DocValues {
+			b, ok := seg.docValuesBuilders[fieldID]
+			if !ok {
+				seg.docValuesBuilders[fieldID] = newDocValuesBuilder(typ, kind)
+			} else if b.typ == DocValuesNumeric && b.kind != kind {
+				b.promote(kind)
+				delete(seg.docValues, fieldID)
+			}
+		}
+	}
+	return nil
+}
+
+// promoteNumericField rebuilds the field's bkd tree with its points converted to kind.  The new
+// tree replaces the old one once it's built, so a failure leaves the field as it was.
+func (seg *Segment) promoteNumericField(fieldID uint32, nf *numericField, kind value.ValueType) error {
+	points, err := nf.allPoints()
+	if err != nil {
+		return err
+	}
+	// the new tree gets its own dir, its files would have the same names as the old tree's.
+	dir, err := ioutil.TempDir(seg.tmpDir, "promoted")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp dir for numeric field: err:%v", err)
+	}
+	bkd, err := newFieldBkdTree(dir, fieldID)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	for _, point := range points {
+		encoded, ok := convertEncoded(nf.kind, kind, point.Vals[0])
+		if !ok {
+			bkd.Close()
+			os.RemoveAll(dir)
+			return fmt.Errorf("can't convert %v values to %v", nf.kind, kind)
+		}
+		if err := bkd.Insert(bkdtree.Point{Vals: []uint64{encoded}, UserData: point.UserData}); err != nil {
+			bkd.Close()
+			os.RemoveAll(dir)
+			return fmt.Errorf("failed writing bkd tree: err:%v", err)
+		}
+	}
+	if err := nf.bkd.Destroy(); err != nil {
+		gou.Warnf("failed to remove the bkd tree of promoted field-id %v: err:%v", fieldID, err)
+	}
+	seg.numericFields[fieldID] = &numericField{kind: kind, bkd: bkd}
+	return nil
+}
+
+// numericKind returns the type of the values of the field's bkd tree or doc values.
+func (seg *Segment) numericKind(field string) (value.ValueType, bool) {
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return value.UnknownType, false
+	}
+	if nf, ok := seg.numericFields[fieldID]; ok {
+		return nf.kind, true
+	}
+	if b, ok := seg.docValuesBuilders[fieldID]; ok && b.typ == DocValuesNumeric {
+		return b.kind, true
+	}
+	return value.UnknownType, false
+}
+
+// allPoints returns every point in the bkd tree.
+func (nf *numericField) allPoints() ([]bkdtree.Point, error) {
+	visitor := &bkdtree.IntersectCollector{
+		LowPoint:  bkdtree.Point{Vals: []uint64{0}},
+		HighPoint: bkdtree.Point{Vals: []uint64{math.MaxUint64}},
+	}
+	if err := nf.bkd.Intersect(visitor); err != nil {
+		return nil, err
+	}
+	return visitor.Points, nil
+}
+
+// NumericRangeQuery matches docs with a numeric value between Min and Max.  A nil Min or Max
+// leaves that side of the range open.  The bounds can be value.IntValue, value.NumberValue or
+// value.TimeValue, and are converted to the type of the field.
+type NumericRangeQuery struct {
+	Field        string
+	Min          value.Value
+	Max          value.Value
+	InclusiveMin bool
+	InclusiveMax bool
+}
+
+func (q *NumericRangeQuery) Type() QType {
+	return TypeNumericRangeQuery
+}
+
+// QueryNumericRange returns the docs with a value for the numeric field inside of the query's range.
+func (seg *Segment) QueryNumericRange(ctx context.Context, query *NumericRangeQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.numericRangeQuery(ctx, query)
+}
+
+func (seg *Segment) numericRangeQuery(ctx context.Context, query *NumericRangeQuery) (*SearchResults, error) {
+	fieldID, ok := seg.fieldToFieldId[query.Field]
+	if !ok {
+		return nil, &FieldNotFoundError{Field: query.Field}
+	}
+	nf, ok := seg.numericFields[fieldID]
+	if !ok {
+		return nil, &FieldNotFoundError{Field: query.Field, Type: "numeric"}
+	}
+
+	res := &SearchResults{internalDocIds: roaring.New()}
+	low, high, ok, err := numericRange(nf.kind, query)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return res, nil
+	}
+
+	visitor := &bitmapVisitor{
+		ctx:  ctx,
+		low:  bkdtree.Point{Vals: []uint64{low}},
+		high: bkdtree.Point{Vals: []uint64{high}},
+		docs: res.internalDocIds,
+	}
+	if err := nf.bkd.Intersect(visitor); err != nil {
+		return nil, fmt.Errorf("failed to query bkd tree for field %v: err:%v", query.Field, err)
+	} else if visitor.err != nil {
+		return nil, visitor.err
+	}
+	res.internalDocIds.And(seg.liveDocs)
+	return res, nil
+}
+
+// numericRange converts the query's bounds into an inclusive range of encoded values.  ok is
+// false if the range is empty.
+func numericRange(kind value.ValueType, query *NumericRangeQuery) (low, high uint64, ok bool, err error) {
+	low, high = 0, math.MaxUint64
+	if query.Min != nil {
+		if low, err = encodeBound(kind, query.Min, true); err != nil {
+			return 0, 0, false, err
+		}
+		if !query.InclusiveMin && isExactBound(kind, query.Min) {
+			if low == math.MaxUint64 {
+				return 0, 0, false, nil
+			}
+			low++
+		}
+	}
+	if query.Max != nil {
+		if high, err = encodeBound(kind, query.Max, false); err != nil {
+			return 0, 0, false, err
+		}
+		if !query.InclusiveMax && isExactBound(kind, query.Max) {
+			if high == 0 {
+				return 0, 0, false, nil
+			}
+			high--
+		}
+	}
+	return low, high, low <= high, nil
+}
+
+// encodeBound encodes a bound of a range query for a field of the given kind.  Fractional bounds
+// on int fields are rounded towards the inside of the range, up for the min and down for the max.
+func encodeBound(kind value.ValueType, bound value.Value, isMin bool) (uint64, error) {
+	if kind == value.IntType && bound.Type() == value.NumberType {
+		f := bound.Value().(float64)
+		if isMin {
+			f = math.Ceil(f)
+		} else {
+			f = math.Floor(f)
+		}
+		switch {
+		case f >= math.MaxInt64:
+			return encodeInt64(math.MaxInt64), nil
+		case f <= math.MinInt64:
+			return encodeInt64(math.MinInt64), nil
+		}
+		return encodeInt64(int64(f)), nil
+	}
+	return encodeNumeric(kind, bound)
+}
+
+// isExactBound is false when encodeBound had to round the bound, the rounded value is then
+// always inside of the range.
+func isExactBound(kind value.ValueType, bound value.Value) bool {
+	if kind == value.IntType && bound.Type() == value.NumberType {
+		f := bound.Value().(float64)
+		return f == math.Trunc(f)
+	}
+	return true
+}
+
+// bitmapVisitor is a bkdtree.IntersectVisitor which adds the doc IDs of the points to a bitmap.
+// The tree can't stop an intersect part way through, so once ctx is done the visitor sets err,
+// ignores the points it's still given, and returns an empty window so the tree skips the nodes
+// it hasn't visited yet.
+type bitmapVisitor struct {
+	ctx    context.Context
+	low    bkdtree.Point
+	high   bkdtree.Point
+	docs   *roaring.Bitmap
+	visits int
+	err    error
+}
+
+func (v *bitmapVisitor) GetLowPoint() bkdtree.Point {
+	if v.err != nil {
+		return bkdtree.Point{Vals: []uint64{math.MaxUint64}}
+	}
+	return v.low
+}
+
+func (v *bitmapVisitor) GetHighPoint() bkdtree.Point {
+	if v.err != nil {
+		return bkdtree.Point{Vals: []uint64{0}}
+	}
+	return v.high
+}
+
+func (v *bitmapVisitor) VisitPoint(point bkdtree.Point) {
+	if v.err != nil {
+		return
+	}
+	if v.visits++; v.visits%cancelCheckInterval == 0 {
+		if v.err = queryCancelled(v.ctx); v.err != nil {
+			return
+		}
+	}
+	v.docs.Add(uint32(point.UserData))
+}
@@ -0,0 +1,248 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestNumericEncodingSortOrder(t *testing.T) {
+	ints := []int64{math.MinInt64, -1000, -1, 0, 1, 42, math.MaxInt64}
+	for i := 1; i < len(ints); i++ {
+		assert.Equalf(t, true, encodeInt64(ints[i-1]) < encodeInt64(ints[i]), "%v < %v", ints[i-1], ints[i])
+		assert.Equal(t, ints[i], decodeInt64(encodeInt64(ints[i])))
+	}
+
+	floats := []float64{math.Inf(-1), -1e300, -2.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 0.5, 3, 1e300, math.Inf(1)}
+	for i := 1; i < len(floats); i++ {
+		assert.Equalf(t, true, encodeFloat64(floats[i-1]) < encodeFloat64(floats[i]), "%v < %v", floats[i-1], floats[i])
+		assert.Equal(t, floats[i], decodeFloat64(encodeFloat64(floats[i])))
+	}
+}
+
+func numericTestDocs(now time.Time) []Document {
+	docs := []Document{}
+	for i := 0; i < 2500; i++ {
+		fieldvals := map[string]value.Value{
+			"age":     value.NewIntValue(int64(i%100 - 50)),
+			"score":   value.NewNumberValue(float64(i) / 4),
+			"created": value.NewTimeValue(now.Add(time.Duration(i) * time.Minute)),
+		}
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%04d", i), fieldvals, now))
+	}
+	return docs
+}
+
+func TestNumericRangeQuery(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), numericTestDocs(now)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	count := func(q *NumericRangeQuery) int {
+		res, err := segment.QueryNumericRange(context.TODO(), q)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return int(res.internalDocIds.GetCardinality())
+	}
+
+	// ages go from -50 to 49, 25 docs each.
+	assert.Equal(t, 2500, count(&NumericRangeQuery{Field: "age"}))
+	assert.Equal(t, 11*25, count(&NumericRangeQuery{"age", value.NewIntValue(-5), value.NewIntValue(5), true, true}))
+	assert.Equal(t, 9*25, count(&NumericRangeQuery{"age", value.NewIntValue(-5), value.NewIntValue(5), false, false}))
+	assert.Equal(t, 50*25, count(&NumericRangeQuery{"age", nil, value.NewIntValue(0), false, false}))
+	assert.Equal(t, 2*25, count(&NumericRangeQuery{"age", value.NewNumberValue(-0.5), value.NewNumberValue(1.5), false, false}))
+	assert.Equal(t, 0, count(&NumericRangeQuery{"age", value.NewIntValue(5), value.NewIntValue(5), false, true}))
+
+	// scores go from 0 to 624.75 in steps of 0.25
+	assert.Equal(t, 5, count(&NumericRangeQuery{"score", value.NewNumberValue(1), value.NewNumberValue(2), true, true}))
+	assert.Equal(t, 4, count(&NumericRangeQuery{"score", value.NewIntValue(1), value.NewIntValue(2), true, false}))
+
+	assert.Equal(t, 61, count(&NumericRangeQuery{"created", value.NewTimeValue(now), value.NewTimeValue(now.Add(time.Hour)), true, true}))
+
+	{ // test case - numeric queries plug into the query builder
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&NumericRangeQuery{"age", value.NewIntValue(49), nil, true, false},
+				&NumericRangeQuery{"score", nil, value.NewNumberValue(100), false, false}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:0099", "doc:0199", "doc:0299", "doc:0399"}, res.ExternalDocIDs)
+	}
+
+	{ // test case - bounds of the wrong type are an error
+		_, err := segment.QueryNumericRange(context.TODO(), &NumericRangeQuery{"created", value.NewIntValue(1), nil, true, true})
+		if err == nil {
+			t.Fatalf("expected an error for an int bound on a time field")
+		}
+	}
+}
+
+func TestNumericFieldPromotion(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, workers := range []int{1, 4} {
+		segment := NewSegment()
+		segment.SetWorkers(workers)
+		kind := func(field string) value.ValueType {
+			return segment.numericFields[segment.fieldToFieldId[field]].kind
+		}
+		if err := segment.IndexDocuments(context.TODO(), numericTestDocs(now)[:1000]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, value.IntType, kind("age"))
+
+		{ // test case - a number promotes an int field, in a later batch or in the same one
+			batch := []Document{
+				NewDocument("doc:float", map[string]value.Value{"age": value.NewNumberValue(41.5)}, now),
+				NewDocument("doc:price1", map[string]value.Value{"price": value.NewIntValue(5)}, now),
+				NewDocument("doc:price2", map[string]value.Value{"price": value.NewNumberValue(5.5)}, now),
+			}
+			if err := segment.IndexDocuments(context.TODO(), batch); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, 1003, segment.NumDocs())
+			assert.Equal(t, value.NumberType, kind("age"))
+			assert.Equal(t, value.NumberType, kind("price"))
+		}
+		{ // test case - the promoted field keeps its old values
+			res, err := segment.QueryNumericRange(context.TODO(), &NumericRangeQuery{"age", value.NewIntValue(41), value.NewIntValue(42), true, false})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, uint64(10+1), res.internalDocIds.GetCardinality())
+
+			ages, err := segment.NumericDocValues("age")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, value.NumberType, ages.Kind())
+			assert.Equal(t, []value.Value{value.NewNumberValue(-49)}, ages.Values(segment.docIDExternalToInternal["doc:0001"]))
+			assert.Equal(t, []value.Value{value.NewNumberValue(41.5)}, ages.Values(segment.docIDExternalToInternal["doc:float"]))
+		}
+		segment.Close()
+	}
+
+	{ // test case - ints and whole numbers are the same distinct value
+		assert.Equal(t, distinctNumericKey(value.IntType, encodeInt64(5)), distinctNumericKey(value.NumberType, encodeFloat64(5)))
+		assert.NotEqual(t, distinctNumericKey(value.NumberType, encodeFloat64(5)), distinctNumericKey(value.NumberType, encodeFloat64(5.5)))
+		assert.Equal(t, "9007199254740993", distinctNumericKey(value.IntType, encodeInt64(1<<53+1)))
+	}
+}
+
+func TestNumericMergeIntsAndNumbers(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	ints := []Document{
+		NewDocument("doc:1", map[string]value.Value{"price": value.NewIntValue(5)}, now),
+		NewDocument("doc:2", map[string]value.Value{"price": value.NewIntValue(1<<53 + 1)}, now),
+	}
+	numbers := []Document{
+		NewDocument("doc:3", map[string]value.Value{"price": value.NewNumberValue(5)}, now),
+		NewDocument("doc:4", map[string]value.Value{"price": value.NewNumberValue(5.5)}, now),
+	}
+	// the int segment is merged with the number segment whichever of them is older.
+	for _, batches := range [][][]Document{{ints, numbers}, {numbers, ints}} {
+		dir, err := ioutil.TempDir("", "sidonia-index")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		policy := &fixedMergePolicy{}
+		idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		for _, batch := range batches {
+			if err := idx.IndexDocuments(context.TODO(), batch); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+		}
+		search := func() ([]string, float64) {
+			res, err := idx.Execute(context.TODO(), &SearchRequest{
+				Query: &NumericRangeQuery{"price", value.NewIntValue(5), value.NewIntValue(6), true, false},
+				Sort:  []SortField{{Field: "price"}},
+				Aggs:  map[string]Aggregation{"prices": &MetricAgg{Field: "price", Metric: MetricCardinality}},
+			})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			ids := []string{}
+			for _, hit := range res.Hits {
+				ids = append(ids, hit.ID)
+			}
+			return ids, res.Aggs["prices"].Value
+		}
+		ids, distinct := search()
+		assert.Equal(t, 3, len(ids))
+		assert.Equal(t, "doc:4", ids[2])
+		// 5 and 5.0 are the same value.
+		assert.Equal(t, float64(2), distinct)
+
+		policy.merges = [][]SegmentInfo{idx.Segments()}
+		if err := idx.MaybeMerge(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, len(idx.Segments()))
+		merged, _ := search()
+		assert.Equal(t, ids, merged)
+
+		idx.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNumericFieldsPersistAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 5, MaxMergeAtOnce: 5, FloorSegmentDocs: 1000, MaxMergedSegmentDocs: 10000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	docs := numericTestDocs(now)
+	for i := 0; i < len(docs); i += 500 {
+		if err := idx.IndexDocuments(context.TODO(), docs[i:i+500]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	if _, err := idx.DeleteDocuments(context.TODO(), "doc:0010"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func() []string {
+		res, err := idx.Search(context.TODO(), &NumericRangeQuery{"age", value.NewIntValue(-40), value.NewIntValue(-40), true, true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+	expected := []string{}
+	for i := 110; i < 2500; i += 100 {
+		expected = append(expected, fmt.Sprintf("doc:%04d", i))
+	}
+	assert.Equal(t, expected, search())
+
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 1, len(idx.Segments()))
+	assert.Equal(t, expected, search())
+}
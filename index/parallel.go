@@ -0,0 +1,416 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+)
+
+// Batches are indexed in three steps.  The docs are mapped and checked in order first, so
+// dynamically mapped fields get the type of their first value as they would one doc at a time.
+// The docs are then split into chunks of indexChunkSize docs, which the segment's workers take in
+// turn, analyzing the string fields of a chunk's docs and collecting their postings, positions
+// and norms.  Finally the docs get their internal IDs, and the chunks are added to the segment in
+// order, so the terms get their IDs in the order of the docs as they would one doc at a time, and
+// a term's posting lists from each chunk are or'ed together with roaring's ParOr.  The FSTs of the
+// fields the batch touched are then rebuilt concurrently.
+//
+// Nothing is added to the segment until the docs are collected, a batch whose ctx is cancelled
+// while it's being mapped or collected leaves the segment as it was.  The docs are added to the
+// live docs last, so a batch which fails part way doesn't leave any of them half indexed.
+const indexChunkSize = 512
+
+// SetWorkers sets the number of workers IndexDocuments uses, 1 or less collects the docs in the
+// calling goroutine.  It defaults to GOMAXPROCS.
+func (seg *Segment) SetWorkers(n int) {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	seg.workers = n
+}
+
+// mappedDoc is a doc of a batch which was mapped and accepted by the segment.
+type mappedDoc struct {
+	doc    Document
+	vals   []mappedValue
+	stored []byte
+}
+
+// collectedTerm is a term's postings in a chunk of docs.
+type collectedTerm struct {
+	docs      *roaring.Bitmap
+	freq      uint32
+	positions map[uint32][]uint32 // internal doc ID --> positions
+	freqs     map[uint32]uint32   // internal doc ID --> frequency, for docs with more than one
+}
+
+// termCollector collects the terms of the string fields of a chunk of docs.
+type termCollector struct {
+	terms map[fieldTerm]*collectedTerm
+	order []fieldTerm                  // the terms in the order they were first seen
+	norms map[string]map[uint32]uint32 // field --> internal doc ID --> length
+}
+
+func newTermCollector() *termCollector {
+	return &termCollector{
+		terms: map[fieldTerm]*collectedTerm{},
+		norms: map[string]map[uint32]uint32{},
+	}
+}
+
+func (c *termCollector) addTerm(field, term string, inDocID uint32) *collectedTerm {
+	key := fieldTerm{field, term}
+	ct, ok := c.terms[key]
+	if !ok {
+		ct = &collectedTerm{docs: roaring.New()}
+		c.terms[key] = ct
+		c.order = append(c.order, key)
+	}
+	if !ct.docs.CheckedAdd(inDocID) {
+		if ct.freqs == nil {
+			ct.freqs = map[uint32]uint32{}
+		}
+		if _, ok := ct.freqs[inDocID]; !ok {
+			ct.freqs[inDocID] = 1
+		}
+		ct.freqs[inDocID]++
+	}
+	ct.freq++
+	return ct
+}
+
+func (c *termCollector) addNorm(field string, inDocID, length uint32) {
+	docs, ok := c.norms[field]
+	if !ok {
+		docs = map[uint32]uint32{}
+		c.norms[field] = docs
+	}
+	docs[inDocID] += length
+}
+
+// collect analyzes the string values of a doc.  The values of a multi-valued text field continue
+// from the position of the field's last value, after a gap of positionGap.
+func (c *termCollector) collect(inDocID uint32, vals []mappedValue) error {
+	nextPositions := map[string]uint32{}
+	for _, mv := range vals {
+		if !mv.mapping.Index {
+			continue
+		}
+		switch mv.mapping.Type {
+		case FieldTypeKeyword:
+			c.addTerm(mv.field, mv.val.Value().(string), inDocID)
+			c.addNorm(mv.field, inDocID, 1)
+		case FieldTypeText:
+			analyzer, err := mv.mapping.analyzer()
+			if err != nil {
+				return fmt.Errorf("failed to index field %v: err:%v", mv.field, err)
+			}
+			tokens := analyzer.Analyze(mv.val.Value().(string))
+			start := nextPositions[mv.field]
+			for _, token := range tokens {
+				ct := c.addTerm(mv.field, token.Term, inDocID)
+				if mv.mapping.Positions {
+					if ct.positions == nil {
+						ct.positions = map[uint32][]uint32{}
+					}
+					ct.positions[inDocID] = append(ct.positions[inDocID], start+uint32(token.Position))
+				}
+			}
+			if len(tokens) > 0 {
+				nextPositions[mv.field] = start + uint32(tokens[len(tokens)-1].Position) + positionGap
+				c.addNorm(mv.field, inDocID, uint32(len(tokens)))
+			}
+		}
+	}
+	return nil
+}
+
+// indexDocuments is IndexDocuments, without the lock.
+func (seg *Segment) indexDocuments(ctx context.Context, docs []Document) error {
+	var docErrs IndexingErrors
+	// the type of the values of the numeric fields first seen in this batch.
+	kinds := map[string]value.ValueType{}
+	mapped := make([]mappedDoc, 0, len(docs))
+	// fields added to the mapping by this batch, they're removed again if it's abandoned.
+	added := []string{}
+	abandon := func(err error) error {
+		for _, field := range added {
+			delete(seg.mapping.Fields, field)
+		}
+		return err
+	}
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return abandon(err)
+		}
+		vals, newFields, err := seg.mapping.mapDocument(doc)
+		if err != nil {
+			docErrs = append(docErrs, &DocumentError{ID: doc.ID(), Err: err})
+			continue
+		}
+		for field, fm := range newFields {
+			seg.mapping.Fields[field] = fm
+			added = append(added, field)
+		}
+		stored, err := seg.mapping.encodeStoredDoc(doc)
+		if err != nil {
+			docErrs = append(docErrs, &DocumentError{ID: doc.ID(), Err: err})
+			continue
+		}
+		if err := seg.checkDocValues(vals); err != nil {
+			docErrs = append(docErrs, &DocumentError{ID: doc.ID(), Err: err})
+			continue
+		}
+		if err := seg.checkNumericValues(kinds, vals); err != nil {
+			docErrs = append(docErrs, &DocumentError{ID: doc.ID(), Err: err})
+			continue
+		}
+		mapped = append(mapped, mappedDoc{doc, vals, stored})
+	}
+
+	// the docs are given consecutive internal IDs from the segment's next ID.
+	base := seg.docIdInc
+	collectors, err := seg.collectTerms(ctx, base, mapped)
+	if err != nil {
+		return abandon(err)
+	}
+	if err := seg.prepareNumericFields(kinds); err != nil {
+		return abandon(err)
+	}
+
+	// the points of the numeric fields are inserted first, they're the only part of a doc which
+	// can fail to be indexed.  Nothing matches the docs until they're added to the live docs, so
+	// the IDs of a batch which fails are skipped rather than reused.
+	end := base + uint32(len(mapped))
+	for i, md := range mapped {
+		for _, mv := range md.vals {
+			if !mv.mapping.Index {
+				continue
+			}
+			if err := seg.indexNumericValue(base+uint32(i), mv); err != nil {
+				seg.docIdInc = end
+				return abandon(err)
+			}
+		}
+	}
+
+	// fields touched by this batch, only their term dictionaries need to be rebuilt.
+	fields := make(IndexableFields, 0)
+	for i, md := range mapped {
+		inDocID := base + uint32(i)
+		seg.stored[inDocID] = md.stored
+		seg.addTimestamp(inDocID, md.doc.Ts())
+		for _, mv := range md.vals {
+			seg.addDocValue(inDocID, mv)
+			if !mv.mapping.Index {
+				continue
+			}
+			switch mv.mapping.Type {
+			case FieldTypeKeyword, FieldTypeText:
+				// the string fields get their IDs in the order they're first seen, like the others.
+				seg.fieldID(mv.field)
+			case FieldTypeBool:
+				seg.processBoolTerm(inDocID, mv.field, mv.val)
+			}
+		}
+	}
+	seg.addCollectedTerms(fields, collectors)
+	if err := seg.buildTermDics(fields); err != nil {
+		seg.docIdInc = end
+		return err
+	}
+
+	// An update is a delete of the doc's old version followed by an add, the new version always
+	// gets a new internal id so the terms of the old version can't match it.  The live docs are
+	// shared with the point-in-time views of the segment, so they're replaced instead of modified.
+	liveDocs := seg.liveDocs.Clone()
+	for i, md := range mapped {
+		inDocID := base + uint32(i)
+		if did, ok := seg.docIDExternalToInternal[md.doc.ID()]; ok {
+			liveDocs.Remove(did)
+		}
+		seg.docIDExternalToInternal[md.doc.ID()] = inDocID
+		seg.docIDInternalToExternal[inDocID] = md.doc.ID()
+		liveDocs.Add(inDocID)
+	}
+	seg.docIdInc = end
+	seg.liveDocs = liveDocs
+
+	if len(docErrs) > 0 {
+		return docErrs
+	}
+	return nil
+}
+
+// collectTerms collects the terms of the docs with the segment's workers, the docs get internal
+// IDs from base.  It returns a collector for each chunk of the docs, in order.
+func (seg *Segment) collectTerms(ctx context.Context, base uint32, docs []mappedDoc) ([]*termCollector, error) {
+	chunks := (len(docs) + indexChunkSize - 1) / indexChunkSize
+	collectors := make([]*termCollector, chunks)
+	errs := make([]error, chunks)
+
+	collectChunk := func(i int) error {
+		c := newTermCollector()
+		from := i * indexChunkSize
+		to := from + indexChunkSize
+		if to > len(docs) {
+			to = len(docs)
+		}
+		for j := from; j < to; j++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := c.collect(base+uint32(j), docs[j].vals); err != nil {
+				return err
+			}
+		}
+		collectors[i] = c
+		return nil
+	}
+
+	workers := seg.workers
+	if workers > chunks {
+		workers = chunks
+	}
+	if workers <= 1 {
+		for i := 0; i < chunks; i++ {
+			if err := collectChunk(i); err != nil {
+				return nil, err
+			}
+		}
+		return collectors, nil
+	}
+
+	jobs := make(chan int, chunks)
+	for i := 0; i < chunks; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[i] = collectChunk(i); errs[i] != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return collectors, nil
+}
+
+// addCollectedTerms adds the terms of the chunks to the segment, the fields of the terms are
+// added to fields.
+func (seg *Segment) addCollectedTerms(fields IndexableFields, collectors []*termCollector) {
+	type mergedTerm struct {
+		lists []*roaring.Bitmap
+		freq  uint32
+	}
+	merged := map[uint32]*mergedTerm{}
+	for _, c := range collectors {
+		for _, key := range c.order {
+			ct := c.terms[key]
+			termID := seg.stringTermID(fields, key.field, key.term)
+			mt, ok := merged[termID]
+			if !ok {
+				mt = &mergedTerm{}
+				if list, ok := seg.postings[termID]; ok {
+					mt.lists = append(mt.lists, list.Postings())
+					mt.freq = list.TermFrequency
+				}
+				merged[termID] = mt
+			}
+			mt.lists = append(mt.lists, ct.docs)
+			mt.freq += ct.freq
+			for did, pos := range ct.positions {
+				seg.addPosition(termID, did, pos...)
+			}
+			// the frequencies of terms with positions are the number of their positions.
+			if ct.positions == nil {
+				for did, freq := range ct.freqs {
+					seg.addFreq(termID, did, freq)
+				}
+			}
+		}
+		for field, docs := range c.norms {
+			fid := seg.fieldID(field)
+			for did, length := range docs {
+				seg.addNorm(fid, did, length)
+			}
+		}
+	}
+
+	for termID, mt := range merged {
+		postings := mt.lists[0]
+		if len(mt.lists) > 1 {
+			postings = roaring.ParOr(seg.workers, mt.lists...)
+		}
+		seg.postings[termID] = TermPostingList{mt.freq, postings}
+	}
+}
+
+// buildTermDics rebuilds the FSTs of the fields concurrently, with the segment's workers.
+func (seg *Segment) buildTermDics(fields IndexableFields) error {
+	if seg.workers <= 1 || len(fields) <= 1 {
+		for _, field := range fields {
+			if err := seg.buildTermDic(field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	jobs := make(chan *IndexableField, len(fields))
+	for _, field := range fields {
+		jobs <- field
+	}
+	close(jobs)
+
+	mu := &sync.Mutex{}
+	built := map[uint32][]byte{}
+	var buildErr error
+	wg := &sync.WaitGroup{}
+	for w := 0; w < seg.workers && w < len(fields); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for field := range jobs {
+				fst, err := buildFST(field)
+				mu.Lock()
+				if err != nil && buildErr == nil {
+					buildErr = err
+				}
+				built[field.FieldID] = fst
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if buildErr != nil {
+		return buildErr
+	}
+
+	for fid, fst := range built {
+		seg.termDicBytes[fid] = fst
+		delete(seg.termDicFstCache, fid)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+// bioDocuments are testDocuments with a text field and a numeric field.
+func bioDocuments(count int) []Document {
+	words := []string{"quick", "brown", "fox", "jumps", "over", "the", "lazy", "dog"}
+	docs := testDocuments(count)
+	for i, doc := range docs {
+		row := doc.Row()
+		row["bio"] = NewStringVal(fmt.Sprintf("%v %v %v", words[i%8], words[(i/8)%8], words[(i/64)%8]))
+		row["age"] = value.NewIntValue(int64(i % 90))
+		docs[i] = NewDocument(doc.ID(), row, doc.Ts())
+	}
+	return docs
+}
+
+// segmentPostings describes the postings, positions, frequencies and norms of each term of a
+// segment.  The
+// IDs of the fields and terms depend on the order the fields of a doc are mapped in, so they're
+// left out.
+func segmentPostings(seg *Segment) []string {
+	fieldNames := map[uint32]string{}
+	for field, fid := range seg.fieldToFieldId {
+		fieldNames[fid] = field
+	}
+	postings := []string{}
+	for fid, field := range seg.fields {
+		for _, term := range field.Terms {
+			list := seg.postings[term.TermID]
+			postings = append(postings, fmt.Sprintf("%v:%v freq:%v docs:%v positions:%v freqs:%v",
+				fieldNames[fid], term.Term, list.TermFrequency, list.Postings().ToArray(), seg.positions[term.TermID],
+				seg.freqs[term.TermID]))
+		}
+		postings = append(postings, fmt.Sprintf("%v norms:%v stats:%v", fieldNames[fid], seg.norms[fid], *seg.normStats[fid]))
+	}
+	sort.Strings(postings)
+	return postings
+}
+
+func TestSegmentParallelIndexing(t *testing.T) {
+	mapping := NewIndexMapping().AddField("bio", NewTextFieldMapping("standard"))
+	docs := bioDocuments(5000)
+	// the second batch updates some of the docs of the first.
+	batches := [][]Document{docs[:3000], append(bioDocuments(1000)[500:], docs[3000:]...)}
+
+	sequential := NewSegment()
+	defer sequential.Close()
+	sequential.SetMapping(mapping.Clone())
+	sequential.SetWorkers(1)
+	parallel := NewSegment()
+	defer parallel.Close()
+	parallel.SetMapping(mapping.Clone())
+	parallel.SetWorkers(4)
+	for _, batch := range batches {
+		if err := sequential.IndexDocuments(context.TODO(), batch); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if err := parallel.IndexDocuments(context.TODO(), batch); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+
+	{ // test case - both segments have the same terms, postings, positions and norms
+		assert.Equal(t, segmentPostings(sequential), segmentPostings(parallel))
+		assert.Equal(t, sequential.liveDocs.ToArray(), parallel.liveDocs.ToArray())
+		assert.Equal(t, sequential.docIDExternalToInternal, parallel.docIDExternalToInternal)
+	}
+	{ // test case - and answer queries the same way
+		queries := []Query{
+			&TermQuery{Field: "first_name", Term: "kevin"},
+			&PhraseQuery{"bio", []string{"fox", "quick"}},
+			&NumericRangeQuery{Field: "age", Min: value.NewIntValue(10), Max: value.NewIntValue(20)},
+		}
+		for _, q := range queries {
+			want, err := NewQueryBuilder(context.TODO(), sequential).And(q).Run()
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			got, err := NewQueryBuilder(context.TODO(), parallel).And(q).Run()
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.NotEqual(t, 0, len(want.ExternalDocIDs))
+			sort.Strings(want.ExternalDocIDs)
+			sort.Strings(got.ExternalDocIDs)
+			assert.Equal(t, want.ExternalDocIDs, got.ExternalDocIDs)
+		}
+	}
+}
+
+func TestSegmentIndexingNoWorkers(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("bio", NewTextFieldMapping("standard")))
+	segment.SetWorkers(-1)
+	// the batch's doc IDs span two roaring containers.
+	segment.docIdInc = 1<<16 - 100
+	if err := segment.IndexDocuments(context.TODO(), bioDocuments(1000)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	res, err := NewQueryBuilder(context.TODO(), segment).And(&TermQuery{Field: "bio", Term: "fox"}).Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 335, len(res.ExternalDocIDs))
+}
+
+// errAfterCtx is a ctx whose Err is context.Canceled once it's been called n times, so a test can
+// cancel a batch part way through.
+type errAfterCtx struct {
+	context.Context
+	n int64
+}
+
+func (c *errAfterCtx) Err() error {
+	if atomic.AddInt64(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestSegmentIndexingCancelled(t *testing.T) {
+	docs := bioDocuments(2000)
+	// the batch is cancelled before its first doc, while its docs are mapped, and while their
+	// terms are collected.
+	for _, cancelAt := range []int64{0, 100, 1990 + 100} {
+		for _, workers := range []int{1, 4} {
+			segment := NewSegment()
+			segment.SetWorkers(workers)
+			if err := segment.IndexDocuments(context.TODO(), testDocuments(10)); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			want := segmentPostings(segment)
+
+			err := segment.IndexDocuments(&errAfterCtx{context.Background(), cancelAt}, docs[10:])
+			assert.Equalf(t, context.Canceled, err, "cancelAt:%v workers:%v", cancelAt, workers)
+			// the docs of the batch aren't added, nor are its terms or its new fields.
+			assert.Equal(t, 10, segment.NumDocs())
+			assert.Equal(t, want, segmentPostings(segment))
+			_, ok := segment.Mapping().Fields["bio"]
+			assert.Equal(t, false, ok)
+
+			{ // test case - the batch can be indexed again
+				if err := segment.IndexDocuments(context.TODO(), docs[10:]); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				assert.Equal(t, 2000, segment.NumDocs())
+			}
+			segment.Close()
+		}
+	}
+}
+
+func TestSegmentIndexingFailed(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), bioDocuments(10)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	want := segment.liveDocs.ToArray()
+	// the age points of the batch overflow the bkd tree's memory, and its files can't be written.
+	if err := os.RemoveAll(segment.tmpDir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	// the batch updates the docs of the segment.
+	err := segment.IndexDocuments(context.TODO(), bioDocuments(2000))
+	assert.NotEqual(t, nil, err)
+	// the old versions of the docs are still live, and none of the batch's docs are.
+	assert.Equal(t, want, segment.liveDocs.ToArray())
+	res, err := NewQueryBuilder(context.TODO(), segment).And(&TermQuery{Field: "first_name", Term: "kevin"}).Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc_number:1"}, res.ExternalDocIDs)
+}
+
+func BenchmarkIndexDocuments(b *testing.B) {
+	docs := bioDocuments(1000000)
+	for _, workers := range []int{1, 0} {
+		name := "sequential"
+		if workers == 0 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				segment := NewSegment()
+				if workers > 0 {
+					segment.SetWorkers(workers)
+				}
+				if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+					b.Fatalf("err:%v", err)
+				}
+				segment.Close()
+			}
+		})
+	}
+}
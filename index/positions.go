@@ -0,0 +1,398 @@
+package index
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Positional postings record the positions of a term in each doc it occurs in, so the term's
+// frequency in a doc is the number of its positions.  They're only kept for text fields mapped
+// with Positions, and make phrase and proximity queries possible.  The terms of other fields
+// keep their frequency in the docs they occur in more than once instead.
+
+// positionGap is left between the values of a multi-valued field, so phrases can't match across
+// two of its values.
+const positionGap = 100
+
+func (seg *Segment) addPosition(termID, inDocID uint32, pos ...uint32) {
+	docs, ok := seg.positions[termID]
+	if !ok {
+		docs = map[uint32][]uint32{}
+		seg.positions[termID] = docs
+	}
+	docs[inDocID] = append(docs[inDocID], pos...)
+}
+
+// termPositions returns the positions of a term by internal doc ID, ok is false if the term
+// wasn't indexed with positions.
+func (seg *Segment) termPositions(termID uint32) (docs map[uint32][]uint32, ok bool, err error) {
+	if docs, ok := seg.positions[termID]; ok {
+		return docs, true, nil
+	}
+	buf, ok := seg.positionBytes[termID]
+	if !ok {
+		return nil, false, nil
+	}
+	seg.cacheMu.Lock()
+	defer seg.cacheMu.Unlock()
+	if docs, ok := seg.positionCache[termID]; ok {
+		return docs, true, nil
+	}
+	if docs, err = decodePositions(buf); err != nil {
+		return nil, false, fmt.Errorf("corrupt positions for term-id %v: err:%v", termID, err)
+	}
+	seg.positionCache[termID] = docs
+	return docs, true, nil
+}
+
+func (seg *Segment) addFreq(termID, inDocID, freq uint32) {
+	docs, ok := seg.freqs[termID]
+	if !ok {
+		docs = map[uint32]uint32{}
+		seg.freqs[termID] = docs
+	}
+	docs[inDocID] = freq
+}
+
+// termFreqs returns the frequencies of a term without positions by internal doc ID, docs which
+// aren't in it have a frequency of 1.
+func (seg *Segment) termFreqs(termID uint32) (map[uint32]uint32, error) {
+	if docs, ok := seg.freqs[termID]; ok {
+		return docs, nil
+	}
+	buf, ok := seg.freqBytes[termID]
+	if !ok {
+		return nil, nil
+	}
+	seg.cacheMu.Lock()
+	defer seg.cacheMu.Unlock()
+	if docs, ok := seg.freqCache[termID]; ok {
+		return docs, nil
+	}
+	docs, err := decodeFreqs(buf)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt frequencies for term-id %v: err:%v", termID, err)
+	}
+	seg.freqCache[termID] = docs
+	return docs, nil
+}
+
+// termFreq returns the frequency of a term in a doc from its positions or frequencies.
+func termFreq(positions map[uint32][]uint32, freqs map[uint32]uint32, did uint32) uint32 {
+	if ps, ok := positions[did]; ok {
+		return uint32(len(ps))
+	}
+	if freq, ok := freqs[did]; ok {
+		return freq
+	}
+	return 1
+}
+
+// encodePositions encodes a term's positions as uvarints, the number of docs followed by each
+// doc's ID delta, its number of positions and the position deltas.
+func encodePositions(docs map[uint32][]uint32) []byte {
+	dids := make([]uint32, 0, len(docs))
+	for did := range docs {
+		dids = append(dids, did)
+	}
+	sortUint32s(dids)
+
+	buf := []byte{}
+	var scratch [binary.MaxVarintLen32]byte
+	put := func(v uint32) {
+		n := binary.PutUvarint(scratch[:], uint64(v))
+		buf = append(buf, scratch[:n]...)
+	}
+	put(uint32(len(dids)))
+	prevDoc := uint32(0)
+	for _, did := range dids {
+		positions := docs[did]
+		sortUint32s(positions)
+		put(did - prevDoc)
+		put(uint32(len(positions)))
+		prevPos := uint32(0)
+		for _, pos := range positions {
+			put(pos - prevPos)
+			prevPos = pos
+		}
+		prevDoc = did
+	}
+	return buf
+}
+
+// encodeFreqs encodes a term's frequencies as uvarints, the number of docs followed by each
+// doc's ID delta and frequency.
+func encodeFreqs(docs map[uint32]uint32) []byte {
+	dids := make([]uint32, 0, len(docs))
+	for did := range docs {
+		dids = append(dids, did)
+	}
+	sortUint32s(dids)
+
+	buf := []byte{}
+	var scratch [binary.MaxVarintLen32]byte
+	put := func(v uint32) {
+		n := binary.PutUvarint(scratch[:], uint64(v))
+		buf = append(buf, scratch[:n]...)
+	}
+	put(uint32(len(dids)))
+	prevDoc := uint32(0)
+	for _, did := range dids {
+		put(did - prevDoc)
+		put(docs[did])
+		prevDoc = did
+	}
+	return buf
+}
+
+func decodeFreqs(buf []byte) (map[uint32]uint32, error) {
+	var err error
+	next := func() uint32 {
+		if err != nil {
+			return 0
+		}
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err = fmt.Errorf("bad uvarint")
+			return 0
+		}
+		buf = buf[n:]
+		return uint32(v)
+	}
+
+	numDocs := next()
+	if err == nil && int(numDocs) > len(buf) {
+		return nil, fmt.Errorf("bad number of docs %v", numDocs)
+	}
+	docs := make(map[uint32]uint32, numDocs)
+	did := uint32(0)
+	for i := uint32(0); i < numDocs && err == nil; i++ {
+		did += next()
+		docs[did] = next()
+	}
+	return docs, err
+}
+
+func decodePositions(buf []byte) (map[uint32][]uint32, error) {
+	var err error
+	next := func() uint32 {
+		if err != nil {
+			return 0
+		}
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err = fmt.Errorf("bad uvarint")
+			return 0
+		}
+		buf = buf[n:]
+		return uint32(v)
+	}
+
+	numDocs := next()
+	docs := make(map[uint32][]uint32, numDocs)
+	did := uint32(0)
+	for i := uint32(0); i < numDocs && err == nil; i++ {
+		did += next()
+		freq := next()
+		if err == nil && int(freq) > len(buf) {
+			return nil, fmt.Errorf("bad frequency %v", freq)
+		}
+		positions := make([]uint32, freq)
+		pos := uint32(0)
+		for j := range positions {
+			pos += next()
+			positions[j] = pos
+		}
+		docs[did] = positions
+	}
+	return docs, err
+}
+
+// PhraseQuery matches docs where the terms occur next to each other, in order.  The terms are
+// matched as they were indexed, so they should already be analyzed.
+type PhraseQuery struct {
+	Field string
+	Terms []string
+}
+
+func (q *PhraseQuery) Type() QType {
+	return TypePhraseQuery
+}
+
+// SpanNearQuery matches docs where the terms occur within Slop positions of each other, Slop is
+// the number of positions between the terms that aren't one of the terms.  If InOrder is set
+// the terms must also occur in the query's order.
+type SpanNearQuery struct {
+	Field   string
+	Terms   []string
+	Slop    int
+	InOrder bool
+}
+
+func (q *SpanNearQuery) Type() QType {
+	return TypeSpanNearQuery
+}
+
+// QueryPhrase returns the docs which contain the query's phrase.
+func (seg *Segment) QueryPhrase(ctx context.Context, query *PhraseQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.phraseQuery(ctx, query)
+}
+
+func (seg *Segment) phraseQuery(ctx context.Context, query *PhraseQuery) (*SearchResults, error) {
+	return seg.querySpans(ctx, query.Field, query.Terms, 0, true)
+}
+
+// QuerySpanNear returns the docs where the query's terms are near each other.
+func (seg *Segment) QuerySpanNear(ctx context.Context, query *SpanNearQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.spanNearQuery(ctx, query)
+}
+
+func (seg *Segment) spanNearQuery(ctx context.Context, query *SpanNearQuery) (*SearchResults, error) {
+	if query.Slop < 0 {
+		return nil, fmt.Errorf("slop can't be negative: %v", query.Slop)
+	}
+	return seg.querySpans(ctx, query.Field, query.Terms, query.Slop, query.InOrder)
+}
+
+func (seg *Segment) querySpans(ctx context.Context, field string, terms []string, slop int, inOrder bool) (*SearchResults, error) {
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("query on field %v has no terms", field)
+	}
+	termDictionary, err := seg.termDictionary(field)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SearchResults{internalDocIds: roaring.New()}
+	candidates := seg.liveDocs.Clone()
+	termPositions := make([]map[uint32][]uint32, len(terms))
+	for i, term := range terms {
+		termID, exists, err := termDictionary.Get([]byte(term))
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up term %v: err:%v", term, err)
+		} else if !exists {
+			return res, nil
+		}
+		list, ok := seg.postings[uint32(termID)]
+		if !ok {
+			return res, nil
+		}
+		candidates.And(list.Postings())
+
+		docs, ok, err := seg.termPositions(uint32(termID))
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("field %v wasn't indexed with positions", field)
+		}
+		termPositions[i] = docs
+	}
+
+	lists := make([][]uint32, len(terms))
+	docIter := candidates.Iterator()
+	for n := 0; docIter.HasNext(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
+		did := docIter.Next()
+		for i, docs := range termPositions {
+			lists[i] = docs[did]
+		}
+		if spanMatch(lists, slop, inOrder) {
+			res.internalDocIds.Add(did)
+		}
+	}
+	return res, nil
+}
+
+// spanMatch returns true if there are distinct positions, one from each of the sorted lists,
+// within slop of each other.
+func spanMatch(lists [][]uint32, slop int, inOrder bool) bool {
+	for _, l := range lists {
+		if len(l) == 0 {
+			return false
+		}
+	}
+	n := len(lists)
+
+	if inOrder {
+		// for each start, taking the first position after the previous term's gives the
+		// narrowest span starting there.
+		for _, start := range lists[0] {
+			end := start
+			for _, l := range lists[1:] {
+				i := sort.Search(len(l), func(i int) bool { return l[i] > end })
+				if i == len(l) {
+					// later starts can't find a position after this one either.
+					return false
+				}
+				end = l[i]
+			}
+			if int(end-start)+1-n <= slop {
+				return true
+			}
+		}
+		return false
+	}
+
+	// slide a window over the lists, moving the list with the smallest position forward.
+	heads := make([]int, n)
+	for {
+		minList, min, max := 0, lists[0][heads[0]], lists[0][heads[0]]
+		for i, l := range lists {
+			pos := l[heads[i]]
+			if pos < min {
+				minList, min = i, pos
+			}
+			if pos > max {
+				max = pos
+			}
+		}
+		// a repeated term's clauses share positions, so each clause needs a position of its own.
+		if int(max-min)+1-n <= slop && distinctPositions(lists, min, min+uint32(slop+n-1)) {
+			return true
+		}
+		heads[minList]++
+		if heads[minList] == len(lists[minList]) {
+			return false
+		}
+	}
+}
+
+// distinctPositions returns true if a distinct position between lo and hi can be picked from
+// each of the sorted lists, matching the lists to positions with augmenting paths.
+func distinctPositions(lists [][]uint32, lo, hi uint32) bool {
+	owners := map[uint32]int{}
+	var pick func(i int, seen map[uint32]bool) bool
+	pick = func(i int, seen map[uint32]bool) bool {
+		l := lists[i]
+		for j := sort.Search(len(l), func(j int) bool { return l[j] >= lo }); j < len(l) && l[j] <= hi; j++ {
+			pos := l[j]
+			if seen[pos] {
+				continue
+			}
+			seen[pos] = true
+			if owner, ok := owners[pos]; !ok || pick(owner, seen) {
+				owners[pos] = i
+				return true
+			}
+		}
+		return false
+	}
+	for i := range lists {
+		if !pick(i, map[uint32]bool{}) {
+			return false
+		}
+	}
+	return true
+}
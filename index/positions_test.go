@@ -0,0 +1,158 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func positionsTestDocs() []Document {
+	now := time.Now()
+	bodies := []value.Value{
+		NewStringVal("The quick brown fox jumps over the lazy dog"),
+		NewStringVal("The lazy brown dog sleeps, the quick fox runs"),
+		NewStringVal("A fox that is quick and brown"),
+		value.NewStringsValue([]string{"a very quick", "brown fox"}),
+	}
+	docs := []Document{}
+	for i, body := range bodies {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"body": body}, now))
+	}
+	return docs
+}
+
+func TestPositionEncoding(t *testing.T) {
+	docs := map[uint32][]uint32{0: {1, 5, 300}, 7: {0}, 1 << 20: {2, 3}}
+	decoded, err := decodePositions(encodePositions(docs))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, docs, decoded)
+
+	_, err = decodePositions(encodePositions(docs)[:4])
+	if err == nil {
+		t.Fatalf("expected an error for truncated positions")
+	}
+}
+
+func TestSpanMatch(t *testing.T) {
+	assert.Equal(t, true, spanMatch([][]uint32{{1, 7}, {8}}, 0, true))
+	assert.Equal(t, false, spanMatch([][]uint32{{8}, {7}}, 0, true))
+	assert.Equal(t, true, spanMatch([][]uint32{{8}, {7}}, 0, false))
+	assert.Equal(t, false, spanMatch([][]uint32{{1}, {4}}, 1, true))
+	assert.Equal(t, true, spanMatch([][]uint32{{1}, {4}}, 2, true))
+	assert.Equal(t, true, spanMatch([][]uint32{{0, 2}, {1, 3}, {0, 2}}, 0, true)) // "to be to" in "to be to be"
+	assert.Equal(t, false, spanMatch([][]uint32{{1}, {}}, 10, false))
+
+	{ // test case - a repeated term needs a position for each of its clauses
+		assert.Equal(t, false, spanMatch([][]uint32{{2}, {2}}, 10, false))
+		assert.Equal(t, false, spanMatch([][]uint32{{5}, {5}, {6}}, 10, false))
+		assert.Equal(t, true, spanMatch([][]uint32{{0, 2}, {1, 3}, {0, 2}}, 0, false))
+		assert.Equal(t, true, spanMatch([][]uint32{{3, 9}, {3, 9}}, 5, false))
+		assert.Equal(t, false, spanMatch([][]uint32{{3, 9}, {3, 9}}, 4, false))
+		assert.Equal(t, true, spanMatch([][]uint32{{3, 4}, {3, 4}, {5}}, 0, false))
+	}
+}
+
+func TestPhraseAndSpanNearQueries(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("body", NewTextFieldMapping("standard")))
+	if err := segment.IndexDocuments(context.TODO(), positionsTestDocs()); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(q Query) []string {
+		res, err := NewQueryBuilder(context.TODO(), segment).And(q).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+
+	assert.Equal(t, []string{"doc:0"}, search(&PhraseQuery{"body", []string{"quick", "brown", "fox"}}))
+	assert.Equal(t, []string{"doc:1"}, search(&PhraseQuery{"body", []string{"quick", "fox"}}))
+	assert.Equal(t, []string{"doc:0", "doc:1"}, search(&PhraseQuery{"body", []string{"lazy"}}))
+	assert.Equal(t, []string{}, search(&PhraseQuery{"body", []string{"quick", "zebra"}}))
+
+	{ // test case - values of a multi-valued field are too far apart for a phrase
+		assert.Equal(t, []string{"doc:0", "doc:3"}, search(&PhraseQuery{"body", []string{"brown", "fox"}}))
+		assert.Equal(t, []string{"doc:0"}, search(&PhraseQuery{"body", []string{"quick", "brown"}}))
+	}
+
+	{ // test case - span near
+		assert.Equal(t, []string{"doc:0", "doc:1"}, search(&SpanNearQuery{"body", []string{"quick", "fox"}, 1, true}))
+		assert.Equal(t, []string{"doc:0", "doc:1", "doc:2"}, search(&SpanNearQuery{"body", []string{"quick", "fox"}, 3, false}))
+		assert.Equal(t, []string{"doc:0", "doc:1"}, search(&SpanNearQuery{"body", []string{"lazy", "dog"}, 1, true}))
+		assert.Equal(t, []string{}, search(&SpanNearQuery{"body", []string{"dog", "lazy"}, 1, true}))
+		assert.Equal(t, []string{"doc:0"}, search(&SpanNearQuery{"body", []string{"dog", "lazy"}, 0, false}))
+		assert.Equal(t, []string{}, search(&SpanNearQuery{"body", []string{"fox", "fox"}, 10, false}))
+		assert.Equal(t, []string{"doc:1"}, search(&SpanNearQuery{"body", []string{"the", "the"}, 4, false}))
+	}
+
+	{ // test case - fields without positions can't be phrase searched
+		segment := NewSegment()
+		defer segment.Close()
+		if err := segment.IndexDocuments(context.TODO(), positionsTestDocs()); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		_, err := segment.QueryPhrase(context.TODO(), &PhraseQuery{"body", []string{"A fox that is quick and brown"}})
+		if err == nil {
+			t.Fatalf("expected an error for a keyword field")
+		}
+	}
+}
+
+func TestPositionsPersistAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentDocs: 1000, MaxMergedSegmentDocs: 10000}
+	mapping := NewIndexMapping().AddField("body", NewTextFieldMapping("standard"))
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, Mapping: mapping, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	docs := positionsTestDocs()
+	for _, batch := range [][]Document{docs[:2], docs[2:]} {
+		if err := idx.IndexDocuments(context.TODO(), batch); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	if _, err := idx.DeleteDocuments(context.TODO(), "doc:1"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(q Query) []string {
+		res, err := idx.Search(context.TODO(), q)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+	phrase := &PhraseQuery{"body", []string{"brown", "fox"}}
+	near := &SpanNearQuery{"body", []string{"quick", "fox"}, 3, false}
+	assert.Equal(t, []string{"doc:0", "doc:3"}, search(phrase))
+	assert.Equal(t, []string{"doc:0", "doc:2"}, search(near))
+
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 1, len(idx.Segments()))
+	assert.Equal(t, []string{"doc:0", "doc:3"}, search(phrase))
+	assert.Equal(t, []string{"doc:0", "doc:2"}, search(near))
+}
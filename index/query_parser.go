@@ -0,0 +1,523 @@
+package index
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/araddon/qlbridge/value"
+)
+
+// The query language is a subset of Lucene's:
+//
+//	first_name:kev* AND last_name:"manning"
+//	(state:ca OR state:or) -status:deleted
+//	age:[10 TO 20] score:{* TO 0.5] name:/man.*/ name:jon~1 body:"quick fox"~2
+//
+// Every term needs a field.  Clauses without an operator between them must all match, like AND,
+// which binds tighter than OR.  NOT, ! and - exclude a clause, + is allowed and does nothing.
+// A term ending in * is a prefix query, other terms with an unescaped * or ? are wildcard
+// queries, and a \ escapes the next character.  ~n makes a term fuzzy with n edits, 2 by default,
+// and a phrase match within a slop of n.  Either side of a range can be * to leave it open.
+
+// ParseError is returned for a query string that can't be parsed, Column is the 1-based
+// position of the character where the problem was found.
+type ParseError struct {
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+// QueryParser parses query strings into queries.  If Mapping is set it decides the query each
+// field's values turn into: the terms of text fields are analyzed, and values of numeric, date
+// and bool fields are parsed.  Without a mapping, fields are treated as keyword fields and ranges
+// with numeric bounds as numeric ranges.
+type QueryParser struct {
+	Mapping *IndexMapping
+}
+
+func NewQueryParser(m *IndexMapping) *QueryParser {
+	return &QueryParser{Mapping: m}
+}
+
+// ParseQuery parses a query string without a mapping.
+func ParseQuery(s string) (Query, error) {
+	return NewQueryParser(nil).Parse(s)
+}
+
+// Parse parses the query string.
+func (p *QueryParser) Parse(s string) (Query, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	ps := &queryParser{p: p, tokens: tokens}
+	q, err := ps.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := ps.peek(); t.kind != tokEOF {
+		return nil, t.errorf("unexpected %v", t)
+	}
+	return q, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokTerm
+	tokPhrase
+	tokRegex
+	tokColon
+	tokLParen
+	tokRParen
+	tokLRange // [ or {
+	tokRRange // ] or }
+	tokTilde
+	tokAnd
+	tokOr
+	tokNot
+	tokPlus
+)
+
+type queryToken struct {
+	kind tokenKind
+	col  int
+	// text is the unescaped text of terms, phrases and regexs, or the character of the other
+	// tokens.
+	text string
+	// raw is a term as it was written, with its escapes.
+	raw string
+	// n is the number after a ~, or -1 if there isn't one.
+	n int
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokTerm:
+		return fmt.Sprintf("term %q", t.raw)
+	case tokPhrase:
+		return fmt.Sprintf("phrase %q", t.text)
+	case tokRegex:
+		return fmt.Sprintf("regex /%v/", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (t queryToken) errorf(format string, args ...interface{}) error {
+	return &ParseError{Column: t.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// isTermRune is true for the characters that can be part of an unescaped term.
+func isTermRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`():"[]{}~/\`, r)
+}
+
+func lexQuery(s string) ([]queryToken, error) {
+	rs := []rune(s)
+	tokens := []queryToken{}
+	for i := 0; i < len(rs); {
+		r, col := rs[i], i+1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1]):
+			// a negative number, it's lexed as a term.
+			tok, j, err := lexTerm(rs, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i = j
+		case r == ':' || r == '(' || r == ')' || r == '+' || r == '-' || r == '!':
+			kind := map[rune]tokenKind{':': tokColon, '(': tokLParen, ')': tokRParen, '+': tokPlus, '-': tokNot, '!': tokNot}[r]
+			tokens = append(tokens, queryToken{kind: kind, col: col, text: string(r)})
+			i++
+		case r == '[' || r == '{':
+			tokens = append(tokens, queryToken{kind: tokLRange, col: col, text: string(r)})
+			i++
+		case r == ']' || r == '}':
+			tokens = append(tokens, queryToken{kind: tokRRange, col: col, text: string(r)})
+			i++
+		case r == '~':
+			j := i + 1
+			for j < len(rs) && rs[j] >= '0' && rs[j] <= '9' {
+				j++
+			}
+			n := -1
+			if j > i+1 {
+				var err error
+				if n, err = strconv.Atoi(string(rs[i+1 : j])); err != nil {
+					return nil, &ParseError{Column: col + 1, Msg: fmt.Sprintf("bad number after ~: %v", err)}
+				}
+			}
+			tokens = append(tokens, queryToken{kind: tokTilde, col: col, text: "~", n: n})
+			i = j
+		case r == '"' || r == '/':
+			kind, name := tokPhrase, "phrase"
+			if r == '/' {
+				kind, name = tokRegex, "regex"
+			}
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+					// a regex keeps its escapes, except for the escaped delimiter.
+					if kind == tokRegex && rs[j] != '/' {
+						text.WriteRune('\\')
+					}
+				}
+				text.WriteRune(rs[j])
+			}
+			if j == len(rs) {
+				return nil, &ParseError{Column: col, Msg: fmt.Sprintf("unterminated %v", name)}
+			}
+			tokens = append(tokens, queryToken{kind: kind, col: col, text: text.String()})
+			i = j + 1
+		default:
+			tok, j, err := lexTerm(rs, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i = j
+		}
+	}
+	return append(tokens, queryToken{kind: tokEOF, col: len(rs) + 1}), nil
+}
+
+// lexTerm lexes the term starting at i, and returns it along with the index after it.
+func lexTerm(rs []rune, i int) (queryToken, int, error) {
+	var text strings.Builder
+	j := i
+	for ; j < len(rs) && (isTermRune(rs[j]) || rs[j] == '\\'); j++ {
+		if rs[j] == '\\' {
+			if j+1 == len(rs) {
+				return queryToken{}, 0, &ParseError{Column: j + 1, Msg: "nothing to escape after \\"}
+			}
+			j++
+		}
+		text.WriteRune(rs[j])
+	}
+	if j == i {
+		return queryToken{}, 0, &ParseError{Column: i + 1, Msg: fmt.Sprintf("unexpected character %q", rs[i])}
+	}
+	tok := queryToken{kind: tokTerm, col: i + 1, text: text.String(), raw: string(rs[i:j])}
+	switch tok.raw {
+	case "AND", "&&":
+		tok.kind = tokAnd
+	case "OR", "||":
+		tok.kind = tokOr
+	case "NOT":
+		tok.kind = tokNot
+	}
+	return tok, j, nil
+}
+
+type queryParser struct {
+	p      *QueryParser
+	tokens []queryToken
+	pos    int
+}
+
+func (ps *queryParser) peek() queryToken {
+	return ps.tokens[ps.pos]
+}
+
+func (ps *queryParser) next() queryToken {
+	t := ps.tokens[ps.pos]
+	if t.kind != tokEOF {
+		ps.pos++
+	}
+	return t
+}
+
+func (ps *queryParser) expect(kind tokenKind, what string) (queryToken, error) {
+	t := ps.next()
+	if t.kind != kind {
+		return t, t.errorf("expected %v, found %v", what, t)
+	}
+	return t, nil
+}
+
+// parseOr parses clauses separated by OR.
+func (ps *queryParser) parseOr() (Query, error) {
+	q, err := ps.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if ps.peek().kind != tokOr {
+		return q, nil
+	}
+	or := &BooleanQuery{Should: []Query{q}}
+	for ps.peek().kind == tokOr {
+		ps.next()
+		q, err := ps.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or.Should = append(or.Should, q)
+	}
+	return or, nil
+}
+
+// parseAnd parses clauses which are separated by AND, or by nothing.
+func (ps *queryParser) parseAnd() (Query, error) {
+	and := &BooleanQuery{}
+	for {
+		negated := false
+		for {
+			if t := ps.peek(); t.kind == tokNot {
+				negated = !negated
+			} else if t.kind != tokPlus {
+				break
+			}
+			ps.next()
+		}
+		q, err := ps.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		if negated {
+			and.MustNot = append(and.MustNot, q)
+		} else {
+			and.Must = append(and.Must, q)
+		}
+
+		switch ps.peek().kind {
+		case tokAnd:
+			ps.next()
+			continue
+		case tokOr, tokRParen, tokEOF:
+		default:
+			continue
+		}
+		break
+	}
+	if len(and.Must) == 1 && len(and.MustNot) == 0 {
+		return and.Must[0], nil
+	}
+	return and, nil
+}
+
+// parseClause parses a group in parentheses or a field's query.
+func (ps *queryParser) parseClause() (Query, error) {
+	t := ps.next()
+	switch t.kind {
+	case tokLParen:
+		q, err := ps.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ps.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case tokTerm:
+		if ps.peek().kind != tokColon {
+			return nil, t.errorf("missing field for %v", t)
+		}
+		ps.next()
+		return ps.parseValue(t.text)
+	}
+	return nil, t.errorf("expected a field or \"(\", found %v", t)
+}
+
+// parseValue parses the query after a field's colon.
+func (ps *queryParser) parseValue(field string) (Query, error) {
+	fm := ps.p.fieldMapping(field)
+	t := ps.next()
+	switch t.kind {
+	case tokRegex:
+		return &RegExTermQuery{Fieldname: field, RegEx: t.text}, nil
+	case tokLRange:
+		return ps.parseRange(field, fm, t)
+	case tokPhrase:
+		if ps.peek().kind == tokTilde {
+			slop := ps.next().n
+			if slop < 0 {
+				slop = 0
+			}
+			terms := strings.Fields(t.text)
+			if fm != nil && fm.Type == FieldTypeText {
+				var err error
+				if terms, err = analyzeTerms(fm, t); err != nil {
+					return nil, err
+				}
+			}
+			return &SpanNearQuery{Field: field, Terms: terms, Slop: slop}, nil
+		}
+		return ps.p.valueQuery(field, fm, t, true)
+	case tokTerm:
+		if ps.peek().kind == tokTilde {
+			edits := ps.next().n
+			if edits < 0 {
+				edits = MaxFuzzyEdits
+			}
+			return &FuzzyQuery{Field: field, Term: t.text, MaxEdits: edits}, nil
+		}
+		if prefix, ok := prefixPattern(t.raw); ok {
+			return &PrefixQuery{Field: field, Prefix: prefix}, nil
+		} else if hasWildcard(t.raw) {
+			return &WildcardQuery{Field: field, Pattern: t.raw}, nil
+		}
+		return ps.p.valueQuery(field, fm, t, false)
+	}
+	return nil, t.errorf("expected a value for field %v, found %v", field, t)
+}
+
+// parseRange parses the rest of a range after its opening bracket.
+func (ps *queryParser) parseRange(field string, fm *FieldMapping, open queryToken) (Query, error) {
+	low, err := ps.expect(tokTerm, "the range's lower bound")
+	if err != nil {
+		return nil, err
+	}
+	if to := ps.next(); to.kind != tokTerm || to.raw != "TO" {
+		return nil, to.errorf("expected TO, found %v", to)
+	}
+	high, err := ps.expect(tokTerm, "the range's upper bound")
+	if err != nil {
+		return nil, err
+	}
+	closing, err := ps.expect(tokRRange, `"]" or "}"`)
+	if err != nil {
+		return nil, err
+	}
+	includeLow, includeHigh := open.text == "[", closing.text == "]"
+
+	lowText, highText := low.text, high.text
+	if low.raw == "*" {
+		lowText = ""
+	}
+	if high.raw == "*" {
+		highText = ""
+	}
+
+	numeric := fm != nil && (fm.Type == FieldTypeNumeric || fm.Type == FieldTypeDate)
+	if fm == nil {
+		_, lowErr := strconv.ParseFloat(lowText, 64)
+		_, highErr := strconv.ParseFloat(highText, 64)
+		numeric = (lowText == "" || lowErr == nil) && (highText == "" || highErr == nil) && lowText+highText != ""
+	}
+	if !numeric {
+		return &TermRangeQuery{Field: field, Low: lowText, High: highText, IncludeLow: includeLow, IncludeHigh: includeHigh}, nil
+	}
+
+	q := &NumericRangeQuery{Field: field, InclusiveMin: includeLow, InclusiveMax: includeHigh}
+	if lowText != "" {
+		if q.Min, err = ps.p.parseNumeric(fm, low); err != nil {
+			return nil, err
+		}
+	}
+	if highText != "" {
+		if q.Max, err = ps.p.parseNumeric(fm, high); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (p *QueryParser) fieldMapping(field string) *FieldMapping {
+	if p.Mapping == nil {
+		return nil
+	}
+	return p.Mapping.Fields[field]
+}
+
+// valueQuery returns the query matching docs where the field has the value of the term or
+// phrase t.
+func (p *QueryParser) valueQuery(field string, fm *FieldMapping, t queryToken, isPhrase bool) (Query, error) {
+	if fm == nil {
+		return &TermQuery{Field: field, Term: t.text}, nil
+	}
+	switch fm.Type {
+	case FieldTypeText:
+		terms, err := analyzeTerms(fm, t)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(terms) == 1:
+			return &TermQuery{Field: field, Term: terms[0]}, nil
+		case isPhrase:
+			return &PhraseQuery{Field: field, Terms: terms}, nil
+		}
+		return &TermsQuery{Field: field, Terms: terms}, nil
+	case FieldTypeBool:
+		b, err := strconv.ParseBool(t.text)
+		if err != nil {
+			return nil, t.errorf("bad value for bool field %v: %q", field, t.text)
+		}
+		return &BoolTermQuery{Field: field, Value: b}, nil
+	case FieldTypeNumeric, FieldTypeDate:
+		v, err := p.parseNumeric(fm, t)
+		if err != nil {
+			return nil, err
+		}
+		return &NumericRangeQuery{Field: field, Min: v, Max: v, InclusiveMin: true, InclusiveMax: true}, nil
+	}
+	return &TermQuery{Field: field, Term: t.text}, nil
+}
+
+// parseNumeric parses a value of a numeric or date field, a nil mapping is a numeric field.
+func (p *QueryParser) parseNumeric(fm *FieldMapping, t queryToken) (value.Value, error) {
+	if fm != nil && fm.Type == FieldTypeDate {
+		v, err := fm.convert(value.NewStringValue(t.text))
+		if err != nil {
+			return nil, t.errorf("bad date %q: %v", t.text, err)
+		}
+		return v, nil
+	}
+	f, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, t.errorf("bad number %q", t.text)
+	}
+	return value.NewNumberValue(f), nil
+}
+
+// analyzeTerms returns the terms of a text field's analyzer for the token's text.
+func analyzeTerms(fm *FieldMapping, t queryToken) ([]string, error) {
+	analyzer, err := fm.analyzer()
+	if err != nil {
+		return nil, t.errorf("%v", err)
+	}
+	terms := []string{}
+	for _, token := range analyzer.Analyze(t.text) {
+		terms = append(terms, token.Term)
+	}
+	return terms, nil
+}
+
+// prefixPattern returns the prefix of a term whose only wildcard is an unescaped * at its end.
+func prefixPattern(raw string) (string, bool) {
+	if !strings.HasSuffix(raw, "*") || hasWildcard(raw[:len(raw)-1]) {
+		return "", false
+	}
+	// an escaped * is quoted in the regexp.
+	expr, prefix := wildcardToRegexp(raw)
+	return prefix, strings.HasSuffix(expr, ".*")
+}
+
+// hasWildcard is true if the term has an unescaped * or ?.
+func hasWildcard(raw string) bool {
+	escaped := false
+	for _, r := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*' || r == '?':
+			return true
+		}
+	}
+	return false
+}
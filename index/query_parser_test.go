@@ -0,0 +1,168 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+	parse := func(s string) Query {
+		q, err := ParseQuery(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: err:%v", s, err)
+		}
+		return q
+	}
+
+	{ // test case - the example
+		assert.Equal(t, &BooleanQuery{Must: []Query{
+			&PrefixQuery{Field: "first_name", Prefix: "kev"},
+			&TermQuery{Field: "last_name", Term: "manning"},
+		}}, parse(`first_name:kev* AND last_name:"manning"`))
+	}
+	{ // test case - implicit AND binds tighter than OR, and negation
+		assert.Equal(t, &BooleanQuery{Should: []Query{
+			&BooleanQuery{Must: []Query{&TermQuery{Field: "a", Term: "1"}, &TermQuery{Field: "b", Term: "2"}}},
+			&BooleanQuery{MustNot: []Query{&TermQuery{Field: "c", Term: "3"}}},
+		}}, parse(`a:1 b:2 OR NOT c:3`))
+
+		assert.Equal(t, &BooleanQuery{
+			Must:    []Query{&TermQuery{Field: "a", Term: "1"}},
+			MustNot: []Query{&TermQuery{Field: "field", Term: "x"}, &TermQuery{Field: "b", Term: "2"}},
+		}, parse(`+a:1 -field:x !b:2`))
+	}
+	{ // test case - parentheses
+		assert.Equal(t, &BooleanQuery{Must: []Query{
+			&BooleanQuery{Should: []Query{&TermQuery{Field: "state", Term: "ca"}, &TermQuery{Field: "state", Term: "or"}}},
+			&TermQuery{Field: "name", Term: "x"},
+		}}, parse(`(state:ca || state:or) && name:x`))
+	}
+	{ // test case - ranges
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewNumberValue(10), Max: value.NewNumberValue(20), InclusiveMin: true, InclusiveMax: true},
+			parse(`age:[10 TO 20]`))
+		assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewNumberValue(-5), InclusiveMin: false, InclusiveMax: true},
+			parse(`age:{-5 TO *]`))
+		assert.Equal(t, &TermRangeQuery{Field: "name", Low: "a", High: "m", IncludeLow: true},
+			parse(`name:[a TO m}`))
+	}
+	{ // test case - regex, wildcards and escapes
+		assert.Equal(t, &RegExTermQuery{Fieldname: "last_name", RegEx: `man.*\d/`}, parse(`last_name:/man.*\d\//`))
+		assert.Equal(t, &WildcardQuery{Field: "name", Pattern: "k?v*n"}, parse(`name:k?v*n`))
+		assert.Equal(t, &TermQuery{Field: "name", Term: "a*b:c"}, parse(`name:a\*b\:c`))
+		assert.Equal(t, &PrefixQuery{Field: "name", Prefix: "a:b"}, parse(`name:a\:b*`))
+		assert.Equal(t, &TermQuery{Field: "title", Term: "new york"}, parse(`title:"new york"`))
+	}
+	{ // test case - fuzzy terms and sloppy phrases
+		assert.Equal(t, &FuzzyQuery{Field: "name", Term: "jon", MaxEdits: 1}, parse(`name:jon~1`))
+		assert.Equal(t, &FuzzyQuery{Field: "name", Term: "jon", MaxEdits: 2}, parse(`name:jon~`))
+		assert.Equal(t, &SpanNearQuery{Field: "body", Terms: []string{"quick", "fox"}, Slop: 2}, parse(`body:"quick fox"~2`))
+	}
+	{ // test case - errors report the column
+		for s, col := range map[string]int{
+			`name:"manning`:          6,
+			`name:kevin AND`:         15,
+			`kevin`:                  1,
+			`(a:1 OR b:2`:            12,
+			`age:[10 20]`:            9,
+			`a:1 ) b:2`:              5,
+			`name:/x`:                6,
+			`age:[10 TO 20] b:\`:     18,
+			`first_name:kev* AND :x`: 21,
+		} {
+			_, err := ParseQuery(s)
+			perr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected a ParseError for %q: err:%v", s, err)
+			}
+			assert.Equalf(t, col, perr.Column, "query %q: %v", s, perr)
+		}
+	}
+}
+
+func TestQueryParserMapping(t *testing.T) {
+	m := NewIndexMapping().
+		AddField("body", NewTextFieldMapping("english")).
+		AddField("age", NewNumericFieldMapping()).
+		AddField("active", NewBoolFieldMapping()).
+		AddField("born", NewDateFieldMapping())
+	p := NewQueryParser(m)
+	parse := func(s string) Query {
+		q, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: err:%v", s, err)
+		}
+		return q
+	}
+
+	assert.Equal(t, &TermQuery{Field: "body", Term: "fox"}, parse(`body:Fox`))
+	assert.Equal(t, &PhraseQuery{Field: "body", Terms: []string{"quick", "fox"}}, parse(`body:"The Quick Fox"`))
+	assert.Equal(t, &SpanNearQuery{Field: "body", Terms: []string{"quick", "fox"}, Slop: 1}, parse(`body:"Quick Fox"~1`))
+	assert.Equal(t, &BoolTermQuery{Field: "active", Value: true}, parse(`active:true`))
+	assert.Equal(t, &NumericRangeQuery{Field: "age", Min: value.NewNumberValue(30), Max: value.NewNumberValue(30), InclusiveMin: true, InclusiveMax: true},
+		parse(`age:30`))
+	born := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, &NumericRangeQuery{Field: "born", Min: value.NewTimeValue(born), InclusiveMin: true, InclusiveMax: true},
+		parse(`born:[1980-01-01T00\:00\:00Z TO *]`))
+	m.AddField("name", NewKeywordFieldMapping())
+	assert.Equal(t, &TermRangeQuery{Field: "name", Low: "1", High: "9", IncludeLow: true, IncludeHigh: true}, parse(`name:[1 TO 9]`))
+
+	for s, col := range map[string]int{
+		`active:yes`:            8,
+		`age:[1 TO x]`:          11,
+		`born:[yesterday TO *]`: 7,
+	} {
+		_, err := p.Parse(s)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("expected a ParseError for %q: err:%v", s, err)
+		}
+		assert.Equalf(t, col, perr.Column, "query %q: %v", s, perr)
+	}
+}
+
+func TestIndexParseQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewIndexMapping().AddField("body", NewTextFieldMapping("english"))
+	idx, err := NewIndex(dir, &IndexOptions{Mapping: m, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	now := time.Now()
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{"first_name": NewStringVal("kevin"), "body": NewStringVal("The quick brown fox")}, now),
+		NewDocument("doc:2", map[string]value.Value{"first_name": NewStringVal("kelly"), "body": NewStringVal("A lazy dog")}, now),
+		NewDocument("doc:3", map[string]value.Value{"first_name": NewStringVal("john"), "body": NewStringVal("Quick fox jumps")}, now),
+	}
+	if err := idx.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(s string) []string {
+		q, err := idx.ParseQuery(s)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		res, err := idx.Search(context.TODO(), q)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+	assert.Equal(t, []string{"doc:1", "doc:3"}, search(`body:FOX`))
+	assert.Equal(t, []string{"doc:1"}, search(`body:"quick brown"`))
+	assert.Equal(t, []string{"doc:2", "doc:3"}, search(`first_name:ke* -body:fox OR first_name:jon~1`))
+}
@@ -0,0 +1,394 @@
+package index
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/couchbase/vellum"
+	"github.com/couchbase/vellum/regexp"
+)
+
+// TermStats are the statistics a Scorer needs about a term.  When searching an Index they're
+// summed over all of its segments, so scores from different segments are comparable.  Like
+// Lucene's, they include deleted docs until a merge drops them.
+type TermStats struct {
+	// DocFreq is the number of docs containing the term.
+	DocFreq int64
+	// DocCount is the number of docs with a value for the term's field.
+	DocCount int64
+	// SumFieldLength is the sum of the lengths of the field in those docs.
+	SumFieldLength int64
+}
+
+// AvgFieldLength is the average length of the term's field.
+func (s *TermStats) AvgFieldLength() float64 {
+	if s.DocCount == 0 {
+		return 1
+	}
+	return float64(s.SumFieldLength) / float64(s.DocCount)
+}
+
+// Scorer scores how relevant a term is to a doc, given the term's frequency in the doc, the
+// length of the doc's field, and the term's stats.  A doc's score is the sum of the scores of
+// the query terms it contains.
+type Scorer interface {
+	Score(tf, fieldLength float64, stats *TermStats) float64
+}
+
+// BM25Scorer is Okapi BM25, the default similarity of Lucene.
+type BM25Scorer struct {
+	// K1 controls how quickly the score saturates as the term frequency grows.
+	K1 float64
+	// B controls how much the field's length normalizes the term frequency.
+	B float64
+}
+
+func NewBM25Scorer() *BM25Scorer {
+	return &BM25Scorer{K1: 1.2, B: 0.75}
+}
+
+func (s *BM25Scorer) Score(tf, fieldLength float64, stats *TermStats) float64 {
+	df, n := float64(stats.DocFreq), float64(stats.DocCount)
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	norm := s.K1 * (1 - s.B + s.B*fieldLength/stats.AvgFieldLength())
+	return idf * tf * (s.K1 + 1) / (tf + norm)
+}
+
+// TFIDFScorer is Lucene's classic similarity, sqrt(tf) * idf^2 / sqrt(fieldLength).
+type TFIDFScorer struct{}
+
+func (TFIDFScorer) Score(tf, fieldLength float64, stats *TermStats) float64 {
+	idf := 1 + math.Log(float64(stats.DocCount+1)/float64(stats.DocFreq+1))
+	return math.Sqrt(tf) * idf * idf / math.Sqrt(fieldLength)
+}
+
+// ScoredDoc is a matching doc and its score.
+type ScoredDoc struct {
+	ID    string
+	Score float64
+}
+
+// topDocs keeps the k best scoring docs in a min heap, so the worst of them is on top and can
+// be replaced by a better doc in log(k).
+type topDocs struct {
+	k    int
+	docs []ScoredDoc
+}
+
+func newTopDocs(k int) (*topDocs, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k must be positive: %v", k)
+	}
+	return &topDocs{k: k}, nil
+}
+
+// better orders docs by descending score, ties are broken by ID so results are deterministic.
+func better(a, b ScoredDoc) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.ID < b.ID
+}
+
+func (t *topDocs) Len() int           { return len(t.docs) }
+func (t *topDocs) Less(i, j int) bool { return better(t.docs[j], t.docs[i]) }
+func (t *topDocs) Swap(i, j int)      { t.docs[i], t.docs[j] = t.docs[j], t.docs[i] }
+func (t *topDocs) Push(x interface{}) { t.docs = append(t.docs, x.(ScoredDoc)) }
+func (t *topDocs) Pop() (x interface{}) {
+	x, t.docs = t.docs[len(t.docs)-1], t.docs[:len(t.docs)-1]
+	return x
+}
+
+func (t *topDocs) add(doc ScoredDoc) {
+	if len(t.docs) < t.k {
+		heap.Push(t, doc)
+	} else if better(doc, t.docs[0]) {
+		t.docs[0] = doc
+		heap.Fix(t, 0)
+	}
+}
+
+// results returns the docs, best first.
+func (t *topDocs) results() []ScoredDoc {
+	docs := make([]ScoredDoc, len(t.docs))
+	copy(docs, t.docs)
+	sort.Slice(docs, func(i, j int) bool { return better(docs[i], docs[j]) })
+	return docs
+}
+
+// fieldTerm is a term of a field which contributes to a doc's score.
+type fieldTerm struct {
+	field string
+	term  string
+}
+
+// collectionStats are the stats of the terms being scored.
+type collectionStats map[fieldTerm]*TermStats
+
+// queryTerms adds the terms the queries score docs by to stats.  Only queries that match terms
+// score docs, the other queries, and the Filter and MustNot clauses of boolean queries, just
+// filter them.
+func (seg *Segment) queryTerms(ctx context.Context, queries []Query, stats collectionStats) error {
+	add := func(field string, terms ...string) {
+		for _, term := range terms {
+			ft := fieldTerm{field, term}
+			if _, ok := stats[ft]; !ok {
+				stats[ft] = &TermStats{}
+			}
+		}
+	}
+	for _, query := range queries {
+		switch q := query.(type) {
+		case *RegExTermQuery:
+			termDictionary, err := seg.termDictionary(q.Fieldname)
+			if _, ok := err.(*FieldNotFoundError); ok {
+				continue
+			} else if err != nil {
+				return err
+			}
+			r, err := regexp.New(q.RegEx)
+			if err != nil {
+				return err
+			}
+			itr, err := termDictionary.Search(r, nil, nil)
+			for terms := 0; err == nil; err = itr.Next() {
+				if terms++; terms%cancelCheckInterval == 0 {
+					if err := queryCancelled(ctx); err != nil {
+						return err
+					}
+				}
+				term, _ := itr.Current()
+				add(q.Fieldname, string(term))
+			}
+			if err != vellum.ErrIteratorDone {
+				return err
+			}
+		case multiTermQuery:
+			err := q.expand(ctx, seg, func(term []byte, _ uint32) {
+				add(q.field(), string(term))
+			})
+			if _, ok := err.(*FieldNotFoundError); ok {
+				continue
+			} else if err != nil {
+				return err
+			}
+		case *TermQuery:
+			add(q.Field, q.Term)
+		case *TermsQuery:
+			add(q.Field, q.Terms...)
+		case *PhraseQuery:
+			add(q.Field, q.Terms...)
+		case *SpanNearQuery:
+			add(q.Field, q.Terms...)
+		case *BooleanQuery:
+			if err := seg.queryTerms(ctx, q.Must, stats); err != nil {
+				return err
+			}
+			if err := seg.queryTerms(ctx, q.Should, stats); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addTermStats adds the segment's stats for each of the terms to stats.
+func (seg *Segment) addTermStats(stats collectionStats) error {
+	for ft, ts := range stats {
+		fieldID, ok := seg.fieldToFieldId[ft.field]
+		if !ok {
+			continue
+		}
+		if fs, ok := seg.normStats[fieldID]; ok {
+			ts.DocCount += fs.docCount
+			ts.SumFieldLength += fs.sumLength
+		}
+		termID, ok, err := seg.termID(ft.field, ft.term)
+		if err != nil {
+			return err
+		} else if ok {
+			ts.DocFreq += int64(seg.postings[termID].Postings().GetCardinality())
+		}
+	}
+	return nil
+}
+
+// termID looks the term up in the field's term dictionary.
+func (seg *Segment) termID(field, term string) (uint32, bool, error) {
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return 0, false, nil
+	} else if _, ok := seg.termDicBytes[fieldID]; !ok {
+		return 0, false, nil
+	}
+	termDictionary, err := seg.termDictionary(field)
+	if err != nil {
+		return 0, false, err
+	}
+	termID, exists, err := termDictionary.Get([]byte(term))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to look up term %v: err:%v", term, err)
+	}
+	return uint32(termID), exists, nil
+}
+
+// scoreDocs scores each of the docs by the terms in stats, and adds them to top.
+func (seg *Segment) scoreDocs(ctx context.Context, docs *roaring.Bitmap, stats collectionStats, scorer Scorer, top *topDocs) error {
+	scores, err := seg.docScores(ctx, docs, stats, scorer)
+	if err != nil {
+		return err
+	}
+	docIter := docs.Iterator()
+	for n := 0; docIter.HasNext(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return err
+			}
+		}
+		did := docIter.Next()
+		externalID, ok := seg.docIDInternalToExternal[did]
+		if !ok {
+			return fmt.Errorf("found an internal docID without an external doc ID mapping: id:%v", did)
+		}
+		top.add(ScoredDoc{ID: externalID, Score: scores[did]})
+	}
+	return nil
+}
+
+// docScores returns the scores of the docs by the terms in stats, docs without any of the terms
+// aren't in the map.  The term frequency is the number of the term's positions in the doc, or its
+// frequency for fields without positions.
+func (seg *Segment) docScores(ctx context.Context, docs *roaring.Bitmap, stats collectionStats, scorer Scorer) (map[uint32]float64, error) {
+	terms := make([]fieldTerm, 0, len(stats))
+	for ft := range stats {
+		terms = append(terms, ft)
+	}
+	// sum the scores in the same order on every run.
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].field != terms[j].field {
+			return terms[i].field < terms[j].field
+		}
+		return terms[i].term < terms[j].term
+	})
+
+	scores := map[uint32]float64{}
+	for _, ft := range terms {
+		if err := queryCancelled(ctx); err != nil {
+			return nil, err
+		}
+		fieldID, ok := seg.fieldToFieldId[ft.field]
+		if !ok {
+			continue
+		}
+		termID, ok, err := seg.termID(ft.field, ft.term)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		positions, _, err := seg.termPositions(termID)
+		if err != nil {
+			return nil, err
+		}
+		freqs, err := seg.termFreqs(termID)
+		if err != nil {
+			return nil, err
+		}
+		norms := seg.norms[fieldID]
+
+		docIter := roaring.And(seg.postings[termID].Postings(), docs).Iterator()
+		for n := 1; docIter.HasNext(); n++ {
+			if n%cancelCheckInterval == 0 {
+				if err := queryCancelled(ctx); err != nil {
+					return nil, err
+				}
+			}
+			did := docIter.Next()
+			tf := float64(termFreq(positions, freqs, did))
+			fieldLength := 1.0
+			if int(did) < len(norms) && norms[did] > 0 {
+				fieldLength = float64(norms[did])
+			}
+			scores[did] += scorer.Score(tf, fieldLength, stats[ft])
+		}
+	}
+	return scores, nil
+}
+
+// RunTopK runs the query and returns the k best scoring docs, best first.
+func (q *QueryBuilder) RunTopK(k int, scorer Scorer) ([]ScoredDoc, error) {
+	q.seg.rwlock.RLock()
+	defer q.seg.rwlock.RUnlock()
+	top, err := newTopDocs(k)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := q.seg.execute(q.ctx, q.root)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := collectionStats{}
+	if err := q.seg.queryTerms(q.ctx, []Query{q.root}, stats); err != nil {
+		return nil, err
+	}
+	if err := q.seg.addTermStats(stats); err != nil {
+		return nil, err
+	}
+	if err := q.seg.scoreDocs(q.ctx, docs, stats, scorer, top); err != nil {
+		return nil, err
+	}
+	return top.results(), nil
+}
+
+// SearchTopK searches a snapshot of the index.  See Snapshot.SearchTopK.
+func (idx *Index) SearchTopK(ctx context.Context, k int, scorer Scorer, queries ...Query) ([]ScoredDoc, error) {
+	snap := idx.Snapshot()
+	defer snap.Close()
+	return snap.SearchTopK(ctx, k, scorer, queries...)
+}
+
+// SearchTopK searches all of the segments for docs matching all of the queries, and returns the
+// k best scoring docs, best first.
+func (snap *Snapshot) SearchTopK(ctx context.Context, k int, scorer Scorer, queries ...Query) ([]ScoredDoc, error) {
+	top, err := newTopDocs(k)
+	if err != nil {
+		return nil, err
+	}
+	segs := snap.segs
+
+	matches := make([]*roaring.Bitmap, len(segs))
+	stats := collectionStats{}
+	for i, s := range segs {
+		segRes, err := NewQueryBuilder(ctx, s.seg).And(queries...).Run()
+		if _, ok := err.(*FieldNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, searchError(s.name, err)
+		}
+		matches[i] = segRes.internalDocIds
+		if err := s.seg.queryTerms(ctx, queries, stats); err != nil {
+			return nil, searchError(s.name, err)
+		}
+	}
+
+	// the stats are gathered from every segment before any doc is scored.
+	for _, s := range segs {
+		if err := s.seg.addTermStats(stats); err != nil {
+			return nil, searchError(s.name, err)
+		}
+	}
+	for i, s := range segs {
+		if matches[i] == nil {
+			continue
+		}
+		if err := s.seg.scoreDocs(ctx, matches[i], stats, scorer, top); err != nil {
+			return nil, searchError(s.name, err)
+		}
+	}
+	return top.results(), nil
+}
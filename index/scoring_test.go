@@ -0,0 +1,207 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestScorers(t *testing.T) {
+	stats := &TermStats{DocFreq: 10, DocCount: 1000, SumFieldLength: 10000}
+	rare := &TermStats{DocFreq: 1, DocCount: 1000, SumFieldLength: 10000}
+	for _, scorer := range []Scorer{NewBM25Scorer(), TFIDFScorer{}} {
+		assert.Equal(t, true, scorer.Score(2, 10, stats) > scorer.Score(1, 10, stats))
+		assert.Equal(t, true, scorer.Score(1, 5, stats) > scorer.Score(1, 20, stats))
+		assert.Equal(t, true, scorer.Score(1, 10, rare) > scorer.Score(1, 10, stats))
+	}
+
+	// idf = ln(1 + (1000-10+0.5)/(10+0.5)), an average length field with a tf of 1 scores idf.
+	idf := math.Log(1 + 990.5/10.5)
+	assert.Equal(t, true, math.Abs(NewBM25Scorer().Score(1, 10, stats)-idf) < 1e-9)
+}
+
+func TestTopDocs(t *testing.T) {
+	top, err := newTopDocs(3)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	for i := 0; i < 100; i++ {
+		top.add(ScoredDoc{ID: fmt.Sprintf("doc:%02d", i), Score: float64(i % 10)})
+	}
+	assert.Equal(t, []ScoredDoc{{"doc:09", 9}, {"doc:19", 9}, {"doc:29", 9}}, top.results())
+
+	if _, err := newTopDocs(0); err == nil {
+		t.Fatalf("expected an error for k == 0")
+	}
+}
+
+func scoringTestDocs() []Document {
+	now := time.Now()
+	bodies := []string{
+		"the fox",
+		"the quick brown fox jumps over the lazy dog by the river bank",
+		"fox fox fox",
+		"a dog and a cat",
+		"the fox and the hound",
+		"fox hunting season",
+	}
+	docs := []Document{}
+	for i, body := range bodies {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{
+			"body":  NewStringVal(body),
+			"group": value.NewIntValue(int64(i % 2)),
+		}, now))
+	}
+	return docs
+}
+
+func TestRunTopK(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("body", NewTextFieldMapping("standard")))
+	if err := segment.IndexDocuments(context.TODO(), scoringTestDocs()); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	ids := func(docs []ScoredDoc) []string {
+		ids := []string{}
+		for _, doc := range docs {
+			ids = append(ids, doc.ID)
+		}
+		return ids
+	}
+
+	{ // test case - more occurrences and shorter fields rank higher
+		docs, err := NewQueryBuilder(context.TODO(), segment).And(&RegExTermQuery{"body", "fox"}).RunTopK(3, NewBM25Scorer())
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:2", "doc:0", "doc:5"}, ids(docs))
+		assert.Equal(t, true, docs[0].Score > docs[1].Score)
+	}
+
+	{ // test case - filters don't change the scores
+		docs, err := NewQueryBuilder(context.TODO(), segment).
+			And(&RegExTermQuery{"body", "fox"}, &NumericRangeQuery{"group", value.NewIntValue(1), nil, true, false}).
+			RunTopK(10, TFIDFScorer{})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:5", "doc:1"}, ids(docs))
+	}
+
+	{ // test case - queries without terms match with a score of 0
+		docs, err := NewQueryBuilder(context.TODO(), segment).
+			And(&NumericRangeQuery{"group", value.NewIntValue(0), value.NewIntValue(0), true, true}).
+			RunTopK(2, NewBM25Scorer())
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []ScoredDoc{{"doc:0", 0}, {"doc:2", 0}}, docs)
+	}
+}
+
+func TestScoringWithoutPositions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the term frequencies of a field without positions are the same as with them.
+	positional := NewSegment()
+	defer positional.Close()
+	positional.SetMapping(NewIndexMapping().AddField("body", NewTextFieldMapping("standard")))
+	fm := NewTextFieldMapping("standard")
+	fm.Positions = false
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("body", fm))
+	for _, seg := range []*Segment{positional, segment} {
+		if err := seg.IndexDocuments(context.TODO(), scoringTestDocs()); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	query := &TermQuery{Field: "body", Term: "fox"}
+	expected, err := NewQueryBuilder(context.TODO(), positional).And(query).RunTopK(3, NewBM25Scorer())
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, "doc:2", expected[0].ID)
+
+	if err := segment.WriteToDir(dir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	opened, err := OpenSegment(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer opened.Close()
+	merged, err := mergeSegments([]*Segment{opened}, []*roaring.Bitmap{opened.liveDocs})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer merged.Close()
+	// the opened segment is searched twice, the second time with its frequencies cached.
+	for _, seg := range []*Segment{segment, opened, opened, merged} {
+		actual, err := NewQueryBuilder(context.TODO(), seg).And(query).RunTopK(3, NewBM25Scorer())
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestSearchTopKAcrossSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapping := NewIndexMapping().AddField("body", NewTextFieldMapping("standard"))
+	idx, err := NewIndex(dir, &IndexOptions{Mapping: mapping, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	docs := scoringTestDocs()
+	for i := 0; i < len(docs); i += 2 {
+		if err := idx.IndexDocuments(context.TODO(), docs[i:i+2]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	assert.Equal(t, 3, len(idx.Segments()))
+
+	// the same docs in a single segment must score the same.
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(mapping.Clone())
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	query := &PhraseQuery{"body", []string{"fox"}}
+	expected, err := NewQueryBuilder(context.TODO(), segment).And(query).RunTopK(4, NewBM25Scorer())
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	actual, err := idx.SearchTopK(context.TODO(), 4, NewBM25Scorer(), query)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 4, len(actual))
+	for i := range expected {
+		assert.Equal(t, expected[i].ID, actual[i].ID)
+		assert.Equal(t, true, math.Abs(expected[i].Score-actual[i].Score) < 1e-9)
+	}
+}
@@ -0,0 +1,518 @@
+package index
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+)
+
+// DefaultSearchSize is the number of hits returned by a SearchRequest without a Size.
+const DefaultSearchSize = 10
+
+// SortBy is what a SortField sorts hits by.
+type SortBy int
+
+const (
+	// SortByField sorts by the doc values of SortField.Field.
+	SortByField SortBy = iota
+	// SortByScore sorts by relevance, the score of the SearchRequest's Scorer.
+	SortByScore
+	// SortByTimestamp sorts by the docs' Document.Ts().
+	SortByTimestamp
+)
+
+// SortField is a key hits are sorted by.  Fields with several values sort by their smallest
+// value in ascending order, and their largest in descending order.  Docs without a value sort
+// after the docs with one in either order, unless MissingFirst is set.
+type SortField struct {
+	Field        string
+	By           SortBy
+	Desc         bool
+	MissingFirst bool
+}
+
+// SearchRequest is a search over every segment of an index.  The hits are sorted by Sort, then
+// by doc ID, and a request without a Sort sorts by descending score.
+//
+// Pages can be fetched with From and Size, but deep pages are cheaper with SearchAfter: set it
+// to the Sort of the last hit of the previous page, and leave From at 0.
+type SearchRequest struct {
+	// Query matches the docs to return, a nil Query matches every doc.
+	Query       Query
+	Sort        []SortField
+	From        int
+	Size        int
+	SearchAfter []value.Value
+	// Scorer scores the hits when they're sorted by score, the default is BM25.
+	Scorer Scorer
+	// Aggs are run over every doc matching the query, not just the page of hits.
+	Aggs map[string]Aggregation
+	// AllowPartialResults returns the results found before the ctx was cancelled, or its deadline
+	// passed, with the response's TimedOut set, instead of failing with a QueryCancelledError.
+	AllowPartialResults bool
+}
+
+// SearchResponse is the page of hits of a SearchRequest.
+type SearchResponse struct {
+	// Total is the number of docs which matched the query.
+	Total int
+	Hits  []*Hit
+	Aggs  map[string]*AggResult
+	// TimedOut is set when the search was cancelled before it was through every segment, the
+	// response then only has the hits collected before then, and its Total is the number of docs
+	// it collected them from.  See SearchRequest.AllowPartialResults.
+	TimedOut bool
+}
+
+// Hit is a doc returned by a SearchRequest.  Sort holds the doc's values for each of the
+// request's SortFields, with a value.NilValue for missing values, followed by the doc's ID.
+type Hit struct {
+	ID    string
+	Score float64
+	Sort  []value.Value
+}
+
+// sortKey is a sort value that compares the same way in every segment.  Strings are compared as
+// strings, ints, numbers, times, bools and scores by their encoding, and an int with a number
+// by their values.  kind is the value.ValueType the key decodes to.
+type sortKey struct {
+	missing bool
+	kind    value.ValueType
+	str     string
+	num     uint64
+}
+
+var missingSortKey = sortKey{missing: true}
+
+func (k sortKey) value() value.Value {
+	switch {
+	case k.missing:
+		return value.NewNilValue()
+	case k.kind == value.StringType:
+		return NewStringVal(k.str)
+	case k.kind == value.BoolType:
+		return value.NewBoolValue(k.num == 1)
+	}
+	return decodeNumeric(k.kind, k.num)
+}
+
+// newSortKey returns the key of a SearchAfter value.
+func newSortKey(val value.Value) (sortKey, error) {
+	if val == nil || val.Nil() {
+		return missingSortKey, nil
+	}
+	switch val.Type() {
+	case value.StringType:
+		return sortKey{kind: value.StringType, str: val.ToString()}, nil
+	case value.BoolType:
+		return boolSortKey(val.Value().(bool)), nil
+	case value.IntType:
+		return sortKey{kind: value.IntType, num: encodeInt64(val.Value().(int64))}, nil
+	case value.NumberType:
+		return sortKey{kind: value.NumberType, num: encodeFloat64(val.Value().(float64))}, nil
+	case value.TimeType:
+		return sortKey{kind: value.TimeType, num: encodeTime(val.Value().(time.Time))}, nil
+	}
+	return sortKey{}, fmt.Errorf("can't sort by a %v value", val.Type())
+}
+
+func boolSortKey(b bool) sortKey {
+	if b {
+		return sortKey{kind: value.BoolType, num: 1}
+	}
+	return sortKey{kind: value.BoolType}
+}
+
+// compare orders the keys by the sort field.
+func (sf *SortField) compare(a, b sortKey) int {
+	if a.missing || b.missing {
+		switch {
+		case a.missing && b.missing:
+			return 0
+		case a.missing == sf.MissingFirst:
+			return -1
+		}
+		return 1
+	}
+	var c int
+	switch {
+	case a.kind == value.IntType && b.kind == value.NumberType:
+		c = compareIntNumber(decodeInt64(a.num), decodeFloat64(b.num))
+	case a.kind == value.NumberType && b.kind == value.IntType:
+		c = -compareIntNumber(decodeInt64(b.num), decodeFloat64(a.num))
+	default:
+		c = strings.Compare(a.str, b.str)
+		if c == 0 && a.num != b.num {
+			c = 1
+			if a.num < b.num {
+				c = -1
+			}
+		}
+	}
+	if sf.Desc {
+		return -c
+	}
+	return c
+}
+
+// compareIntNumber compares an int with a number without converting the int to a float64, which
+// would round ints above 2^53.  NaN sorts after every int, as it does after every number.
+func compareIntNumber(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f) || f >= math.MaxInt64:
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+	t := math.Trunc(f)
+	switch ti := int64(t); {
+	case i < ti:
+		return -1
+	case i > ti:
+		return 1
+	case f > t:
+		return -1
+	case f < t:
+		return 1
+	}
+	return 0
+}
+
+// sortedHit is a hit along with its sort keys.
+type sortedHit struct {
+	id    string
+	score float64
+	keys  []sortKey
+}
+
+// compareHits orders hits by the sort fields, and then by ID.
+func compareHits(fields []SortField, a, b *sortedHit) int {
+	for i := range fields {
+		if c := fields[i].compare(a.keys[i], b.keys[i]); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// topHits keeps the first k hits in a max heap, so the last of them is on top and can be
+// replaced by a hit that sorts before it in log(k).
+type topHits struct {
+	k      int
+	fields []SortField
+	hits   []*sortedHit
+}
+
+func (t *topHits) Len() int           { return len(t.hits) }
+func (t *topHits) Less(i, j int) bool { return compareHits(t.fields, t.hits[i], t.hits[j]) > 0 }
+func (t *topHits) Swap(i, j int)      { t.hits[i], t.hits[j] = t.hits[j], t.hits[i] }
+func (t *topHits) Push(x interface{}) { t.hits = append(t.hits, x.(*sortedHit)) }
+func (t *topHits) Pop() (x interface{}) {
+	x, t.hits = t.hits[len(t.hits)-1], t.hits[:len(t.hits)-1]
+	return x
+}
+
+// wants returns true if a hit with the keys and ID would make it into the top k.
+func (t *topHits) wants(hit *sortedHit) bool {
+	return len(t.hits) < t.k || compareHits(t.fields, hit, t.hits[0]) < 0
+}
+
+func (t *topHits) add(hit *sortedHit) {
+	if len(t.hits) < t.k {
+		heap.Push(t, hit)
+	} else {
+		t.hits[0] = hit
+		heap.Fix(t, 0)
+	}
+}
+
+// results returns the hits in order.
+func (t *topHits) results() []*sortedHit {
+	hits := make([]*sortedHit, len(t.hits))
+	copy(hits, t.hits)
+	sort.Slice(hits, func(i, j int) bool { return compareHits(t.fields, hits[i], hits[j]) < 0 })
+	return hits
+}
+
+// sortKeyReader reads a doc's key for a sort field.
+type sortKeyReader func(did uint32, score float64) sortKey
+
+// sortKeyReaders returns the readers of the segment's keys for each sort field.  Docs in
+// segments without the field are missing a value.
+func (seg *Segment) sortKeyReaders(fields []SortField) ([]sortKeyReader, error) {
+	readers := make([]sortKeyReader, len(fields))
+	for i := range fields {
+		sf := &fields[i]
+		switch sf.By {
+		case SortByScore:
+			readers[i] = func(_ uint32, score float64) sortKey {
+				return sortKey{kind: value.NumberType, num: encodeFloat64(score)}
+			}
+		case SortByTimestamp:
+			readers[i] = seg.fieldSortKeyReader(TimestampField, sf.Desc)
+		case SortByField:
+			if fieldID, ok := seg.fieldToFieldId[sf.Field]; ok {
+				if _, ok := seg.docValuesByID(fieldID); !ok {
+					return nil, fmt.Errorf("can't sort by field %v, it doesn't have doc values", sf.Field)
+				}
+			}
+			readers[i] = seg.fieldSortKeyReader(sf.Field, sf.Desc)
+		default:
+			return nil, fmt.Errorf("unknown sort: %v", sf.By)
+		}
+	}
+	return readers, nil
+}
+
+// fieldSortKeyReader reads the keys of a field's doc values, the smallest of a doc's values when
+// sorting in ascending order and the largest when descending.
+func (seg *Segment) fieldSortKeyReader(field string, desc bool) sortKeyReader {
+	fieldID, ok := seg.fieldToFieldId[field]
+	if !ok {
+		return func(uint32, float64) sortKey { return missingSortKey }
+	}
+	dv, ok := seg.docValuesByID(fieldID)
+	if !ok {
+		return func(uint32, float64) sortKey { return missingSortKey }
+	}
+	switch dv := dv.(type) {
+	case *SortedSetDocValues:
+		var ords []uint32
+		return func(did uint32, _ float64) sortKey {
+			ords = dv.Ords(ords[:0], did)
+			switch {
+			case len(ords) == 0:
+				return missingSortKey
+			case desc:
+				return sortKey{kind: value.StringType, str: dv.Term(ords[len(ords)-1])}
+			}
+			return sortKey{kind: value.StringType, str: dv.Term(ords[0])}
+		}
+	case *NumericDocValues:
+		var vals []uint64
+		return func(did uint32, _ float64) sortKey {
+			vals = dv.Encoded(vals[:0], did)
+			if len(vals) == 0 {
+				return missingSortKey
+			}
+			v := vals[0]
+			if desc {
+				v = vals[len(vals)-1]
+			}
+			return sortKey{kind: dv.kind, num: v}
+		}
+	case *BoolDocValues:
+		return func(did uint32, _ float64) sortKey {
+			hasTrue, hasFalse := dv.Has(did, true), dv.Has(did, false)
+			switch {
+			case !hasTrue && !hasFalse:
+				return missingSortKey
+			case desc:
+				return boolSortKey(hasTrue)
+			}
+			return boolSortKey(!hasFalse)
+		}
+	}
+	return func(uint32, float64) sortKey { return missingSortKey }
+}
+
+// Execute runs the search request against a snapshot of the index.  See Snapshot.Execute.
+func (idx *Index) Execute(ctx context.Context, req *SearchRequest) (*SearchResponse, error) {
+	snap := idx.Snapshot()
+	defer snap.Close()
+	return snap.Execute(ctx, req)
+}
+
+// Execute runs the search request against every segment of the snapshot, and returns the page
+// of hits it asked for.  Paging through the hits of a snapshot with SearchAfter sees the same
+// docs on every page.
+func (snap *Snapshot) Execute(ctx context.Context, req *SearchRequest) (*SearchResponse, error) {
+	if req.From < 0 || req.Size < 0 {
+		return nil, fmt.Errorf("from and size can't be negative, from:%v size:%v", req.From, req.Size)
+	}
+	size := req.Size
+	if size == 0 {
+		size = DefaultSearchSize
+	}
+	fields := req.Sort
+	if len(fields) == 0 {
+		fields = []SortField{{By: SortByScore, Desc: true}}
+	}
+	scored := false
+	for _, sf := range fields {
+		scored = scored || sf.By == SortByScore
+	}
+	scorer := req.Scorer
+	if scorer == nil {
+		scorer = NewBM25Scorer()
+	}
+
+	var after *sortedHit
+	if req.SearchAfter != nil {
+		if len(req.SearchAfter) != len(fields)+1 {
+			return nil, fmt.Errorf("search after needs %d values, a value per sort field and the doc ID: got:%d",
+				len(fields)+1, len(req.SearchAfter))
+		}
+		after = &sortedHit{keys: make([]sortKey, len(fields))}
+		for i, val := range req.SearchAfter[:len(fields)] {
+			key, err := newSortKey(val)
+			if err != nil {
+				return nil, fmt.Errorf("bad search after value %d: err:%v", i, err)
+			}
+			after.keys[i] = key
+		}
+		after.id = req.SearchAfter[len(fields)].ToString()
+	}
+
+	segs := snap.segs
+	res := &SearchResponse{Hits: []*Hit{}}
+	// timedOut is true if err cancelled a search which allows partial results, the search then
+	// stops and returns what it has.
+	timedOut := func(err error) bool {
+		if _, ok := err.(*QueryCancelledError); ok && req.AllowPartialResults {
+			res.TimedOut = true
+			return true
+		}
+		return false
+	}
+
+	matches := make([]*roaring.Bitmap, len(segs))
+	stats := collectionStats{}
+	for i, s := range segs {
+		docs, err := s.seg.matchingDocs(ctx, req.Query)
+		if _, ok := err.(*FieldNotFoundError); ok {
+			continue
+		} else if timedOut(err) {
+			break
+		} else if err != nil {
+			return nil, searchError(s.name, err)
+		}
+		if scored && req.Query != nil {
+			if err := s.seg.queryTerms(ctx, []Query{req.Query}, stats); timedOut(err) {
+				break
+			} else if err != nil {
+				return nil, searchError(s.name, err)
+			}
+		}
+		matches[i] = docs
+	}
+	if scored {
+		for _, s := range segs {
+			if err := s.seg.addTermStats(stats); err != nil {
+				return nil, searchError(s.name, err)
+			}
+		}
+	}
+
+	// a search which timed out stops collecting at its next check, and returns the hits collected
+	// so far.  Its Total only counts the docs it got through, so it agrees with the hits.
+	top := &topHits{k: req.From + size, fields: fields}
+	for i, s := range segs {
+		if matches[i] == nil {
+			continue
+		}
+		collected, err := s.seg.collectSorted(ctx, matches[i], stats, scored, scorer, after, top)
+		res.Total += collected
+		if timedOut(err) {
+			break
+		} else if err != nil {
+			return nil, searchError(s.name, err)
+		}
+		if req.Aggs == nil {
+			continue
+		}
+		if err := queryCancelled(ctx); timedOut(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		aggs, err := collectAggs(s.seg, matches[i], req.Aggs)
+		if err != nil {
+			return nil, searchError(s.name, err)
+		}
+		if res.Aggs == nil {
+			res.Aggs = aggs
+		} else {
+			mergeAggResults(res.Aggs, aggs)
+		}
+	}
+	if req.Aggs != nil {
+		if res.Aggs == nil {
+			res.Aggs = map[string]*AggResult{}
+		}
+		finishAggs(req.Aggs, res.Aggs)
+	}
+
+	hits := top.results()
+	if req.From >= len(hits) {
+		return res, nil
+	}
+	for _, h := range hits[req.From:] {
+		hit := &Hit{ID: h.id, Score: h.score, Sort: make([]value.Value, 0, len(h.keys)+1)}
+		for _, key := range h.keys {
+			hit.Sort = append(hit.Sort, key.value())
+		}
+		hit.Sort = append(hit.Sort, NewStringVal(h.id))
+		res.Hits = append(res.Hits, hit)
+	}
+	return res, nil
+}
+
+// matchingDocs returns the live docs matching the query, or every live doc for a nil query.
+func (seg *Segment) matchingDocs(ctx context.Context, query Query) (*roaring.Bitmap, error) {
+	if query == nil {
+		return seg.liveDocs.Clone(), nil
+	}
+	return seg.execute(ctx, query)
+}
+
+// collectSorted adds the docs which sort after the after hit, if there is one, to top.  It
+// returns the number of docs it went through, which is less than the number of docs if it's
+// cancelled.
+func (seg *Segment) collectSorted(ctx context.Context, docs *roaring.Bitmap, stats collectionStats, scored bool, scorer Scorer, after *sortedHit, top *topHits) (int, error) {
+	readers, err := seg.sortKeyReaders(top.fields)
+	if err != nil {
+		return 0, err
+	}
+	var scores map[uint32]float64
+	if scored {
+		if scores, err = seg.docScores(ctx, docs, stats, scorer); err != nil {
+			return 0, err
+		}
+	}
+
+	hit := &sortedHit{keys: make([]sortKey, len(readers))}
+	docIter := docs.Iterator()
+	n := 0
+	for ; docIter.HasNext(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return n, err
+			}
+		}
+		did := docIter.Next()
+		externalID, ok := seg.docIDInternalToExternal[did]
+		if !ok {
+			return n, fmt.Errorf("found an internal docID without an external doc ID mapping: id:%v", did)
+		}
+		hit.id, hit.score = externalID, scores[did]
+		for i, read := range readers {
+			hit.keys[i] = read(did, hit.score)
+		}
+		if after != nil && compareHits(top.fields, hit, after) <= 0 {
+			continue
+		}
+		if top.wants(hit) {
+			top.add(hit)
+			hit = &sortedHit{keys: make([]sortKey, len(readers))}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,251 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestSearchRequestSort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapping := NewIndexMapping().AddField("bio", NewTextFieldMapping("standard"))
+	idx, err := NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true, Mapping: mapping})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	people := []struct {
+		name string
+		age  int64
+		bio  string
+	}{
+		{"kevin", 35, "the quick brown fox"},
+		{"kelly", 28, "a lazy dog"},
+		{"john", 41, "quick quick quick"},
+		{"jane", 19, "brown horse"},
+		{"eric", 0, "no age"},
+		{"amy", 28, "quick"},
+	}
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	// two docs per segment, so every sort has to merge hits across segments.
+	for i := 0; i < len(people); i += 2 {
+		docs := []Document{}
+		for j, p := range people[i : i+2] {
+			row := map[string]value.Value{"name": NewStringVal(p.name), "bio": NewStringVal(p.bio)}
+			if p.age > 0 {
+				row["age"] = value.NewIntValue(p.age)
+			}
+			// the timestamps are in the reverse order of the names.
+			ts := start.Add(time.Duration(len(people)-i-j) * time.Hour)
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i+j), row, ts))
+		}
+		if err := idx.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	assert.Equal(t, 3, len(idx.Segments()))
+
+	search := func(req *SearchRequest) []string {
+		res, err := idx.Execute(context.TODO(), req)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		names := []string{}
+		for _, hit := range res.Hits {
+			var i int
+			fmt.Sscanf(hit.ID, "doc:%d", &i)
+			names = append(names, people[i].name)
+		}
+		return names
+	}
+
+	{ // test case - sort by a string field
+		assert.Equal(t, []string{"amy", "eric", "jane", "john", "kelly", "kevin"},
+			search(&SearchRequest{Sort: []SortField{{Field: "name"}}}))
+		assert.Equal(t, []string{"kevin", "kelly", "john"},
+			search(&SearchRequest{Sort: []SortField{{Field: "name", Desc: true}}, Size: 3}))
+	}
+	{ // test case - sort by a numeric field, ties broken by the next sort field, missing values last
+		assert.Equal(t, []string{"jane", "amy", "kelly", "kevin", "john", "eric"},
+			search(&SearchRequest{Sort: []SortField{{Field: "age"}, {Field: "name"}}}))
+		assert.Equal(t, []string{"john", "kevin", "kelly", "amy", "jane", "eric"},
+			search(&SearchRequest{Sort: []SortField{{Field: "age", Desc: true}, {Field: "name", Desc: true}}}))
+		assert.Equal(t, []string{"eric", "jane"},
+			search(&SearchRequest{Sort: []SortField{{Field: "age", MissingFirst: true}}, Size: 2}))
+	}
+	{ // test case - sort by timestamp
+		assert.Equal(t, []string{"amy", "eric", "jane"},
+			search(&SearchRequest{Sort: []SortField{{By: SortByTimestamp}}, Size: 3}))
+	}
+	{ // test case - sort by score, the default
+		assert.Equal(t, []string{"john", "amy", "kevin"},
+			search(&SearchRequest{Query: &TermQuery{Field: "bio", Term: "quick"}}))
+		res, err := idx.Execute(context.TODO(), &SearchRequest{Query: &TermQuery{Field: "bio", Term: "quick"}})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 3, res.Total)
+		assert.Equal(t, true, res.Hits[0].Score > res.Hits[2].Score)
+		assert.Equal(t, value.NewNumberValue(res.Hits[0].Score), res.Hits[0].Sort[0])
+	}
+	{ // test case - from and size
+		assert.Equal(t, []string{"jane", "john"},
+			search(&SearchRequest{Sort: []SortField{{Field: "name"}}, From: 2, Size: 2}))
+		assert.Equal(t, []string{},
+			search(&SearchRequest{Sort: []SortField{{Field: "name"}}, From: 10}))
+	}
+	{ // test case - search after pages through every hit once
+		sorts := []SortField{{Field: "age", Desc: true}}
+		names := []string{}
+		var after []value.Value
+		for page := 0; page < 10; page++ {
+			res, err := idx.Execute(context.TODO(), &SearchRequest{Sort: sorts, Size: 2, SearchAfter: after})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(res.Hits) == 0 {
+				break
+			}
+			for _, hit := range res.Hits {
+				var i int
+				fmt.Sscanf(hit.ID, "doc:%d", &i)
+				names = append(names, people[i].name)
+			}
+			after = res.Hits[len(res.Hits)-1].Sort
+		}
+		// kelly and amy are tied, and are ordered by their IDs.
+		assert.Equal(t, []string{"john", "kevin", "kelly", "amy", "jane", "eric"}, names)
+	}
+	{ // test case - a cancelled search fails, unless it allows partial results
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := &SearchRequest{Query: &TermQuery{Field: "bio", Term: "quick"}}
+		_, err := idx.Execute(ctx, req)
+		assert.Equal(t, true, errors.Is(err, ErrQueryCancelled))
+		req.AllowPartialResults = true
+		res, err := idx.Execute(ctx, req)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, true, res.TimedOut)
+		assert.Equal(t, 0, len(res.Hits))
+		assert.Equal(t, 0, res.Total)
+
+		// wherever the search is cancelled, while it's matching or collecting, its Total counts
+		// the docs it collected the hits from.
+		for n := 0; n < 12; n++ {
+			res, err := idx.Execute(&cancelAfterCtx{Context: context.Background(), n: n}, req)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equalf(t, res.Total, len(res.Hits), "n:%v", n)
+		}
+
+		// the search is cancelled when it gets to the third segment, so it has the hits of the
+		// first two.
+		res, err = idx.Execute(&cancelAfterCtx{Context: context.Background(), n: 2},
+			&SearchRequest{Sort: []SortField{{Field: "name"}}, AllowPartialResults: true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, true, res.TimedOut)
+		names := []string{}
+		for _, hit := range res.Hits {
+			var i int
+			fmt.Sscanf(hit.ID, "doc:%d", &i)
+			names = append(names, people[i].name)
+		}
+		assert.Equal(t, []string{"jane", "john", "kelly", "kevin"}, names)
+		assert.Equal(t, 4, res.Total)
+	}
+	{ // test case - bad requests
+		_, err := idx.Execute(context.TODO(), &SearchRequest{Sort: []SortField{{Field: "bio"}}})
+		assert.NotEqual(t, nil, err)
+		_, err = idx.Execute(context.TODO(), &SearchRequest{SearchAfter: []value.Value{NewStringVal("doc:1")}})
+		assert.NotEqual(t, nil, err)
+		_, err = idx.Execute(context.TODO(), &SearchRequest{Size: -1})
+		assert.NotEqual(t, nil, err)
+	}
+}
+
+func TestSearchRequestSortLargeInts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := NewIndex(dir, &IndexOptions{DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	// 2^53 and 2^53+1 are the same float64, doc:1 sorts after doc:2 by value but before it by ID.
+	batches := [][]Document{
+		{
+			NewDocument("doc:1", map[string]value.Value{"id": value.NewIntValue(1<<53 + 1)}, time.Time{}),
+			NewDocument("doc:2", map[string]value.Value{"id": value.NewIntValue(1 << 53)}, time.Time{}),
+		},
+		// the field holds numbers in the second segment.
+		{
+			NewDocument("doc:3", map[string]value.Value{"id": value.NewNumberValue(1 << 54)}, time.Time{}),
+			NewDocument("doc:4", map[string]value.Value{"id": value.NewNumberValue(1.5)}, time.Time{}),
+		},
+	}
+	for _, batch := range batches {
+		if err := idx.IndexDocuments(context.TODO(), batch); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	search := func(req *SearchRequest) ([]string, []*Hit) {
+		res, err := idx.Execute(context.TODO(), req)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return ids, res.Hits
+	}
+
+	{ // test case - ints are compared as ints, and with numbers by their values
+		ids, hits := search(&SearchRequest{Sort: []SortField{{Field: "id"}}})
+		assert.Equal(t, []string{"doc:4", "doc:2", "doc:1", "doc:3"}, ids)
+		assert.Equal(t, value.NewIntValue(1<<53), hits[1].Sort[0])
+		ids, _ = search(&SearchRequest{Sort: []SortField{{Field: "id", Desc: true}}})
+		assert.Equal(t, []string{"doc:3", "doc:1", "doc:2", "doc:4"}, ids)
+	}
+	{ // test case - and so are the values of search after
+		ids, _ := search(&SearchRequest{Sort: []SortField{{Field: "id"}},
+			SearchAfter: []value.Value{value.NewIntValue(1 << 53), NewStringVal("doc:2")}})
+		assert.Equal(t, []string{"doc:1", "doc:3"}, ids)
+		ids, _ = search(&SearchRequest{Sort: []SortField{{Field: "id"}},
+			SearchAfter: []value.Value{value.NewIntValue(1), NewStringVal("doc:0")}})
+		assert.Equal(t, []string{"doc:4", "doc:2", "doc:1", "doc:3"}, ids)
+	}
+	{ // test case - compareIntNumber
+		assert.Equal(t, 0, compareIntNumber(5, 5))
+		assert.Equal(t, -1, compareIntNumber(5, 5.5))
+		assert.Equal(t, 1, compareIntNumber(-5, -5.5))
+		assert.Equal(t, 1, compareIntNumber(1<<53+1, 1<<53))
+		assert.Equal(t, -1, compareIntNumber(math.MaxInt64, math.Inf(1)))
+		assert.Equal(t, 1, compareIntNumber(math.MinInt64, math.Inf(-1)))
+		assert.Equal(t, -1, compareIntNumber(0, math.NaN()))
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"runtime"
 	"sort"
+	"sync"
 
 	"github.com/RoaringBitmap/roaring"
-	"github.com/araddon/gou"
 	"github.com/araddon/qlbridge/value"
 	"github.com/couchbase/vellum"
 )
@@ -24,10 +26,79 @@ type Segment struct {
 
 	postings map[uint32]TermPostingList // termID --> list of doc Ids // TODO replace with roaring bitmaps...
 
+	// positions are the positional postings of the terms of text fields, termID --> internal doc
+	// ID --> positions.  The positions of opened segments are kept encoded in positionBytes, and
+	// decoded into positionCache when a query needs them.
+	positions     map[uint32]map[uint32][]uint32
+	positionBytes map[uint32][]byte
+	positionCache map[uint32]map[uint32][]uint32
+
+	// freqs are the frequencies of the terms of fields without positions, termID --> internal doc
+	// ID --> frequency, for the docs a term occurs in more than once.  Like the positions, opened
+	// segments keep them encoded in freqBytes and decode them into freqCache.
+	freqs     map[uint32]map[uint32]uint32
+	freqBytes map[uint32][]byte
+	freqCache map[uint32]map[uint32]uint32
+
+	// norms are the lengths of the string fields, fieldID --> internal doc ID --> length, and
+	// normStats their totals.
+	norms     map[uint32][]uint32
+	normStats map[uint32]*fieldStats
+
+	// numericFields are the bkd trees of the int, number and time fields.
+	numericFields map[uint32]*numericField
+
+	// boolFields are the true and false docs of the bool fields.
+	boolFields map[uint32]*boolField
+
+	// stored are the encoded stored fields of each doc, by internal doc ID.  Opened segments keep
+	// them in compressed blocks of storedBlockSize docs instead.
+	stored           map[uint32][]byte
+	storedBlockBytes [][]byte
+
+	// docValuesBuilders collect the doc values of an in-memory segment's fields, and docValues
+	// are the columns built from them, or loaded by OpenSegment.  fieldID --> column.
+	docValuesBuilders map[uint32]*docValuesBuilder
+	docValues         map[uint32]docValues
+
+	// mapping decides how each field is indexed, fields added by its dynamic policy are added to
+	// it as docs are indexed.
+	mapping *IndexMapping
+
+	// fields holds the terms of each field, so the term dictionaries can be rebuilt when later
+	// calls to IndexDocuments add new terms to a field.
+	fields IndexableFields
+
 	// docid to doc
 	docIdInc                uint32
 	docIDInternalToExternal map[uint32]string
 	docIDExternalToInternal map[string]uint32
+
+	// liveDocs is the set of internal doc IDs which haven't been deleted or replaced by an update.
+	// Deleted docs are left in the posting lists, every query is and'ed with liveDocs to remove
+	// them, and merges drop them.
+	liveDocs *roaring.Bitmap
+
+	// dir, file and data are only set on segments loaded with OpenSegment.  The term dictionaries
+	// and postings of those segments point into data, which is the memory mapped segment file.
+	dir  string
+	file *os.File
+	data []byte
+
+	// tmpDir holds the bkd trees of the numeric fields of an in-memory segment.
+	tmpDir string
+
+	// rwlock makes the segment safe for one writer and many readers.  readers: the Query
+	// methods, QueryBuilder, Document, the doc values, NumDocs, WriteToDir.  writers:
+	// IndexDocuments, DeleteDocuments, SetMapping, Close.  The unexported methods assume it's held.
+	// It's a pointer, so the point-in-time views of the segment share it.
+	rwlock *sync.RWMutex
+	// cacheMu guards the FSTs, doc values, positions and frequencies readers load into
+	// termDicFstCache, docValues, positionCache and freqCache.
+	cacheMu *sync.Mutex
+
+	// workers is the size of the worker pool IndexDocuments analyzes docs and builds FSTs with.
+	workers int
 }
 
 func NewSegment() *Segment {
@@ -38,94 +109,155 @@ func NewSegment() *Segment {
 		postings:                map[uint32]TermPostingList{},
 		docIDInternalToExternal: map[uint32]string{},
 		docIDExternalToInternal: map[string]uint32{},
+		liveDocs:                roaring.New(),
 
 		termDicFstCache: map[uint32]*vellum.FST{},
+		positions:       map[uint32]map[uint32][]uint32{},
+		positionBytes:   map[uint32][]byte{},
+		positionCache:   map[uint32]map[uint32][]uint32{},
+		freqs:           map[uint32]map[uint32]uint32{},
+		freqBytes:       map[uint32][]byte{},
+		freqCache:       map[uint32]map[uint32]uint32{},
+		norms:           map[uint32][]uint32{},
+		normStats:       map[uint32]*fieldStats{},
+		numericFields:   map[uint32]*numericField{},
+		boolFields:      map[uint32]*boolField{},
+		stored:          map[uint32][]byte{},
+
+		docValuesBuilders: map[uint32]*docValuesBuilder{},
+		docValues:         map[uint32]docValues{},
+		mapping:           NewIndexMapping(),
+
+		fields: IndexableFields{},
+
+		rwlock:  &sync.RWMutex{},
+		cacheMu: &sync.Mutex{},
+		workers: runtime.GOMAXPROCS(0),
 	}
 }
 
+// SetMapping sets the mapping used to index docs, the segment adds new dynamically mapped
+// fields to it.
+func (seg *Segment) SetMapping(m *IndexMapping) {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
+	seg.mapping = m
+}
+
+// SetAnalyzer sets the analyzer used to split the field's string values into terms, it maps the
+// field as a text field.
+func (seg *Segment) SetAnalyzer(field string, analyzer Analyzer) {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
+	seg.mapping.setAnalyzer(field, analyzer)
+}
+
+// Mapping returns the segment's mapping.
+func (seg *Segment) Mapping() *IndexMapping {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.mapping
+}
+
+// IndexDocuments indexes the docs, replacing older versions of docs already in the segment.  Docs
+// which don't match the mapping aren't indexed, they're returned as IndexingErrors once the rest
+// of the batch has been indexed.  A batch whose ctx is cancelled returns ctx's error, and leaves
+// the segment as it was.
 func (seg *Segment) IndexDocuments(ctx context.Context, docs []Document) error {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
+	if seg.data != nil {
+		return fmt.Errorf("segment is read-only, it was loaded from disk")
+	}
+	return seg.indexDocuments(ctx, docs)
+}
 
-	// TODO for performance pass in a count of docs * fields so we can presize the array?
-	// TODO is it faster to count the terms first, so the array can be an exact size
-	fields := make(IndexableFields, 0)
-
-	for _, doc := range docs {
-		// TODO For performance we'll assume that each docId is unique?  That way we can just increment
-		//      the docIdInc counter on each doc without checking if the doc already exists.
-		inDocID := uint32(0) // internal document id
-		if did, ok := seg.docIDExternalToInternal[doc.ID()]; ok {
-			inDocID = did
-		} else {
-			inDocID = seg.docIdInc
-			seg.docIDExternalToInternal[doc.ID()] = inDocID
-			seg.docIDInternalToExternal[inDocID] = doc.ID()
-			// fmt.Println(doc.DocID)
-			seg.docIdInc++
+// indexNumericValue adds a numeric, date or geo value of a doc to its field's bkd trees.
+func (seg *Segment) indexNumericValue(inDocID uint32, mv mappedValue) error {
+	switch mv.mapping.Type {
+	case FieldTypeNumeric, FieldTypeDate:
+		if err := seg.processNumericTerm(inDocID, mv.field, mv.val); err != nil {
+			return fmt.Errorf("failed to index field %v: err:%v", mv.field, err)
 		}
-
-		for field, fieldTerm := range doc.Row() {
-			if fieldTerm.Nil() {
-				// TODO log and continue
-				continue
-			}
-			if fieldTerm.Err() {
-				// TODO log and continue
-				continue
-			}
-			// TODO add a mappings setting for the index, and look up the field's mappings
-			//      to ensure that the term type match's the mapping type.
-			switch fieldTerm.Type() {
-			case value.StringType:
-				seg.processStringTerm(fields, inDocID, field, fieldTerm)
-			default:
-				gou.InfoCtx(ctx, "Type %v isn't currently supported.", fieldTerm.Type())
-				continue
-			}
+	case FieldTypeGeo:
+		lat, lon, _ := geoPoint(mv.val)
+		if err := seg.processNumericTerm(inDocID, mv.field+".lat", value.NewNumberValue(lat)); err != nil {
+			return fmt.Errorf("failed to index field %v: err:%v", mv.field, err)
+		}
+		if err := seg.processNumericTerm(inDocID, mv.field+".lon", value.NewNumberValue(lon)); err != nil {
+			return fmt.Errorf("failed to index field %v: err:%v", mv.field, err)
 		}
 	}
+	return nil
+}
+
+// buildTermDic (re)builds the FST for all of the field's terms.
+func (seg *Segment) buildTermDic(field *IndexableField) error {
+	fst, err := buildFST(field)
+	if err != nil {
+		return err
+	}
+	seg.termDicBytes[field.FieldID] = fst
+	delete(seg.termDicFstCache, field.FieldID)
+	return nil
+}
 
-	//
-	// Build the Term Dictionary, using an FST (vellum) for string types
-	//
-	// f, err := os.Create("/tmp/term.test.dic")
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	mkFst := func() (*vellum.Builder, *bytes.Buffer, error) {
-		buff := bytes.NewBuffer([]byte{})
-		var vellumOptions *vellum.BuilderOpts
-		dic, err := vellum.New(buff, vellumOptions)
+// buildFST sorts the field's terms and returns the FST of them.
+func buildFST(field *IndexableField) ([]byte, error) {
+	sort.Sort(field.Terms)
+
+	buff := bytes.NewBuffer([]byte{})
+	var vellumOptions *vellum.BuilderOpts
+	fst, err := vellum.New(buff, vellumOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FST builder: %v", err)
+	}
+	for _, term := range field.Terms {
+		err := fst.Insert([]byte(term.Term), uint64(term.TermID))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		return dic, buff, nil
 	}
 
-	for _, field := range fields {
-		sort.Sort(field.Terms)
+	if err := fst.Close(); err != nil {
+		return nil, fmt.Errorf("vellum close failed:%v", err)
+	}
+	return buff.Bytes(), nil
+}
 
-		// TODO lets stop saving the map of term dics builders on index and
-		// save them onto the IndexableField struct
+// NumDocs returns the number of live docs in the segment.
+func (seg *Segment) NumDocs() int {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return int(seg.liveDocs.GetCardinality())
+}
 
-		fst, buff, err := mkFst()
-		if err != nil {
-			return fmt.Errorf("failed to create FST builder: %v", err)
-		}
-		for _, term := range field.Terms {
-			err := fst.Insert([]byte(term.Term), uint64(term.TermID))
-			if err != nil {
-				return err
-			}
-		}
+// DeleteDocuments deletes the docs with the given external IDs, IDs which aren't in the segment
+// are ignored.  It returns the number of docs deleted.  The deletes of segments loaded with
+// OpenSegment are written to the segment's live docs file.
+func (seg *Segment) DeleteDocuments(ids ...string) (int, error) {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
 
-		if err := fst.Close(); err != nil {
-			return fmt.Errorf("vellum close failed:%v", err)
+	// the live docs are shared with the point-in-time views of the segment, so replace them
+	// instead of modifying them.
+	liveDocs := seg.liveDocs.Clone()
+	deleted := 0
+	for _, id := range ids {
+		if did, ok := seg.docIDExternalToInternal[id]; ok && liveDocs.CheckedRemove(did) {
+			deleted++
 		}
-		seg.termDicBytes[field.FieldID] = buff.Bytes()
 	}
-
-	return nil
+	if deleted == 0 {
+		return 0, nil
+	}
+	if seg.data != nil {
+		if err := writeLiveDocs(seg.dir, liveDocs); err != nil {
+			return 0, err
+		}
+	}
+	seg.liveDocs = liveDocs
+	return deleted, nil
 }
 
 func (seg *Segment) fieldID(field string) uint32 {
@@ -139,19 +271,18 @@ func (seg *Segment) fieldID(field string) uint32 {
 	}
 }
 
-// processStringTerm processes value.Values of type string, if the wrong type is passed in then we'll get a panic
-func (seg *Segment) processStringTerm(fields IndexableFields, inDocID uint32, field string, rawTerm value.Value) {
-
+// stringTermID returns the ID of a term of a string field, the term is added to the field if
+// it's new.  The field is added to fields.
+func (seg *Segment) stringTermID(fields IndexableFields, field string, term string) uint32 {
 	fieldID := seg.fieldID(field)
 
-	term := rawTerm.Value().(string) // this will panic if you use the wrong type
-
 	// TODO is this the best way to index strutured data ?
-	iField, ok := fields[fieldID]
+	iField, ok := seg.fields[fieldID]
 	if !ok {
 		iField = NewIndexableField(field, fieldID)
-		fields[fieldID] = iField
+		seg.fields[fieldID] = iField
 	}
+	fields[fieldID] = iField
 
 	// Term ids are uniq to this instance (aka construction of) a segment.  They are not uniq across segments.
 	termID := uint32(0)
@@ -163,18 +294,7 @@ func (seg *Segment) processStringTerm(fields IndexableFields, inDocID uint32, fi
 		iField.termToTermID[term] = termID
 		// iField.terminIdInt++
 		seg.termIdInc++
+		iField.Terms = append(iField.Terms, &Term{Term: term, TermID: termID})
 	}
-
-	iField.Terms = append(iField.Terms, &Term{Term: term, TermID: termID, InternalDocId: inDocID})
-
-	// fields = append(fields, &IndexableField{InternalDocId: docID, FieldID: fieldID, Term: term, TermID: termID})
-	if list, ok := seg.postings[termID]; ok {
-		postingList := seg.postings[termID]
-		postingList.Postings().Add(inDocID)
-		postingList.TermFrequency++
-	} else {
-		list = TermPostingList{1, roaring.New()}
-		list.Postings().Add(inDocID)
-		seg.postings[termID] = list
-	}
+	return termID
 }
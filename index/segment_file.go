@@ -0,0 +1,799 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/couchbase/vellum"
+	"github.com/epsniff/sidonia/index/bkdtree"
+)
+
+// A segment is a dir holding the segment file, and a bkd tree per numeric field.  The bkd trees
+// are written first, so a segment dir without a segment file is a partial write.
+//
+// Segment file layout (all fixed width integers are big endian):
+//
+//	header:   magic(8) | formatVersion(uint32)
+//	sections: the sections listed in the table of contents, each one starts 8 byte aligned.
+//	toc:      numSections(uint32) | numSections * { sectionID(uint32) | offset(uint64) | length(uint64) }
+//	footer:   tocOffset(uint64) | crc32(uint32) | formatVersion(uint32) | magic(8)
+//
+// The crc32 (IEEE) covers every byte in the file before the footer.  Segment files are
+// immutable, they are written once to a tmp file and then renamed into place.  Deletes made
+// after the segment was written go into the live docs file next to it, which is replaced the
+// same way.
+const (
+	segmentFileName      = "segment.dat"
+	liveDocsFileName     = "livedocs.dat"
+	segmentFileMagic     = "sidonia\x00"
+	segmentFormatVersion = uint32(9)
+
+	segmentHeaderSize = len(segmentFileMagic) + 4
+	segmentFooterSize = 8 + 4 + 4 + len(segmentFileMagic)
+)
+
+type sectionID uint32
+
+const (
+	sectionMeta      sectionID = 1  // segment counters
+	sectionFields    sectionID = 2  // field name --> field id table
+	sectionTermDics  sectionID = 3  // field id --> vellum FST bytes
+	sectionPostings  sectionID = 4  // term id --> term frequency and roaring bitmap
+	sectionDocIDs    sectionID = 5  // internal doc id --> external doc id
+	sectionLiveDocs  sectionID = 6  // roaring bitmap of the live internal doc ids
+	sectionNumeric   sectionID = 7  // field id --> value type of the numeric fields
+	sectionBools     sectionID = 8  // field id --> roaring bitmaps of the true and false docs
+	sectionPositions sectionID = 9  // term id --> encoded positions of the term in each doc
+	sectionNorms     sectionID = 10 // field id --> length of the field in each doc
+	sectionStored    sectionID = 11 // compressed blocks of the docs' stored fields
+	sectionDocValues sectionID = 12 // field id --> doc values column
+	sectionFreqs     sectionID = 13 // term id --> encoded frequencies of the term in each doc
+)
+
+type sectionInfo struct {
+	ID     sectionID
+	Offset uint64
+	Length uint64
+}
+
+// WriteToDir persists the segment into dir as an immutable segment file.  The segment can be
+// loaded back with OpenSegment.
+//
+// Note this isn't named WriteTo, as that name is reserved for io.WriterTo.
+func (seg *Segment) WriteToDir(dir string) error {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create segment dir: err:%v", err)
+	}
+	fp := filepath.Join(dir, segmentFileName)
+	tmpFp := fp + ".tmp"
+	f, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: err:%v", err)
+	}
+	// the tmp file is removed if the segment file can't be written, it's gone once it's renamed.
+	defer os.Remove(tmpFp)
+	defer f.Close()
+
+	if err := seg.writeNumericFields(dir); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	sw := newSegmentWriter(bw)
+	if err := seg.writeSegmentFile(sw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush segment file: err:%v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment file: err:%v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close segment file: err:%v", err)
+	}
+	if err := os.Rename(tmpFp, fp); err != nil {
+		return fmt.Errorf("failed to rename segment file: err:%v", err)
+	}
+	return nil
+}
+
+func (seg *Segment) writeSegmentFile(sw *segmentWriter) error {
+	sw.write([]byte(segmentFileMagic))
+	sw.putUint32(segmentFormatVersion)
+
+	toc := []sectionInfo{}
+	section := func(id sectionID, fn func()) {
+		sw.align(8)
+		start := sw.offset
+		fn()
+		toc = append(toc, sectionInfo{id, uint64(start), uint64(sw.offset - start)})
+	}
+
+	section(sectionMeta, func() {
+		sw.putUint32(seg.fieldIdInt)
+		sw.putUint32(seg.termIdInc)
+		sw.putUint32(seg.docIdInc)
+	})
+
+	fieldNames := make([]string, 0, len(seg.fieldToFieldId))
+	for name := range seg.fieldToFieldId {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+	section(sectionFields, func() {
+		sw.putUint32(uint32(len(fieldNames)))
+		for _, name := range fieldNames {
+			sw.putUint32(seg.fieldToFieldId[name])
+			sw.putString(name)
+		}
+	})
+
+	fieldIDs := make([]uint32, 0, len(seg.termDicBytes))
+	for fid := range seg.termDicBytes {
+		fieldIDs = append(fieldIDs, fid)
+	}
+	sortUint32s(fieldIDs)
+	section(sectionTermDics, func() {
+		sw.putUint32(uint32(len(fieldIDs)))
+		for _, fid := range fieldIDs {
+			sw.putUint32(fid)
+			sw.putBytes(seg.termDicBytes[fid])
+		}
+	})
+
+	termIDs := make([]uint32, 0, len(seg.postings))
+	for tid := range seg.postings {
+		termIDs = append(termIDs, tid)
+	}
+	sortUint32s(termIDs)
+	section(sectionPostings, func() {
+		sw.putUint32(uint32(len(termIDs)))
+		for _, tid := range termIDs {
+			list := seg.postings[tid]
+			sw.putUint32(tid)
+			sw.putUint32(list.TermFrequency)
+			sw.putBitmap(list.Postings())
+		}
+	})
+
+	section(sectionDocIDs, func() {
+		sw.putUint32(uint32(seg.liveDocs.GetCardinality()))
+		docIter := seg.liveDocs.Iterator()
+		for docIter.HasNext() {
+			did := docIter.Next()
+			sw.putUint32(did)
+			sw.putString(seg.docIDInternalToExternal[did])
+		}
+	})
+
+	section(sectionLiveDocs, func() {
+		if sw.err == nil {
+			_, sw.err = seg.liveDocs.WriteTo(sw)
+		}
+	})
+
+	numericIDs := make([]uint32, 0, len(seg.numericFields))
+	for fid := range seg.numericFields {
+		numericIDs = append(numericIDs, fid)
+	}
+	sortUint32s(numericIDs)
+	section(sectionNumeric, func() {
+		sw.putUint32(uint32(len(numericIDs)))
+		for _, fid := range numericIDs {
+			sw.putUint32(fid)
+			sw.putUint32(uint32(seg.numericFields[fid].kind))
+		}
+	})
+
+	boolIDs := make([]uint32, 0, len(seg.boolFields))
+	for fid := range seg.boolFields {
+		boolIDs = append(boolIDs, fid)
+	}
+	sortUint32s(boolIDs)
+	section(sectionBools, func() {
+		sw.putUint32(uint32(len(boolIDs)))
+		for _, fid := range boolIDs {
+			sw.putUint32(fid)
+			sw.putBitmap(seg.boolFields[fid].trueDocs)
+			sw.putBitmap(seg.boolFields[fid].falseDocs)
+		}
+	})
+
+	posTermIDs := make([]uint32, 0, len(seg.positions))
+	for tid := range seg.positions {
+		posTermIDs = append(posTermIDs, tid)
+	}
+	sortUint32s(posTermIDs)
+	section(sectionPositions, func() {
+		sw.putUint32(uint32(len(posTermIDs)))
+		for _, tid := range posTermIDs {
+			sw.putUint32(tid)
+			sw.putBytes(encodePositions(seg.positions[tid]))
+		}
+	})
+
+	freqTermIDs := make([]uint32, 0, len(seg.freqs))
+	for tid := range seg.freqs {
+		freqTermIDs = append(freqTermIDs, tid)
+	}
+	sortUint32s(freqTermIDs)
+	section(sectionFreqs, func() {
+		sw.putUint32(uint32(len(freqTermIDs)))
+		for _, tid := range freqTermIDs {
+			sw.putUint32(tid)
+			sw.putBytes(encodeFreqs(seg.freqs[tid]))
+		}
+	})
+
+	normFieldIDs := make([]uint32, 0, len(seg.norms))
+	for fid := range seg.norms {
+		normFieldIDs = append(normFieldIDs, fid)
+	}
+	sortUint32s(normFieldIDs)
+	section(sectionNorms, func() {
+		sw.putUint32(uint32(len(normFieldIDs)))
+		for _, fid := range normFieldIDs {
+			norms := seg.norms[fid]
+			sw.putUint32(fid)
+			sw.putUint32(uint32(len(norms)))
+			for _, length := range norms {
+				sw.putUint32(length)
+			}
+		}
+	})
+
+	blocks, err := seg.storedBlocks()
+	if err != nil {
+		return err
+	}
+	section(sectionStored, func() {
+		sw.putUint32(storedBlockSize)
+		sw.putUint32(uint32(len(blocks)))
+		for _, block := range blocks {
+			sw.putBytes(block)
+		}
+	})
+
+	dvFieldIDs := []uint32{}
+	for _, fid := range seg.fieldToFieldId {
+		if _, ok := seg.docValuesByID(fid); ok {
+			dvFieldIDs = append(dvFieldIDs, fid)
+		}
+	}
+	sortUint32s(dvFieldIDs)
+	section(sectionDocValues, func() {
+		sw.putUint32(uint32(len(dvFieldIDs)))
+		for _, fid := range dvFieldIDs {
+			dv, _ := seg.docValuesByID(fid)
+			sw.putUint32(fid)
+			sw.putUint32(uint32(dv.Type()))
+			dv.write(sw)
+		}
+	})
+
+	tocOffset := sw.offset
+	sw.putUint32(uint32(len(toc)))
+	for _, s := range toc {
+		sw.putUint32(uint32(s.ID))
+		sw.putUint64(s.Offset)
+		sw.putUint64(s.Length)
+	}
+	crc := sw.crc
+	sw.putUint64(uint64(tocOffset))
+	sw.putUint32(crc)
+	sw.putUint32(segmentFormatVersion)
+	sw.write([]byte(segmentFileMagic))
+
+	if sw.err != nil {
+		return fmt.Errorf("failed writing segment file: err:%v", sw.err)
+	}
+	return nil
+}
+
+// OpenSegment memory maps the segment file in dir, which was written by WriteToDir.  The
+// returned segment is read-only and must be closed to release the mapping.
+func OpenSegment(dir string) (*Segment, error) {
+	f, err := os.Open(filepath.Join(dir, segmentFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment file: err:%v", err)
+	}
+	data, err := bkdtree.FileMmap(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to mmap segment file: err:%v", err)
+	}
+
+	seg := NewSegment()
+	seg.dir = dir
+	seg.file = f
+	seg.data = data
+	if err := seg.loadSegmentFile(data); err != nil {
+		seg.Close()
+		return nil, fmt.Errorf("failed to load segment file %v: err:%v", dir, err)
+	}
+	return seg, nil
+}
+
+// writeNumericFields writes a copy of each numeric field's bkd tree into dir.
+func (seg *Segment) writeNumericFields(dir string) error {
+	for fid, nf := range seg.numericFields {
+		points, err := nf.allPoints()
+		if err != nil {
+			return fmt.Errorf("failed reading bkd tree: err:%v", err)
+		}
+		bkd, err := newFieldBkdTree(dir, fid)
+		if err != nil {
+			return err
+		}
+		for _, point := range points {
+			if err := bkd.Insert(point); err != nil {
+				bkd.Close()
+				return fmt.Errorf("failed writing bkd tree: err:%v", err)
+			}
+		}
+		if err := bkd.Close(); err != nil {
+			return fmt.Errorf("failed closing bkd tree: err:%v", err)
+		}
+	}
+	return nil
+}
+
+// Close releases the segment's files.  Segments loaded with OpenSegment unmap their segment
+// file, and in-memory segments remove the tmp files of their numeric fields.  The segment can't
+// be used after it has been closed.
+func (seg *Segment) Close() error {
+	seg.rwlock.Lock()
+	defer seg.rwlock.Unlock()
+	var firstErr error
+	for fid, nf := range seg.numericFields {
+		if err := nf.bkd.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(seg.numericFields, fid)
+	}
+	if seg.tmpDir != "" {
+		if err := os.RemoveAll(seg.tmpDir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		seg.tmpDir = ""
+	}
+	if seg.data == nil {
+		return firstErr
+	}
+
+	data, f := seg.data, seg.file
+	seg.data, seg.file = nil, nil
+	seg.termDicFstCache = map[uint32]*vellum.FST{}
+	seg.termDicBytes = map[uint32][]byte{}
+	seg.postings = map[uint32]TermPostingList{}
+	seg.boolFields = map[uint32]*boolField{}
+	seg.positionBytes = map[uint32][]byte{}
+	seg.positionCache = map[uint32]map[uint32][]uint32{}
+	seg.freqBytes = map[uint32][]byte{}
+	seg.freqCache = map[uint32]map[uint32]uint32{}
+	seg.norms = map[uint32][]uint32{}
+	seg.normStats = map[uint32]*fieldStats{}
+	seg.storedBlockBytes = nil
+	seg.docValues = map[uint32]docValues{}
+	if err := bkdtree.FileMunmap(data); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := f.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (seg *Segment) loadSegmentFile(data []byte) error {
+	if len(data) < segmentHeaderSize+segmentFooterSize {
+		return fmt.Errorf("segment file is truncated, size:%v", len(data))
+	}
+	if string(data[:len(segmentFileMagic)]) != segmentFileMagic {
+		return fmt.Errorf("bad segment file magic in header")
+	}
+	footer := data[len(data)-segmentFooterSize:]
+	if string(footer[16:]) != segmentFileMagic {
+		return fmt.Errorf("bad segment file magic in footer")
+	}
+	if ver := binary.BigEndian.Uint32(footer[12:16]); ver != segmentFormatVersion {
+		return fmt.Errorf("unsupported segment format version: %v", ver)
+	}
+	if crc := crc32.ChecksumIEEE(data[:len(data)-segmentFooterSize]); crc != binary.BigEndian.Uint32(footer[8:12]) {
+		return fmt.Errorf("segment file checksum mismatch")
+	}
+
+	tocOffset := binary.BigEndian.Uint64(footer[0:8])
+	if tocOffset > uint64(len(data)-segmentFooterSize) {
+		return fmt.Errorf("bad table of contents offset: %v", tocOffset)
+	}
+	tr := &segmentReader{data: data[:len(data)-segmentFooterSize], pos: int(tocOffset)}
+	sections := map[sectionID][]byte{}
+	numSections := tr.uint32()
+	for i := uint32(0); i < numSections && tr.err == nil; i++ {
+		id := sectionID(tr.uint32())
+		off, length := tr.uint64(), tr.uint64()
+		if off+length > tocOffset {
+			return fmt.Errorf("section %v is out of bounds", id)
+		}
+		sections[id] = data[off : off+length]
+	}
+	if tr.err != nil {
+		return tr.err
+	}
+
+	section := func(id sectionID) (*segmentReader, error) {
+		b, ok := sections[id]
+		if !ok {
+			return nil, fmt.Errorf("missing section %v", id)
+		}
+		return &segmentReader{data: b}, nil
+	}
+
+	r, err := section(sectionMeta)
+	if err != nil {
+		return err
+	}
+	seg.fieldIdInt = r.uint32()
+	seg.termIdInc = r.uint32()
+	seg.docIdInc = r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionFields); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid := r.uint32()
+		seg.fieldToFieldId[r.string()] = fid
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionTermDics); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid := r.uint32()
+		seg.termDicBytes[fid] = r.bytes()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionPostings); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		tid, freq := r.uint32(), r.uint32()
+		bm := r.bitmap()
+		if r.err != nil {
+			return fmt.Errorf("failed to load postings for term-id %v: err:%v", tid, r.err)
+		}
+		seg.postings[tid] = TermPostingList{freq, bm}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionDocIDs); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		did := r.uint32()
+		externalID := r.string()
+		seg.docIDInternalToExternal[did] = externalID
+		seg.docIDExternalToInternal[externalID] = did
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	b, ok := sections[sectionLiveDocs]
+	if !ok {
+		return fmt.Errorf("missing section %v", sectionLiveDocs)
+	}
+	// the live docs are copied out of the mmap, so deletes can modify them.
+	if err := seg.liveDocs.UnmarshalBinary(b); err != nil {
+		return fmt.Errorf("failed to load live docs: err:%v", err)
+	}
+	liveDocs, err := readLiveDocs(seg.dir)
+	if err != nil {
+		return err
+	} else if liveDocs != nil {
+		seg.liveDocs = liveDocs
+	}
+
+	if r, err = section(sectionPositions); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		tid := r.uint32()
+		seg.positionBytes[tid] = r.bytes()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionFreqs); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		tid := r.uint32()
+		seg.freqBytes[tid] = r.bytes()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionNorms); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid, numDocs := r.uint32(), r.uint32()
+		for did := uint32(0); did < numDocs && r.err == nil; did++ {
+			seg.addNorm(fid, did, r.uint32())
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionBools); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid := r.uint32()
+		seg.boolFields[fid] = &boolField{r.bitmap(), r.bitmap()}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionStored); err != nil {
+		return err
+	}
+	if blockSize := r.uint32(); r.err == nil && blockSize != storedBlockSize {
+		return fmt.Errorf("unsupported stored fields block size: %v", blockSize)
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		seg.storedBlockBytes = append(seg.storedBlockBytes, r.bytes())
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionDocValues); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid, typ := r.uint32(), DocValuesType(r.uint32())
+		dv, err := readDocValues(r, typ)
+		if err != nil {
+			return fmt.Errorf("failed to load doc values for field-id %v: err:%v", fid, err)
+		}
+		seg.docValues[fid] = dv
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if r, err = section(sectionNumeric); err != nil {
+		return err
+	}
+	for i, n := uint32(0), r.uint32(); i < n && r.err == nil; i++ {
+		fid, kind := r.uint32(), value.ValueType(r.uint32())
+		bkd, err := bkdtree.NewBkdTreeExt(seg.dir, fmt.Sprintf(bkdPrefixFormat, fid))
+		if err != nil {
+			return fmt.Errorf("failed to open bkd tree for field-id %v: err:%v", fid, err)
+		}
+		seg.numericFields[fid] = &numericField{kind: kind, bkd: bkd}
+	}
+	return r.err
+}
+
+// writeLiveDocs replaces the live docs file in dir.  The file is the serialized roaring bitmap
+// followed by its crc32.
+func writeLiveDocs(dir string, liveDocs *roaring.Bitmap) error {
+	buf, err := liveDocs.ToBytes()
+	if err != nil {
+		return fmt.Errorf("failed to serialize live docs: err:%v", err)
+	}
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[:len(buf)-4]))
+
+	fp := filepath.Join(dir, liveDocsFileName)
+	tmpFp := fp + ".tmp"
+	f, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create live docs file: err:%v", err)
+	}
+	defer os.Remove(tmpFp)
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write live docs file: err:%v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync live docs file: err:%v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close live docs file: err:%v", err)
+	}
+	if err := os.Rename(tmpFp, fp); err != nil {
+		return fmt.Errorf("failed to rename live docs file: err:%v", err)
+	}
+	return nil
+}
+
+// readLiveDocs reads the live docs file in dir, it returns nil if the segment has no deletes
+// since it was written.
+func readLiveDocs(dir string) (*roaring.Bitmap, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, liveDocsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read live docs file: err:%v", err)
+	}
+	if len(buf) < 4 || crc32.ChecksumIEEE(buf[:len(buf)-4]) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, fmt.Errorf("live docs file checksum mismatch")
+	}
+	liveDocs := roaring.New()
+	if err := liveDocs.UnmarshalBinary(buf[:len(buf)-4]); err != nil {
+		return nil, fmt.Errorf("failed to load live docs: err:%v", err)
+	}
+	return liveDocs, nil
+}
+
+// segmentWriter tracks the offset and running checksum of everything written to a segment file.
+// The first error is kept, and all writes after it are dropped.
+type segmentWriter struct {
+	w       io.Writer
+	crc     uint32
+	offset  int
+	err     error
+	scratch [8]byte
+}
+
+func newSegmentWriter(w io.Writer) *segmentWriter {
+	return &segmentWriter{w: w}
+}
+
+// Write implements io.Writer so roaring bitmaps can serialize themselves directly into the file.
+func (sw *segmentWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(p)
+	sw.crc = crc32.Update(sw.crc, crc32.IEEETable, p[:n])
+	sw.offset += n
+	sw.err = err
+	return n, err
+}
+
+func (sw *segmentWriter) write(p []byte) {
+	sw.Write(p)
+}
+
+func (sw *segmentWriter) align(n int) {
+	if pad := (n - sw.offset%n) % n; pad > 0 {
+		sw.write(make([]byte, pad))
+	}
+}
+
+func (sw *segmentWriter) putUint32(v uint32) {
+	binary.BigEndian.PutUint32(sw.scratch[:4], v)
+	sw.write(sw.scratch[:4])
+}
+
+func (sw *segmentWriter) putUint64(v uint64) {
+	binary.BigEndian.PutUint64(sw.scratch[:8], v)
+	sw.write(sw.scratch[:8])
+}
+
+func (sw *segmentWriter) putBytes(b []byte) {
+	sw.putUint32(uint32(len(b)))
+	sw.write(b)
+}
+
+func (sw *segmentWriter) putString(s string) {
+	sw.putBytes([]byte(s))
+}
+
+func (sw *segmentWriter) putBitmap(bm *roaring.Bitmap) {
+	// the bitmap is read by searchers while the segment is written, so a copy is optimized.
+	bm = bm.Clone()
+	bm.RunOptimize()
+	sw.putUint32(uint32(bm.GetSerializedSizeInBytes()))
+	// roaring reads its containers in place from the mmap, keep them aligned.
+	sw.align(8)
+	if sw.err == nil {
+		_, sw.err = bm.WriteTo(sw)
+	}
+}
+
+// segmentReader decodes what segmentWriter encoded.  Like segmentWriter the first error is kept,
+// and reads after it return zero values.  The []byte returned by bytes() and next() reference
+// the underlying data, they aren't copies.
+type segmentReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *segmentReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *segmentReader) align(n int) {
+	// sections start 8 byte aligned in the file, so aligning the position within the section
+	// also aligns it in the file.
+	if pad := (n - r.pos%n) % n; pad > 0 {
+		r.next(pad)
+	}
+}
+
+func (r *segmentReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *segmentReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *segmentReader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *segmentReader) string() string {
+	return string(r.bytes())
+}
+
+// bitmap returns a roaring bitmap which reads its containers in place from the data, the bitmap
+// must not be modified.
+func (r *segmentReader) bitmap() *roaring.Bitmap {
+	size := r.uint32()
+	r.align(8)
+	buf := r.next(int(size))
+	bm := roaring.New()
+	if r.err != nil {
+		return bm
+	}
+	if _, err := bm.FromBuffer(buf); err != nil {
+		r.err = err
+	}
+	return bm
+}
+
+func sortUint32s(a []uint32) {
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+}
@@ -0,0 +1,129 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSegmentWriteToDirAndOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(500)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := segment.WriteToDir(dir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	opened, err := OpenSegment(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer opened.Close()
+
+	assert.Equal(t, segment.fieldToFieldId, opened.fieldToFieldId)
+	assert.Equal(t, segment.docIDInternalToExternal, opened.docIDInternalToExternal)
+	assert.Equal(t, len(segment.postings), len(opened.postings))
+	for termID, list := range segment.postings {
+		assert.Equalf(t, list.TermFrequency, opened.postings[termID].TermFrequency, "term-id:%v", termID)
+		assert.Equalf(t, true, list.Postings().Equals(opened.postings[termID].Postings()), "term-id:%v", termID)
+	}
+
+	{ // test case - the same query returns the same docs from the opened segment
+		res, err := NewQueryBuilder(context.TODO(), opened).
+			And(&RegExTermQuery{"first_name", "kev.*"}, &RegExTermQuery{"last_name", "manning"}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+	}
+
+	{ // test case - opened segments are read-only
+		err := opened.IndexDocuments(context.TODO(), testDocuments(1))
+		if err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Fatalf("expected a read-only error, err:%v", err)
+		}
+	}
+}
+
+func TestSegmentWriteToDirConcurrentSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(5000)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	// the segment is written while it's searched, run with -race.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := segment.WriteToDir(filepath.Join(dir, fmt.Sprint(i))); err != nil {
+				t.Errorf("err:%v", err)
+			}
+		}(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := NewQueryBuilder(context.TODO(), segment).And(&TermQuery{Field: "first_name", Term: "eric"}).Run()
+			if err != nil {
+				t.Errorf("err:%v", err)
+				return
+			}
+			assert.Equal(t, 50, len(res.ExternalDocIDs))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOpenSegmentChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(10)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := segment.WriteToDir(dir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// flip a byte in the middle of the file
+	fp := filepath.Join(dir, segmentFileName)
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(fp, data, 0600); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	_, err = OpenSegment(dir)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum error, err:%v", err)
+	}
+}
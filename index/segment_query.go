@@ -2,6 +2,7 @@ package index
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/araddon/gou"
@@ -18,77 +19,71 @@ type Query interface {
 type QType int
 
 const (
-	TypeRegExtQuery QType = 10
+	TypeRegExtQuery       QType = 10
+	TypeTermQuery         QType = 11
+	TypeTermsQuery        QType = 12
+	TypePrefixQuery       QType = 13
+	TypeWildcardQuery     QType = 14
+	TypeTermRangeQuery    QType = 15
+	TypeFuzzyQuery        QType = 16
+	TypeNumericRangeQuery QType = 20
+	TypeBoolTermQuery     QType = 30
+	TypePhraseQuery       QType = 40
+	TypeSpanNearQuery     QType = 41
+	TypeBooleanQuery      QType = 50
+	TypeExprQuery         QType = 60
 )
 
+// QueryBuilder builds a BooleanQuery and runs it on a segment.
 type QueryBuilder struct {
-	ctx context.Context
-	seg *Segment
-	ops func() (*SearchResults, error) // TODO drop SearchResults in favor of using a Roaring bitmap to gather results in.
+	ctx  context.Context
+	seg  *Segment
+	root *BooleanQuery
 }
 
 func NewQueryBuilder(ctx context.Context, seg *Segment) *QueryBuilder {
-	return &QueryBuilder{ctx, seg, nil}
+	return &QueryBuilder{ctx: ctx, seg: seg, root: &BooleanQuery{}}
 }
 
+// And adds queries which every matching doc must match.
 func (q *QueryBuilder) And(queries ...Query) *QueryBuilder {
-	currentOps := q.ops
-	op := func() (*SearchResults, error) {
-		// TODO and all the queries together.
-		res := &SearchResults{roaring.New(), nil}
-		firstRun := true
-		for _, query := range queries {
-			switch query.Type() {
-			case TypeRegExtQuery:
-				tmpq := query.(*RegExTermQuery)
-				results, err := q.seg.QueryRegEx(q.ctx, tmpq)
-				if err != nil {
-					return nil, err
-				}
-				if firstRun {
-					res.internalDocIds.Or(results.internalDocIds) // Add all of them on the first loop
-					firstRun = false
-				} else {
-					res.internalDocIds.And(results.internalDocIds)
-				}
-				// fmt.Printf(" DEBUG >> %v  --> %v  \n", query, res.internalDocIds.ToArray())
-			default:
-				return nil, fmt.Errorf("unsupported query type")
-			}
+	q.root.Must = append(q.root.Must, queries...)
+	return q
+}
 
-		}
+// Or adds a clause which matches the docs that match any of the queries.
+func (q *QueryBuilder) Or(queries ...Query) *QueryBuilder {
+	q.root.Must = append(q.root.Must, &BooleanQuery{Should: queries})
+	return q
+}
 
-		// TODO this isn't write, for now we're treating all children as OR statements with this batch of AND blocks
-		//      We need to rethink this and consider this and decide of a better way to build an AST ?
-		if currentOps != nil {
-			// TODO This whole block is all wrong, but I need to revisit it later.
-			children, err := currentOps()
-			if err != nil {
-				return nil, err
-			}
-			res.internalDocIds.Or(children.internalDocIds)
-		}
-		return res, nil
-	}
+// AndNot excludes the docs which match any of the queries.
+func (q *QueryBuilder) AndNot(queries ...Query) *QueryBuilder {
+	q.root.MustNot = append(q.root.MustNot, queries...)
+	return q
+}
 
-	q.ops = op
+// Filter adds queries which every matching doc must match, without them adding to its score.
+func (q *QueryBuilder) Filter(queries ...Query) *QueryBuilder {
+	q.root.Filter = append(q.root.Filter, queries...)
 	return q
 }
 
+// Query returns the query built so far.
+func (q *QueryBuilder) Query() *BooleanQuery {
+	return q.root
+}
+
 func (q *QueryBuilder) Run() (*SearchResults, error) {
-	results, err := q.ops()
+	q.seg.rwlock.RLock()
+	defer q.seg.rwlock.RUnlock()
+	docs, err := q.seg.execute(q.ctx, q.root)
 	if err != nil {
 		gou.Errorf("error running query: err:%v", err)
 		return nil, err
 	}
-	// for i, internalDocID := range results.internalDocIds.ToArray() {
-	// 	externalDocID, ok := q.seg.docIDInternalToExternal[internalDocID]
-	// 	if !ok {
-	// 		gou.Warnf("found an internal docID without an external doc ID mapping: id:%v", internalDocID)
-	// 	}
-	// 	array[i] = externalDocID
-	// }
-	array, err := GetExternalIDs(q.seg, results.internalDocIds)
+	results := &SearchResults{internalDocIds: docs, seg: q.seg}
+	array, err := q.seg.externalIDs(q.ctx, results.internalDocIds)
 	if err != nil {
 		gou.Errorf("error from GetExternalIDs: err:%v", err)
 		return nil, err
@@ -98,13 +93,76 @@ func (q *QueryBuilder) Run() (*SearchResults, error) {
 	return results, nil
 }
 
+// execute returns the live docs of the segment which match the query.
+func (seg *Segment) execute(ctx context.Context, query Query) (*roaring.Bitmap, error) {
+	if err := queryCancelled(ctx); err != nil {
+		return nil, err
+	}
+	var results *SearchResults
+	var err error
+	switch q := query.(type) {
+	case *RegExTermQuery:
+		results, err = seg.regExQuery(ctx, q)
+	case *TermQuery:
+		results, err = seg.termQuery(ctx, q)
+	case *TermsQuery:
+		results, err = seg.termsQuery(ctx, q)
+	case *PrefixQuery:
+		results, err = seg.prefixQuery(ctx, q)
+	case *WildcardQuery:
+		results, err = seg.wildcardQuery(ctx, q)
+	case *TermRangeQuery:
+		results, err = seg.termRangeQuery(ctx, q)
+	case *FuzzyQuery:
+		var fuzzy *FuzzyResults
+		if fuzzy, err = seg.fuzzyQuery(ctx, q); err == nil {
+			results = fuzzy.SearchResults
+		}
+	case *NumericRangeQuery:
+		results, err = seg.numericRangeQuery(ctx, q)
+	case *BoolTermQuery:
+		results, err = seg.boolTermQuery(ctx, q)
+	case *PhraseQuery:
+		results, err = seg.phraseQuery(ctx, q)
+	case *SpanNearQuery:
+		results, err = seg.spanNearQuery(ctx, q)
+	case *BooleanQuery:
+		results, err = seg.booleanQuery(ctx, q)
+	case *ExprQuery:
+		results, err = seg.exprQuery(ctx, q)
+	default:
+		return nil, &UnsupportedQueryError{query}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results.internalDocIds, nil
+}
+
 // GetExternalIDs takes a bitmap of internal ids and converts them to an array of external ids
-// extacted from the segment.
+// extacted from the segment.  Deleted docs are skipped.
 func GetExternalIDs(seg *Segment, internalDocIds *roaring.Bitmap) ([]string, error) {
+	return GetExternalIDsContext(context.Background(), seg, internalDocIds)
+}
+
+// GetExternalIDsContext is GetExternalIDs, it stops with a QueryCancelledError once ctx is done.
+func GetExternalIDsContext(ctx context.Context, seg *Segment, internalDocIds *roaring.Bitmap) ([]string, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.externalIDs(ctx, internalDocIds)
+}
+
+func (seg *Segment) externalIDs(ctx context.Context, internalDocIds *roaring.Bitmap) ([]string, error) {
+	internalDocIds = roaring.And(internalDocIds, seg.liveDocs)
 	array := make([]string, internalDocIds.GetCardinality())
 	postingIter := internalDocIds.Iterator()
 	i := 0
 	for postingIter.HasNext() {
+		if i%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
 		internalDocID := postingIter.Next()
 		externalDocID, ok := seg.docIDInternalToExternal[internalDocID]
 		if !ok {
@@ -120,6 +178,70 @@ type SearchResults struct {
 	internalDocIds *roaring.Bitmap
 
 	ExternalDocIDs []string
+
+	// seg is the segment the results came from, it's set by QueryBuilder.Run.
+	seg *Segment
+}
+
+// FieldNotFoundError is returned when a query references a field that isn't in the segment.  Type
+// is set when the segment has the field, but not as a field of the type the query needs, which
+// no doc can match either.
+type FieldNotFoundError struct {
+	Field string
+	Type  string
+}
+
+func (e *FieldNotFoundError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("field %v isn't a %v field", e.Field, e.Type)
+	}
+	return fmt.Sprintf("no field-id found for field: %v", e.Field)
+}
+
+// ErrQueryCancelled is what a query fails with when its ctx is cancelled, or its deadline passes,
+// before it finishes.  The error returned is a *QueryCancelledError, which errors.Is matches to
+// ErrQueryCancelled and to the ctx's error.
+var ErrQueryCancelled = errors.New("query cancelled")
+
+// QueryCancelledError is returned by a query which stopped because its ctx was done.  Err is the
+// ctx's error, context.Canceled or context.DeadlineExceeded.
+type QueryCancelledError struct {
+	Err error
+}
+
+func (e *QueryCancelledError) Error() string {
+	return fmt.Sprintf("query cancelled: %v", e.Err)
+}
+
+func (e *QueryCancelledError) Is(target error) bool {
+	return target == ErrQueryCancelled
+}
+
+func (e *QueryCancelledError) Unwrap() error {
+	return e.Err
+}
+
+// cancelCheckInterval is the number of terms or docs a query goes through between checks of its
+// ctx.
+const cancelCheckInterval = 1024
+
+// queryCancelled returns a *QueryCancelledError if the ctx is done.
+func queryCancelled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return &QueryCancelledError{Err: ctx.Err()}
+	default:
+		return nil
+	}
+}
+
+// UnsupportedQueryError is returned for queries a segment doesn't know how to run.
+type UnsupportedQueryError struct {
+	Query Query
+}
+
+func (e *UnsupportedQueryError) Error() string {
+	return fmt.Sprintf("unsupported query type: %T", e.Query)
 }
 
 type RegExTermQuery struct {
@@ -131,29 +253,59 @@ func (q *RegExTermQuery) Type() QType {
 	return TypeRegExtQuery
 }
 
-func (seg *Segment) QueryRegEx(ctx context.Context, query *RegExTermQuery) (*SearchResults, error) {
-
-	field := query.Fieldname
-	regEx := query.RegEx
-
-	var err error
+// termDictionary returns the field's term dictionary, loading the FST into the cache the first
+// time it's used.
+func (seg *Segment) termDictionary(field string) (*vellum.FST, error) {
 	fieldId, ok := seg.fieldToFieldId[field]
 	if !ok {
-		return nil, fmt.Errorf("no field-id found for field: %v", field)
+		return nil, &FieldNotFoundError{Field: field}
 	}
 
+	seg.cacheMu.Lock()
+	defer seg.cacheMu.Unlock()
 	termDictionary, ok := seg.termDicFstCache[fieldId]
 	if !ok {
 		tbytes, ok := seg.termDicBytes[fieldId]
-		if !ok {
-			return nil, fmt.Errorf("no term dictionary found for field: %v", field)
+		if !ok && !seg.isIndexed(fieldId) {
+			// the field only has doc values.
+			return nil, &FieldNotFoundError{Field: field}
+		} else if !ok {
+			return nil, &FieldNotFoundError{Field: field, Type: "string"}
 		}
+		var err error
 		termDictionary, err = vellum.Load(tbytes)
 		if err != nil {
 			return nil, fmt.Errorf("failed loading term dictionary: err:%v", err)
 		}
 		seg.termDicFstCache[fieldId] = termDictionary
 	}
+	return termDictionary, nil
+}
+
+// isIndexed returns true if the field has a term dictionary, a bkd tree or bool bitmaps.
+func (seg *Segment) isIndexed(fieldID uint32) bool {
+	_, hasTerms := seg.termDicBytes[fieldID]
+	_, isNumeric := seg.numericFields[fieldID]
+	_, isBool := seg.boolFields[fieldID]
+	return hasTerms || isNumeric || isBool
+}
+
+// QueryRegEx returns the docs with a term matching the query's regular expression.
+func (seg *Segment) QueryRegEx(ctx context.Context, query *RegExTermQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.regExQuery(ctx, query)
+}
+
+func (seg *Segment) regExQuery(ctx context.Context, query *RegExTermQuery) (*SearchResults, error) {
+
+	field := query.Fieldname
+	regEx := query.RegEx
+
+	termDictionary, err := seg.termDictionary(field)
+	if err != nil {
+		return nil, err
+	}
 	//
 	// Query the Term Dic
 	//
@@ -162,9 +314,14 @@ func (seg *Segment) QueryRegEx(ctx context.Context, query *RegExTermQuery) (*Sea
 		return nil, err
 	}
 
-	var res *SearchResults = &SearchResults{roaring.New(), nil}
+	var res *SearchResults = &SearchResults{internalDocIds: roaring.New()}
 	itr, err := termDictionary.Search(r, nil, nil)
-	for ; err == nil; err = itr.Next() {
+	for terms := 0; err == nil; err = itr.Next() {
+		if terms++; terms%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
 		_, termID := itr.Current()
 		postingList := seg.postings[uint32(termID)]
 		postings := postingList.Postings()
@@ -184,6 +341,7 @@ func (seg *Segment) QueryRegEx(ctx context.Context, query *RegExTermQuery) (*Sea
 		// }
 	}
 	// fmt.Printf("  ----%v\n", seg.terminIdInt)
+	res.internalDocIds.And(seg.liveDocs)
 
 	return res, nil
 }
@@ -2,8 +2,12 @@ package index
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,38 +16,7 @@ import (
 )
 
 func TestIndex(t *testing.T) {
-	docs := []Document{}
-	now := time.Now()
-	for i := 0; i < 500; i++ {
-		fieldvals := map[string]value.Value{}
-		fieldvals["doc_id"] = NewStringVal(fmt.Sprintf("%000d", i))
-		fieldvals["userid"] = NewStringVal(hash(fmt.Sprintf("%000d", i)))
-
-		switch {
-		case i%100 == 0:
-			fieldvals["first_name"] = NewStringVal("eric")
-		case i%100 == 1:
-			fieldvals["first_name"] = NewStringVal("kevin")
-		case i%100 == 2:
-			fieldvals["first_name"] = NewStringVal("angela")
-		case i%100 == 3:
-			fieldvals["first_name"] = NewStringVal("jon")
-		case i%100 == 4:
-			fieldvals["first_name"] = NewStringVal("john")
-		case i%100 == 5:
-			fieldvals["first_name"] = NewStringVal("james")
-		}
-
-		if i == 101 {
-			fieldvals["first_name"] = NewStringVal("kevin")
-			fieldvals["last_name"] = NewStringVal("manning")
-		}
-		if i == 102 {
-			fieldvals["last_name"] = NewStringVal("smith")
-		}
-
-		docs = append(docs, NewDocument(fmt.Sprintf("doc_number:%000d", i), fieldvals, now))
-	}
+	docs := testDocuments(500)
 	segment := NewSegment()
 	err := segment.IndexDocuments(context.TODO(), docs)
 	if err != nil {
@@ -82,9 +55,355 @@ func TestIndex(t *testing.T) {
 
 }
 
+func TestIndexDocumentsMultipleBatches(t *testing.T) {
+	docs := testDocuments(200)
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), docs[:100]); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := segment.IndexDocuments(context.TODO(), docs[100:]); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// the second batch must not drop the terms of the first batch from the term dictionary.
+	res, err := NewQueryBuilder(context.TODO(), segment).
+		And(&RegExTermQuery{"first_name", "kevin"}).
+		Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc_number:1", "doc_number:101"}, res.ExternalDocIDs)
+}
+
+func TestDeleteDocuments(t *testing.T) {
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(200)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	deleted, err := segment.DeleteDocuments("doc_number:1", "doc_number:1", "not-a-doc")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, 199, segment.NumDocs())
+
+	res, err := NewQueryBuilder(context.TODO(), segment).
+		And(&RegExTermQuery{"first_name", "kevin"}).
+		Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+
+	regExRes, err := segment.QueryRegEx(context.TODO(), &RegExTermQuery{"first_name", "kev.*"})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []uint32{101}, regExRes.internalDocIds.ToArray())
+}
+
+func TestUpdateDocuments(t *testing.T) {
+	segment := NewSegment()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(200)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// doc 101 is kevin manning, rename it to kevin smith.
+	update := NewDocument("doc_number:101", map[string]value.Value{
+		"first_name": NewStringVal("kevin"),
+		"last_name":  NewStringVal("smith"),
+	}, time.Now())
+	if err := segment.IndexDocuments(context.TODO(), []Document{update}); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 200, segment.NumDocs())
+
+	{ // test case - the old value must not match anymore
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&RegExTermQuery{"last_name", "manning"}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{}, res.ExternalDocIDs)
+	}
+
+	{ // test case - the new value matches
+		res, err := NewQueryBuilder(context.TODO(), segment).
+			And(&RegExTermQuery{"last_name", "smith"}).
+			Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc_number:102", "doc_number:101"}, res.ExternalDocIDs)
+	}
+}
+
+func TestMultiValuedFields(t *testing.T) {
+	now := time.Now()
+	docs := []Document{
+		NewDocument("doc:1", map[string]value.Value{
+			"tags":  value.NewStringsValue([]string{"go", "search", "go"}),
+			"attrs": value.NewMapStringValue(map[string]string{"color": "red", "size": "xl"}),
+		}, now),
+		NewDocument("doc:2", map[string]value.Value{
+			"tags":  value.NewSliceValues([]value.Value{NewStringVal("rust"), NewStringVal("search")}),
+			"attrs": value.NewMapValue(map[string]interface{}{"color": "blue", "stock": int64(4)}),
+		}, now),
+	}
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	search := func(queries ...Query) []string {
+		res, err := NewQueryBuilder(context.TODO(), segment).And(queries...).Run()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return res.ExternalDocIDs
+	}
+
+	{ // test case - term queries match any element
+		assert.Equal(t, []string{"doc:1", "doc:2"}, search(&RegExTermQuery{"tags", "search"}))
+		assert.Equal(t, []string{"doc:2"}, search(&RegExTermQuery{"tags", "rust"}))
+		assert.Equal(t, []string{"doc:1"}, search(&RegExTermQuery{"tags", "go"}, &RegExTermQuery{"tags", "search"}))
+	}
+
+	{ // test case - maps are flattened to field.key
+		assert.Equal(t, []string{"doc:1"}, search(&RegExTermQuery{"attrs.color", "red"}))
+		assert.Equal(t, []string{"doc:2"}, search(&RegExTermQuery{"attrs.color", "blue"}))
+		assert.Equal(t, []string{"doc:2"}, search(&NumericRangeQuery{"attrs.stock", value.NewIntValue(4), nil, true, false}))
+	}
+
+	{ // test case - term frequency counts every element
+		termDictionary, err := segment.termDictionary("tags")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		freqs := map[string]uint32{}
+		for _, term := range []string{"go", "search", "rust"} {
+			tid, exists, err := termDictionary.Get([]byte(term))
+			if err != nil || !exists {
+				t.Fatalf("term %v not found err:%v", term, err)
+			}
+			freqs[term] = segment.postings[uint32(tid)].TermFrequency
+		}
+		assert.Equal(t, map[string]uint32{"go": 2, "search": 2, "rust": 1}, freqs)
+	}
+}
+
+// testDocuments generates count docs.  The first six docs of every hundred get a first_name, and
+// docs 101 and 102 also get a last_name.
+func testDocuments(count int) []Document {
+	docs := []Document{}
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		fieldvals := map[string]value.Value{}
+		fieldvals["doc_id"] = NewStringVal(fmt.Sprintf("%000d", i))
+		fieldvals["userid"] = NewStringVal(hash(fmt.Sprintf("%000d", i)))
+
+		switch {
+		case i%100 == 0:
+			fieldvals["first_name"] = NewStringVal("eric")
+		case i%100 == 1:
+			fieldvals["first_name"] = NewStringVal("kevin")
+		case i%100 == 2:
+			fieldvals["first_name"] = NewStringVal("angela")
+		case i%100 == 3:
+			fieldvals["first_name"] = NewStringVal("jon")
+		case i%100 == 4:
+			fieldvals["first_name"] = NewStringVal("john")
+		case i%100 == 5:
+			fieldvals["first_name"] = NewStringVal("james")
+		}
+
+		if i == 101 {
+			fieldvals["first_name"] = NewStringVal("kevin")
+			fieldvals["last_name"] = NewStringVal("manning")
+		}
+		if i == 102 {
+			fieldvals["last_name"] = NewStringVal("smith")
+		}
+
+		docs = append(docs, NewDocument(fmt.Sprintf("doc_number:%000d", i), fieldvals, now))
+	}
+	return docs
+}
+
 func hash(s string) string {
 	h := fnv.New64() // FNV hash name to int
 	h.Write([]byte(s))
 	key := h.Sum64()
 	return fmt.Sprintf("%v", key)
 }
+
+func segWriter(abort chan interface{}, t *testing.T, seg *Segment) {
+	for i := 0; ; i++ {
+		select {
+		case <-abort:
+			return
+		default:
+		}
+
+		docs := []Document{}
+		for j := 0; j < 10; j++ {
+			id := rand.Intn(1000)
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", id), map[string]value.Value{
+				"name": NewStringVal(fmt.Sprintf("name-%d", id%50)),
+				"age":  value.NewIntValue(int64(id % 100)),
+			}, time.Now()))
+		}
+		if err := seg.IndexDocuments(context.TODO(), docs); err != nil {
+			t.Errorf("err:%v", err)
+		}
+		if _, err := seg.DeleteDocuments(fmt.Sprintf("doc:%d", rand.Intn(1000))); err != nil {
+			t.Errorf("err:%v", err)
+		}
+	}
+}
+
+func segReader(abort chan interface{}, t *testing.T, seg *Segment) {
+	for {
+		select {
+		case <-abort:
+			return
+		default:
+		}
+
+		name := fmt.Sprintf("name-%d", rand.Intn(50))
+		res, err := NewQueryBuilder(context.TODO(), seg).And(
+			&RegExTermQuery{"name", "name-.*"},
+			&NumericRangeQuery{Field: "age", Min: value.NewIntValue(0), Max: value.NewIntValue(100)},
+		).Or(&TermQuery{Field: "name", Term: name}, &PrefixQuery{Field: "name", Prefix: "name-1"}).Run()
+		if err != nil {
+			t.Errorf("err:%v", err)
+			continue
+		}
+		if _, err := res.Documents("name"); err != nil {
+			t.Errorf("err:%v", err)
+		}
+		if _, err := res.Aggregate(map[string]Aggregation{"names": &TermsAgg{Field: "name"}}); err != nil {
+			t.Errorf("err:%v", err)
+		}
+		if _, err := seg.NumericDocValues("age"); err != nil {
+			t.Errorf("err:%v", err)
+		}
+		seg.NumDocs()
+	}
+}
+
+func TestSegmentConcurrentOps(t *testing.T) {
+	seg := NewSegment()
+	defer seg.Close()
+	// the readers start once every field exists.
+	if err := seg.IndexDocuments(context.TODO(), []Document{NewDocument("doc:0", map[string]value.Value{
+		"name": NewStringVal("name-0"),
+		"age":  value.NewIntValue(0),
+	}, time.Now())}); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	ch := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		segWriter(ch, t, seg)
+	}()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			segReader(ch, t, seg)
+		}()
+	}
+	// run a while, then tell the readers and writer to stop.
+	time.Sleep(2 * time.Second)
+	close(ch)
+	wg.Wait()
+}
+
+// cancelAfterCtx is a ctx which is done once Done has been called n times, so a test can stop a
+// query part way through.
+type cancelAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfterCtx) Done() <-chan struct{} {
+	if c.n--; c.n >= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (c *cancelAfterCtx) Err() error {
+	if c.n < 0 {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func TestQueryCancelled(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	segment.SetMapping(NewIndexMapping().AddField("bio", NewTextFieldMapping("standard")))
+	if err := segment.IndexDocuments(context.TODO(), bioDocuments(5000)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	{ // test case - every query type stops with a cancelled ctx
+		queries := []Query{
+			&RegExTermQuery{"doc_id", ".*"},
+			&TermQuery{Field: "first_name", Term: "kevin"},
+			&TermsQuery{Field: "first_name", Terms: []string{"kevin", "eric"}},
+			&PrefixQuery{Field: "doc_id", Prefix: "1"},
+			&WildcardQuery{Field: "doc_id", Pattern: "1*"},
+			&TermRangeQuery{Field: "doc_id", Low: "1", High: "2"},
+			&FuzzyQuery{Field: "first_name", Term: "kevn", MaxEdits: 1},
+			&NumericRangeQuery{Field: "age", Min: value.NewIntValue(10)},
+			&PhraseQuery{"bio", []string{"quick", "brown"}},
+			&SpanNearQuery{Field: "bio", Terms: []string{"quick", "fox"}, Slop: 2},
+			&BooleanQuery{Should: []Query{&TermQuery{Field: "first_name", Term: "kevin"}}},
+		}
+		for _, q := range queries {
+			_, err := NewQueryBuilder(cancelled, segment).And(q).Run()
+			_, ok := err.(*QueryCancelledError)
+			assert.Equalf(t, true, ok, "%T err:%v", q, err)
+			assert.Equal(t, true, errors.Is(err, ErrQueryCancelled))
+			assert.Equal(t, true, errors.Is(err, context.Canceled))
+		}
+	}
+	{ // test case - queries stop part way through the terms and docs they go through
+		queries := []Query{
+			&RegExTermQuery{"doc_id", ".*"},
+			&WildcardQuery{Field: "doc_id", Pattern: "*", MaxExpansions: 10000},
+			&TermsQuery{Field: "doc_id", Terms: strings.Split(strings.Repeat("1 2 3 ", 500), " ")},
+			&NumericRangeQuery{Field: "age", Min: value.NewIntValue(0)},
+			&PhraseQuery{"bio", []string{"the"}},
+		}
+		for _, q := range queries {
+			// the first check is the one before the query runs.
+			ctx := &cancelAfterCtx{Context: context.Background(), n: 1}
+			_, err := segment.execute(ctx, q)
+			assert.Equalf(t, true, errors.Is(err, ErrQueryCancelled), "%T err:%v", q, err)
+			assert.Equal(t, true, errors.Is(err, context.DeadlineExceeded))
+		}
+	}
+	{ // test case - and so does turning the results into external IDs
+		_, err := GetExternalIDsContext(cancelled, segment, segment.liveDocs)
+		assert.Equal(t, true, errors.Is(err, ErrQueryCancelled))
+		ids, err := GetExternalIDs(segment, segment.liveDocs)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 5000, len(ids))
+	}
+}
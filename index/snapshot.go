@@ -0,0 +1,58 @@
+package index
+
+import (
+	"sync"
+)
+
+// Snapshot is a point-in-time view of an index.  It sees the segments and deletes of the index
+// when it was taken, the segments added by later refreshes and flushes, the merges which replace
+// its segments, and later deletes aren't seen by it.  Its segments aren't removed until it's
+// closed, so it stays valid while the index changes underneath it.
+type Snapshot struct {
+	segs []*indexSegment // the snapshot's views of the segments, oldest to newest
+	srcs []*indexSegment // the index's segments, acquired until the snapshot is closed
+	once sync.Once
+}
+
+// Snapshot returns a point-in-time view of the index, which must be closed by the caller.
+func (idx *Index) Snapshot() *Snapshot {
+	// deletes replace the live docs of the segments while holding mu, so the read lock is
+	// enough to pin them.
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	snap := &Snapshot{
+		segs: make([]*indexSegment, len(idx.segments)),
+		srcs: make([]*indexSegment, len(idx.segments)),
+	}
+	for i, s := range idx.segments {
+		s.acquire()
+		snap.srcs[i] = s
+		snap.segs[i] = &indexSegment{name: s.name, gen: s.gen, dir: s.dir, seg: s.seg.pointInTime()}
+	}
+	return snap
+}
+
+// Close releases the snapshot's segments.
+func (snap *Snapshot) Close() {
+	snap.once.Do(func() {
+		releaseSegments(snap.srcs)
+	})
+}
+
+// Segments describes the segments of the snapshot, oldest to newest.
+func (snap *Snapshot) Segments() []SegmentInfo {
+	infos := make([]SegmentInfo, len(snap.segs))
+	for i, s := range snap.segs {
+		infos[i] = SegmentInfo{s.name, s.seg.NumDocs()}
+	}
+	return infos
+}
+
+// pointInTime returns a copy of an opened segment which keeps the segment's current live docs,
+// deletes made to the segment after it's taken aren't seen by the copy.  The copy shares the
+// segment's data and locks, and mustn't be closed.  Nothing writes to the copy, so the index
+// reads it without taking its read lock.
+func (seg *Segment) pointInTime() *Segment {
+	view := *seg
+	return &view
+}
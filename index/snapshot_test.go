@@ -0,0 +1,97 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentDocs: 1, MaxMergedSegmentDocs: 100}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			doc := NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"name": NewStringVal("kevin")}, time.Now())
+			if err := idx.AddDocument(context.TODO(), doc); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+		}
+		if err := idx.Refresh(context.TODO()); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	search := func(snap *Snapshot) []string {
+		res, err := snap.Search(context.TODO(), &TermQuery{Field: "name", Term: "kevin"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+
+	add(0, 2)
+	snap := idx.Snapshot()
+	defer snap.Close()
+	assert.Equal(t, []string{"doc:0", "doc:1"}, search(snap))
+
+	// refreshes, deletes and merges after the snapshot was taken aren't seen by it.
+	add(2, 3)
+	add(3, 4)
+	if _, err := idx.DeleteDocuments(context.TODO(), "doc:0"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	merged := map[string]bool{}
+	for _, info := range snap.Segments() {
+		merged[info.Name] = true
+	}
+	for _, info := range idx.Segments() {
+		delete(merged, info.Name)
+	}
+	assert.Equal(t, 1, len(merged))
+	assert.Equal(t, []string{"doc:0", "doc:1"}, search(snap))
+	_, found, err := snap.Document("doc:0")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, true, found)
+	res, err := snap.Execute(context.TODO(), &SearchRequest{Sort: []SortField{{By: SortByTimestamp}}})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 2, res.Total)
+
+	latest := idx.Snapshot()
+	defer latest.Close()
+	assert.Equal(t, []string{"doc:1", "doc:2", "doc:3"}, search(latest))
+
+	// the merged away segment is removed once the snapshot is closed.
+	for name := range merged {
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.Equal(t, nil, err)
+		snap.Close()
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.Equal(t, true, os.IsNotExist(err))
+	}
+}
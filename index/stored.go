@@ -0,0 +1,468 @@
+package index
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+)
+
+// Stored fields keep the original values of each doc's fields, along with its timestamp, so
+// searches can return the docs and not just their IDs.  A doc's top-level fields are stored
+// unless their mapping turns Store off.  They're encoded when the doc is indexed, and written
+// to the segment file in flate compressed blocks of storedBlockSize docs, which are decompressed
+// when one of their docs is loaded.
+
+// storedBlockSize is the number of docs compressed together.  Bigger blocks compress better, but
+// loading a doc decompresses its whole block.
+const storedBlockSize = 16
+
+// value tags of the stored fields encoding.
+const (
+	storedNil byte = iota
+	storedString
+	storedInt
+	storedNumber
+	storedBool
+	storedTime
+	storedStrings
+	storedSlice
+	storedMap
+	storedMapString
+)
+
+// encodeStoredDoc encodes the doc's stored fields and timestamp.
+func (m *IndexMapping) encodeStoredDoc(doc Document) ([]byte, error) {
+	return encodeDoc(doc, func(field string) bool {
+		fm, ok := m.Fields[field]
+		return !ok || fm.Store
+	})
+}
+
+// encodeDoc encodes the doc's timestamp and the fields keep returns true for, or all of its
+// fields if keep is nil.  The encoding is a uvarint flag and varint unix nano timestamp, the
+// number of fields, and each field's name followed by the length of its value and the value, so
+// unwanted fields can be skipped.
+func encodeDoc(doc Document, keep func(field string) bool) ([]byte, error) {
+	fields := make([]string, 0, len(doc.Row()))
+	for field := range doc.Row() {
+		if keep == nil || keep(field) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	enc := &storedEncoder{}
+	if ts := doc.Ts(); ts.IsZero() {
+		enc.uvarint(0)
+	} else {
+		enc.uvarint(1)
+		enc.varint(ts.UnixNano())
+	}
+	enc.uvarint(uint64(len(fields)))
+	for _, field := range fields {
+		val := &storedEncoder{}
+		if err := val.value(doc.Row()[field]); err != nil {
+			return nil, fmt.Errorf("can't store field %v: err:%v", field, err)
+		}
+		enc.bytes([]byte(field))
+		enc.bytes(val.buf)
+	}
+	return enc.buf, nil
+}
+
+type storedEncoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *storedEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *storedEncoder) varint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *storedEncoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *storedEncoder) value(val value.Value) error {
+	if val == nil {
+		e.buf = append(e.buf, storedNil)
+		return nil
+	}
+	switch val.Type() {
+	case value.NilType:
+		e.buf = append(e.buf, storedNil)
+	case value.StringType:
+		e.buf = append(e.buf, storedString)
+		e.bytes([]byte(val.Value().(string)))
+	case value.IntType:
+		e.buf = append(e.buf, storedInt)
+		e.varint(val.Value().(int64))
+	case value.NumberType:
+		e.buf = append(e.buf, storedNumber)
+		e.uvarint(math.Float64bits(val.Value().(float64)))
+	case value.BoolType:
+		e.buf = append(e.buf, storedBool)
+		if val.Value().(bool) {
+			e.uvarint(1)
+		} else {
+			e.uvarint(0)
+		}
+	case value.TimeType:
+		e.buf = append(e.buf, storedTime)
+		e.varint(val.Value().(time.Time).UnixNano())
+	case value.StringsType:
+		strs := val.Value().([]string)
+		e.buf = append(e.buf, storedStrings)
+		e.uvarint(uint64(len(strs)))
+		for _, s := range strs {
+			e.bytes([]byte(s))
+		}
+	case value.SliceValueType:
+		vals := val.(value.Slice).SliceValue()
+		e.buf = append(e.buf, storedSlice)
+		e.uvarint(uint64(len(vals)))
+		for _, v := range vals {
+			if err := e.value(v); err != nil {
+				return err
+			}
+		}
+	case value.MapValueType:
+		m := val.(value.MapValue).Val()
+		e.buf = append(e.buf, storedMap)
+		e.uvarint(uint64(len(m)))
+		for _, k := range sortedKeys(m) {
+			e.bytes([]byte(k))
+			if err := e.value(m[k]); err != nil {
+				return err
+			}
+		}
+	case value.MapStringType:
+		m := val.Value().(map[string]string)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.buf = append(e.buf, storedMapString)
+		e.uvarint(uint64(len(m)))
+		for _, k := range keys {
+			e.bytes([]byte(k))
+			e.bytes([]byte(m[k]))
+		}
+	default:
+		return fmt.Errorf("can't store a %v value", val.Type())
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]value.Value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type storedDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *storedDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("bad uvarint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *storedDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("bad varint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *storedDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("bad length %v", n)
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *storedDecoder) value() value.Value {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) == 0 {
+		d.err = fmt.Errorf("missing value")
+		return nil
+	}
+	tag := d.buf[0]
+	d.buf = d.buf[1:]
+	switch tag {
+	case storedNil:
+		return value.NewNilValue()
+	case storedString:
+		return NewStringVal(string(d.bytes()))
+	case storedInt:
+		return value.NewIntValue(d.varint())
+	case storedNumber:
+		return value.NewNumberValue(math.Float64frombits(d.uvarint()))
+	case storedBool:
+		return value.NewBoolValue(d.uvarint() == 1)
+	case storedTime:
+		return value.NewTimeValue(time.Unix(0, d.varint()))
+	case storedStrings:
+		strs := []string{}
+		for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+			strs = append(strs, string(d.bytes()))
+		}
+		return value.NewStringsValue(strs)
+	case storedSlice:
+		vals := []value.Value{}
+		for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+			vals = append(vals, d.value())
+		}
+		return value.NewSliceValues(vals)
+	case storedMap:
+		m := map[string]interface{}{}
+		for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+			k := string(d.bytes())
+			if v := d.value(); v != nil {
+				m[k] = v.Value()
+			}
+		}
+		return value.NewMapValue(m)
+	case storedMapString:
+		m := map[string]string{}
+		for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+			k := string(d.bytes())
+			m[k] = string(d.bytes())
+		}
+		return value.NewMapStringValue(m)
+	}
+	d.err = fmt.Errorf("unknown value tag %v", tag)
+	return nil
+}
+
+// decodeStoredDoc decodes a doc encoded by encodeDoc.  Only the fields in want are
+// decoded, or all of them if want is nil.
+func decodeStoredDoc(id string, buf []byte, want map[string]bool) (Document, error) {
+	d := &storedDecoder{buf: buf}
+	var ts time.Time
+	if d.uvarint() == 1 {
+		ts = time.Unix(0, d.varint())
+	}
+	fields := map[string]value.Value{}
+	for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+		field := string(d.bytes())
+		val := d.bytes()
+		if want != nil && !want[field] {
+			continue
+		}
+		vd := &storedDecoder{buf: val}
+		v := vd.value()
+		if vd.err != nil {
+			return nil, fmt.Errorf("corrupt stored field %v of doc %v: err:%v", field, id, vd.err)
+		}
+		fields[field] = v
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("corrupt stored fields of doc %v: err:%v", id, d.err)
+	}
+	return NewDocument(id, fields, ts), nil
+}
+
+// encodeStoredBlock compresses the encoded docs of a block, a nil doc is a doc which was deleted.
+func encodeStoredBlock(docs [][]byte) ([]byte, error) {
+	enc := &storedEncoder{}
+	enc.uvarint(uint64(len(docs)))
+	for _, doc := range docs {
+		enc.bytes(doc)
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(enc.buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeStoredBlock(block []byte) ([][]byte, error) {
+	buf, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(block)))
+	if err != nil {
+		return nil, err
+	}
+	d := &storedDecoder{buf: buf}
+	n := d.uvarint()
+	if d.err == nil && n > storedBlockSize {
+		return nil, fmt.Errorf("bad number of docs in block: %v", n)
+	}
+	docs := make([][]byte, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		docs = append(docs, d.bytes())
+	}
+	return docs, d.err
+}
+
+// storedBlocks encodes the stored docs of an in-memory segment into compressed blocks, deleted
+// docs are left out.
+func (seg *Segment) storedBlocks() ([][]byte, error) {
+	numBlocks := (int(seg.docIdInc) + storedBlockSize - 1) / storedBlockSize
+	blocks := make([][]byte, numBlocks)
+	for b := range blocks {
+		docs := make([][]byte, 0, storedBlockSize)
+		for did := uint32(b * storedBlockSize); did < seg.docIdInc && len(docs) < storedBlockSize; did++ {
+			if seg.liveDocs.Contains(did) {
+				docs = append(docs, seg.stored[did])
+			} else {
+				docs = append(docs, nil)
+			}
+		}
+		block, err := encodeStoredBlock(docs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress stored fields: err:%v", err)
+		}
+		blocks[b] = block
+	}
+	return blocks, nil
+}
+
+// storedReader reads the encoded stored docs of a segment, keeping the last decompressed block
+// so docs read in order only decompress each block once.
+type storedReader struct {
+	seg   *Segment
+	block int
+	docs  [][]byte
+}
+
+func (seg *Segment) newStoredReader() *storedReader {
+	return &storedReader{seg: seg, block: -1}
+}
+
+// doc returns the encoded stored fields of the doc, or nil if it doesn't have any.
+func (r *storedReader) doc(did uint32) ([]byte, error) {
+	if r.seg.data == nil {
+		return r.seg.stored[did], nil
+	}
+	b := int(did / storedBlockSize)
+	if b >= len(r.seg.storedBlockBytes) {
+		return nil, nil
+	}
+	if b != r.block {
+		docs, err := decodeStoredBlock(r.seg.storedBlockBytes[b])
+		if err != nil {
+			return nil, fmt.Errorf("corrupt stored fields block %v: err:%v", b, err)
+		}
+		r.block, r.docs = b, docs
+	}
+	if i := int(did % storedBlockSize); i < len(r.docs) {
+		return r.docs[i], nil
+	}
+	return nil, nil
+}
+
+// document decodes the wanted stored fields of a live doc.
+func (r *storedReader) document(did uint32, want map[string]bool) (Document, error) {
+	externalID, ok := r.seg.docIDInternalToExternal[did]
+	if !ok || !r.seg.liveDocs.Contains(did) {
+		return nil, fmt.Errorf("doc %v isn't a live doc of the segment", did)
+	}
+	buf, err := r.doc(did)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStoredDoc(externalID, buf, want)
+}
+
+// Document returns the live doc with the internal ID, with its stored fields.
+func (seg *Segment) Document(internalID uint32) (Document, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.newStoredReader().document(internalID, nil)
+}
+
+// Documents loads the stored fields of each doc in the results, in the order of ExternalDocIDs.
+// Only the given fields are loaded, or all of them if there are none.
+func (r *SearchResults) Documents(fields ...string) ([]Document, error) {
+	if r.seg == nil {
+		return nil, fmt.Errorf("the results don't come from a segment")
+	}
+	r.seg.rwlock.RLock()
+	defer r.seg.rwlock.RUnlock()
+	var want map[string]bool
+	if len(fields) > 0 {
+		want = make(map[string]bool, len(fields))
+		for _, field := range fields {
+			want[field] = true
+		}
+	}
+	docs := []Document{}
+	reader := r.seg.newStoredReader()
+	docIter := roaring.And(r.internalDocIds, r.seg.liveDocs).Iterator()
+	for docIter.HasNext() {
+		doc, err := reader.document(docIter.Next(), want)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// mergeStored copies the stored docs of another segment, remapping their doc IDs with docMap.
+func (seg *Segment) mergeStored(other *Segment, docMap []int64) error {
+	reader := other.newStoredReader()
+	for did, newID := range docMap {
+		if newID < 0 {
+			continue
+		}
+		buf, err := reader.doc(uint32(did))
+		if err != nil {
+			return err
+		}
+		seg.stored[uint32(newID)] = buf
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestStoredDocEncoding(t *testing.T) {
+	ts := time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)
+	row := map[string]value.Value{
+		"name":   NewStringVal("kevin"),
+		"age":    value.NewIntValue(35),
+		"score":  value.NewNumberValue(0.25),
+		"active": value.NewBoolValue(true),
+		"born":   value.NewTimeValue(ts),
+		"tags":   value.NewStringsValue([]string{"a", "b"}),
+		"mixed":  value.NewSliceValues([]value.Value{NewStringVal("x"), value.NewIntValue(1)}),
+		"labels": value.NewMapStringValue(map[string]string{"k": "v"}),
+		"geo":    value.NewMapValue(map[string]interface{}{"lat": 1.5, "lon": -2.5}),
+		"secret": NewStringVal("hidden"),
+	}
+	m := NewIndexMapping().AddField("secret", &FieldMapping{Type: FieldTypeKeyword, Index: true})
+	buf, err := m.encodeStoredDoc(NewDocument("doc:1", row, ts))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	{ // test case - every field but the unstored one round trips
+		doc, err := decodeStoredDoc("doc:1", buf, nil)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		delete(row, "secret")
+		assert.Equal(t, "doc:1", doc.ID())
+		assert.Equal(t, true, doc.Ts().Equal(ts))
+		assert.Equal(t, len(row), len(doc.Row()))
+		for field, val := range row {
+			got, _ := doc.Get(field)
+			if field == "born" {
+				assert.Equal(t, true, got.Value().(time.Time).Equal(ts))
+				continue
+			}
+			assert.Equalf(t, val.Value(), got.Value(), "field:%v", field)
+		}
+	}
+	{ // test case - only the wanted fields are decoded
+		doc, err := decodeStoredDoc("doc:1", buf, map[string]bool{"name": true, "nope": true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, map[string]value.Value{"name": NewStringVal("kevin")}, doc.Row())
+	}
+	{ // test case - corrupt docs fail to decode
+		_, err := decodeStoredDoc("doc:1", buf[:len(buf)-3], nil)
+		assert.NotEqual(t, nil, err)
+	}
+}
+
+func TestSegmentStoredFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-segment")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(50)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if _, err := segment.DeleteDocuments("doc_number:3"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := segment.WriteToDir(dir); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	opened, err := OpenSegment(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer opened.Close()
+	// 50 docs take 4 blocks.
+	assert.Equal(t, 4, len(opened.storedBlockBytes))
+
+	for _, seg := range []*Segment{segment, opened} {
+		{ // test case - docs in every block can be loaded
+			for _, id := range []string{"doc_number:1", "doc_number:20", "doc_number:49"} {
+				doc, err := seg.Document(seg.docIDExternalToInternal[id])
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				assert.Equal(t, id, doc.ID())
+				docID, _ := doc.Get("doc_id")
+				assert.Equal(t, id[len("doc_number:"):], docID.ToString())
+			}
+			_, err := seg.Document(segment.docIDExternalToInternal["doc_number:3"])
+			assert.NotEqual(t, nil, err)
+			_, err = seg.Document(1000)
+			assert.NotEqual(t, nil, err)
+		}
+		{ // test case - the results of a search load the selected fields
+			res, err := NewQueryBuilder(context.TODO(), seg).And(&RegExTermQuery{"first_name", "kevin|jon"}).Run()
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			docs, err := res.Documents("first_name")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equal(t, len(res.ExternalDocIDs), len(docs))
+			for i, doc := range docs {
+				assert.Equal(t, res.ExternalDocIDs[i], doc.ID())
+				assert.Equal(t, 1, len(doc.Row()))
+			}
+		}
+	}
+}
+
+func TestIndexDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentDocs: 1000, MaxMergedSegmentDocs: 10000}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+
+	now := time.Now()
+	for batch := 0; batch < 2; batch++ {
+		docs := []Document{}
+		for i := 0; i < 20; i++ {
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%02d", i), map[string]value.Value{
+				"batch": value.NewIntValue(int64(batch)),
+				"name":  NewStringVal(fmt.Sprintf("name-%d", i)),
+			}, now))
+		}
+		if err := idx.IndexDocuments(context.TODO(), docs[batch*10:]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+
+	check := func() {
+		doc, found, err := idx.Document("doc:15")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, true, found)
+		batch, _ := doc.Get("batch")
+		assert.Equal(t, int64(1), batch.Value())
+
+		doc, found, err = idx.Document("doc:05")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, true, found)
+		name, _ := doc.Get("name")
+		assert.Equal(t, "name-5", name.Value())
+
+		_, found, err = idx.Document("doc:99")
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, false, found)
+	}
+
+	{ // test case - the newest version of a doc is returned
+		check()
+	}
+	{ // test case - merges keep the stored fields
+		if err := idx.MaybeMerge(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, len(idx.Segments()))
+		check()
+	}
+}
@@ -0,0 +1,103 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/couchbase/vellum"
+)
+
+// TermQuery matches docs with the exact term, it's a single lookup in the term dictionary.
+type TermQuery struct {
+	Field string
+	Term  string
+}
+
+func (q *TermQuery) Type() QType {
+	return TypeTermQuery
+}
+
+// TermsQuery matches docs with any of the terms.
+type TermsQuery struct {
+	Field string
+	Terms []string
+}
+
+func (q *TermsQuery) Type() QType {
+	return TypeTermsQuery
+}
+
+// QueryTerm returns the docs containing the query's term.
+func (seg *Segment) QueryTerm(ctx context.Context, query *TermQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.termQuery(ctx, query)
+}
+
+func (seg *Segment) termQuery(ctx context.Context, query *TermQuery) (*SearchResults, error) {
+	termDictionary, err := seg.termDictionary(query.Field)
+	if err != nil {
+		return nil, err
+	}
+	res := &SearchResults{internalDocIds: roaring.New()}
+	termID, exists, err := termDictionary.Get([]byte(query.Term))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up term %v: err:%v", query.Term, err)
+	} else if exists {
+		res.internalDocIds.Or(seg.postings[uint32(termID)].Postings())
+		res.internalDocIds.And(seg.liveDocs)
+	}
+	return res, nil
+}
+
+// QueryTerms returns the docs containing any of the query's terms.  The terms are sorted, and
+// found in a single walk over the term dictionary, seeking forward from one term to the next.
+func (seg *Segment) QueryTerms(ctx context.Context, query *TermsQuery) (*SearchResults, error) {
+	seg.rwlock.RLock()
+	defer seg.rwlock.RUnlock()
+	return seg.termsQuery(ctx, query)
+}
+
+func (seg *Segment) termsQuery(ctx context.Context, query *TermsQuery) (*SearchResults, error) {
+	termDictionary, err := seg.termDictionary(query.Field)
+	if err != nil {
+		return nil, err
+	}
+	res := &SearchResults{internalDocIds: roaring.New()}
+	if len(query.Terms) == 0 {
+		return res, nil
+	}
+
+	terms := make([]string, len(query.Terms))
+	copy(terms, query.Terms)
+	sort.Strings(terms)
+
+	postings := []*roaring.Bitmap{}
+	itr, err := termDictionary.Iterator([]byte(terms[0]), nil)
+	for i := 0; err == nil && i < len(terms); i++ {
+		if i > 0 && i%cancelCheckInterval == 0 {
+			if err := queryCancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if i > 0 && terms[i] == terms[i-1] {
+			continue
+		}
+		if err = itr.Seek([]byte(terms[i])); err != nil {
+			break
+		}
+		term, termID := itr.Current()
+		if string(term) == terms[i] {
+			postings = append(postings, seg.postings[uint32(termID)].Postings())
+		}
+	}
+	if err != nil && err != vellum.ErrIteratorDone {
+		return nil, fmt.Errorf("failed iterating term dictionary for field %v: err:%v", query.Field, err)
+	}
+
+	res.internalDocIds = roaring.FastOr(postings...)
+	res.internalDocIds.And(seg.liveDocs)
+	return res, nil
+}
@@ -0,0 +1,91 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestTermQuery(t *testing.T) {
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), testDocuments(200)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	res, err := NewQueryBuilder(context.TODO(), segment).
+		And(&TermQuery{"first_name", "kevin"}, &TermQuery{"last_name", "manning"}).
+		Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, []string{"doc_number:101"}, res.ExternalDocIDs)
+
+	{ // test case - terms are matched exactly
+		for _, term := range []string{"kev", "kevin.*", "Kevin", ""} {
+			res, err := segment.QueryTerm(context.TODO(), &TermQuery{"first_name", term})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			assert.Equalf(t, uint64(0), res.internalDocIds.GetCardinality(), "term:%q", term)
+		}
+	}
+
+	{ // test case - unknown fields
+		_, err := segment.QueryTerm(context.TODO(), &TermQuery{"middle_name", "kevin"})
+		assert.Equal(t, &FieldNotFoundError{Field: "middle_name"}, err)
+	}
+}
+
+func TestTermsQuery(t *testing.T) {
+	now := time.Now()
+	docs := []Document{}
+	for i := 0; i < 20000; i++ {
+		docs = append(docs, NewDocument(fmt.Sprintf("doc:%05d", i), map[string]value.Value{
+			"user_id": NewStringVal(fmt.Sprintf("user-%05d", i)),
+		}, now))
+	}
+	segment := NewSegment()
+	defer segment.Close()
+	if err := segment.IndexDocuments(context.TODO(), docs); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if _, err := segment.DeleteDocuments("doc:00007"); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// every 7th user, in reverse order, with duplicates and users that don't exist.
+	terms := []string{"a-not-a-user", "user-00007", "zzz-not-a-user"}
+	expected := []string{}
+	for i := 30000; i >= 0; i -= 7 {
+		terms = append(terms, fmt.Sprintf("user-%05d", i))
+		if i < 20000 && i != 7 {
+			expected = append(expected, fmt.Sprintf("doc:%05d", i))
+		}
+	}
+	sort.Strings(expected)
+
+	res, err := NewQueryBuilder(context.TODO(), segment).And(&TermsQuery{"user_id", terms}).Run()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, expected, res.ExternalDocIDs)
+
+	{ // test case - no terms match nothing
+		res, err := segment.QueryTerms(context.TODO(), &TermsQuery{"user_id", nil})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, uint64(0), res.internalDocIds.GetCardinality())
+		res, err = segment.QueryTerms(context.TODO(), &TermsQuery{"user_id", []string{"zzz"}})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, uint64(0), res.internalDocIds.GetCardinality())
+	}
+}
@@ -0,0 +1,312 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/araddon/gou"
+)
+
+// The write-ahead log records each batch of docs and deletes before it's applied to the index,
+// so a batch which was acknowledged survives a crash before its segment is committed.  The
+// commit file is the index's list of segments, it's replaced with a tmp-then-rename each time
+// the segments change.  On open the index loads the committed segments, removes any segment
+// dirs it doesn't list, and replays the log records newer than the commit on top of them.
+//
+// Each log record is:
+//
+//	length(uint32) | crc32(uint32) | seq(uvarint) | op(byte) | body
+//
+// where length and the crc32 (IEEE) cover the seq, op and body.  The body of an index or add op
+// is the number of docs followed by each doc's ID and encodeDoc encoding, and the body of a
+// delete op is the number of IDs followed by the IDs.  A torn or corrupt record at the end of the log is
+// a write which was never acknowledged, and is truncated.  So is the record of a batch which
+// fails before it's applied, so the batch isn't replayed.
+const (
+	walFileName    = "wal.log"
+	commitFileName = "commit"
+
+	commitFormatVersion = uint32(1)
+)
+
+// ops of the write-ahead log records.
+const (
+	walIndexOp byte = iota + 1
+	walDeleteOp
+	walAddOp // a doc added to the index's buffer
+)
+
+type walRecord struct {
+	seq  uint64
+	op   byte
+	docs []Document // index and add ops
+	ids  []string   // delete op
+}
+
+// writeAheadLog is the index's log file.  Assumes the index's writeMu is held while it's used.
+type writeAheadLog struct {
+	f    *os.File
+	seq  uint64 // seq of the last record appended
+	size int64  // length of the log
+	last int64  // offset of the last record appended, see abort
+}
+
+// openWriteAheadLog opens the log in dir, creating it if it doesn't exist, and returns the
+// records in it.  seq is the seq of the last commit, new records are numbered after it.
+func openWriteAheadLog(dir string, seq uint64) (*writeAheadLog, []*walRecord, error) {
+	fp := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(fp, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open wal: err:%v", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to read wal: err:%v", err)
+	}
+
+	w := &writeAheadLog{f: f, seq: seq}
+	records := []*walRecord{}
+	off := 0
+	for off+8 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		if off+8+n > len(data) {
+			break
+		}
+		payload := data[off+8 : off+8+n]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[off+4:]) {
+			break
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("corrupt wal record at offset %v: err:%v", off, err)
+		}
+		records = append(records, rec)
+		if rec.seq > w.seq {
+			w.seq = rec.seq
+		}
+		off += 8 + n
+	}
+	if off < len(data) {
+		gou.Warnf("truncating %v bytes of torn records from the wal", len(data)-off)
+		if err := f.Truncate(int64(off)); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to truncate wal: err:%v", err)
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to sync wal: err:%v", err)
+		}
+	}
+	if _, err := f.Seek(int64(off), io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to seek wal: err:%v", err)
+	}
+	w.size, w.last = int64(off), int64(off)
+	return w, records, nil
+}
+
+// append writes a record to the log and syncs it, and returns its seq.
+func (w *writeAheadLog) append(op byte, docs []Document, ids []string) (uint64, error) {
+	seq := w.seq + 1
+	enc := &storedEncoder{buf: make([]byte, 8)}
+	enc.uvarint(seq)
+	enc.buf = append(enc.buf, op)
+	switch op {
+	case walIndexOp, walAddOp:
+		enc.uvarint(uint64(len(docs)))
+		for _, doc := range docs {
+			buf, err := encodeDoc(doc, nil)
+			if err != nil {
+				return 0, fmt.Errorf("failed to log doc %v: err:%v", doc.ID(), err)
+			}
+			enc.bytes([]byte(doc.ID()))
+			enc.bytes(buf)
+		}
+	case walDeleteOp:
+		enc.uvarint(uint64(len(ids)))
+		for _, id := range ids {
+			enc.bytes([]byte(id))
+		}
+	}
+	binary.BigEndian.PutUint32(enc.buf[0:4], uint32(len(enc.buf)-8))
+	binary.BigEndian.PutUint32(enc.buf[4:8], crc32.ChecksumIEEE(enc.buf[8:]))
+
+	if _, err := w.f.Write(enc.buf); err != nil {
+		return 0, fmt.Errorf("failed to write wal: err:%v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync wal: err:%v", err)
+	}
+	w.seq = seq
+	w.last = w.size
+	w.size += int64(len(enc.buf))
+	return seq, nil
+}
+
+// abort removes the record seq, which must be the last record appended, from the log.  It's used
+// for a batch which failed before it was applied, so the batch isn't replayed.
+func (w *writeAheadLog) abort(seq uint64) error {
+	if seq != w.seq || w.last == w.size {
+		return fmt.Errorf("can't abort wal record %v, it isn't the last record in the wal", seq)
+	}
+	if err := w.truncate(w.last); err != nil {
+		return err
+	}
+	w.seq--
+	return nil
+}
+
+// reset empties the log, once every record in it has been committed.
+func (w *writeAheadLog) reset() error {
+	return w.truncate(0)
+}
+
+// truncate cuts the log down to its first size bytes.
+func (w *writeAheadLog) truncate(size int64) error {
+	if err := w.f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate wal: err:%v", err)
+	}
+	if _, err := w.f.Seek(size, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek wal: err:%v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: err:%v", err)
+	}
+	w.size, w.last = size, size
+	return nil
+}
+
+func (w *writeAheadLog) close() error {
+	return w.f.Close()
+}
+
+func decodeWALRecord(payload []byte) (*walRecord, error) {
+	d := &storedDecoder{buf: payload}
+	rec := &walRecord{seq: d.uvarint()}
+	if d.err == nil && len(d.buf) == 0 {
+		return nil, fmt.Errorf("missing op")
+	} else if d.err == nil {
+		rec.op = d.buf[0]
+		d.buf = d.buf[1:]
+	}
+	switch n := d.uvarint(); rec.op {
+	case walIndexOp, walAddOp:
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			id := string(d.bytes())
+			buf := d.bytes()
+			if d.err != nil {
+				break
+			}
+			doc, err := decodeStoredDoc(id, buf, nil)
+			if err != nil {
+				return nil, err
+			}
+			rec.docs = append(rec.docs, doc)
+		}
+	case walDeleteOp:
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			rec.ids = append(rec.ids, string(d.bytes()))
+		}
+	default:
+		return nil, fmt.Errorf("unknown op %v", rec.op)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return rec, nil
+}
+
+// commitPoint is the content of the commit file.
+type commitPoint struct {
+	seq      uint64 // seq of the last wal record the segments include
+	segGen   uint64 // generation of the next segment
+	segments []commitSegment
+}
+
+type commitSegment struct {
+	name string
+	gen  uint64
+}
+
+// writeCommit replaces the commit file in dir.  The file is the format version, the seq, the
+// next segment generation, the number of segments and each segment's name and generation, all
+// followed by a crc32.
+func writeCommit(dir string, cp *commitPoint) error {
+	enc := &storedEncoder{}
+	enc.uvarint(uint64(commitFormatVersion))
+	enc.uvarint(cp.seq)
+	enc.uvarint(cp.segGen)
+	enc.uvarint(uint64(len(cp.segments)))
+	for _, s := range cp.segments {
+		enc.bytes([]byte(s.name))
+		enc.uvarint(s.gen)
+	}
+	buf := append(enc.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[:len(buf)-4]))
+
+	fp := filepath.Join(dir, commitFileName)
+	tmpFp := fp + ".tmp"
+	f, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create commit file: err:%v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write commit file: err:%v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync commit file: err:%v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close commit file: err:%v", err)
+	}
+	if err := os.Rename(tmpFp, fp); err != nil {
+		return fmt.Errorf("failed to rename commit file: err:%v", err)
+	}
+	return syncDir(dir)
+}
+
+// readCommit reads the commit file in dir, it returns nil if the index has never committed.
+func readCommit(dir string) (*commitPoint, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, commitFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read commit file: err:%v", err)
+	}
+	if len(buf) < 4 || crc32.ChecksumIEEE(buf[:len(buf)-4]) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, fmt.Errorf("commit file checksum mismatch")
+	}
+	d := &storedDecoder{buf: buf[:len(buf)-4]}
+	if v := uint32(d.uvarint()); d.err == nil && v != commitFormatVersion {
+		return nil, fmt.Errorf("unsupported commit format version %v", v)
+	}
+	cp := &commitPoint{seq: d.uvarint(), segGen: d.uvarint()}
+	for i, n := uint64(0), d.uvarint(); i < n && d.err == nil; i++ {
+		cp.segments = append(cp.segments, commitSegment{name: string(d.bytes()), gen: d.uvarint()})
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("corrupt commit file: err:%v", d.err)
+	}
+	return cp, nil
+}
+
+// syncDir syncs dir, so the files renamed into it survive a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open dir %v: err:%v", dir, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dir %v: err:%v", dir, err)
+	}
+	return nil
+}
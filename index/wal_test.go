@@ -0,0 +1,483 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/araddon/qlbridge/value"
+	"github.com/bmizerany/assert"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	doc := NewDocument("doc:1", map[string]value.Value{
+		"name": NewStringVal("kevin"),
+		"age":  value.NewIntValue(35),
+	}, now)
+
+	wal, records, err := openWriteAheadLog(dir, 5)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 0, len(records))
+	if seq, err := wal.append(walIndexOp, []Document{doc}, nil); err != nil {
+		t.Fatalf("err:%v", err)
+	} else {
+		assert.Equal(t, uint64(6), seq)
+	}
+	if _, err := wal.append(walDeleteOp, nil, []string{"doc:1", "doc:2"}); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	wal.close()
+
+	{ // test case - the records are read back in order
+		wal, records, err := openWriteAheadLog(dir, 0)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, uint64(7), wal.seq)
+		assert.Equal(t, 2, len(records))
+		assert.Equal(t, walIndexOp, records[0].op)
+		assert.Equal(t, "doc:1", records[0].docs[0].ID())
+		assert.Equal(t, doc.Row(), records[0].docs[0].Row())
+		assert.Equal(t, true, records[0].docs[0].Ts().Equal(now))
+		assert.Equal(t, walDeleteOp, records[1].op)
+		assert.Equal(t, []string{"doc:1", "doc:2"}, records[1].ids)
+		wal.close()
+	}
+	{ // test case - a torn record at the end of the log is truncated
+		fp := filepath.Join(dir, walFileName)
+		info, err := os.Stat(fp)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if err := os.Truncate(fp, info.Size()-3); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		wal, records, err := openWriteAheadLog(dir, 0)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 1, len(records))
+		assert.Equal(t, uint64(6), wal.seq)
+		if _, err := wal.append(walDeleteOp, nil, []string{"doc:3"}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		wal.close()
+
+		wal, records, err = openWriteAheadLog(dir, 0)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 2, len(records))
+		assert.Equal(t, []string{"doc:3"}, records[1].ids)
+		wal.close()
+	}
+	{ // test case - an aborted record is removed, and its seq is reused
+		wal, _, err := openWriteAheadLog(dir, 0)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		seq, err := wal.append(walDeleteOp, nil, []string{"doc:4"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, uint64(8), seq)
+		if err := wal.abort(seq); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.NotEqual(t, nil, wal.abort(seq-1))
+		if seq, err = wal.append(walDeleteOp, nil, []string{"doc:5"}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, uint64(8), seq)
+		wal.close()
+
+		wal, records, err := openWriteAheadLog(dir, 0)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		defer wal.close()
+		assert.Equal(t, 3, len(records))
+		assert.Equal(t, []string{"doc:5"}, records[2].ids)
+	}
+}
+
+func TestCommitFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cp, err := readCommit(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, (*commitPoint)(nil), cp)
+
+	want := &commitPoint{seq: 12, segGen: 4, segments: []commitSegment{{"seg_00000003", 3}, {"seg_00000001", 1}}}
+	if err := writeCommit(dir, want); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	cp, err = readCommit(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, want, cp)
+
+	// a corrupt commit file is an error, and not an empty index.
+	fp := filepath.Join(dir, commitFileName)
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	data[2] ^= 0xff
+	if err := ioutil.WriteFile(fp, data, 0600); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	_, err = readCommit(dir)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestIndexRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &IndexOptions{DisableBackgroundMerges: true}
+	idx, err := NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	now := time.Now()
+	batch := func(from, to int) []Document {
+		docs := []Document{}
+		for i := from; i < to; i++ {
+			docs = append(docs, NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{
+				"name": NewStringVal(fmt.Sprintf("name-%d", i%3)),
+			}, now))
+		}
+		return docs
+	}
+	for i := 0; i < 3; i++ {
+		if err := idx.IndexDocuments(context.TODO(), batch(i*5, i*5+5)); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	ids := func(idx *Index) []string {
+		res, err := idx.Search(context.TODO(), &TermQuery{Field: "name", Term: "name-1"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		sort.Strings(res.ExternalDocIDs)
+		return res.ExternalDocIDs
+	}
+	assert.Equal(t, []string{"doc:1", "doc:10", "doc:13", "doc:4", "doc:7"}, ids(idx))
+	// the wal is emptied once its records are committed.
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, int64(0), info.Size())
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	{ // test case - batches which were logged but not committed are replayed
+		wal, _, err := openWriteAheadLog(dir, 3)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if _, err := wal.append(walIndexOp, batch(15, 20), nil); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if _, err := wal.append(walDeleteOp, nil, []string{"doc:1", "doc:16"}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		// a batch which was being written when the process crashed.
+		if _, err := wal.f.Write([]byte{0, 0, 1, 0, 1, 2}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		wal.close()
+
+		idx, err := NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:10", "doc:13", "doc:19", "doc:4", "doc:7"}, ids(idx))
+		assert.Equal(t, 4, len(idx.Segments()))
+		if err := idx.Close(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+
+		// replaying again doesn't duplicate anything.
+		idx, err = NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, []string{"doc:10", "doc:13", "doc:19", "doc:4", "doc:7"}, ids(idx))
+		assert.Equal(t, 4, len(idx.Segments()))
+		if err := idx.Close(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	{ // test case - segments which weren't committed are removed
+		idx, err := NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		segs := idx.Segments()
+		if err := idx.Close(); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+
+		// a merge which crashed after writing its segment, the sources are still committed.
+		seg, err := OpenSegment(filepath.Join(dir, segs[0].Name))
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		merged, err := mergeSegments([]*Segment{seg}, []*roaring.Bitmap{seg.liveDocs})
+		seg.Close()
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		mergedDir := filepath.Join(dir, segmentName(99))
+		if err := merged.WriteToDir(mergedDir); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		merged.Close()
+
+		idx, err = NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		defer idx.Close()
+		assert.Equal(t, segs, idx.Segments())
+		assert.Equal(t, []string{"doc:10", "doc:13", "doc:19", "doc:4", "doc:7"}, ids(idx))
+		_, err = os.Stat(mergedDir)
+		assert.Equal(t, true, os.IsNotExist(err))
+	}
+}
+
+func TestIndexCancelledBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &IndexOptions{DisableBackgroundMerges: true}
+	idx, err := NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := idx.IndexDocuments(context.TODO(), testDocuments(10)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// the batch is logged, then cancelled before it's indexed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = idx.IndexDocuments(ctx, bioDocuments(20)[10:])
+	assert.Equal(t, context.Canceled, err)
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, int64(0), info.Size())
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	{ // test case - the cancelled batch isn't replayed
+		idx, err := NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		defer idx.Close()
+		res, err := idx.Search(context.TODO(), &RegExTermQuery{"doc_id", ".*"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 10, len(res.ExternalDocIDs))
+		_, ok := idx.Mapping().Fields["bio"]
+		assert.Equal(t, false, ok)
+
+		// and the index carries on from the last batch which was applied.
+		if err := idx.IndexDocuments(context.TODO(), bioDocuments(20)[10:]); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		res, err = idx.Search(context.TODO(), &RegExTermQuery{"doc_id", ".*"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 20, len(res.ExternalDocIDs))
+	}
+}
+
+func TestIndexFailedFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &IndexOptions{DisableBackgroundMerges: true}
+	idx, err := NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := idx.IndexDocuments(context.TODO(), testDocuments(10)); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// a file in the way of the next segment's dir fails the batch's flush.
+	blocker := filepath.Join(dir, segmentName(idx.segGen))
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	err = idx.IndexDocuments(context.TODO(), bioDocuments(20)[10:])
+	assert.NotEqual(t, nil, err)
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, int64(0), info.Size())
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	{ // test case - the failed batch isn't replayed
+		idx, err := NewIndex(dir, opts)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		defer idx.Close()
+		res, err := idx.Search(context.TODO(), &RegExTermQuery{"doc_id", ".*"})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		assert.Equal(t, 10, len(res.ExternalDocIDs))
+	}
+}
+
+func TestIndexMergeCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &IndexOptions{MergePolicy: &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentDocs: 1, MaxMergedSegmentDocs: 100}, DisableBackgroundMerges: true}
+	idx, err := NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	for i := 0; i < 4; i++ {
+		doc := NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"n": value.NewIntValue(int64(i))}, time.Now())
+		if err := idx.IndexDocuments(context.TODO(), []Document{doc}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	segs := idx.Segments()
+	assert.Equal(t, true, len(segs) < 4)
+	if err := idx.Close(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	cp, err := readCommit(dir)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, len(segs), len(cp.segments))
+	for i, s := range segs {
+		assert.Equal(t, s.Name, cp.segments[i].name)
+	}
+
+	idx, err = NewIndex(dir, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+	assert.Equal(t, segs, idx.Segments())
+	matches, err := filepath.Glob(filepath.Join(dir, "seg_*"))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, len(segs), len(matches))
+}
+
+// fixedMergePolicy returns its merges once.
+type fixedMergePolicy struct {
+	merges [][]SegmentInfo
+}
+
+func (p *fixedMergePolicy) FindMerges(segments []SegmentInfo) [][]SegmentInfo {
+	merges := p.merges
+	p.merges = nil
+	return merges
+}
+
+func TestIndexFailedMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidonia-index")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := &fixedMergePolicy{}
+	idx, err := NewIndex(dir, &IndexOptions{MergePolicy: policy, DisableBackgroundMerges: true})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer idx.Close()
+	for i := 0; i < 4; i++ {
+		doc := NewDocument(fmt.Sprintf("doc:%d", i), map[string]value.Value{"n": value.NewIntValue(int64(i))}, time.Now())
+		if err := idx.IndexDocuments(context.TODO(), []Document{doc}); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	segs := idx.Segments()
+
+	// a file where the first merge writes its segment makes it fail.
+	blocker := filepath.Join(dir, segmentName(idx.segGen))
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	policy.merges = [][]SegmentInfo{segs[:2], segs[2:]}
+	assert.NotEqual(t, nil, idx.MaybeMerge())
+	// the merge after the failed one still ran, and neither left its segments marked as merging.
+	assert.Equal(t, 3, len(idx.Segments()))
+	assert.Equal(t, 0, len(idx.merging))
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	policy.merges = [][]SegmentInfo{segs[:2]}
+	if err := idx.MaybeMerge(); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	assert.Equal(t, 2, len(idx.Segments()))
+}
@@ -22,20 +22,20 @@ func TestBKDTree(t *testing.T) {
 		return
 	}
 	//fmt.Printf("created BkdTree %v\n", bkd)
-	err = bkd.Insert(bkdtree.Point{[]uint64{55}, 55})
+	err = bkd.Insert(bkdtree.Point{Vals: []uint64{55}, UserData: 55})
 	if err != nil {
 		t.Fatalf(" -- %v", err)
 	}
-	err = bkd.Insert(bkdtree.Point{[]uint64{555}, 55})
+	err = bkd.Insert(bkdtree.Point{Vals: []uint64{555}, UserData: 55})
 	if err != nil {
 		t.Fatalf(" -- %v", err)
 	}
 
 	size := bkdCap
 
-	lowPoint := bkdtree.Point{[]uint64{55}, 0}
-	highPoint := bkdtree.Point{[]uint64{55}, 0}
-	visitor := &bkdtree.IntersectCollector{lowPoint, highPoint, make([]bkdtree.Point, 0, size)}
+	lowPoint := bkdtree.Point{Vals: []uint64{55}, UserData: 0}
+	highPoint := bkdtree.Point{Vals: []uint64{55}, UserData: 0}
+	visitor := &bkdtree.IntersectCollector{LowPoint: lowPoint, HighPoint: highPoint, Points: make([]bkdtree.Point, 0, size)}
 	bkd.Intersect(visitor)
 
 	for _, p := range visitor.Points {